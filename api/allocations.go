@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"net/url"
 	"sort"
 	"time"
 )
@@ -67,6 +68,76 @@ func (a *Allocations) Stats(alloc *Allocation, q *QueryOptions) (*AllocResourceU
 	return &resp, err
 }
 
+// Signal sends the signal, e.g. SIGHUP, to the task of the allocation, or to
+// all of its tasks if task is empty.
+func (a *Allocations) Signal(alloc *Allocation, task, signal string, q *WriteOptions) error {
+	node, _, err := a.client.Nodes().Info(alloc.NodeID, &QueryOptions{})
+	if err != nil {
+		return err
+	}
+	if node.Status == "down" {
+		return NodeDownErr
+	}
+	if node.HTTPAddr == "" {
+		return fmt.Errorf("http addr of the node where alloc %q is running is not advertised", alloc.ID)
+	}
+	client, err := NewClient(a.client.config.CopyConfig(node.HTTPAddr, node.TLSEnabled))
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("signal", signal)
+	if task != "" {
+		v.Set("task", task)
+	}
+	_, err = client.write("/v1/client/allocation/"+alloc.ID+"/signal?"+v.Encode(), nil, nil, q)
+	return err
+}
+
+// Exec runs a command inside the task of the allocation and returns its exit
+// code and output. The task may be empty if the allocation has a single task.
+func (a *Allocations) Exec(alloc *Allocation, task, cmd string, args []string, q *WriteOptions) (*ExecResult, error) {
+	node, _, err := a.client.Nodes().Info(alloc.NodeID, &QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if node.Status == "down" {
+		return nil, NodeDownErr
+	}
+	if node.HTTPAddr == "" {
+		return nil, fmt.Errorf("http addr of the node where alloc %q is running is not advertised", alloc.ID)
+	}
+	client, err := NewClient(a.client.config.CopyConfig(node.HTTPAddr, node.TLSEnabled))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &ExecRequest{
+		Task: task,
+		Cmd:  cmd,
+		Args: args,
+	}
+	var res ExecResult
+	if _, err := client.write("/v1/client/allocation/"+alloc.ID+"/exec", req, &res, q); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ExecRequest is used to run a command inside a task
+type ExecRequest struct {
+	Task string
+	Cmd  string
+	Args []string
+}
+
+// ExecResult is the result of a command run inside a task
+type ExecResult struct {
+	ExitCode int
+	Output   string
+}
+
 // Allocation is used for serialization of allocations.
 type Allocation struct {
 	ID                 string
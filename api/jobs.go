@@ -203,6 +203,7 @@ type Job struct {
 	Periodic          *PeriodicConfig
 	Meta              map[string]string
 	VaultToken        string
+	Payload           []byte
 	Status            string
 	StatusDescription string
 	CreateIndex       uint64
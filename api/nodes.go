@@ -91,6 +91,32 @@ func (n *Nodes) Stats(nodeID string, q *QueryOptions) (*HostStats, error) {
 	return &resp, nil
 }
 
+// GC garbage collects the directories of all terminal allocations on the node
+// and returns how many allocations were collected.
+func (n *Nodes) GC(nodeID string, q *WriteOptions) (*NodeGCResponse, error) {
+	node, _, err := n.client.Nodes().Info(nodeID, nil)
+	if err != nil {
+		return nil, err
+	}
+	if node.HTTPAddr == "" {
+		return nil, fmt.Errorf("http addr of the node %q is running is not advertised", nodeID)
+	}
+	client, err := NewClient(n.client.config.CopyConfig(node.HTTPAddr, node.TLSEnabled))
+	if err != nil {
+		return nil, err
+	}
+	var resp NodeGCResponse
+	if _, err := client.write("/v1/client/gc", nil, &resp, q); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// NodeGCResponse is the result of garbage collecting a node
+type NodeGCResponse struct {
+	Collected int
+}
+
 // Node is used to deserialize a node entry.
 type Node struct {
 	ID                string
@@ -8,6 +8,7 @@ type Resources struct {
 	DiskMB   int
 	IOPS     int
 	Networks []*NetworkResource
+	Devices  []*DeviceResource
 }
 
 type Port struct {
@@ -25,3 +26,13 @@ type NetworkResource struct {
 	IP            string
 	MBits         int
 }
+
+// DeviceResource is used to describe the devices, such as GPUs, required by a
+// given task.
+type DeviceResource struct {
+	Vendor string
+	Type   string
+	Name   string
+	Count  int
+	IDs    []string
+}
@@ -12,6 +12,7 @@ type MemoryStats struct {
 	MaxUsage       uint64
 	KernelUsage    uint64
 	KernelMaxUsage uint64
+	GuestUsage     uint64
 	Measured       []string
 }
 
@@ -26,10 +27,20 @@ type CpuStats struct {
 	Measured         []string
 }
 
-// ResourceUsage holds information related to cpu and memory stats
+// IOStats holds disk IO related stats
+type IOStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+	Measured   []string
+}
+
+// ResourceUsage holds information related to cpu, memory and disk IO stats
 type ResourceUsage struct {
 	MemoryStats *MemoryStats
 	CpuStats    *CpuStats
+	IOStats     *IOStats
 }
 
 // TaskResourceUsage holds aggregated resource usage of all processes in a Task
@@ -143,20 +154,22 @@ type LogConfig struct {
 
 // Task is a single process in a task group.
 type Task struct {
-	Name        string
-	Driver      string
-	User        string
-	Config      map[string]interface{}
-	Constraints []*Constraint
-	Env         map[string]string
-	Services    []Service
-	Resources   *Resources
-	Meta        map[string]string
-	KillTimeout time.Duration
-	LogConfig   *LogConfig
-	Artifacts   []*TaskArtifact
-	Vault       *Vault
-	Templates   []*Template
+	Name            string
+	Driver          string
+	User            string
+	Config          map[string]interface{}
+	Constraints     []*Constraint
+	Env             map[string]string
+	Services        []Service
+	Resources       *Resources
+	Meta            map[string]string
+	KillTimeout     time.Duration
+	LogConfig       *LogConfig
+	Artifacts       []*TaskArtifact
+	Vault           *Vault
+	Templates       []*Template
+	Hooks           []*TaskHook
+	DispatchPayload *DispatchPayloadConfig
 }
 
 // TaskArtifact is used to download artifacts before running a task.
@@ -166,6 +179,21 @@ type TaskArtifact struct {
 	RelativeDest  string
 }
 
+// TaskHook is a command run before a task is started or after it has exited.
+type TaskHook struct {
+	Type          string
+	Command       string
+	Args          []string
+	Timeout       time.Duration
+	IgnoreFailure bool
+}
+
+// DispatchPayloadConfig configures where the job's payload is written for a
+// task.
+type DispatchPayloadConfig struct {
+	File string
+}
+
 type Template struct {
 	SourcePath   string
 	DestPath     string
@@ -248,10 +276,12 @@ const (
 	TaskNotRestarting          = "Not Restarting"
 	TaskDownloadingArtifacts   = "Downloading Artifacts"
 	TaskArtifactDownloadFailed = "Failed Artifact Download"
+	TaskHookFailed             = "Hook Failed"
 	TaskVaultRenewalFailed     = "Vault token renewal failed"
 	TaskSiblingFailed          = "Sibling task failed"
 	TaskSignaling              = "Signaling"
 	TaskRestartSignal          = "Restart Signaled"
+	TaskDriverMessage          = "Driver"
 )
 
 // TaskEvent is an event that effects the state of a task and contains meta-data
@@ -271,6 +301,7 @@ type TaskEvent struct {
 	KillError        string
 	StartDelay       int64
 	DownloadError    string
+	HookError        string
 	ValidationError  string
 	DiskLimit        int64
 	DiskSize         int64
@@ -278,4 +309,5 @@ type TaskEvent struct {
 	VaultError       string
 	TaskSignalReason string
 	TaskSignal       string
+	DriverMessage    string
 }
@@ -12,6 +12,7 @@ import (
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	"github.com/hashicorp/nomad/client/vaultclient"
 	"github.com/hashicorp/nomad/nomad/structs"
 
@@ -615,6 +616,70 @@ func (r *AllocRunner) shouldUpdate(serverIndex uint64) bool {
 	return r.alloc.AllocModifyIndex < serverIndex
 }
 
+// Suspend asks the allocation's tasks to save their state by the deadline as
+// the client is shutting down. The tasks are suspended concurrently.
+func (r *AllocRunner) Suspend(deadline time.Time) error {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var mErr multierror.Error
+	for _, tr := range r.getTaskRunners() {
+		wg.Add(1)
+		go func(tr *TaskRunner) {
+			defer wg.Done()
+			if err := tr.Suspend(deadline); err != nil {
+				lock.Lock()
+				mErr.Errors = append(mErr.Errors, err)
+				lock.Unlock()
+			}
+		}(tr)
+	}
+	wg.Wait()
+	return mErr.ErrorOrNil()
+}
+
+// Signal sends the signal to the allocation's task with the given name, or to
+// all of its tasks if the name is empty
+func (r *AllocRunner) Signal(taskName string, s os.Signal) error {
+	runners := r.getTaskRunners()
+	if taskName != "" {
+		r.taskLock.RLock()
+		tr, ok := r.tasks[taskName]
+		r.taskLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("allocation %q has no task %q", r.alloc.ID, taskName)
+		}
+		runners = []*TaskRunner{tr}
+	}
+
+	var mErr multierror.Error
+	for _, tr := range runners {
+		if err := tr.Signal("operator", "signal requested through the API", s); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to signal task %q: %v", tr.task.Name, err))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// Exec runs a command inside the allocation's task with the given name. The
+// name may be empty if the allocation has a single task.
+func (r *AllocRunner) Exec(taskName, cmd string, args []string) (*dstructs.ExecResult, error) {
+	r.taskLock.RLock()
+	if taskName == "" && len(r.tasks) == 1 {
+		for name := range r.tasks {
+			taskName = name
+		}
+	}
+	tr, ok := r.tasks[taskName]
+	r.taskLock.RUnlock()
+	if taskName == "" {
+		return nil, fmt.Errorf("allocation %q has multiple tasks, the task must be specified", r.alloc.ID)
+	}
+	if !ok {
+		return nil, fmt.Errorf("allocation %q has no task %q", r.alloc.ID, taskName)
+	}
+	return tr.Exec(cmd, args)
+}
+
 // Destroy is used to indicate that the allocation context should be destroyed
 func (r *AllocRunner) Destroy() {
 	r.destroyLock.Lock()
@@ -627,6 +692,13 @@ func (r *AllocRunner) Destroy() {
 	close(r.destroyCh)
 }
 
+// isDestroyed returns whether the allocation context was set to be destroyed
+func (r *AllocRunner) isDestroyed() bool {
+	r.destroyLock.Lock()
+	defer r.destroyLock.Unlock()
+	return r.destroy
+}
+
 // WaitCh returns a channel to wait for termination
 func (r *AllocRunner) WaitCh() <-chan struct{} {
 	return r.waitCh
@@ -23,6 +23,8 @@ import (
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/client/driver/executor"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	"github.com/hashicorp/nomad/client/fingerprint"
 	"github.com/hashicorp/nomad/client/stats"
 	"github.com/hashicorp/nomad/client/vaultclient"
@@ -81,6 +83,14 @@ const (
 	// allocSyncRetryIntv is the interval on which we retry updating
 	// the status of the allocation
 	allocSyncRetryIntv = 5 * time.Second
+
+	// suspendTimeout bounds saving the state of all tasks when the client
+	// shuts down, which takes as long as writing out the memory of the VMs
+	suspendTimeout = 5 * time.Minute
+
+	// driverFingerprintIntervalOption is the client option overriding how
+	// often the drivers that can change state are fingerprinted
+	driverFingerprintIntervalOption = "driver.fingerprint.interval"
 )
 
 // ClientStatsReporter exposes all the APIs related to resource usage of a Nomad
@@ -154,6 +164,9 @@ type Client struct {
 	// migratingAllocs is the set of allocs whose data migration is in flight
 	migratingAllocs     map[string]chan struct{}
 	migratingAllocsLock sync.Mutex
+
+	// gcLock serializes garbage collections of terminal allocations
+	gcLock sync.Mutex
 }
 
 var (
@@ -248,6 +261,9 @@ func NewClient(cfg *config.Config, consulSyncer *consul.Syncer, logger *log.Logg
 		return nil, fmt.Errorf("failed to setup vault client: %v", err)
 	}
 
+	// Remove the cgroups of tasks that exited while the client was down
+	c.reapCgroups()
+
 	// Restore the state
 	if err := c.restoreState(); err != nil {
 		return nil, fmt.Errorf("failed to restore state: %v", err)
@@ -268,6 +284,9 @@ func NewClient(cfg *config.Config, consulSyncer *consul.Syncer, logger *log.Logg
 	// Start collecting stats
 	go c.collectHostStats()
 
+	// Begin garbage collecting the directories of terminal allocations
+	go c.periodicGC()
+
 	c.logger.Printf("[INFO] client: Node ID %q", c.Node().ID)
 	return c, nil
 }
@@ -375,14 +394,38 @@ func (c *Client) Shutdown() error {
 			<-ar.WaitCh()
 		}
 		c.allocLock.Unlock()
+	} else {
+		// Tasks keep running while the client is down, but the host may be
+		// restarted before it comes back
+		c.suspendAllocs(time.Now().Add(suspendTimeout))
 	}
 
+	driver.ShutdownExternalDrivers()
+
 	c.shutdown = true
 	close(c.shutdownCh)
 	c.connPool.Shutdown()
 	return c.saveState()
 }
 
+// suspendAllocs asks all allocations to save the state of their tasks by the
+// deadline. The allocations are suspended concurrently, and it returns once
+// all of them are done so that no task is still saving its state through an
+// external driver when the drivers are shut down.
+func (c *Client) suspendAllocs(deadline time.Time) {
+	var wg sync.WaitGroup
+	for id, ar := range c.getAllocRunners() {
+		wg.Add(1)
+		go func(id string, ar *AllocRunner) {
+			defer wg.Done()
+			if err := ar.Suspend(deadline); err != nil {
+				c.logger.Printf("[ERR] client: failed to suspend alloc %q: %v", id, err)
+			}
+		}(id, ar)
+	}
+	wg.Wait()
+}
+
 // RPC is used to forward an RPC call to a nomad server, or fail if no servers.
 func (c *Client) RPC(method string, args interface{}, reply interface{}) error {
 	// Invoke the RPCHandler if it exists
@@ -476,6 +519,29 @@ func (c *Client) GetAllocFS(allocID string) (allocdir.AllocDirFS, error) {
 	return ar.GetAllocDir(), nil
 }
 
+// SignalAlloc sends the signal to the task of the allocation, or to all of its
+// tasks if task is empty.
+func (c *Client) SignalAlloc(allocID, task string, s os.Signal) error {
+	c.allocLock.RLock()
+	ar, ok := c.allocs[allocID]
+	c.allocLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown allocation ID %q", allocID)
+	}
+	return ar.Signal(task, s)
+}
+
+// ExecAlloc runs a command inside the task of the allocation with the given ID
+func (c *Client) ExecAlloc(allocID, task, cmd string, args []string) (*dstructs.ExecResult, error) {
+	c.allocLock.RLock()
+	ar, ok := c.allocs[allocID]
+	c.allocLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown allocation ID %q", allocID)
+	}
+	return ar.Exec(task, cmd, args)
+}
+
 // GetServers returns the list of nomad servers this client is aware of.
 func (c *Client) GetServers() []string {
 	endpoints := c.servers.all()
@@ -516,6 +582,22 @@ func (c *Client) SetServers(servers []string) error {
 	return nil
 }
 
+// reapCgroups removes the cgroups left behind by tasks that are gone. Clients
+// in dev mode may share the host with other clients, so they leave the cgroups
+// alone.
+func (c *Client) reapCgroups() {
+	if c.config.DevMode {
+		return
+	}
+	reaped, err := executor.ReapOrphanedCgroups()
+	if err != nil {
+		c.logger.Printf("[WARN] client: failed to remove orphaned cgroups: %v", err)
+	}
+	if len(reaped) != 0 {
+		c.logger.Printf("[DEBUG] client: removed orphaned cgroups %v", reaped)
+	}
+}
+
 // restoreState is used to restore our state from the data dir
 func (c *Client) restoreState() error {
 	if c.config.DevMode {
@@ -778,14 +860,36 @@ func (c *Client) fingerprintPeriodic(name string, f fingerprint.Fingerprint, d t
 
 // setupDrivers is used to find the available drivers
 func (c *Client) setupDrivers() error {
-	// Build the whitelist of drivers.
+	// Build the whitelist and blacklist of drivers.
 	whitelist := c.config.ReadStringListToMap("driver.whitelist")
 	whitelistEnabled := len(whitelist) > 0
+	blacklist := c.config.ReadStringListToMap("driver.blacklist")
+
+	// Allow overriding how often the periodic drivers are fingerprinted
+	var interval time.Duration
+	if v := c.config.Read(driverFingerprintIntervalOption); v != "" {
+		var err error
+		interval, err = time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid %s %q: must be a positive duration", driverFingerprintIntervalOption, v)
+		}
+	}
 
 	var avail []string
 	var skipped []string
-	driverCtx := driver.NewDriverContext("", c.config, c.config.Node, c.logger, nil)
+	var blacklisted []string
+	driverCtx := driver.NewDriverContext("", c.config, c.config.Node, c.logger, nil, nil)
+
+	// Fingerprint the external drivers installed in the plugin directory along
+	// with the builtin drivers
+	var names []string
 	for name := range driver.BuiltinDrivers {
+		names = append(names, name)
+	}
+	for name := range driver.ExternalDrivers(c.config.PluginDir) {
+		names = append(names, name)
+	}
+	for _, name := range names {
 		// Skip fingerprinting drivers that are not in the whitelist if it is
 		// enabled.
 		if _, ok := whitelist[name]; whitelistEnabled && !ok {
@@ -793,6 +897,12 @@ func (c *Client) setupDrivers() error {
 			continue
 		}
 
+		// Skip fingerprinting drivers that are blacklisted.
+		if _, ok := blacklist[name]; ok {
+			blacklisted = append(blacklisted, name)
+			continue
+		}
+
 		d, err := driver.NewDriver(name, driverCtx)
 		if err != nil {
 			return err
@@ -809,9 +919,11 @@ func (c *Client) setupDrivers() error {
 
 		p, period := d.Periodic()
 		if p {
+			if interval != 0 {
+				period = interval
+			}
 			go c.fingerprintPeriodic(name, d, period)
 		}
-
 	}
 
 	c.logger.Printf("[DEBUG] client: available drivers %v", avail)
@@ -820,6 +932,10 @@ func (c *Client) setupDrivers() error {
 		c.logger.Printf("[DEBUG] client: drivers skipped due to whitelist: %v", skipped)
 	}
 
+	if len(blacklisted) != 0 {
+		c.logger.Printf("[DEBUG] client: drivers skipped due to blacklist: %v", blacklisted)
+	}
+
 	return nil
 }
 
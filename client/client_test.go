@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
 	"github.com/hashicorp/nomad/command/agent/consul"
 	"github.com/hashicorp/nomad/nomad"
 	"github.com/hashicorp/nomad/nomad/mock"
@@ -283,6 +284,51 @@ func TestClient_Drivers_OutOfWhitelist(t *testing.T) {
 	}
 }
 
+func TestClient_Drivers_InBlacklist(t *testing.T) {
+	c := testClient(t, func(c *config.Config) {
+		if c.Options == nil {
+			c.Options = make(map[string]string)
+		}
+
+		c.Options["driver.blacklist"] = "exec, raw_exec"
+	})
+	defer c.Shutdown()
+
+	node := c.Node()
+	if node.Attributes["driver.exec"] != "" || node.Attributes["driver.raw_exec"] != "" {
+		t.Fatalf("found blacklisted driver: %v", node.Attributes)
+	}
+}
+
+func TestClient_Drivers_FingerprintInterval(t *testing.T) {
+	c := testClient(t, func(c *config.Config) {
+		if c.Options == nil {
+			c.Options = make(map[string]string)
+		}
+		c.Options["driver.whitelist"] = "raw_exec"
+		c.Options[driverFingerprintIntervalOption] = "1s"
+	})
+	defer c.Shutdown()
+
+	if c.Node().Attributes["driver.raw_exec"] == "" {
+		t.Fatalf("missing raw_exec driver")
+	}
+
+	// Invalid intervals are rejected
+	for _, v := range []string{"foo", "0s", "-1s"} {
+		conf := config.DefaultConfig()
+		conf.DevMode = true
+		conf.Options = map[string]string{
+			"driver.whitelist":              "raw_exec",
+			driverFingerprintIntervalOption: v,
+		}
+		logger := log.New(conf.LogOutput, "", log.LstdFlags)
+		if _, err := NewClient(conf, nil, logger); err == nil {
+			t.Fatalf("expected an error for interval %q", v)
+		}
+	}
+}
+
 func TestClient_Register(t *testing.T) {
 	s1, _ := testServer(t, nil)
 	defer s1.Shutdown()
@@ -714,3 +760,52 @@ func TestClient_BlockedAllocations(t *testing.T) {
 	c1.allocLock.Unlock()
 
 }
+
+// testSuspendHandle is a suspendable handle whose Suspend takes the delay and
+// reports the timeout it was given
+type testSuspendHandle struct {
+	driver.DriverHandle
+	delay    time.Duration
+	timeouts chan time.Duration
+}
+
+func (h *testSuspendHandle) Suspend(timeout time.Duration) error {
+	h.timeouts <- timeout
+	time.Sleep(h.delay)
+	return nil
+}
+
+func TestClient_SuspendAllocs(t *testing.T) {
+	c := testGCClient(t)
+	defer os.RemoveAll(c.config.AllocDir)
+
+	timeouts := make(chan time.Duration, 4)
+	for i := 0; i < 2; i++ {
+		ar := &AllocRunner{alloc: mock.Alloc(), tasks: make(map[string]*TaskRunner)}
+		for _, name := range []string{"web", "db"} {
+			_, tr := testTaskRunner(false)
+			defer tr.ctx.AllocDir.Destroy()
+			tr.handle = &testSuspendHandle{delay: 200 * time.Millisecond, timeouts: timeouts}
+			ar.tasks[name] = tr
+		}
+		c.allocs[ar.alloc.ID] = ar
+	}
+
+	// All tasks are suspended concurrently against the same deadline
+	start := time.Now()
+	c.suspendAllocs(start.Add(time.Minute))
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Fatalf("suspending took %v; tasks weren't suspended concurrently", elapsed)
+	}
+	close(timeouts)
+	n := 0
+	for timeout := range timeouts {
+		if timeout > time.Minute || timeout < time.Minute-time.Second {
+			t.Fatalf("task suspended with timeout %v; want the time left to the deadline", timeout)
+		}
+		n++
+	}
+	if n != 4 {
+		t.Fatalf("suspended %d tasks; want 4", n)
+	}
+}
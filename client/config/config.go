@@ -60,6 +60,9 @@ type Config struct {
 	// AllocDir is where we store data for allocations
 	AllocDir string
 
+	// PluginDir is where external task drivers are installed
+	PluginDir string
+
 	// LogOutput is the destination for logs
 	LogOutput io.Writer
 
@@ -78,6 +81,24 @@ type Config struct {
 	// used.
 	MaxKillTimeout time.Duration
 
+	// GCInterval is the interval at which the directories of terminal
+	// allocations are garbage collected
+	GCInterval time.Duration
+
+	// GCMaxAge is how long after terminating the directory of an allocation
+	// is garbage collected. Zero disables collecting allocations by age.
+	GCMaxAge time.Duration
+
+	// GCMaxAllocs is the number of terminal allocations whose directories are
+	// kept. Zero disables collecting allocations by count.
+	GCMaxAllocs int
+
+	// GCDiskUsageThreshold is the used percentage of the disk holding the
+	// allocation directories above which the directories of terminal
+	// allocations are garbage collected. Zero disables collecting allocations
+	// by disk usage.
+	GCDiskUsageThreshold float64
+
 	// Servers is a list of known server addresses. These are as "host:port"
 	Servers []string
 
@@ -159,6 +180,9 @@ func DefaultConfig() *Config {
 		Region:                  "global",
 		StatsCollectionInterval: 1 * time.Second,
 		TLSConfig:               &config.TLSConfig{},
+		GCInterval:              1 * time.Minute,
+		GCMaxAllocs:             50,
+		GCDiskUsageThreshold:    80,
 	}
 }
 
@@ -2,6 +2,7 @@ package client
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -319,7 +320,10 @@ func templateRunner(tmpls []*structs.Template, config *config.Config,
 	}
 
 	// Parse the templates
-	ctmplMapping := parseTemplateConfigs(tmpls, taskDir, taskEnv)
+	ctmplMapping, err := parseTemplateConfigs(tmpls, taskDir, taskEnv)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Set the config
 	flat := make([]*ctconf.ConfigTemplate, 0, len(ctmplMapping))
@@ -348,27 +352,34 @@ func templateRunner(tmpls []*structs.Template, config *config.Config,
 	return runner, lookup, nil
 }
 
-// parseTemplateConfigs converts the tasks templates into consul-templates
-func parseTemplateConfigs(tmpls []*structs.Template, taskDir string, taskEnv *env.TaskEnvironment) map[ctconf.ConfigTemplate]*structs.Template {
+// parseTemplateConfigs converts the tasks templates into consul-templates. The
+// task's environment, such as node attributes and the Nomad env vars, is
+// interpolated into the contents of the templates before they are handed to
+// consul-template, so templates sourced from files are read here.
+func parseTemplateConfigs(tmpls []*structs.Template, taskDir string, taskEnv *env.TaskEnvironment) (map[ctconf.ConfigTemplate]*structs.Template, error) {
 	// Build the task environment
-	// TODO Should be able to inject the Nomad env vars into Consul-template for
-	// rendering
 	taskEnv.Build()
 
 	ctmpls := make(map[ctconf.ConfigTemplate]*structs.Template, len(tmpls))
 	for _, tmpl := range tmpls {
-		var src, dest string
+		contents := tmpl.EmbeddedTmpl
 		if tmpl.SourcePath != "" {
-			src = filepath.Join(taskDir, taskEnv.ReplaceEnv(tmpl.SourcePath))
+			src := filepath.Join(taskDir, taskEnv.ReplaceEnv(tmpl.SourcePath))
+			raw, err := ioutil.ReadFile(src)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read template source %q: %v", src, err)
+			}
+			contents = string(raw)
 		}
+
+		var dest string
 		if tmpl.DestPath != "" {
 			dest = filepath.Join(taskDir, taskEnv.ReplaceEnv(tmpl.DestPath))
 		}
 
 		ct := ctconf.ConfigTemplate{
-			Source:           src,
 			Destination:      dest,
-			EmbeddedTemplate: tmpl.EmbeddedTmpl,
+			EmbeddedTemplate: taskEnv.ReplaceEnv(contents),
 			Perms:            ctconf.DefaultFilePerms,
 			Wait:             &watch.Wait{},
 		}
@@ -376,7 +387,7 @@ func parseTemplateConfigs(tmpls []*structs.Template, taskDir string, taskEnv *en
 		ctmpls[ct] = tmpl
 	}
 
-	return ctmpls
+	return ctmpls, nil
 }
 
 // runnerConfig returns a consul-template runner configuration, setting the
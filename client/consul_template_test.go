@@ -719,6 +719,72 @@ func TestTaskTemplateManager_Interpolate_Destination(t *testing.T) {
 	}
 }
 
+func TestTaskTemplateManager_Interpolate_Contents(t *testing.T) {
+	// Make templates, one of them sourced from a file, that will have the
+	// node's attributes and the task's environment interpolated
+	embedded := &structs.Template{
+		EmbeddedTmpl: "kernel=${attr.kernel.name} dc=${node.datacenter}",
+		DestPath:     "embedded.conf",
+		ChangeMode:   structs.TemplateChangeModeNoop,
+	}
+	sourced := &structs.Template{
+		SourcePath: "local/source.tmpl",
+		DestPath:   "sourced.conf",
+		ChangeMode: structs.TemplateChangeModeNoop,
+	}
+
+	harness := newTestHarness(t, []*structs.Template{embedded, sourced}, false, false)
+	harness.taskEnv.SetEnvvars(map[string]string{"PORT": "8080"})
+	if err := os.MkdirAll(filepath.Join(harness.taskDir, "local"), 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	source := `port={{ "${PORT}" }} unknown=${UNKNOWN}`
+	if err := ioutil.WriteFile(filepath.Join(harness.taskDir, "local", "source.tmpl"), []byte(source), 0666); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	harness.start(t)
+	defer harness.stop()
+
+	// Ensure unblock
+	select {
+	case <-harness.mockHooks.UnblockCh:
+	case <-time.After(time.Duration(5*testutil.TestMultiplier()) * time.Second):
+		t.Fatalf("Task unblock should have been called")
+	}
+
+	expected := map[string]string{
+		"embedded.conf": fmt.Sprintf("kernel=%s dc=%s", harness.node.Attributes["kernel.name"], harness.node.Datacenter),
+		"sourced.conf":  "port=8080 unknown=${UNKNOWN}",
+	}
+	for file, content := range expected {
+		path := filepath.Join(harness.taskDir, file)
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read rendered template from %q: %v", path, err)
+		}
+		if s := string(raw); s != content {
+			t.Fatalf("Unexpected template data for %q; got %q, want %q", file, s, content)
+		}
+	}
+}
+
+func TestTaskTemplateManager_Missing_Source(t *testing.T) {
+	template := &structs.Template{
+		SourcePath: "local/missing.tmpl",
+		DestPath:   "missing.conf",
+		ChangeMode: structs.TemplateChangeModeNoop,
+	}
+
+	harness := newTestHarness(t, []*structs.Template{template}, false, false)
+	defer harness.stop()
+
+	_, err := NewTaskTemplateManager(harness.mockHooks, harness.templates,
+		harness.config, harness.vaultToken, harness.taskDir, harness.taskEnv)
+	if err == nil || !strings.Contains(err.Error(), "failed to read template source") {
+		t.Fatalf("expected an error for a missing source; got %v", err)
+	}
+}
+
 func TestTaskTemplateManager_Signal_Error(t *testing.T) {
 	// Make a template that renders based on a key in Consul and sends SIGALRM
 	key1 := "foo"
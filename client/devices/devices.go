@@ -0,0 +1,118 @@
+// Package devices implements the plugins detecting the devices of a node, such
+// as GPUs, which the scheduler assigns to the tasks asking for them in their
+// resources.
+package devices
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// Plugin detects the devices of one kind on the node, and exposes the ones
+// assigned to a task to it.
+type Plugin interface {
+	// Fingerprint returns the device groups found on the node, along with the
+	// node attributes describing them. A plugin that finds no devices returns
+	// no groups and no error.
+	Fingerprint(logger *log.Logger) ([]*structs.DeviceResource, map[string]string, error)
+
+	// TaskEnv returns the environment variables exposing the devices assigned
+	// to a task to it, beyond the NOMAD_DEVICE_ variables every task gets. It
+	// is passed all of the task's devices, and ignores those it didn't
+	// fingerprint.
+	TaskEnv(assigned []*structs.DeviceResource) map[string]string
+}
+
+var (
+	// plugins are the registered device plugins by name
+	plugins     = make(map[string]Plugin)
+	pluginsLock sync.RWMutex
+)
+
+func init() {
+	Register("nvidia_gpu", nvidiaGPU{})
+
+	// Initialize the plugins available on the platform
+	initPlatformPlugins()
+}
+
+// Register adds the device plugin under the name, so that it is fingerprinted
+// by the client and exposes the devices it finds to tasks. Plugins are
+// registered by the packages implementing them when they are initialized. It
+// panics if a plugin has already been registered under the name.
+func Register(name string, plugin Plugin) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	if _, ok := plugins[name]; ok {
+		panic(fmt.Sprintf("device plugin %q registered twice", name))
+	}
+	plugins[name] = plugin
+}
+
+// registered returns the names of the registered plugins in sorted order and
+// the plugins by name
+func registered() ([]string, map[string]Plugin) {
+	pluginsLock.RLock()
+	defer pluginsLock.RUnlock()
+	names := make([]string, 0, len(plugins))
+	byName := make(map[string]Plugin, len(plugins))
+	for name, plugin := range plugins {
+		names = append(names, name)
+		byName[name] = plugin
+	}
+	sort.Strings(names)
+	return names, byName
+}
+
+// Fingerprint returns the devices found on the node by all plugins, along with
+// the node attributes describing them. Plugins that fail are logged and
+// skipped, so that the devices of the other plugins can still be used.
+func Fingerprint(logger *log.Logger) ([]*structs.DeviceResource, map[string]string) {
+	names, byName := registered()
+	var devices []*structs.DeviceResource
+	attrs := make(map[string]string)
+	for _, name := range names {
+		found, pluginAttrs, err := byName[name].Fingerprint(logger)
+		if err != nil {
+			logger.Printf("[WARN] devices.%s: %v", name, err)
+			continue
+		}
+		devices = append(devices, found...)
+		for k, v := range pluginAttrs {
+			attrs[k] = v
+		}
+	}
+	return devices, attrs
+}
+
+// TaskEnv returns the environment variables the plugins expose the devices
+// assigned to a task with
+func TaskEnv(assigned []*structs.DeviceResource) map[string]string {
+	names, byName := registered()
+	env := make(map[string]string)
+	if len(assigned) == 0 {
+		return env
+	}
+	for _, name := range names {
+		for k, v := range byName[name].TaskEnv(assigned) {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// deviceResources sorts device groups by vendor and name
+type deviceResources []*structs.DeviceResource
+
+func (d deviceResources) Len() int      { return len(d) }
+func (d deviceResources) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d deviceResources) Less(i, j int) bool {
+	if d[i].Vendor != d[j].Vendor {
+		return d[i].Vendor < d[j].Vendor
+	}
+	return d[i].Name < d[j].Name
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package devices
+
+func initPlatformPlugins() {
+}
@@ -0,0 +1,5 @@
+package devices
+
+func initPlatformPlugins() {
+	Register("vfio", vfio{})
+}
@@ -0,0 +1,95 @@
+package devices
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func testLogger() *log.Logger {
+	return log.New(os.Stderr, "", log.LstdFlags)
+}
+
+// testPlugin is a device plugin returning fixed devices, or failing if err is
+// set
+type testPlugin struct {
+	devices []*structs.DeviceResource
+	attrs   map[string]string
+	err     error
+}
+
+func (p *testPlugin) Fingerprint(*log.Logger) ([]*structs.DeviceResource, map[string]string, error) {
+	return p.devices, p.attrs, p.err
+}
+
+func (p *testPlugin) TaskEnv(assigned []*structs.DeviceResource) map[string]string {
+	var ids []string
+	for _, d := range assigned {
+		if d.Vendor == "acme" {
+			ids = append(ids, d.IDs...)
+		}
+	}
+	return map[string]string{"ACME_DEVICES": strings.Join(ids, ",")}
+}
+
+// testRegister registers the plugins for the duration of a test, hiding the
+// built in ones
+func testRegister(t *testing.T, registered map[string]Plugin) func() {
+	pluginsLock.Lock()
+	old := plugins
+	plugins = make(map[string]Plugin)
+	pluginsLock.Unlock()
+	for name, plugin := range registered {
+		Register(name, plugin)
+	}
+	return func() {
+		pluginsLock.Lock()
+		plugins = old
+		pluginsLock.Unlock()
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	acme := &testPlugin{
+		devices: []*structs.DeviceResource{{Vendor: "acme", Type: "fpga", Name: "x1", IDs: []string{"fpga0"}}},
+		attrs:   map[string]string{"device.acme.fpga.count": "1"},
+	}
+	defer testRegister(t, map[string]Plugin{
+		"acme":   acme,
+		"broken": &testPlugin{err: fmt.Errorf("no driver")},
+	})()
+
+	// Failing plugins don't keep the devices of the others from being used
+	devices, attrs := Fingerprint(testLogger())
+	if !reflect.DeepEqual(devices, acme.devices) {
+		t.Fatalf("got %#v; want %#v", devices, acme.devices)
+	}
+	if !reflect.DeepEqual(attrs, acme.attrs) {
+		t.Fatalf("got %v; want %v", attrs, acme.attrs)
+	}
+
+	env := TaskEnv(acme.devices)
+	if exp := map[string]string{"ACME_DEVICES": "fpga0"}; !reflect.DeepEqual(env, exp) {
+		t.Fatalf("got %v; want %v", env, exp)
+	}
+
+	// Tasks without devices get no variables
+	if env := TaskEnv(nil); len(env) != 0 {
+		t.Fatalf("unexpected env %v", env)
+	}
+}
+
+func TestRegister_Twice(t *testing.T) {
+	defer testRegister(t, map[string]Plugin{"acme": &testPlugin{}})()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic")
+		}
+	}()
+	Register("acme", &testPlugin{})
+}
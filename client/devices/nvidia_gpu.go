@@ -0,0 +1,118 @@
+package devices
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// nvidiaVendor and gpuType are the vendor and type of the devices
+	// fingerprinted by the nvidiaGPU plugin
+	nvidiaVendor = "nvidia"
+	gpuType      = "gpu"
+
+	// NvidiaVisibleDevices and CudaVisibleDevices restrict the NVIDIA GPUs
+	// visible to the task to the assigned ones.
+	NvidiaVisibleDevices = "NVIDIA_VISIBLE_DEVICES"
+	CudaVisibleDevices   = "CUDA_VISIBLE_DEVICES"
+)
+
+// nvidiaGPU is the device plugin listing the NVIDIA GPUs of the node using
+// nvidia-smi
+type nvidiaGPU struct{}
+
+func (nvidiaGPU) Fingerprint(logger *log.Logger) ([]*structs.DeviceResource, map[string]string, error) {
+	path, err := exec.LookPath("nvidia-smi")
+	if err != nil {
+		// No NVIDIA driver installed
+		return nil, nil, nil
+	}
+
+	out, err := exec.Command(path, "--query-gpu=uuid,name,driver_version", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query GPUs: %v", err)
+	}
+
+	devices, version, err := parseNvidiaSMIOutput(string(out))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(devices) == 0 {
+		return nil, nil, nil
+	}
+
+	count := 0
+	for _, d := range devices {
+		count += len(d.IDs)
+	}
+	attrs := map[string]string{
+		"device.nvidia.gpu.count":      strconv.Itoa(count),
+		"device.nvidia.driver.version": version,
+	}
+	return devices, attrs, nil
+}
+
+// TaskEnv makes only the assigned GPUs visible to CUDA applications and the
+// NVIDIA container runtime
+func (nvidiaGPU) TaskEnv(assigned []*structs.DeviceResource) map[string]string {
+	var ids []string
+	for _, d := range assigned {
+		if d.Vendor == nvidiaVendor && d.Type == gpuType {
+			ids = append(ids, d.IDs...)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	visible := strings.Join(ids, ",")
+	return map[string]string{
+		NvidiaVisibleDevices: visible,
+		CudaVisibleDevices:   visible,
+	}
+}
+
+// parseNvidiaSMIOutput parses the CSV output of nvidia-smi querying the uuid,
+// name and driver_version of the GPUs into device groups by model, and returns
+// them along with the driver version.
+func parseNvidiaSMIOutput(out string) ([]*structs.DeviceResource, string, error) {
+	groups := make(map[string]*structs.DeviceResource)
+	var version string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, "", fmt.Errorf("unexpected nvidia-smi output line %q", line)
+		}
+		uuid := strings.TrimSpace(fields[0])
+		name := strings.TrimSpace(fields[1])
+		version = strings.TrimSpace(fields[2])
+
+		group, ok := groups[name]
+		if !ok {
+			group = &structs.DeviceResource{
+				Vendor: nvidiaVendor,
+				Type:   gpuType,
+				Name:   name,
+			}
+			groups[name] = group
+		}
+		group.IDs = append(group.IDs, uuid)
+	}
+
+	devices := make([]*structs.DeviceResource, 0, len(groups))
+	for _, group := range groups {
+		devices = append(devices, group)
+	}
+	sort.Sort(deviceResources(devices))
+	return devices, version, nil
+}
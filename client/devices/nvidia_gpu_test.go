@@ -0,0 +1,53 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestNvidiaGPUFingerprint_Parse(t *testing.T) {
+	out := `GPU-b1c2, Tesla K80, 375.26
+GPU-a3d4, Tesla K80, 375.26
+GPU-e5f6, Tesla P100-PCIE-16GB, 375.26
+`
+	devices, version, err := parseNvidiaSMIOutput(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if version != "375.26" {
+		t.Fatalf("bad version: %q", version)
+	}
+	expected := []*structs.DeviceResource{
+		{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80", IDs: []string{"GPU-b1c2", "GPU-a3d4"}},
+		{Vendor: "nvidia", Type: "gpu", Name: "Tesla P100-PCIE-16GB", IDs: []string{"GPU-e5f6"}},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("got %#v; want %#v", devices, expected)
+	}
+
+	if _, _, err := parseNvidiaSMIOutput("No devices were found"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestNvidiaGPU_TaskEnv(t *testing.T) {
+	assigned := []*structs.DeviceResource{
+		{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80", IDs: []string{"GPU-1", "GPU-2"}},
+		{Vendor: "nvidia", Type: "gpu", Name: "Tesla P100-PCIE-16GB", IDs: []string{"GPU-3"}},
+		{Vendor: "nvidia", Type: "vfio", Name: "0x1db4", IDs: []string{"0000:01:00.0"}},
+	}
+	expected := map[string]string{
+		NvidiaVisibleDevices: "GPU-1,GPU-2,GPU-3",
+		CudaVisibleDevices:   "GPU-1,GPU-2,GPU-3",
+	}
+	if env := (nvidiaGPU{}).TaskEnv(assigned); !reflect.DeepEqual(env, expected) {
+		t.Fatalf("got %v; want %v", env, expected)
+	}
+
+	// Tasks without GPUs don't get the variables
+	if env := (nvidiaGPU{}).TaskEnv(assigned[2:]); len(env) != 0 {
+		t.Fatalf("unexpected env %v", env)
+	}
+}
@@ -0,0 +1,122 @@
+package devices
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// vfioType is the type of the PCI devices bound to vfio-pci, which can be
+	// passed through to VMs
+	vfioType = "vfio"
+
+	// vfioDriver is the host driver of the devices that are fingerprinted
+	vfioDriver = "vfio-pci"
+)
+
+var (
+	// pciDevicesDir is where the host's PCI devices are listed
+	pciDevicesDir = "/sys/bus/pci/devices"
+
+	// pciVendors are the names of the vendors of common PCI devices. Other
+	// vendors are identified by their PCI vendor ID.
+	pciVendors = map[string]string{
+		"0x1002": "amd",
+		"0x10de": "nvidia",
+		"0x8086": "intel",
+	}
+)
+
+// vfio is the device plugin listing the PCI devices bound to vfio-pci, which
+// the qemu driver passes through to the VMs they are assigned to
+type vfio struct{}
+
+func (vfio) Fingerprint(logger *log.Logger) ([]*structs.DeviceResource, map[string]string, error) {
+	devices, err := vfioDevices(pciDevicesDir)
+	if err != nil {
+		logger.Printf("[DEBUG] devices.vfio: failed to list PCI devices: %v", err)
+		return nil, nil, nil
+	}
+	if len(devices) == 0 {
+		return nil, nil, nil
+	}
+
+	count := 0
+	for _, d := range devices {
+		count += len(d.IDs)
+	}
+	return devices, map[string]string{"device.vfio.count": strconv.Itoa(count)}, nil
+}
+
+// TaskEnv exposes no further variables, as the devices are consumed by the
+// driver rather than the task
+func (vfio) TaskEnv(assigned []*structs.DeviceResource) map[string]string {
+	return nil
+}
+
+// vfioDevices returns the PCI devices in dir that are bound to vfio-pci,
+// grouped by vendor and device ID.
+func vfioDevices(dir string) ([]*structs.DeviceResource, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*structs.DeviceResource)
+	for _, entry := range entries {
+		addr := entry.Name()
+		link, err := os.Readlink(filepath.Join(dir, addr, "driver"))
+		if err != nil || filepath.Base(link) != vfioDriver {
+			continue
+		}
+
+		vendorID, err := readPCIID(filepath.Join(dir, addr, "vendor"))
+		if err != nil {
+			return nil, err
+		}
+		deviceID, err := readPCIID(filepath.Join(dir, addr, "device"))
+		if err != nil {
+			return nil, err
+		}
+		vendor, ok := pciVendors[vendorID]
+		if !ok {
+			vendor = vendorID
+		}
+
+		key := vendor + "/" + deviceID
+		group, ok := groups[key]
+		if !ok {
+			group = &structs.DeviceResource{
+				Vendor: vendor,
+				Type:   vfioType,
+				Name:   deviceID,
+			}
+			groups[key] = group
+		}
+		group.IDs = append(group.IDs, addr)
+	}
+
+	devices := make([]*structs.DeviceResource, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.IDs)
+		devices = append(devices, group)
+	}
+	sort.Sort(deviceResources(devices))
+	return devices, nil
+}
+
+// readPCIID reads a vendor or device ID from sysfs, e.g. "0x10de"
+func readPCIID(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSpace(string(b))), nil
+}
@@ -0,0 +1,66 @@
+package devices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestVFIO_Fingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pci")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := pciDevicesDir
+	defer func() { pciDevicesDir = oldDir }()
+	pciDevicesDir = filepath.Join(dir, "devices")
+
+	devices := []struct {
+		addr, driver, vendor, device string
+	}{
+		{"0000:01:00.0", "vfio-pci", "0x10de", "0x1db4"},
+		{"0000:02:00.0", "vfio-pci", "0x10de", "0x1db4"},
+		{"0000:03:00.0", "vfio-pci", "0x1af4", "0x1000"},
+		{"0000:04:00.0", "nvidia", "0x10de", "0x1db4"},
+		{"0000:05:00.0", "", "0x8086", "0x1533"},
+	}
+	for _, d := range devices {
+		path := filepath.Join(pciDevicesDir, d.addr)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "vendor"), []byte(d.vendor+"\n"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "device"), []byte(d.device+"\n"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d.driver != "" {
+			if err := os.Symlink(filepath.Join(dir, "drivers", d.driver), filepath.Join(path, "driver")); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+
+	found, attrs, err := (vfio{}).Fingerprint(testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if attrs["device.vfio.count"] != "3" {
+		t.Fatalf("bad count: %q", attrs["device.vfio.count"])
+	}
+	expected := []*structs.DeviceResource{
+		{Vendor: "0x1af4", Type: "vfio", Name: "0x1000", IDs: []string{"0000:03:00.0"}},
+		{Vendor: "nvidia", Type: "vfio", Name: "0x1db4", IDs: []string{"0000:01:00.0", "0000:02:00.0"}},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("got %#v; want %#v", found, expected)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/armon/circbuf"
 	docker "github.com/fsouza/go-dockerclient"
 
 	"github.com/hashicorp/go-multierror"
@@ -48,6 +49,7 @@ var (
 	// The statistics the Docker driver exposes
 	DockerMeasuredMemStats = []string{"RSS", "Cache", "Swap", "Max Usage"}
 	DockerMeasuredCpuStats = []string{"Throttled Periods", "Throttled Time", "Percent"}
+	DockerMeasuredIOStats  = []string{"Read Bytes", "Write Bytes", "Read Ops", "Write Ops"}
 )
 
 const (
@@ -1062,6 +1064,33 @@ func (h *DockerHandle) Signal(s os.Signal) error {
 
 }
 
+// Exec runs the command in the container, like docker exec
+func (h *DockerHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	dexec, err := h.client.CreateExec(docker.CreateExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          append([]string{cmd}, args...),
+		Container:    h.containerID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create exec in container %s: %v", h.containerID, err)
+	}
+
+	output, _ := circbuf.NewBuffer(int64(dstructs.ExecBufSize))
+	startOpts := docker.StartExecOptions{
+		OutputStream: output,
+		ErrorStream:  output,
+	}
+	if err := h.client.StartExec(dexec.ID, startOpts); err != nil {
+		return nil, fmt.Errorf("Failed to start exec in container %s: %v", h.containerID, err)
+	}
+	res, err := h.client.InspectExec(dexec.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to inspect exec in container %s: %v", h.containerID, err)
+	}
+	return &dstructs.ExecResult{ExitCode: res.ExitCode, Output: string(output.Bytes())}, nil
+}
+
 // Kill is used to terminate the task. This uses `docker stop -t killTimeout`
 func (h *DockerHandle) Kill() error {
 	// Stop the container
@@ -1183,11 +1212,16 @@ func (h *DockerHandle) collectStats() {
 					s.CPUStats.CPUUsage.TotalUsage, s.PreCPUStats.CPUUsage.TotalUsage, cores)
 				cs.TotalTicks = (cs.Percent / 100) * shelpers.TotalTicksAvailable() / float64(numCores)
 
+				is := &cstructs.IOStats{Measured: DockerMeasuredIOStats}
+				is.ReadBytes, is.WriteBytes = sumDockerBlkioStats(s.BlkioStats.IOServiceBytesRecursive)
+				is.ReadOps, is.WriteOps = sumDockerBlkioStats(s.BlkioStats.IOServicedRecursive)
+
 				h.resourceUsageLock.Lock()
 				h.resourceUsage = &cstructs.TaskResourceUsage{
 					ResourceUsage: &cstructs.ResourceUsage{
 						MemoryStats: ms,
 						CpuStats:    cs,
+						IOStats:     is,
 					},
 					Timestamp: s.Read.UTC().UnixNano(),
 				}
@@ -1199,6 +1233,20 @@ func (h *DockerHandle) collectStats() {
 	}
 }
 
+// sumDockerBlkioStats returns the totals of the reads and writes of the blkio
+// stat entries across all devices
+func sumDockerBlkioStats(entries []docker.BlkioStatsEntry) (read, write uint64) {
+	for _, entry := range entries {
+		switch entry.Op {
+		case "Read":
+			read += entry.Value
+		case "Write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
 func calculatePercent(newSample, oldSample, newTotal, oldTotal uint64, cores int) float64 {
 	numerator := newSample - oldSample
 	denom := newTotal - oldTotal
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
@@ -25,14 +26,21 @@ var BuiltinDrivers = map[string]Factory{
 	"java":     NewJavaDriver,
 	"qemu":     NewQemuDriver,
 	"rkt":      NewRktDriver,
+	"nspawn":   NewNspawnDriver,
 }
 
 // NewDriver is used to instantiate and return a new driver
-// given the name and a logger
+// given the name and a logger. Drivers that aren't builtin are looked up in
+// the client's plugin directory.
 func NewDriver(name string, ctx *DriverContext) (Driver, error) {
 	// Lookup the factory function
 	factory, ok := BuiltinDrivers[name]
 	if !ok {
+		if ctx.config != nil {
+			if path, ok := ExternalDrivers(ctx.config.PluginDir)[name]; ok {
+				return NewExternalDriver(ctx, name, path), nil
+			}
+		}
 		return nil, fmt.Errorf("unknown driver '%s'", name)
 	}
 
@@ -41,6 +49,14 @@ func NewDriver(name string, ctx *DriverContext) (Driver, error) {
 	return f, nil
 }
 
+// IsBuiltinDriver returns whether the driver is compiled into Nomad. Other
+// drivers may be external drivers installed on the clients, so only the
+// clients can validate the configs of their tasks.
+func IsBuiltinDriver(name string) bool {
+	_, ok := BuiltinDrivers[name]
+	return ok
+}
+
 // Factory is used to instantiate a new Driver
 type Factory func(*DriverContext) Driver
 
@@ -70,26 +86,60 @@ type DriverAbilities struct {
 	SendSignals bool
 }
 
+const (
+	// DriverEventStartRequested is emitted when a driver is asked to start a
+	// task.
+	DriverEventStartRequested = "Start Requested"
+
+	// DriverEventProcessStarted is emitted once the task's process has been
+	// launched.
+	DriverEventProcessStarted = "Process Started"
+
+	// DriverEventProcessExited is emitted when the task's process exits.
+	DriverEventProcessExited = "Process Exited"
+)
+
+// DriverEvent is a structured event emitted by a driver over the lifecycle of
+// a task.
+type DriverEvent struct {
+	// Type is the type of the event, e.g. DriverEventProcessStarted
+	Type string
+
+	// TaskName is the name of the task the event is for
+	TaskName string
+
+	// Time is the time at which the event occurred
+	Time time.Time
+
+	// Details holds event specific information such as the exit code
+	Details map[string]string
+}
+
+// EventSink receives the events emitted by a driver.
+type EventSink func(event *DriverEvent)
+
 // DriverContext is a means to inject dependencies such as loggers, configs, and
 // node attributes into a Driver without having to change the Driver interface
 // each time we do it. Used in conjection with Factory, above.
 type DriverContext struct {
-	taskName string
-	config   *config.Config
-	logger   *log.Logger
-	node     *structs.Node
-	taskEnv  *env.TaskEnvironment
+	taskName  string
+	config    *config.Config
+	logger    *log.Logger
+	node      *structs.Node
+	taskEnv   *env.TaskEnvironment
+	eventSink EventSink
 }
 
 // NewEmptyDriverContext returns a DriverContext with all fields set to their
 // zero value.
 func NewEmptyDriverContext() *DriverContext {
 	return &DriverContext{
-		taskName: "",
-		config:   nil,
-		node:     nil,
-		logger:   nil,
-		taskEnv:  nil,
+		taskName:  "",
+		config:    nil,
+		node:      nil,
+		logger:    nil,
+		taskEnv:   nil,
+		eventSink: nil,
 	}
 }
 
@@ -98,16 +148,37 @@ func NewEmptyDriverContext() *DriverContext {
 // private to the driver. If we want to change this later we can gorename all of
 // the fields in DriverContext.
 func NewDriverContext(taskName string, config *config.Config, node *structs.Node,
-	logger *log.Logger, taskEnv *env.TaskEnvironment) *DriverContext {
+	logger *log.Logger, taskEnv *env.TaskEnvironment, eventSink EventSink) *DriverContext {
 	return &DriverContext{
-		taskName: taskName,
-		config:   config,
-		node:     node,
-		logger:   logger,
-		taskEnv:  taskEnv,
+		taskName:  taskName,
+		config:    config,
+		node:      node,
+		logger:    logger,
+		taskEnv:   taskEnv,
+		eventSink: eventSink,
 	}
 }
 
+// emitEvent sends an event of the given type to the event sink, if one was
+// configured.
+func (d *DriverContext) emitEvent(eventType string, details map[string]string) {
+	emitDriverEvent(d.eventSink, d.taskName, eventType, details)
+}
+
+// emitDriverEvent sends an event to the sink if it is non-nil. It is used by
+// handles, which outlive the DriverContext they were created from.
+func emitDriverEvent(sink EventSink, taskName, eventType string, details map[string]string) {
+	if sink == nil {
+		return
+	}
+	sink(&DriverEvent{
+		Type:     eventType,
+		TaskName: taskName,
+		Time:     time.Now(),
+		Details:  details,
+	})
+}
+
 // DriverHandle is an opaque handle into a driver used for task
 // manipulation
 type DriverHandle interface {
@@ -129,6 +200,20 @@ type DriverHandle interface {
 
 	// Signal is used to send a signal to the task
 	Signal(s os.Signal) error
+
+	// Exec runs a command inside the task, e.g. to diagnose it, and returns
+	// once the command exits
+	Exec(cmd string, args []string) (*dstructs.ExecResult, error)
+}
+
+// SuspendableHandle is implemented by handles of tasks that can save their
+// state when the client shuts down, so that they can resume rather than start
+// over if they have to be started again before the client comes back.
+type SuspendableHandle interface {
+	DriverHandle
+
+	// Suspend saves the state of the task, giving up once the timeout elapses
+	Suspend(timeout time.Duration) error
 }
 
 // ExecContext is shared between drivers within an allocation
@@ -173,7 +258,8 @@ func GetTaskEnv(allocDir *allocdir.AllocDir, node *structs.Node,
 	if task.Resources != nil {
 		env.SetMemLimit(task.Resources.MemoryMB).
 			SetCpuLimit(task.Resources.CPU).
-			SetNetworks(task.Resources.Networks)
+			SetNetworks(task.Resources.Networks).
+			SetDevices(task.Resources.Devices)
 	}
 
 	if alloc != nil {
@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/hashicorp/nomad/client/devices"
 	hargs "github.com/hashicorp/nomad/helper/args"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -64,6 +65,11 @@ const (
 	// MetaPrefix is the prefix for passing task meta data.
 	MetaPrefix = "NOMAD_META_"
 
+	// DevicePrefix is the prefix for passing the IDs of the devices assigned
+	// to a task, followed by the vendor and type of the devices.
+	// E.g$NOMAD_DEVICE_NVIDIA_GPU=GPU-b1c2,GPU-a3d4
+	DevicePrefix = "NOMAD_DEVICE_"
+
 	// VaultToken is the environment variable for passing the Vault token
 	VaultToken = "VAULT_TOKEN"
 )
@@ -98,6 +104,7 @@ type TaskEnvironment struct {
 	AllocName        string
 	Node             *structs.Node
 	Networks         []*structs.NetworkResource
+	Devices          []*structs.DeviceResource
 	PortMap          map[string]int
 	VaultToken       string
 	InjectVaultToken bool
@@ -126,6 +133,52 @@ func (t *TaskEnvironment) ParseAndReplace(args []string) []string {
 	return replaced
 }
 
+// ParseAndReplaceConfig returns a copy of the driver config of a task with any
+// instance of an environment variable or nomad variable in its string values
+// replaced, including those nested in lists and blocks.
+func (t *TaskEnvironment) ParseAndReplaceConfig(config map[string]interface{}) map[string]interface{} {
+	if config == nil {
+		return nil
+	}
+	replaced := make(map[string]interface{}, len(config))
+	for k, v := range config {
+		replaced[k] = t.replaceConfigValue(v)
+	}
+	return replaced
+}
+
+// replaceConfigValue interpolates a value of a driver config, as decoded from
+// HCL or JSON
+func (t *TaskEnvironment) replaceConfigValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return t.ReplaceEnv(v)
+	case []string:
+		return t.ParseAndReplace(v)
+	case map[string]interface{}:
+		return t.ParseAndReplaceConfig(v)
+	case []map[string]interface{}:
+		replaced := make([]map[string]interface{}, len(v))
+		for i, m := range v {
+			replaced[i] = t.ParseAndReplaceConfig(m)
+		}
+		return replaced
+	case []interface{}:
+		replaced := make([]interface{}, len(v))
+		for i, e := range v {
+			replaced[i] = t.replaceConfigValue(e)
+		}
+		return replaced
+	case map[string]string:
+		replaced := make(map[string]string, len(v))
+		for k, s := range v {
+			replaced[k] = t.ReplaceEnv(s)
+		}
+		return replaced
+	}
+	return v
+}
+
 // ReplaceEnv takes an arg and replaces all occurrences of environment variables
 // and nomad variables.  If the variable is found in the passed map it is
 // replaced, otherwise the original string is returned.
@@ -160,6 +213,20 @@ func (t *TaskEnvironment) Build() *TaskEnvironment {
 		}
 	}
 
+	// Build the devices, along with the variables the device plugins expose
+	// them with
+	assigned := make(map[string][]string)
+	for _, d := range t.Devices {
+		key := fmt.Sprintf("%s%s_%s", DevicePrefix, strings.ToUpper(d.Vendor), strings.ToUpper(d.Type))
+		assigned[key] = append(assigned[key], d.IDs...)
+	}
+	for k, ids := range assigned {
+		t.TaskEnv[k] = strings.Join(ids, ",")
+	}
+	for k, v := range devices.TaskEnv(t.Devices) {
+		t.TaskEnv[k] = v
+	}
+
 	// Build the directories
 	if t.AllocDir != "" {
 		t.TaskEnv[AllocDir] = t.AllocDir
@@ -314,6 +381,16 @@ func (t *TaskEnvironment) clearNetworks() *TaskEnvironment {
 	return t
 }
 
+func (t *TaskEnvironment) SetDevices(devices []*structs.DeviceResource) *TaskEnvironment {
+	t.Devices = devices
+	return t
+}
+
+func (t *TaskEnvironment) clearDevices() *TaskEnvironment {
+	t.Devices = nil
+	return t
+}
+
 func (t *TaskEnvironment) SetPortMap(portMap map[string]int) *TaskEnvironment {
 	t.PortMap = portMap
 	return t
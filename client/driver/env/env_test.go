@@ -124,6 +124,37 @@ func TestEnvironment_ParseAndReplace_Mixed(t *testing.T) {
 	}
 }
 
+func TestEnvironment_ParseAndReplaceConfig(t *testing.T) {
+	env := testTaskEnvironment()
+	attr := fmt.Sprintf("${%v%v}", nodeAttributePrefix, attrKey)
+	meta := fmt.Sprintf("${%v%v}", nodeMetaPrefix, metaKey)
+	envOne := fmt.Sprintf("${%v}", envOneKey)
+
+	input := map[string]interface{}{
+		"image":  "image-" + attr + ".img",
+		"args":   []interface{}{envOne, 1},
+		"count":  2,
+		"labels": []map[string]interface{}{{"dc": meta}},
+		"nested": map[string]interface{}{"list": []string{envOne}},
+	}
+	exp := map[string]interface{}{
+		"image":  "image-" + attrVal + ".img",
+		"args":   []interface{}{envOneVal, 1},
+		"count":  2,
+		"labels": []map[string]interface{}{{"dc": metaVal}},
+		"nested": map[string]interface{}{"list": []string{envOneVal}},
+	}
+	act := env.ParseAndReplaceConfig(input)
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("ParseAndReplaceConfig(%v) returned %#v; want %#v", input, act, exp)
+	}
+
+	// The input is left untouched
+	if input["image"] != "image-"+attr+".img" {
+		t.Fatalf("input modified: %#v", input)
+	}
+}
+
 func TestEnvironment_ReplaceEnv_Mixed(t *testing.T) {
 	input := fmt.Sprintf("${%v}${%v%v}", nodeNameKey, nodeAttributePrefix, attrKey)
 	exp := fmt.Sprintf("%v%v", nodeName, attrVal)
@@ -163,6 +194,28 @@ func TestEnvironment_AsList(t *testing.T) {
 	}
 }
 
+func TestEnvironment_Devices(t *testing.T) {
+	n := mock.Node()
+	env := NewTaskEnvironment(n).
+		SetDevices([]*structs.DeviceResource{
+			{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80", IDs: []string{"GPU-1", "GPU-2"}},
+			{Vendor: "nvidia", Type: "vfio", Name: "0x1db4", IDs: []string{"0000:01:00.0"}},
+		}).Build()
+
+	act := env.EnvList()
+	exp := []string{
+		"NOMAD_DEVICE_NVIDIA_GPU=GPU-1,GPU-2",
+		"NOMAD_DEVICE_NVIDIA_VFIO=0000:01:00.0",
+		"NVIDIA_VISIBLE_DEVICES=GPU-1,GPU-2",
+		"CUDA_VISIBLE_DEVICES=GPU-1,GPU-2",
+	}
+	sort.Strings(act)
+	sort.Strings(exp)
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("env.List() returned %v; want %v", act, exp)
+	}
+}
+
 func TestEnvironment_VaultToken(t *testing.T) {
 	n := mock.Node()
 	env := NewTaskEnvironment(n).SetVaultToken("123", false).Build()
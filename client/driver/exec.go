@@ -276,6 +276,10 @@ func (h *execHandle) Signal(s os.Signal) error {
 	return h.executor.Signal(s)
 }
 
+func (h *execHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return h.executor.Exec(cmd, args)
+}
+
 func (h *execHandle) Kill() error {
 	if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
@@ -15,6 +15,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/armon/circbuf"
 	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/go-ps"
 	"github.com/shirou/gopsutil/process"
@@ -37,12 +38,17 @@ const (
 	// tree for finding out the pids that the executor and it's child processes
 	// have forked
 	pidScanInterval = 5 * time.Second
+
+	// execTimeout is how long commands run in the task through Exec may run
+	// before they are killed
+	execTimeout = 30 * time.Second
 )
 
 var (
 	// The statistics the basic executor exposes
 	ExecutorBasicMeasuredMemStats = []string{"RSS", "Swap"}
 	ExecutorBasicMeasuredCpuStats = []string{"System Mode", "User Mode", "Percent"}
+	ExecutorBasicMeasuredIOStats  = []string{"Read Bytes", "Write Bytes", "Read Ops", "Write Ops"}
 )
 
 // Executor is the interface which allows a driver to launch and supervise
@@ -61,6 +67,7 @@ type Executor interface {
 	Version() (*ExecutorVersion, error)
 	Stats() (*cstructs.TaskResourceUsage, error)
 	Signal(s os.Signal) error
+	Exec(cmd string, args []string) (*dstructs.ExecResult, error)
 }
 
 // ConsulContext holds context to configure the Consul client and run checks
@@ -86,6 +93,10 @@ type ConsulContext struct {
 
 	// DockerEndpoint is the endpoint of the docker daemon
 	DockerEndpoint string
+
+	// ServiceAddress is the address services are registered with instead of
+	// the host address of their port, e.g. the address of a VM on a bridge
+	ServiceAddress string
 }
 
 // ExecutorContext holds context to configure the command user
@@ -541,7 +552,14 @@ func (e *UniversalExecutor) SyncServices(ctx *ConsulContext) error {
 	}
 	e.interpolateServices(e.ctx.Task)
 	e.consulSyncer.SetDelegatedChecks(e.createCheckMap(), e.createCheck)
-	e.consulSyncer.SetAddrFinder(e.ctx.Task.FindHostAndPortFor)
+	if ctx.ServiceAddress != "" {
+		e.consulSyncer.SetAddrFinder(func(portLabel string) (string, int) {
+			_, port := e.ctx.Task.FindHostAndPortFor(portLabel)
+			return ctx.ServiceAddress, port
+		})
+	} else {
+		e.consulSyncer.SetAddrFinder(e.ctx.Task.FindHostAndPortFor)
+	}
 	domain := consul.NewExecutorDomain(e.ctx.AllocID, e.ctx.Task.Name)
 	serviceMap := generateServiceKeys(e.ctx.AllocID, e.ctx.Task.Services)
 	e.consulSyncer.SetServices(domain, serviceMap)
@@ -589,7 +607,16 @@ func (e *UniversalExecutor) pidStats() (map[string]*cstructs.ResourceUsage, erro
 			// calculate cpu usage percent
 			cs.Percent = np.cpuStatsTotal.Percent(cpuStats.Total() * float64(time.Second))
 		}
-		stats[strconv.Itoa(pid)] = &cstructs.ResourceUsage{MemoryStats: ms, CpuStats: cs}
+
+		is := &cstructs.IOStats{}
+		if ioStats, err := p.IOCounters(); err == nil {
+			is.ReadBytes = ioStats.ReadBytes
+			is.WriteBytes = ioStats.WriteBytes
+			is.ReadOps = ioStats.ReadCount
+			is.WriteOps = ioStats.WriteCount
+			is.Measured = ExecutorBasicMeasuredIOStats
+		}
+		stats[strconv.Itoa(pid)] = &cstructs.ResourceUsage{MemoryStats: ms, CpuStats: cs, IOStats: is}
 	}
 
 	return stats, nil
@@ -850,6 +877,7 @@ func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstruct
 		totalRSS, totalSwap                 uint64
 	)
 
+	totalIO := &cstructs.IOStats{}
 	for _, pidStat := range pidStats {
 		systemModeCPU += pidStat.CpuStats.SystemMode
 		userModeCPU += pidStat.CpuStats.UserMode
@@ -857,6 +885,10 @@ func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstruct
 
 		totalRSS += pidStat.MemoryStats.RSS
 		totalSwap += pidStat.MemoryStats.Swap
+
+		if pidStat.IOStats != nil {
+			totalIO.Add(pidStat.IOStats)
+		}
 	}
 
 	totalCPU := &cstructs.CpuStats{
@@ -876,6 +908,7 @@ func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstruct
 	resourceUsage := cstructs.ResourceUsage{
 		MemoryStats: totalMemory,
 		CpuStats:    totalCPU,
+		IOStats:     totalIO,
 	}
 	return &cstructs.TaskResourceUsage{
 		ResourceUsage: &resourceUsage,
@@ -899,3 +932,80 @@ func (e *UniversalExecutor) Signal(s os.Signal) error {
 
 	return nil
 }
+
+// Exec runs a command in the task's environment, with the same user and
+// chroot as the task, and returns its exit code and output. The executor has
+// joined the task's resource container, so the command is subject to the
+// task's limits too.
+func (e *UniversalExecutor) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	if e.cmd.Process == nil {
+		return nil, fmt.Errorf("Task not yet run")
+	}
+	select {
+	case <-e.processExited:
+		return nil, fmt.Errorf("Task has exited")
+	default:
+	}
+
+	path, err := e.lookupBin(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binaries in the task dir have to be run relative to the chroot, while
+	// the host's binaries are embedded in the chroot at the same path.
+	if e.fsIsolationEnforced && strings.HasPrefix(path, e.taskDir) {
+		rel, err := filepath.Rel(e.taskDir, path)
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join("/", rel)
+	}
+
+	e.logger.Printf("[DEBUG] executor: running command %v %v in task", path, strings.Join(args, " "))
+	buf, _ := circbuf.NewBuffer(int64(dstructs.ExecBufSize))
+	c := exec.Cmd{
+		Path:   path,
+		Args:   append([]string{path}, args...),
+		Env:    e.ctx.TaskEnv.EnvList(),
+		Dir:    e.cmd.Dir,
+		Stdout: buf,
+		Stderr: buf,
+	}
+	if e.cmd.SysProcAttr != nil {
+		attr := *e.cmd.SysProcAttr
+		c.SysProcAttr = &attr
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Wait()
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-time.After(execTimeout):
+		c.Process.Kill()
+		<-errCh
+		return nil, fmt.Errorf("command did not exit within %v", execTimeout)
+	}
+
+	res := &dstructs.ExecResult{Output: string(buf.Bytes())}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+		res.ExitCode = 1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			res.ExitCode = status.ExitStatus()
+			if status.Signaled() {
+				res.ExitCode = 128 + int(status.Signal())
+			}
+		}
+	}
+	return res, nil
+}
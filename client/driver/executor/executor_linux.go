@@ -43,6 +43,7 @@ var (
 	// The statistics the executor exposes when using cgroups
 	ExecutorCgroupMeasuredMemStats = []string{"RSS", "Cache", "Swap", "Max Usage", "Kernel Usage", "Kernel Max Usage"}
 	ExecutorCgroupMeasuredCpuStats = []string{"System Mode", "User Mode", "Throttled Periods", "Throttled Time", "Percent"}
+	ExecutorCgroupMeasuredIOStats  = []string{"Read Bytes", "Write Bytes", "Read Ops", "Write Ops"}
 )
 
 // configureIsolation configures chroot and creates cgroups
@@ -97,7 +98,7 @@ func (e *UniversalExecutor) configureCgroups(resources *structs.Resources) error
 	e.resConCtx.groups = &cgroupConfig.Cgroup{}
 	e.resConCtx.groups.Resources = &cgroupConfig.Resources{}
 	cgroupName := structs.GenerateUUID()
-	e.resConCtx.groups.Path = filepath.Join("/nomad", cgroupName)
+	e.resConCtx.groups.Path = filepath.Join(cgroupParent, cgroupName)
 
 	// TODO: verify this is needed for things like network access
 	e.resConCtx.groups.Resources.AllowAllDevices = true
@@ -176,10 +177,17 @@ func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 		TotalTicks:       e.systemCpuStats.TicksConsumed(totalPercent),
 		Measured:         ExecutorCgroupMeasuredCpuStats,
 	}
+	// Disk IO Related Stats
+	blkio := stats.BlkioStats
+	is := &cstructs.IOStats{Measured: ExecutorCgroupMeasuredIOStats}
+	is.ReadBytes, is.WriteBytes = sumBlkioStats(blkio.IoServiceBytesRecursive)
+	is.ReadOps, is.WriteOps = sumBlkioStats(blkio.IoServicedRecursive)
+
 	taskResUsage := cstructs.TaskResourceUsage{
 		ResourceUsage: &cstructs.ResourceUsage{
 			MemoryStats: ms,
 			CpuStats:    cs,
+			IOStats:     is,
 		},
 		Timestamp: ts.UTC().UnixNano(),
 	}
@@ -189,6 +197,20 @@ func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 	return &taskResUsage, nil
 }
 
+// sumBlkioStats returns the totals of the reads and writes of the blkio stat
+// entries across all devices
+func sumBlkioStats(entries []cgroups.BlkioStatEntry) (read, write uint64) {
+	for _, entry := range entries {
+		switch entry.Op {
+		case "Read":
+			read += entry.Value
+		case "Write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
 // runAs takes a user id as a string and looks up the user, and sets the command
 // to execute as that user.
 func (e *UniversalExecutor) runAs(userid string) error {
@@ -4,6 +4,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -13,6 +15,8 @@ import (
 	cstructs "github.com/hashicorp/nomad/client/driver/structs"
 	"github.com/hashicorp/nomad/client/testutil"
 	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
 )
 
 func testExecutorContextWithChroot(t *testing.T) *ExecutorContext {
@@ -114,3 +118,104 @@ ld.so.conf.d/`
 		t.Fatalf("Command output incorrectly: want %v; got %v", expected, act)
 	}
 }
+
+func TestExecutor_RunAs(t *testing.T) {
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("user nobody not found: %v", err)
+	}
+
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags)).(*UniversalExecutor)
+	if err := executor.runAs("nobody"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cred := executor.cmd.SysProcAttr.Credential
+	if cred == nil {
+		t.Fatalf("expected a credential")
+	}
+	if act := strconv.Itoa(int(cred.Uid)); act != u.Uid {
+		t.Fatalf("uid %s; want %s", act, u.Uid)
+	}
+	if act := strconv.Itoa(int(cred.Gid)); act != u.Gid {
+		t.Fatalf("gid %s; want %s", act, u.Gid)
+	}
+
+	if err := executor.runAs("nomad-no-such-user"); err == nil {
+		t.Fatalf("expected error for unknown user")
+	}
+}
+
+func TestExecutor_ReapOrphanedCgroups(t *testing.T) {
+	testutil.ExecCompatible(t)
+
+	mount, err := cgroups.FindCgroupMountpoint("memory")
+	if err != nil {
+		t.Skip("memory cgroup isn't mounted")
+	}
+
+	// Create a cgroup without processes and one with a process in it
+	parent := filepath.Join(mount, cgroupParent)
+	orphan := structs.GenerateUUID()
+	used := structs.GenerateUUID()
+	for _, name := range []string{orphan, used} {
+		if err := os.MkdirAll(filepath.Join(parent, name), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	defer os.Remove(filepath.Join(parent, orphan))
+	defer os.Remove(filepath.Join(parent, used))
+
+	cmd := exec.Command("/bin/sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := []byte(strconv.Itoa(cmd.Process.Pid))
+	if err := ioutil.WriteFile(filepath.Join(parent, used, "cgroup.procs"), pid, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	reaped, err := ReapOrphanedCgroups()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	found := false
+	for _, name := range reaped {
+		if name == used {
+			t.Fatalf("cgroup %s with a process was reaped", name)
+		}
+		found = found || name == orphan
+	}
+	if !found {
+		t.Fatalf("cgroup %s wasn't reaped: %v", orphan, reaped)
+	}
+	if _, err := os.Stat(filepath.Join(parent, orphan)); !os.IsNotExist(err) {
+		t.Fatalf("cgroup %s still exists: %v", orphan, err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, used)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Move the process out so that the cgroup can be removed
+	if err := ioutil.WriteFile(filepath.Join(mount, "cgroup.procs"), pid, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecutor_SumBlkioStats(t *testing.T) {
+	entries := []cgroups.BlkioStatEntry{
+		{Major: 8, Minor: 0, Op: "Read", Value: 100},
+		{Major: 8, Minor: 0, Op: "Write", Value: 20},
+		{Major: 8, Minor: 0, Op: "Total", Value: 120},
+		{Major: 8, Minor: 16, Op: "Read", Value: 5},
+		{Major: 8, Minor: 16, Op: "Write", Value: 1},
+	}
+	read, write := sumBlkioStats(entries)
+	if read != 105 || write != 21 {
+		t.Fatalf("bad: read %d, write %d", read, write)
+	}
+}
@@ -1,6 +1,7 @@
 package executor
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -265,6 +266,36 @@ func TestExecutor_Start_Kill(t *testing.T) {
 	}
 }
 
+func TestExecutor_Exec(t *testing.T) {
+	execCmd := ExecCommand{Cmd: "/bin/sleep", Args: []string{"10"}}
+	ctx := testExecutorContext(t)
+	defer ctx.AllocDir.Destroy()
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+	if _, err := executor.Exec("/bin/echo", nil); err == nil {
+		t.Fatalf("expected an error running a command before the task")
+	}
+
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	defer executor.Exit()
+
+	// Commands run in the task's directory with its environment
+	res, err := executor.Exec("/bin/sh", []string{"-c", "pwd; echo $NOMAD_ALLOC_ID >&2; exit 3"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	taskDir := ctx.AllocDir.TaskDirs[ctx.Task.Name]
+	expected := fmt.Sprintf("%s\n%s\n", taskDir, ctx.AllocID)
+	if res.ExitCode != 3 || res.Output != expected {
+		t.Fatalf("bad: %#v, expected output %q", res, expected)
+	}
+}
+
 func TestExecutor_MakeExecutable(t *testing.T) {
 	// Create a temp file
 	f, err := ioutil.TempFile("", "")
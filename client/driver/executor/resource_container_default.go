@@ -22,3 +22,7 @@ func (rc *resourceContainerContext) executorCleanup() error {
 func (rc *resourceContainerContext) getIsolationConfig() *dstructs.IsolationConfig {
 	return nil
 }
+
+func ReapOrphanedCgroups() ([]string, error) {
+	return nil, nil
+}
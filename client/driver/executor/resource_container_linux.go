@@ -1,13 +1,23 @@
 package executor
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 
+	"github.com/hashicorp/go-multierror"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
 	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
 )
 
+const (
+	// cgroupParent is the cgroup the cgroups of tasks are created in
+	cgroupParent = "/nomad"
+)
+
 // resourceContainerContext is a platform-specific struct for managing a
 // resource container.  In the case of Linux, this is used to control Cgroups.
 type resourceContainerContext struct {
@@ -40,3 +50,58 @@ func (rc *resourceContainerContext) getIsolationConfig() *dstructs.IsolationConf
 		CgroupPaths: rc.cgPaths,
 	}
 }
+
+// ReapOrphanedCgroups removes the cgroups of tasks that no processes are left
+// in, e.g. because the executor was killed or the host was restarted while the
+// client was down. Cgroups that still have processes in them are left alone,
+// as the client may reattach to their tasks. It returns the names of the
+// removed cgroups.
+func ReapOrphanedCgroups() ([]string, error) {
+	subsystems, err := cgroups.GetAllSubsystems()
+	if err != nil {
+		return nil, err
+	}
+
+	var merr multierror.Error
+	reaped := make(map[string]struct{})
+	seen := make(map[string]struct{})
+	for _, subsystem := range subsystems {
+		mount, err := cgroups.FindCgroupMountpoint(subsystem)
+		if err != nil {
+			continue
+		}
+
+		// Subsystems may be mounted together
+		if _, ok := seen[mount]; ok {
+			continue
+		}
+		seen[mount] = struct{}{}
+
+		parent := filepath.Join(mount, cgroupParent)
+		entries, err := ioutil.ReadDir(parent)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(parent, entry.Name())
+			pids, err := cgroups.GetPids(path)
+			if err != nil || len(pids) != 0 {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				merr.Errors = append(merr.Errors, fmt.Errorf("failed to remove cgroup %s: %v", path, err))
+				continue
+			}
+			reaped[entry.Name()] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(reaped))
+	for name := range reaped {
+		names = append(names, name)
+	}
+	return names, merr.ErrorOrNil()
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/nomad/client/driver/executor"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -38,6 +39,13 @@ type SyncServicesArgs struct {
 	Ctx *executor.ConsulContext
 }
 
+// ExecArgs wraps a command to run in the task and its args for the purposes of
+// RPC
+type ExecArgs struct {
+	Cmd  string
+	Args []string
+}
+
 func (e *ExecutorRPC) LaunchCmd(cmd *executor.ExecCommand) (*executor.ProcessState, error) {
 	var ps *executor.ProcessState
 	err := e.client.Call("Plugin.LaunchCmd", LaunchCmdArgs{Cmd: cmd}, &ps)
@@ -100,6 +108,12 @@ func (e *ExecutorRPC) Signal(s os.Signal) error {
 	return e.client.Call("Plugin.Signal", &s, new(interface{}))
 }
 
+func (e *ExecutorRPC) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	var res dstructs.ExecResult
+	err := e.client.Call("Plugin.Exec", ExecArgs{Cmd: cmd, Args: args}, &res)
+	return &res, err
+}
+
 type ExecutorRPCServer struct {
 	Impl   executor.Executor
 	logger *log.Logger
@@ -177,6 +191,14 @@ func (e *ExecutorRPCServer) Signal(args os.Signal, resp *interface{}) error {
 	return e.Impl.Signal(args)
 }
 
+func (e *ExecutorRPCServer) Exec(args ExecArgs, res *dstructs.ExecResult) error {
+	r, err := e.Impl.Exec(args.Cmd, args.Args)
+	if r != nil {
+		*res = *r
+	}
+	return err
+}
+
 type ExecutorPlugin struct {
 	logger *log.Logger
 	Impl   *ExecutorRPCServer
@@ -0,0 +1,375 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-plugin"
+	"github.com/hashicorp/nomad/client/config"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// externalDriverPrefix is the prefix of the file names of the external
+	// drivers installed in the plugin directory, followed by the name of the
+	// driver
+	externalDriverPrefix = "nomad-driver-"
+
+	// externalDriverPlugin is the name external drivers are served as
+	externalDriverPlugin = "driver"
+)
+
+var (
+	// externalPlugins holds the plugin processes shared by the fingerprints
+	// and validations of the external drivers, by the path of the driver, so
+	// that a plugin isn't launched for every call. externalPluginsLock guards
+	// access to the map.
+	externalPlugins     = make(map[string]*externalPlugin)
+	externalPluginsLock sync.Mutex
+)
+
+// externalPlugin is a running plugin process of an external driver
+type externalPlugin struct {
+	driver       ExternalDriver
+	pluginClient *plugin.Client
+}
+
+// sharedExternalPlugin returns the shared plugin process of the driver at
+// path, launching it if it isn't running
+func sharedExternalPlugin(path string, clientConfig *config.Config) (*externalPlugin, error) {
+	externalPluginsLock.Lock()
+	defer externalPluginsLock.Unlock()
+
+	if p, ok := externalPlugins[path]; ok && !p.pluginClient.Exited() {
+		return p, nil
+	}
+	pluginConfig := &plugin.ClientConfig{
+		Cmd: exec.Command(path),
+	}
+	driver, pluginClient, err := createExternalDriver(pluginConfig, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	p := &externalPlugin{driver: driver, pluginClient: pluginClient}
+	externalPlugins[path] = p
+	return p, nil
+}
+
+// ShutdownExternalDrivers kills the plugin processes shared by the
+// fingerprints and validations of the external drivers. The plugins running
+// tasks are left running.
+func ShutdownExternalDrivers() {
+	externalPluginsLock.Lock()
+	defer externalPluginsLock.Unlock()
+
+	for path, p := range externalPlugins {
+		p.pluginClient.Kill()
+		delete(externalPlugins, path)
+	}
+}
+
+// ExternalDrivers returns the paths of the external drivers installed in dir
+// by their name. Drivers with the name of a builtin driver are ignored.
+func ExternalDrivers(dir string) map[string]string {
+	drivers := make(map[string]string)
+	if dir == "" {
+		return drivers
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return drivers
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, externalDriverPrefix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+
+		// Follow symlinks to the plugin's binary
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if runtime.GOOS == "windows" {
+			name = strings.TrimSuffix(name, ".exe")
+		} else if fi.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		name = strings.TrimPrefix(name, externalDriverPrefix)
+		if _, ok := BuiltinDrivers[name]; ok || name == "" {
+			continue
+		}
+		drivers[name] = path
+	}
+	return drivers
+}
+
+// externalDriver runs tasks with a driver shipped as a plugin, see
+// ExternalDriver
+type externalDriver struct {
+	DriverContext
+	name string
+	path string
+}
+
+// externalHandle is returned from Start/Open as a handle to the plugin process
+// of the task
+type externalHandle struct {
+	pluginClient   *plugin.Client
+	driver         ExternalDriver
+	handleID       string
+	name           string
+	killTimeout    time.Duration
+	maxKillTimeout time.Duration
+	logger         *log.Logger
+	waitCh         chan *dstructs.WaitResult
+	doneCh         chan struct{}
+}
+
+// NewExternalDriver is used to create a driver running tasks with the plugin
+// at path
+func NewExternalDriver(ctx *DriverContext, name, path string) Driver {
+	return &externalDriver{DriverContext: *ctx, name: name, path: path}
+}
+
+// attr is the key populated in Node Attributes to indicate the presence of
+// the driver
+func (d *externalDriver) attr() string {
+	return "driver." + d.name
+}
+
+// shared calls f with the driver's shared plugin process, for calls that
+// aren't about a task.
+func (d *externalDriver) shared(f func(ExternalDriver) error) error {
+	p, err := sharedExternalPlugin(d.path, d.config)
+	if err != nil {
+		return err
+	}
+	return f(p.driver)
+}
+
+func (d *externalDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	req := &ExternalFingerprintRequest{
+		Options:    cfg.Options,
+		Attributes: node.Attributes,
+	}
+	var resp *ExternalFingerprintResponse
+	err := d.shared(func(driver ExternalDriver) error {
+		var err error
+		resp, err = driver.Fingerprint(req)
+		return err
+	})
+	if err != nil {
+		d.logger.Printf("[WARN] driver.%s: failed to fingerprint: %v", d.name, err)
+		delete(node.Attributes, d.attr())
+		return false, nil
+	}
+
+	if !resp.Detected {
+		delete(node.Attributes, d.attr())
+		return false, nil
+	}
+	for k, v := range resp.Attributes {
+		node.Attributes[k] = v
+	}
+	node.Attributes[d.attr()] = "1"
+	return true, nil
+}
+
+// Periodic fingerprints external drivers less often than the builtin ones, as
+// each fingerprint is an RPC to the driver's plugin.
+func (d *externalDriver) Periodic() (bool, time.Duration) {
+	return true, 30 * time.Second
+}
+
+// Validate is used to validate the driver configuration
+func (d *externalDriver) Validate(config map[string]interface{}) error {
+	return d.shared(func(driver ExternalDriver) error {
+		return driver.Validate(config)
+	})
+}
+
+func (d *externalDriver) Abilities() DriverAbilities {
+	return DriverAbilities{
+		SendSignals: false,
+	}
+}
+
+func (d *externalDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	// Get the task directory for storing the plugin's logs.
+	taskDir, ok := ctx.AllocDir.TaskDirs[d.DriverContext.taskName]
+	if !ok {
+		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
+	}
+
+	pluginLogFile := filepath.Join(taskDir, fmt.Sprintf("%s-%s.out", task.Name, d.name))
+	pluginConfig := &plugin.ClientConfig{
+		Cmd: exec.Command(d.path, pluginLogFile),
+	}
+	driver, pluginClient, err := createExternalDriver(pluginConfig, d.config)
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.Validate(task.Config); err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+
+	req := &ExternalStartRequest{
+		AllocID:  ctx.AllocID,
+		AllocDir: ctx.AllocDir,
+		Task:     task,
+		Env:      d.taskEnv.EnvMap(),
+		Options:  d.config.Options,
+	}
+	handleID, err := driver.Start(req)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+	d.logger.Printf("[DEBUG] driver.%s: started task %q via plugin with pid: %v",
+		d.name, task.Name, pluginClient.ReattachConfig().Pid)
+
+	// Return a driver handle
+	maxKill := d.DriverContext.config.MaxKillTimeout
+	h := &externalHandle{
+		pluginClient:   pluginClient,
+		driver:         driver,
+		handleID:       handleID,
+		name:           d.name,
+		killTimeout:    GetKillTimeout(task.KillTimeout, maxKill),
+		maxKillTimeout: maxKill,
+		logger:         d.logger,
+		doneCh:         make(chan struct{}),
+		waitCh:         make(chan *dstructs.WaitResult, 1),
+	}
+	go h.run()
+	return h, nil
+}
+
+type externalId struct {
+	HandleID       string
+	KillTimeout    time.Duration
+	MaxKillTimeout time.Duration
+	PluginConfig   *PluginReattachConfig
+}
+
+func (d *externalDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+	id := &externalId{}
+	if err := json.Unmarshal([]byte(handleID), id); err != nil {
+		return nil, fmt.Errorf("Failed to parse handle '%s': %v", handleID, err)
+	}
+
+	pluginConfig := &plugin.ClientConfig{
+		Reattach: id.PluginConfig.PluginConfig(),
+	}
+	driver, pluginClient, err := createExternalDriver(pluginConfig, d.config)
+	if err != nil {
+		d.logger.Printf("[ERR] driver.%s: error connecting to plugin so destroying plugin pid", d.name)
+		if e := killProcess(id.PluginConfig.Pid); e != nil {
+			d.logger.Printf("[ERR] driver.%s: error destroying plugin: %v", d.name, e)
+		}
+		return nil, fmt.Errorf("error connecting to plugin: %v", err)
+	}
+	if err := driver.Open(id.HandleID); err != nil {
+		pluginClient.Kill()
+		return nil, fmt.Errorf("failed to reopen task: %v", err)
+	}
+
+	// Return a driver handle
+	h := &externalHandle{
+		pluginClient:   pluginClient,
+		driver:         driver,
+		handleID:       id.HandleID,
+		name:           d.name,
+		killTimeout:    id.KillTimeout,
+		maxKillTimeout: id.MaxKillTimeout,
+		logger:         d.logger,
+		doneCh:         make(chan struct{}),
+		waitCh:         make(chan *dstructs.WaitResult, 1),
+	}
+	go h.run()
+	return h, nil
+}
+
+func (h *externalHandle) ID() string {
+	id := externalId{
+		HandleID:       h.handleID,
+		KillTimeout:    h.killTimeout,
+		MaxKillTimeout: h.maxKillTimeout,
+		PluginConfig:   NewPluginReattachConfig(h.pluginClient.ReattachConfig()),
+	}
+
+	data, err := json.Marshal(id)
+	if err != nil {
+		h.logger.Printf("[ERR] driver.%s: failed to marshal ID to JSON: %s", h.name, err)
+	}
+	return string(data)
+}
+
+func (h *externalHandle) WaitCh() chan *dstructs.WaitResult {
+	return h.waitCh
+}
+
+func (h *externalHandle) Update(task *structs.Task) error {
+	// Store the updated kill timeout.
+	h.killTimeout = GetKillTimeout(task.KillTimeout, h.maxKillTimeout)
+
+	// Update is not possible
+	return nil
+}
+
+func (h *externalHandle) Signal(s os.Signal) error {
+	return fmt.Errorf("signals not supported by the %s driver", h.name)
+}
+
+func (h *externalHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return nil, fmt.Errorf("running commands not supported by the %s driver", h.name)
+}
+
+// Kill asks the plugin to stop the task, and kills the plugin if the task
+// hasn't stopped within the kill timeout.
+func (h *externalHandle) Kill() error {
+	if err := h.driver.Kill(h.handleID); err != nil {
+		if h.pluginClient.Exited() {
+			return nil
+		}
+		return fmt.Errorf("driver plugin Kill failed: %v", err)
+	}
+
+	select {
+	case <-h.doneCh:
+		return nil
+	case <-time.After(h.killTimeout):
+		h.pluginClient.Kill()
+		return nil
+	}
+}
+
+func (h *externalHandle) Stats() (*cstructs.TaskResourceUsage, error) {
+	return nil, fmt.Errorf("stats not implemented for the %s driver", h.name)
+}
+
+func (h *externalHandle) run() {
+	res, err := h.driver.Wait(h.handleID)
+	close(h.doneCh)
+	if err == nil && res.Err != "" {
+		err = fmt.Errorf("%s", res.Err)
+	}
+	h.waitCh <- dstructs.NewWaitResult(res.ExitCode, res.Signal, err)
+	close(h.waitCh)
+	h.pluginClient.Kill()
+}
@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"net/rpc"
+	"os"
+
+	"github.com/hashicorp/go-plugin"
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// ExternalDriver is implemented by task drivers shipped as plugins rather than
+// compiled into Nomad. A plugin serves it with ServeExternalDriver. The client
+// launches a plugin process for each task, which outlives the client so that
+// the task keeps running while the client is restarted, and short lived ones
+// to fingerprint the node and validate task configs.
+type ExternalDriver interface {
+	// Fingerprint returns whether the driver can run tasks on the node, and
+	// the node attributes it sets
+	Fingerprint(req *ExternalFingerprintRequest) (*ExternalFingerprintResponse, error)
+
+	// Validate returns an error if the task's driver config is invalid
+	Validate(config map[string]interface{}) error
+
+	// Start starts the task and returns an opaque ID to refer to it by
+	Start(req *ExternalStartRequest) (string, error)
+
+	// Open is called when the client reattaches to the plugin process of a
+	// task after being restarted. It returns an error if the task with the ID
+	// returned by Start is gone.
+	Open(handleID string) error
+
+	// Wait blocks until the task exits
+	Wait(handleID string) (*ExternalWaitResult, error)
+
+	// Kill stops the task
+	Kill(handleID string) error
+}
+
+// ExternalFingerprintRequest is passed to an external driver to fingerprint
+// the node
+type ExternalFingerprintRequest struct {
+	// Options are the client's config options
+	Options map[string]string
+
+	// Attributes are the node attributes fingerprinted so far
+	Attributes map[string]string
+}
+
+// ExternalFingerprintResponse is the result of fingerprinting the node
+type ExternalFingerprintResponse struct {
+	// Detected is whether the driver can run tasks on the node
+	Detected bool
+
+	// Attributes are the node attributes to set, usually prefixed with
+	// "driver.<name>."
+	Attributes map[string]string
+}
+
+// ExternalStartRequest is passed to an external driver to start a task
+type ExternalStartRequest struct {
+	AllocID  string
+	AllocDir *allocdir.AllocDir
+	Task     *structs.Task
+
+	// Env is the task's environment, including the NOMAD_* variables
+	Env map[string]string
+
+	// Options are the client's config options
+	Options map[string]string
+}
+
+// ExternalWaitResult is the result of a task of an external driver exiting.
+// The error is a string as errors can't be sent over RPC.
+type ExternalWaitResult struct {
+	ExitCode int
+	Signal   int
+	Err      string
+}
+
+// ServeExternalDriver serves the driver from the main function of a plugin.
+// The client passes the plugin a file to log to as its only argument, as the
+// plugin's stderr is gone once the client exits.
+func ServeExternalDriver(impl ExternalDriver) {
+	if len(os.Args) > 1 {
+		if f, err := os.OpenFile(os.Args[1], os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600); err == nil {
+			os.Stderr = f
+		}
+	}
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: HandshakeConfig,
+		Plugins: map[string]plugin.Plugin{
+			externalDriverPlugin: &ExternalDriverPlugin{Impl: impl},
+		},
+	})
+}
+
+type ExternalDriverRPC struct {
+	client *rpc.Client
+}
+
+// ExternalHandleArgs wraps the ID of a task for the purposes of RPC
+type ExternalHandleArgs struct {
+	HandleID string
+}
+
+// ExternalValidateArgs wraps the driver config of a task for the purposes of
+// RPC
+type ExternalValidateArgs struct {
+	Config map[string]interface{}
+}
+
+func (e *ExternalDriverRPC) Fingerprint(req *ExternalFingerprintRequest) (*ExternalFingerprintResponse, error) {
+	var resp ExternalFingerprintResponse
+	err := e.client.Call("Plugin.Fingerprint", req, &resp)
+	return &resp, err
+}
+
+func (e *ExternalDriverRPC) Validate(config map[string]interface{}) error {
+	return e.client.Call("Plugin.Validate", ExternalValidateArgs{Config: config}, new(interface{}))
+}
+
+func (e *ExternalDriverRPC) Start(req *ExternalStartRequest) (string, error) {
+	var id string
+	err := e.client.Call("Plugin.Start", req, &id)
+	return id, err
+}
+
+func (e *ExternalDriverRPC) Open(handleID string) error {
+	return e.client.Call("Plugin.Open", ExternalHandleArgs{HandleID: handleID}, new(interface{}))
+}
+
+func (e *ExternalDriverRPC) Wait(handleID string) (*ExternalWaitResult, error) {
+	var res ExternalWaitResult
+	err := e.client.Call("Plugin.Wait", ExternalHandleArgs{HandleID: handleID}, &res)
+	return &res, err
+}
+
+func (e *ExternalDriverRPC) Kill(handleID string) error {
+	return e.client.Call("Plugin.Kill", ExternalHandleArgs{HandleID: handleID}, new(interface{}))
+}
+
+type ExternalDriverRPCServer struct {
+	Impl ExternalDriver
+}
+
+func (e *ExternalDriverRPCServer) Fingerprint(args *ExternalFingerprintRequest, resp *ExternalFingerprintResponse) error {
+	r, err := e.Impl.Fingerprint(args)
+	if r != nil {
+		*resp = *r
+	}
+	return err
+}
+
+func (e *ExternalDriverRPCServer) Validate(args ExternalValidateArgs, resp *interface{}) error {
+	return e.Impl.Validate(args.Config)
+}
+
+func (e *ExternalDriverRPCServer) Start(args *ExternalStartRequest, id *string) error {
+	handleID, err := e.Impl.Start(args)
+	*id = handleID
+	return err
+}
+
+func (e *ExternalDriverRPCServer) Open(args ExternalHandleArgs, resp *interface{}) error {
+	return e.Impl.Open(args.HandleID)
+}
+
+func (e *ExternalDriverRPCServer) Wait(args ExternalHandleArgs, res *ExternalWaitResult) error {
+	r, err := e.Impl.Wait(args.HandleID)
+	if r != nil {
+		*res = *r
+	}
+	return err
+}
+
+func (e *ExternalDriverRPCServer) Kill(args ExternalHandleArgs, resp *interface{}) error {
+	return e.Impl.Kill(args.HandleID)
+}
+
+// ExternalDriverPlugin is the plugin serving an ExternalDriver. The client
+// side doesn't need Impl to be set.
+type ExternalDriverPlugin struct {
+	Impl ExternalDriver
+}
+
+func (p *ExternalDriverPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &ExternalDriverRPCServer{Impl: p.Impl}, nil
+}
+
+func (p *ExternalDriverPlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &ExternalDriverRPC{client: c}, nil
+}
@@ -0,0 +1,271 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/testtask"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// testExternalDriverEnv makes the test binary serve testExternalDriver
+const testExternalDriverEnv = "NOMAD_TEST_EXTERNAL_DRIVER"
+
+// testExternalDriver is an external driver whose tasks exit with exit code 3
+// after a second, or with SIGTERM if killed first.
+type testExternalDriver struct {
+	lock  sync.Mutex
+	tasks map[string]chan struct{}
+	next  int
+}
+
+func (d *testExternalDriver) Fingerprint(req *ExternalFingerprintRequest) (*ExternalFingerprintResponse, error) {
+	return &ExternalFingerprintResponse{
+		Detected:   true,
+		Attributes: map[string]string{"driver.test.kernel": req.Attributes["kernel.name"]},
+	}, nil
+}
+
+func (d *testExternalDriver) Validate(config map[string]interface{}) error {
+	if _, ok := config["exit_code"]; !ok {
+		return fmt.Errorf("exit_code is required")
+	}
+	return nil
+}
+
+func (d *testExternalDriver) Start(req *ExternalStartRequest) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.tasks == nil {
+		d.tasks = make(map[string]chan struct{})
+	}
+	d.next++
+	id := fmt.Sprintf("%s-%d", req.Task.Name, d.next)
+	d.tasks[id] = make(chan struct{})
+	return id, nil
+}
+
+func (d *testExternalDriver) Open(handleID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.tasks[handleID]; !ok {
+		return fmt.Errorf("unknown task %q", handleID)
+	}
+	return nil
+}
+
+func (d *testExternalDriver) Wait(handleID string) (*ExternalWaitResult, error) {
+	d.lock.Lock()
+	killCh, ok := d.tasks[handleID]
+	d.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown task %q", handleID)
+	}
+	select {
+	case <-killCh:
+		return &ExternalWaitResult{Signal: 15}, nil
+	case <-time.After(time.Second):
+		return &ExternalWaitResult{ExitCode: 3}, nil
+	}
+}
+
+func (d *testExternalDriver) Kill(handleID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	killCh, ok := d.tasks[handleID]
+	if !ok {
+		return fmt.Errorf("unknown task %q", handleID)
+	}
+	close(killCh)
+	return nil
+}
+
+func init() {
+	if os.Getenv(testExternalDriverEnv) != "" {
+		ServeExternalDriver(new(testExternalDriver))
+		os.Exit(0)
+	}
+}
+
+// setupExternalDriver installs the test binary as the "test" external driver in
+// a plugin directory, which is returned along with a function removing it.
+func setupExternalDriver(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("external driver test plugin requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "nomad-plugins")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	script := fmt.Sprintf("#!/bin/sh\n%s=1 exec %s \"$@\"\n", testExternalDriverEnv, strconv.Quote(testtask.Path()))
+	if err := ioutil.WriteFile(filepath.Join(dir, externalDriverPrefix+"test"), []byte(script), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Files that aren't executable or lack the prefix aren't drivers
+	ioutil.WriteFile(filepath.Join(dir, externalDriverPrefix+"noexec"), []byte(script), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "test"), []byte(script), 0755)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestExternalDrivers(t *testing.T) {
+	dir, cleanup := setupExternalDriver(t)
+	defer cleanup()
+
+	drivers := ExternalDrivers(dir)
+	if len(drivers) != 1 || drivers["test"] != filepath.Join(dir, externalDriverPrefix+"test") {
+		t.Fatalf("bad: %v", drivers)
+	}
+	if drivers := ExternalDrivers(""); len(drivers) != 0 {
+		t.Fatalf("bad: %v", drivers)
+	}
+}
+
+func TestExternalDriver_Fingerprint(t *testing.T) {
+	dir, cleanup := setupExternalDriver(t)
+	defer cleanup()
+
+	task := &structs.Task{Name: "foo", Driver: "test", Resources: structs.DefaultResources()}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.PluginDir = dir
+
+	d, err := NewDriver("test", driverCtx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	node := mock.Node()
+	node.Attributes["kernel.name"] = "linux"
+	apply, err := d.Fingerprint(driverCtx.config, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !apply {
+		t.Fatalf("should apply")
+	}
+	if node.Attributes["driver.test"] != "1" || node.Attributes["driver.test.kernel"] != "linux" {
+		t.Fatalf("bad: %v", node.Attributes)
+	}
+
+	// Fingerprints and validations share a single plugin process
+	path := filepath.Join(dir, externalDriverPrefix+"test")
+	p := externalPlugins[path]
+	if _, err := d.Fingerprint(driverCtx.config, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := d.Validate(map[string]interface{}{"exit_code": 0}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if externalPlugins[path] != p {
+		t.Fatalf("expected the plugin to be reused")
+	}
+
+	// The shared plugin is killed once the client shuts down
+	ShutdownExternalDrivers()
+	if !p.pluginClient.Exited() {
+		t.Fatalf("expected the shared plugin to be killed")
+	}
+	if _, ok := externalPlugins[path]; ok {
+		t.Fatalf("expected the shared plugin to be removed")
+	}
+
+	// Drivers not installed in the plugin directory are unknown
+	if _, err := NewDriver("missing", driverCtx); err == nil {
+		t.Fatalf("expected an unknown driver error")
+	}
+}
+
+func TestExternalDriver_StartWait(t *testing.T) {
+	dir, cleanup := setupExternalDriver(t)
+	defer cleanup()
+
+	task := &structs.Task{
+		Name:      "foo",
+		Driver:    "test",
+		Config:    map[string]interface{}{"exit_code": 3},
+		Resources: structs.DefaultResources(),
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.PluginDir = dir
+
+	d, err := NewDriver("test", driverCtx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := d.Validate(map[string]interface{}{}); err == nil {
+		t.Fatalf("expected a validation error")
+	}
+	defer ShutdownExternalDrivers()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-handle.WaitCh():
+		if res.ExitCode != 3 || res.Signal != 0 || res.Err != nil {
+			t.Fatalf("bad: %#v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExternalDriver_OpenKill(t *testing.T) {
+	dir, cleanup := setupExternalDriver(t)
+	defer cleanup()
+
+	task := &structs.Task{
+		Name:      "foo",
+		Driver:    "test",
+		Config:    map[string]interface{}{"exit_code": 0},
+		Resources: structs.DefaultResources(),
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.PluginDir = dir
+
+	d, err := NewDriver("test", driverCtx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reattach to the plugin process of the task, as a restarted client would
+	handle2, err := d.Open(execCtx, handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if handle2.ID() != handle.ID() {
+		t.Fatalf("bad: %q, expected %q", handle2.ID(), handle.ID())
+	}
+
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-handle.WaitCh():
+		if res.Signal != 15 {
+			t.Fatalf("bad: %#v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+	select {
+	case <-handle2.WaitCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/executor"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
-	"github.com/hashicorp/nomad/client/fingerprint"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper/discover"
 	"github.com/hashicorp/nomad/helper/fields"
@@ -38,11 +37,11 @@ const (
 // It literally just fork/execs tasks with the java command.
 type JavaDriver struct {
 	DriverContext
-	fingerprint.StaticFingerprinter
 }
 
 type JavaDriverConfig struct {
 	JarPath string   `mapstructure:"jar_path"`
+	Class   string   `mapstructure:"class"`
 	JvmOpts []string `mapstructure:"jvm_options"`
 	Args    []string `mapstructure:"args"`
 }
@@ -78,6 +77,9 @@ func (d *JavaDriver) Validate(config map[string]interface{}) error {
 				Type:     fields.TypeString,
 				Required: true,
 			},
+			"class": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
 			"jvm_options": &fields.FieldSchema{
 				Type: fields.TypeArray,
 			},
@@ -94,12 +96,32 @@ func (d *JavaDriver) Validate(config map[string]interface{}) error {
 	return nil
 }
 
+// javaHeapOpts returns the JVM options with the maximum heap size limited to
+// the task's memory of memoryMB, unless the options already set it. Otherwise
+// the JVM sizes its heap after the host's memory and is killed once it grows
+// beyond the task's memory limit.
+func javaHeapOpts(opts []string, memoryMB int) []string {
+	if memoryMB <= 0 {
+		return opts
+	}
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, "-Xmx") || strings.HasPrefix(opt, "-XX:MaxHeapSize=") {
+			return opts
+		}
+	}
+	return append([]string{fmt.Sprintf("-Xmx%dm", memoryMB)}, opts...)
+}
+
 func (d *JavaDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
 		SendSignals: true,
 	}
 }
 
+func (d *JavaDriver) Periodic() (bool, time.Duration) {
+	return true, 15 * time.Second
+}
+
 func (d *JavaDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
 	// Get the current status so that we can log any debug messages only if the
 	// state changes
@@ -188,9 +210,17 @@ func (d *JavaDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle,
 		d.logger.Printf("[DEBUG] driver.java: found JVM options: %s", driverConfig.JvmOpts)
 		args = append(args, driverConfig.JvmOpts...)
 	}
+	if task.Resources != nil {
+		args = javaHeapOpts(args, task.Resources.MemoryMB)
+	}
 
-	// Build the argument list.
-	args = append(args, "-jar", driverConfig.JarPath)
+	// Build the argument list, running the main class of the jar unless the
+	// task sets one
+	if driverConfig.Class != "" {
+		args = append(args, "-cp", driverConfig.JarPath, driverConfig.Class)
+	} else {
+		args = append(args, "-jar", driverConfig.JarPath)
+	}
 	if len(driverConfig.Args) != 0 {
 		args = append(args, driverConfig.Args...)
 	}
@@ -376,6 +406,10 @@ func (h *javaHandle) Signal(s os.Signal) error {
 	return h.executor.Signal(s)
 }
 
+func (h *javaHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return h.executor.Exec(cmd, args)
+}
+
 func (h *javaHandle) Kill() error {
 	if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"syscall"
@@ -327,3 +328,22 @@ func TestJavaDriverUser(t *testing.T) {
 		t.Fatalf("Expecting '%v' in '%v'", msg, err)
 	}
 }
+
+func TestJavaDriver_HeapOpts(t *testing.T) {
+	cases := []struct {
+		opts     []string
+		memoryMB int
+		expected []string
+	}{
+		{nil, 256, []string{"-Xmx256m"}},
+		{[]string{"-Xms64m"}, 256, []string{"-Xmx256m", "-Xms64m"}},
+		{[]string{"-Xmx128m"}, 256, []string{"-Xmx128m"}},
+		{[]string{"-XX:MaxHeapSize=128m"}, 256, []string{"-XX:MaxHeapSize=128m"}},
+		{[]string{"-Xms64m"}, 0, []string{"-Xms64m"}},
+	}
+	for _, c := range cases {
+		if opts := javaHeapOpts(c.opts, c.memoryMB); !reflect.DeepEqual(opts, c.expected) {
+			t.Fatalf("opts %v, memory %d: got %v; want %v", c.opts, c.memoryMB, opts, c.expected)
+		}
+	}
+}
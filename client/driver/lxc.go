@@ -370,7 +370,7 @@ func (h *lxcDriverHandle) WaitCh() chan *dstructs.WaitResult {
 }
 
 func (h *lxcDriverHandle) Update(task *structs.Task) error {
-	h.killTimeout = GetKillTimeout(task.KillTimeout, h.killTimeout)
+	h.killTimeout = GetKillTimeout(task.KillTimeout, h.maxKillTimeout)
 	return nil
 }
 
@@ -390,6 +390,10 @@ func (h *lxcDriverHandle) Signal(s os.Signal) error {
 	return fmt.Errorf("LXC does not support signals")
 }
 
+func (h *lxcDriverHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return nil, fmt.Errorf("LXC does not support running commands in tasks")
+}
+
 func (h *lxcDriverHandle) Stats() (*cstructs.TaskResourceUsage, error) {
 	cpuStats, err := h.container.CPUStats()
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/mitchellh/mapstructure"
@@ -211,6 +212,11 @@ func (h *mockDriverHandle) Signal(s os.Signal) error {
 	return h.signalErr
 }
 
+// Exec returns the command line as the output of the command
+func (h *mockDriverHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return &dstructs.ExecResult{Output: strings.Join(append([]string{cmd}, args...), " ")}, nil
+}
+
 // Kill kills a mock task
 func (h *mockDriverHandle) Kill() error {
 	h.logger.Printf("[DEBUG] driver.mock: killing task %q after kill timeout: %v", h.taskName, h.killTimeout)
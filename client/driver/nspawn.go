@@ -0,0 +1,582 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/armon/circbuf"
+	"github.com/hashicorp/go-plugin"
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver/executor"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/helper/discover"
+	"github.com/hashicorp/nomad/helper/fields"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/mitchellh/mapstructure"
+)
+
+var (
+	reNspawnVersion = regexp.MustCompile(`systemd (\d+)`)
+
+	// reNspawnMachineName matches the characters that aren't allowed in
+	// machine names
+	reNspawnMachineName = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+)
+
+const (
+	// The key populated in the Node Attributes to indicate the presence of the
+	// nspawn driver
+	nspawnDriverAttr = "driver.nspawn"
+
+	// nspawnCmd, machinectlCmd and systemdRunCmd are the commands of systemd
+	// the driver uses to run and manage containers
+	nspawnCmd     = "systemd-nspawn"
+	machinectlCmd = "machinectl"
+	systemdRunCmd = "systemd-run"
+
+	// nspawnRootfsDir is the directory in the task directory that rootfs
+	// tarballs are extracted into
+	nspawnRootfsDir = "rootfs"
+
+	// nspawnMaxMachineName is the maximum length of machine names
+	nspawnMaxMachineName = 64
+
+	// nspawnExecTimeout is how long commands run in containers through Exec
+	// may run
+	nspawnExecTimeout = 30 * time.Second
+)
+
+// NspawnDriver is a driver for booting OS images in containers with
+// systemd-nspawn
+type NspawnDriver struct {
+	DriverContext
+}
+
+type NspawnDriverConfig struct {
+	Image   string   `mapstructure:"image"`   // A directory, raw disk image or rootfs tarball
+	Boot    *bool    `mapstructure:"boot"`    // Boot the image's init system rather than running Command
+	Command string   `mapstructure:"command"` // The command to run if the image isn't booted
+	Args    []string `mapstructure:"args"`    // Arguments to the init system or command
+}
+
+// nspawnHandle is returned from Start/Open as a handle to the PID
+type nspawnHandle struct {
+	pluginClient   *plugin.Client
+	executorPid    int
+	executor       executor.Executor
+	allocDir       *allocdir.AllocDir
+	machine        string
+	boot           bool
+	logger         *log.Logger
+	killTimeout    time.Duration
+	maxKillTimeout time.Duration
+	waitCh         chan *dstructs.WaitResult
+	doneCh         chan struct{}
+}
+
+// nspawnPID is a struct to map the pid running the process to the machine it
+// runs
+type nspawnPID struct {
+	PluginConfig   *PluginReattachConfig
+	AllocDir       *allocdir.AllocDir
+	ExecutorPid    int
+	Machine        string
+	Boot           bool
+	KillTimeout    time.Duration
+	MaxKillTimeout time.Duration
+}
+
+// NewNspawnDriver is used to create a new nspawn driver
+func NewNspawnDriver(ctx *DriverContext) Driver {
+	return &NspawnDriver{DriverContext: *ctx}
+}
+
+// Validate is used to validate the driver configuration
+func (d *NspawnDriver) Validate(config map[string]interface{}) error {
+	fd := &fields.FieldData{
+		Raw: config,
+		Schema: map[string]*fields.FieldSchema{
+			"image": &fields.FieldSchema{
+				Type:     fields.TypeString,
+				Required: true,
+			},
+			"boot": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"command": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"args": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+		},
+	}
+
+	if err := fd.Validate(); err != nil {
+		return err
+	}
+
+	if boot, ok := fd.GetOk("boot"); ok && !boot.(bool) {
+		if command, ok := fd.GetOk("command"); !ok || command.(string) == "" {
+			return fmt.Errorf("command must be set when boot is false")
+		}
+	}
+	return nil
+}
+
+func (d *NspawnDriver) Abilities() DriverAbilities {
+	return DriverAbilities{
+		SendSignals: true,
+	}
+}
+
+func (d *NspawnDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	// Get the current status so that we can log any debug messages only if the
+	// state changes
+	_, currentlyEnabled := node.Attributes[nspawnDriverAttr]
+
+	// Only enable if we are root on linux.
+	if runtime.GOOS != "linux" || syscall.Geteuid() != 0 {
+		if currentlyEnabled {
+			d.logger.Printf("[DEBUG] driver.nspawn: must run as root user on linux, disabling")
+		}
+		delete(node.Attributes, nspawnDriverAttr)
+		delete(node.Attributes, "driver.nspawn.version")
+		return false, nil
+	}
+
+	outBytes, err := exec.Command(nspawnCmd, "--version").Output()
+	if err != nil {
+		delete(node.Attributes, nspawnDriverAttr)
+		delete(node.Attributes, "driver.nspawn.version")
+		return false, nil
+	}
+
+	// machinectl is needed to manage the containers
+	if _, err := exec.LookPath(machinectlCmd); err != nil {
+		if currentlyEnabled {
+			d.logger.Printf("[DEBUG] driver.nspawn: %s not found, disabling", machinectlCmd)
+		}
+		delete(node.Attributes, nspawnDriverAttr)
+		delete(node.Attributes, "driver.nspawn.version")
+		return false, nil
+	}
+
+	version := parseNspawnVersion(string(outBytes))
+	if version == "" {
+		delete(node.Attributes, nspawnDriverAttr)
+		delete(node.Attributes, "driver.nspawn.version")
+		return false, fmt.Errorf("Unable to parse systemd-nspawn version string: %q", outBytes)
+	}
+
+	if !currentlyEnabled {
+		d.logger.Printf("[DEBUG] driver.nspawn: systemd-nspawn of systemd %s detected", version)
+	}
+	node.Attributes[nspawnDriverAttr] = "1"
+	node.Attributes["driver.nspawn.version"] = version
+	return true, nil
+}
+
+func (d *NspawnDriver) Periodic() (bool, time.Duration) {
+	return true, 15 * time.Second
+}
+
+// parseNspawnVersion returns the systemd version in the output of
+// systemd-nspawn --version, or an empty string if there is none
+func parseNspawnVersion(out string) string {
+	matches := reNspawnVersion.FindStringSubmatch(out)
+	if len(matches) != 2 {
+		return ""
+	}
+	return matches[1]
+}
+
+// nspawnMachineName returns the name of the machine running the task. The
+// characters machine names can't contain are replaced, and the task name is
+// truncated to fit the allocation ID in.
+func nspawnMachineName(allocID, taskName string) string {
+	name := reNspawnMachineName.ReplaceAllString(taskName, "-")
+	if max := nspawnMaxMachineName - len(allocID) - 1; len(name) > max {
+		name = name[:max]
+	}
+	return fmt.Sprintf("%s-%s", name, allocID)
+}
+
+// isTarball returns whether the path has the extension of a tarball
+func isTarball(path string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// nspawnImageArg returns the systemd-nspawn argument to run the image at
+// path. Directories are used as the container's root directory and other
+// files as raw disk images, except for tarballs, which are extracted into the
+// task directory first.
+func nspawnImageArg(taskDir, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(taskDir, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to find image: %v", err)
+	}
+	if fi.IsDir() {
+		return fmt.Sprintf("--directory=%s", path), nil
+	}
+	if !isTarball(path) {
+		return fmt.Sprintf("--image=%s", path), nil
+	}
+
+	rootfs := filepath.Join(taskDir, nspawnRootfsDir)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return "", fmt.Errorf("failed to create rootfs directory: %v", err)
+	}
+	out, err := exec.Command("tar", "--numeric-owner", "-xpf", path, "-C", rootfs).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract image %q: %v\n\nOutput: %s", path, err, out)
+	}
+	return fmt.Sprintf("--directory=%s", rootfs), nil
+}
+
+// Start boots the image of the task.
+func (d *NspawnDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	var driverConfig NspawnDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
+		return nil, err
+	}
+	boot := driverConfig.Boot == nil || *driverConfig.Boot
+	if !boot && driverConfig.Command == "" {
+		return nil, fmt.Errorf("command must be set when boot is false")
+	}
+
+	// Get the tasks local directory.
+	taskName := d.DriverContext.taskName
+	taskDir, ok := ctx.AllocDir.TaskDirs[taskName]
+	if !ok {
+		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
+	}
+
+	imageArg, err := nspawnImageArg(taskDir, driverConfig.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	machine := nspawnMachineName(ctx.AllocID, task.Name)
+	cmdArgs := []string{
+		imageArg,
+		fmt.Sprintf("--machine=%s", machine),
+		"--quiet",
+
+		// Mount /alloc, /local and /secrets
+		fmt.Sprintf("--bind=%s:%s", ctx.AllocDir.SharedDir, allocdir.SharedAllocContainerPath),
+		fmt.Sprintf("--bind=%s:%s", filepath.Join(taskDir, allocdir.TaskLocal), allocdir.TaskLocalContainerPath),
+		fmt.Sprintf("--bind=%s:%s", filepath.Join(taskDir, allocdir.TaskSecrets), allocdir.TaskSecretsContainerPath),
+
+		// Limit the resources of the container's scope unit
+		fmt.Sprintf("--property=MemoryLimit=%dM", task.Resources.MemoryMB),
+		fmt.Sprintf("--property=CPUShares=%d", task.Resources.CPU),
+	}
+
+	// Inject environment variables
+	d.taskEnv.SetAllocDir(allocdir.SharedAllocContainerPath)
+	d.taskEnv.SetTaskLocalDir(allocdir.TaskLocalContainerPath)
+	d.taskEnv.SetSecretDir(allocdir.TaskSecretsContainerPath)
+	d.taskEnv.Build()
+	for k, v := range d.taskEnv.EnvMap() {
+		cmdArgs = append(cmdArgs, fmt.Sprintf("--setenv=%s=%s", k, v))
+	}
+
+	if boot {
+		cmdArgs = append(cmdArgs, "--boot")
+	}
+
+	// Add the command and the user passed arguments, which are passed to the
+	// init system when booting.
+	args := d.taskEnv.ParseAndReplace(driverConfig.Args)
+	if !boot || len(args) != 0 {
+		cmdArgs = append(cmdArgs, "--")
+	}
+	if !boot {
+		cmdArgs = append(cmdArgs, d.taskEnv.ReplaceEnv(driverConfig.Command))
+	}
+	cmdArgs = append(cmdArgs, args...)
+
+	// Set the host environment variables.
+	filter := strings.Split(d.config.ReadDefault("env.blacklist", config.DefaultEnvBlacklist), ",")
+	d.taskEnv.AppendHostEnvvars(filter)
+
+	bin, err := discover.NomadExecutable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the nomad binary: %v", err)
+	}
+
+	pluginLogFile := filepath.Join(taskDir, fmt.Sprintf("%s-executor.out", task.Name))
+	pluginConfig := &plugin.ClientConfig{
+		Cmd: exec.Command(bin, "executor", pluginLogFile),
+	}
+
+	execIntf, pluginClient, err := createExecutor(pluginConfig, d.config.LogOutput, d.config)
+	if err != nil {
+		return nil, err
+	}
+	executorCtx := &executor.ExecutorContext{
+		TaskEnv:  d.taskEnv,
+		Driver:   "nspawn",
+		AllocDir: ctx.AllocDir,
+		AllocID:  ctx.AllocID,
+		Task:     task,
+	}
+	if err := execIntf.SetContext(executorCtx); err != nil {
+		pluginClient.Kill()
+		return nil, fmt.Errorf("failed to set executor context: %v", err)
+	}
+
+	absPath, err := GetAbsolutePath(nspawnCmd)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+
+	execCmd := &executor.ExecCommand{
+		Cmd:  absPath,
+		Args: cmdArgs,
+	}
+	ps, err := execIntf.LaunchCmd(execCmd)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+
+	d.logger.Printf("[DEBUG] driver.nspawn: started machine %q with: %v", machine, cmdArgs)
+	maxKill := d.DriverContext.config.MaxKillTimeout
+	h := &nspawnHandle{
+		pluginClient:   pluginClient,
+		executor:       execIntf,
+		executorPid:    ps.Pid,
+		allocDir:       ctx.AllocDir,
+		machine:        machine,
+		boot:           boot,
+		logger:         d.logger,
+		killTimeout:    GetKillTimeout(task.KillTimeout, maxKill),
+		maxKillTimeout: maxKill,
+		doneCh:         make(chan struct{}),
+		waitCh:         make(chan *dstructs.WaitResult, 1),
+	}
+	if err := h.executor.SyncServices(consulContext(d.config, "")); err != nil {
+		h.logger.Printf("[ERR] driver.nspawn: error registering services for task: %q: %v", task.Name, err)
+	}
+	go h.run()
+	return h, nil
+}
+
+func (d *NspawnDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+	// Parse the handle
+	pidBytes := []byte(strings.TrimPrefix(handleID, "Nspawn:"))
+	id := &nspawnPID{}
+	if err := json.Unmarshal(pidBytes, id); err != nil {
+		return nil, fmt.Errorf("failed to parse Nspawn handle '%s': %v", handleID, err)
+	}
+
+	pluginConfig := &plugin.ClientConfig{
+		Reattach: id.PluginConfig.PluginConfig(),
+	}
+	exec, pluginClient, err := createExecutor(pluginConfig, d.config.LogOutput, d.config)
+	if err != nil {
+		d.logger.Println("[ERROR] driver.nspawn: error connecting to plugin so destroying plugin pid and machine")
+		if e := destroyPlugin(id.PluginConfig.Pid, id.ExecutorPid); e != nil {
+			d.logger.Printf("[ERROR] driver.nspawn: error destroying plugin and executor pid: %v", e)
+		}
+		if e := machinectl("terminate", id.Machine); e != nil {
+			d.logger.Printf("[DEBUG] driver.nspawn: error terminating machine %q: %v", id.Machine, e)
+		}
+		return nil, fmt.Errorf("error connecting to plugin: %v", err)
+	}
+
+	// The machine has to still be registered for the task to be running
+	if err := machinectl("status", id.Machine); err != nil {
+		d.logger.Printf("[ERROR] driver.nspawn: machine %q is gone: %v", id.Machine, err)
+		exec.Exit()
+		pluginClient.Kill()
+		return nil, fmt.Errorf("machine %q is gone: %v", id.Machine, err)
+	}
+
+	ver, _ := exec.Version()
+	d.logger.Printf("[DEBUG] driver.nspawn: version of executor: %v", ver.Version)
+	// Return a driver handle
+	h := &nspawnHandle{
+		pluginClient:   pluginClient,
+		executorPid:    id.ExecutorPid,
+		allocDir:       id.AllocDir,
+		executor:       exec,
+		machine:        id.Machine,
+		boot:           id.Boot,
+		logger:         d.logger,
+		killTimeout:    id.KillTimeout,
+		maxKillTimeout: id.MaxKillTimeout,
+		doneCh:         make(chan struct{}),
+		waitCh:         make(chan *dstructs.WaitResult, 1),
+	}
+	if err := h.executor.SyncServices(consulContext(d.config, "")); err != nil {
+		h.logger.Printf("[ERR] driver.nspawn: error registering services: %v", err)
+	}
+	go h.run()
+	return h, nil
+}
+
+// machinectl runs a machinectl command on the machine
+func machinectl(command, machine string, args ...string) error {
+	cmdArgs := append([]string{command}, args...)
+	cmdArgs = append(cmdArgs, machine)
+	out, err := exec.Command(machinectlCmd, cmdArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (h *nspawnHandle) ID() string {
+	// Return a handle to the PID
+	pid := &nspawnPID{
+		PluginConfig:   NewPluginReattachConfig(h.pluginClient.ReattachConfig()),
+		KillTimeout:    h.killTimeout,
+		MaxKillTimeout: h.maxKillTimeout,
+		ExecutorPid:    h.executorPid,
+		AllocDir:       h.allocDir,
+		Machine:        h.machine,
+		Boot:           h.boot,
+	}
+	data, err := json.Marshal(pid)
+	if err != nil {
+		h.logger.Printf("[ERR] driver.nspawn: failed to marshal nspawn PID to JSON: %s", err)
+	}
+	return fmt.Sprintf("Nspawn:%s", string(data))
+}
+
+func (h *nspawnHandle) WaitCh() chan *dstructs.WaitResult {
+	return h.waitCh
+}
+
+func (h *nspawnHandle) Update(task *structs.Task) error {
+	// Store the updated kill timeout.
+	h.killTimeout = GetKillTimeout(task.KillTimeout, h.maxKillTimeout)
+	h.executor.UpdateTask(task)
+
+	// Update is not possible
+	return nil
+}
+
+// Signal sends the signal to the container's init system or command.
+func (h *nspawnHandle) Signal(s os.Signal) error {
+	sig, ok := s.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("Failed to determine signal number")
+	}
+	return machinectl("kill", h.machine, "--kill-who=leader", fmt.Sprintf("--signal=%d", sig))
+}
+
+// Exec runs a command in the container with systemd-run and returns its exit
+// code and output.
+func (h *nspawnHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	cmdArgs := append([]string{fmt.Sprintf("--machine=%s", h.machine), "--quiet", "--wait", "--pipe", "--"}, cmd)
+	cmdArgs = append(cmdArgs, args...)
+
+	buf, _ := circbuf.NewBuffer(int64(dstructs.ExecBufSize))
+	c := exec.Command(systemdRunCmd, cmdArgs...)
+	c.Stdout = buf
+	c.Stderr = buf
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(nspawnExecTimeout):
+		c.Process.Kill()
+		<-errCh
+		return nil, fmt.Errorf("command did not exit within %v", nspawnExecTimeout)
+	}
+
+	res := &dstructs.ExecResult{Output: string(buf.Bytes())}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+		res.ExitCode = 1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			res.ExitCode = status.ExitStatus()
+		}
+	}
+	return res, nil
+}
+
+// Kill is used to terminate the task. Booted containers are powered off
+// through machinectl so that their services are stopped in order, and other
+// containers are interrupted. Containers that haven't exited within the kill
+// timeout are terminated.
+func (h *nspawnHandle) Kill() error {
+	if h.boot {
+		if err := machinectl("poweroff", h.machine); err != nil {
+			h.logger.Printf("[DEBUG] driver.nspawn: failed to power off machine %q: %v", h.machine, err)
+			h.executor.ShutDown()
+		}
+	} else {
+		h.executor.ShutDown()
+	}
+
+	select {
+	case <-h.doneCh:
+		return nil
+	case <-time.After(h.killTimeout):
+		if err := machinectl("terminate", h.machine); err != nil {
+			h.logger.Printf("[DEBUG] driver.nspawn: failed to terminate machine %q: %v", h.machine, err)
+		}
+		return h.executor.Exit()
+	}
+}
+
+func (h *nspawnHandle) Stats() (*cstructs.TaskResourceUsage, error) {
+	return h.executor.Stats()
+}
+
+func (h *nspawnHandle) run() {
+	ps, err := h.executor.Wait()
+	close(h.doneCh)
+	if ps.ExitCode == 0 && err != nil {
+		if e := killProcess(h.executorPid); e != nil {
+			h.logger.Printf("[ERROR] driver.nspawn: error killing user process: %v", e)
+		}
+	}
+	h.waitCh <- dstructs.NewWaitResult(ps.ExitCode, 0, err)
+	close(h.waitCh)
+	// Remove services
+	if err := h.executor.DeregisterServices(); err != nil {
+		h.logger.Printf("[ERR] driver.nspawn: failed to deregister services: %v", err)
+	}
+
+	if err := h.executor.Exit(); err != nil {
+		h.logger.Printf("[ERR] driver.nspawn: error killing executor: %v", err)
+	}
+	h.pluginClient.Kill()
+}
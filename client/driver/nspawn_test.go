@@ -0,0 +1,283 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestNspawnVersionRegex(t *testing.T) {
+	cases := map[string]string{
+		"systemd 229\n+PAM +AUDIT +SELINUX":            "229",
+		"systemd 249 (249.11-0ubuntu3.6)\n+PAM +AUDIT": "249",
+		"unknown": "",
+	}
+	for out, expected := range cases {
+		if version := parseNspawnVersion(out); version != expected {
+			t.Fatalf("got %q for %q; want %q", version, out, expected)
+		}
+	}
+}
+
+func TestNspawnMachineName(t *testing.T) {
+	allocID := structs.GenerateUUID()
+	if name := nspawnMachineName(allocID, "web server"); name != "web-server-"+allocID {
+		t.Fatalf("bad: %q", name)
+	}
+	name := nspawnMachineName(allocID, strings.Repeat("a", 100))
+	if len(name) != nspawnMaxMachineName || !strings.HasSuffix(name, allocID) {
+		t.Fatalf("bad: %q", name)
+	}
+}
+
+func TestNspawnDriver_Validate(t *testing.T) {
+	d := NewNspawnDriver(NewEmptyDriverContext())
+	valid := []map[string]interface{}{
+		{"image": "local/rootfs"},
+		{"image": "local/image.raw", "boot": true, "args": []string{"--unit=rescue.target"}},
+		{"image": "local/rootfs.tar.gz", "boot": false, "command": "/bin/sleep", "args": []string{"10"}},
+	}
+	for _, config := range valid {
+		if err := d.Validate(config); err != nil {
+			t.Fatalf("err for %v: %v", config, err)
+		}
+	}
+	invalid := []map[string]interface{}{
+		{},
+		{"image": "local/rootfs", "boot": false},
+		{"image": "local/rootfs", "foo": "bar"},
+	}
+	for _, config := range invalid {
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected an error for %v", config)
+		}
+	}
+}
+
+func TestNspawnImageArg(t *testing.T) {
+	taskDir, err := ioutil.TempDir("", "nspawn")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+
+	// Directories are booted directly
+	if err := os.MkdirAll(filepath.Join(taskDir, "local", "image", "etc"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg, err := nspawnImageArg(taskDir, "local/image")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := "--directory=" + filepath.Join(taskDir, "local", "image"); arg != expected {
+		t.Fatalf("got %q; want %q", arg, expected)
+	}
+
+	// Other files are raw disk images
+	raw := filepath.Join(taskDir, "local", "image.raw")
+	if err := ioutil.WriteFile(raw, []byte("disk"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if arg, err := nspawnImageArg(taskDir, raw); err != nil || arg != "--image="+raw {
+		t.Fatalf("bad: %q, %v", arg, err)
+	}
+
+	// Tarballs are extracted into the task directory
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not installed")
+	}
+	ioutil.WriteFile(filepath.Join(taskDir, "local", "image", "etc", "os-release"), []byte("ID=test\n"), 0644)
+	tarball := filepath.Join(taskDir, "local", "image.tar.gz")
+	if out, err := exec.Command("tar", "-czf", tarball, "-C", filepath.Join(taskDir, "local", "image"), ".").CombinedOutput(); err != nil {
+		t.Fatalf("err: %v: %s", err, out)
+	}
+	arg, err = nspawnImageArg(taskDir, "local/image.tar.gz")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := "--directory=" + filepath.Join(taskDir, nspawnRootfsDir); arg != expected {
+		t.Fatalf("got %q; want %q", arg, expected)
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, nspawnRootfsDir, "etc", "os-release")); err != nil {
+		t.Fatalf("image not extracted: %v", err)
+	}
+
+	if _, err := nspawnImageArg(taskDir, "local/missing"); err == nil {
+		t.Fatalf("expected an error for a missing image")
+	}
+}
+
+// setupFakeNspawn installs systemd-nspawn and machinectl scripts in PATH, which
+// log their arguments to files in the returned directory. systemd-nspawn sleeps
+// for the given number of seconds, or until it is interrupted.
+func setupFakeNspawn(t *testing.T, sleep int) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake systemd commands require a shell")
+	}
+	dir, err := ioutil.TempDir("", "fakenspawn")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	nspawn := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nexec sleep %d\n",
+		filepath.Join(dir, "nspawn.args"), sleep)
+	machinectl := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", filepath.Join(dir, "machinectl.args"))
+	if err := ioutil.WriteFile(filepath.Join(dir, nspawnCmd), []byte(nspawn), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, machinectlCmd), []byte(machinectl), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// readFakeNspawnArgs returns the arguments a fake command was last run with,
+// waiting for it to be run
+func readFakeNspawnArgs(t *testing.T, path string) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && len(data) != 0 {
+			return string(data)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not written: %v", path, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNspawnDriver_Start_Wait(t *testing.T) {
+	dir, cleanup := setupFakeNspawn(t, 0)
+	defer cleanup()
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image": "local/image",
+			"args":  []string{"--unit=multi-user.target"},
+		},
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	if err := os.MkdirAll(filepath.Join(taskDir, "local", "image"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := NewNspawnDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if handle == nil {
+		t.Fatalf("missing handle")
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	args := readFakeNspawnArgs(t, filepath.Join(dir, "nspawn.args"))
+	machine := nspawnMachineName(execCtx.AllocID, task.Name)
+	for _, expected := range []string{
+		"--directory=" + filepath.Join(taskDir, "local", "image"),
+		"--machine=" + machine,
+		fmt.Sprintf("--bind=%s:%s", execCtx.AllocDir.SharedDir, allocdir.SharedAllocContainerPath),
+		"--property=MemoryLimit=256M",
+		"--setenv=NOMAD_TASK_DIR=" + allocdir.TaskLocalContainerPath,
+		"--boot -- --unit=multi-user.target",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Fatalf("missing %q in %q", expected, args)
+		}
+	}
+}
+
+func TestNspawnDriver_Signal_Kill(t *testing.T) {
+	dir, cleanup := setupFakeNspawn(t, 30)
+	defer cleanup()
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image":   "local/image",
+			"boot":    false,
+			"command": "/bin/sleep",
+			"args":    []string{"30"},
+		},
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		KillTimeout: 10 * time.Second,
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	if err := os.MkdirAll(filepath.Join(taskDir, "local", "image"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := NewNspawnDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args := readFakeNspawnArgs(t, filepath.Join(dir, "nspawn.args"))
+	if strings.Contains(args, "--boot") || !strings.HasSuffix(strings.TrimSpace(args), "-- /bin/sleep 30") {
+		t.Fatalf("bad: %q", args)
+	}
+
+	// Signals are sent through machinectl
+	machine := nspawnMachineName(execCtx.AllocID, task.Name)
+	if err := handle.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := fmt.Sprintf("kill --kill-who=leader --signal=%d %s", syscall.SIGHUP, machine)
+	if args := readFakeNspawnArgs(t, filepath.Join(dir, "machinectl.args")); strings.TrimSpace(args) != expected {
+		t.Fatalf("got %q; want %q", args, expected)
+	}
+
+	// Containers that aren't booted are interrupted
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-handle.WaitCh():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
@@ -2,14 +2,22 @@ package driver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-plugin"
@@ -17,22 +25,115 @@ import (
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/executor"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
-	"github.com/hashicorp/nomad/client/fingerprint"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper/discover"
 	"github.com/hashicorp/nomad/helper/fields"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/mitchellh/mapstructure"
+	"github.com/shirou/gopsutil/process"
 )
 
 var (
+	// ErrQemuMissingImagePath is returned from Start if the task doesn't set
+	// image_path
+	ErrQemuMissingImagePath = errors.New("image_path must be set")
+
+	// reQemuMemory matches a memory size with an optional unit, in MB by default
+	reQemuMemory = regexp.MustCompile(`^(\d+)([kKmMgGtT])?[bB]?$`)
+
 	reQemuVersion = regexp.MustCompile(`version (\d[\.\d+]+)`)
+
+	// reQemuArch matches the architecture suffix of a qemu-system-<arch> binary
+	reQemuArch = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+	// qemuDefaultMachines are the machine types used for architectures if the
+	// task doesn't set one. Architectures that aren't listed have no sensible
+	// default and require machine to be set.
+	qemuDefaultMachines = map[string]string{
+		"x86_64":  "pc",
+		"i386":    "pc",
+		"aarch64": "virt",
+		"arm":     "virt",
+		"riscv32": "virt",
+		"riscv64": "virt",
+	}
+
+	// reQemuArchVersionAttr matches the per architecture version attributes
+	reQemuArchVersionAttr = regexp.MustCompile(`^driver\.qemu\.[^.]+\.version$`)
+
+	// rePCIAddress matches a PCI device address in [domain:]bus:slot.function
+	// form, e.g. 0000:01:00.0
+	rePCIAddress = regexp.MustCompile(`^([0-9a-fA-F]{4}:)?[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+	// qemuDiskFormats are the image formats that can be set with disk_format
+	qemuDiskFormats = map[string]struct{}{
+		"raw":   struct{}{},
+		"qcow2": struct{}{},
+		"qcow":  struct{}{},
+		"qed":   struct{}{},
+		"vmdk":  struct{}{},
+		"vdi":   struct{}{},
+		"vhdx":  struct{}{},
+		"vpc":   struct{}{},
+	}
+
+	// qemuFreeDiskBytes returns the free bytes on the filesystem of a path
+	qemuFreeDiskBytes = freeDiskBytes
+
+	// qemuVFIODevice and qemuIOMMUGroupsDir must both be present for PCI
+	// devices to be passed through with VFIO
+	qemuVFIODevice     = "/dev/vfio/vfio"
+	qemuIOMMUGroupsDir = "/sys/kernel/iommu_groups"
+
+	// qemuKVMDevice must be accessible for VMs to use the KVM accelerator
+	qemuKVMDevice = "/dev/kvm"
 )
 
 const (
 	// The key populated in Node Attributes to indicate presence of the Qemu
 	// driver
 	qemuDriverAttr = "driver.qemu"
+
+	// qemuAllocDirTag is the mount tag the allocation directory is shared
+	// into the guest with
+	qemuAllocDirTag = "alloc"
+
+	// qemuConsoleLogSuffix is appended to the task name to name the file the
+	// serial console is written to in the allocation's log directory
+	qemuConsoleLogSuffix = ".console.log"
+
+	// qemuShutdownPollInterval is the interval at which the guest's state is
+	// checked while waiting for it to shut down
+	qemuShutdownPollInterval = 500 * time.Millisecond
+
+	// qemuKillGrace is the part of the kill timeout kept for the qemu process
+	// to exit once it is interrupted, if the guest doesn't power down in the
+	// rest of it
+	qemuKillGrace = 5 * time.Second
+
+	// The key populated in Node Attributes to indicate that PCI devices can be
+	// passed through to VMs with VFIO
+	qemuVFIOAttr = "driver.qemu.vfio"
+
+	// The key populated in Node Attributes to indicate whether VMs can use the
+	// KVM accelerator
+	qemuKVMAttr = "driver.qemu.kvm"
+
+	// The key populated in Node Attributes to indicate that x86_64 VMs can
+	// boot with UEFI firmware
+	qemuUEFIAttr = "driver.qemu.uefi"
+
+	// qemuArgsConfigOption is the key for allowing tasks to pass arguments
+	// directly to qemu, and to set the other options giving VMs access to host
+	// files and devices. Operators of shared clusters may want to disable it.
+	qemuArgsConfigOption  = "qemu.args.enabled"
+	qemuArgsConfigDefault = true
+
+	// qemuHooksConfigOption is the key for allowing tasks to run
+	// pre_start_command and post_stop_command on the host. The commands run as
+	// the client's user, so they have to be enabled by the operator.
+	qemuHooksConfigOption  = "qemu.hooks.enabled"
+	qemuHooksConfigDefault = false
 )
 
 // QemuDriver is a driver for running images via Qemu
@@ -40,14 +141,112 @@ const (
 // planned in the future
 type QemuDriver struct {
 	DriverContext
-	fingerprint.StaticFingerprinter
 }
 
 type QemuDriverConfig struct {
 	ImagePath   string           `mapstructure:"image_path"`
 	Accelerator string           `mapstructure:"accelerator"`
-	PortMap     []map[string]int `mapstructure:"port_map"` // A map of host port labels and to guest ports.
-	Args        []string         `mapstructure:"args"`     // extra arguments to qemu executable
+	PortMap     []map[string]int `mapstructure:"port_map"`    // A map of host port labels and to guest ports.
+	Args        []string         `mapstructure:"args"`        // extra arguments to qemu executable
+	UserData    string           `mapstructure:"user_data"`   // cloud-init user-data template
+	TCGThreads  string           `mapstructure:"tcg_threads"` // "single" or "multi" threaded TCG
+	TCGTBSize   int              `mapstructure:"tcg_tb_size"` // TCG translation block cache size in MB
+	SSHKeys     []string         `mapstructure:"ssh_keys"`    // SSH public keys granted to the default user
+	Snapshot    bool             `mapstructure:"snapshot"`    // discard guest writes to the image
+	ReadOnly    bool             `mapstructure:"readonly"`    // attach the image read-only
+	Overlay     bool             `mapstructure:"overlay"`     // boot from a qcow2 overlay backed by a shared base image
+	VMName      string           `mapstructure:"vm_name"`     // guest name and process title
+	DiskFormat  string           `mapstructure:"disk_format"` // format of the image, disables format probing
+	DiskMB      int              `mapstructure:"disk_mb"`     // size the VM's disks may grow to in the alloc dir
+	DiskSize    string           `mapstructure:"disk_size"`   // size the image is grown to before the VM boots
+	RawDevice   string           `mapstructure:"raw_device"`  // host block device or raw image attached as a second disk
+	ImageMode   string           `mapstructure:"image_mode"`  // octal permissions the image is set to
+	RTCBase     string           `mapstructure:"rtc_base"`    // "utc" or "localtime" guest clock base
+	RTCClock    string           `mapstructure:"rtc_clock"`   // "host", "rt" or "vm" guest clock source
+	RunAsUser   string           `mapstructure:"run_as_user"` // user the qemu process runs as
+	Balloon     bool             `mapstructure:"balloon"`     // add a virtio-balloon device to resize memory on update
+	GuestAgent  bool             `mapstructure:"guest_agent"` // attach a qemu-guest-agent channel
+	ConsoleLog  bool             `mapstructure:"console_log"` // also write the serial console to a log file
+	Memory      string           `mapstructure:"memory"`      // VM memory with units, overrides the memory resource
+	DryRun      bool             `mapstructure:"dry_run"`     // fail Start with the command instead of launching it
+	SaveState   bool             `mapstructure:"save_state"`  // save the VM's state on client shutdown to resume from
+	Hugepages   bool             `mapstructure:"hugepages"`   // back the VM's memory with hugepages
+
+	MaxMemory   string `mapstructure:"max_memory"`   // memory the VM can be grown to with hotplug
+	MemorySlots int    `mapstructure:"memory_slots"` // slots reserved for hotplugged memory
+
+	MetaData []map[string]string `mapstructure:"meta_data"` // cloud-init meta-data keys added to the seed ISO
+
+	Disks []QemuDisk `mapstructure:"disk"` // data disks attached besides the image
+
+	ShareAllocDir bool `mapstructure:"share_alloc_dir"` // export the alloc dir to the guest over virtio-9p
+
+	ConvertFormat string `mapstructure:"convert_format"` // format the image is converted to before the VM boots
+
+	OOMScoreAdj *int   `mapstructure:"oom_score_adj"` // OOM score adjustment of the qemu process
+	Nice        *int   `mapstructure:"nice"`          // scheduling priority of the qemu process
+	IONiceClass string `mapstructure:"ionice_class"`  // I/O scheduling class of the qemu process
+	IONiceLevel *int   `mapstructure:"ionice_level"`  // I/O priority of the qemu process within its class
+
+	PreStartCommand []string `mapstructure:"pre_start_command"` // host command run before the VM is launched
+	PostStopCommand []string `mapstructure:"post_stop_command"` // host command run after the VM exits
+	HookTimeout     string   `mapstructure:"hook_timeout"`      // how long the hook commands may run
+
+	AcceleratorFallback string `mapstructure:"accelerator_fallback"` // accelerator used if the accelerator isn't available
+
+	PCIPassthrough []string `mapstructure:"pci_passthrough"` // host PCI addresses passed through with VFIO
+
+	ReadinessPort    string `mapstructure:"readiness_port"`    // port_map label probed before the VM is started
+	ReadinessTimeout string `mapstructure:"readiness_timeout"` // how long to wait for the readiness port
+
+	HealthCheck    string `mapstructure:"health_check"`        // "tcp" or "qmp" guest liveness check
+	HealthPort     string `mapstructure:"health_port"`         // port_map label probed by tcp health checks
+	HealthInterval string `mapstructure:"health_interval"`     // interval between health checks
+	HealthFailures int    `mapstructure:"health_failures"`     // consecutive failures before the VM is restarted
+	HealthGrace    string `mapstructure:"health_grace_period"` // how long failures are ignored after the VM starts
+
+	NetworkMode      string `mapstructure:"network_mode"`       // "user" or "bridge" networking
+	Bridge           string `mapstructure:"bridge"`             // host bridge the tap device is attached to in bridge mode
+	NetworkRateLimit int    `mapstructure:"network_rate_limit"` // Mbit/s the tap device's traffic is shaped to each way
+	MACAddress       string `mapstructure:"mac_address"`        // MAC address of the NIC in bridge mode
+	GuestAddress     string `mapstructure:"guest_address"`      // static guest IP services are registered with in bridge mode
+
+	Arch    string `mapstructure:"arch"`    // architecture of the qemu-system-<arch> emulator, "x86_64" by default
+	Machine string `mapstructure:"machine"` // machine type, defaults to a common one for the architecture
+
+	Firmware string `mapstructure:"firmware"` // "bios" or "uefi" firmware the VM boots with
+
+	CPUPinning []int          `mapstructure:"cpu_pinning"` // host cores the vCPUs are pinned to, one vCPU per core
+	NUMA       []QemuNUMANode `mapstructure:"numa"`        // guest NUMA nodes
+
+	VNC             string `mapstructure:"vnc"`              // port label the VNC display listens on
+	SPICE           string `mapstructure:"spice"`            // port label the SPICE display listens on
+	DisplayPassword string `mapstructure:"display_password"` // password clients need to connect to the display
+}
+
+// QemuDisk is a data disk attached to the VM besides its image
+type QemuDisk struct {
+	Size         string `mapstructure:"size"`          // size of the disk, e.g. "10G"
+	Format       string `mapstructure:"format"`        // format of the disk file, "qcow2" by default
+	Source       string `mapstructure:"source"`        // image in the task directory the disk is created from
+	SourceFormat string `mapstructure:"source_format"` // format of the source, "raw" by default
+}
+
+// QemuNUMANode is a NUMA node of the guest
+type QemuNUMANode struct {
+	CPUs     string `mapstructure:"cpus"`      // vCPUs of the node, e.g. "0-1"
+	Memory   string `mapstructure:"memory"`    // memory of the node, e.g. "1G"
+	HostNode *int   `mapstructure:"host_node"` // host NUMA node the memory is bound to
+}
+
+// QemuDryRunError is returned from Start instead of launching the VM when
+// dry_run is set. It carries the command that would have been run.
+type QemuDryRunError struct {
+	Args []string
+}
+
+func (e *QemuDryRunError) Error() string {
+	return fmt.Sprintf("dry_run is set, not launching: %s", strings.Join(e.Args, " "))
 }
 
 // qemuHandle is returned from Start/Open as a handle to the PID
@@ -60,6 +259,29 @@ type qemuHandle struct {
 	maxKillTimeout time.Duration
 	logger         *log.Logger
 	version        string
+	vmID           string
+	taskName       string
+	eventSink      EventSink
+	qmpPath        string
+	agentPath      string
+	tapDevice      string
+	guestAddress   string
+	display        *qemuDisplay
+	postStop       *qemuHook
+	balloon        bool
+	memoryMB       int
+	maxMemoryMB    int
+	memorySlots    int
+	usedSlots      int
+	updateLock     sync.Mutex
+	healthCheck    *qemuHealthCheck
+	healthErr      error
+	healthLock     sync.Mutex
+	saveState      bool
+	suspended      bool
+	guestStats     bool
+	guestStatsLock sync.Mutex
+	startTime      time.Time
 	waitCh         chan *dstructs.WaitResult
 	doneCh         chan struct{}
 }
@@ -81,12 +303,186 @@ func (d *QemuDriver) Validate(config map[string]interface{}) error {
 			"accelerator": &fields.FieldSchema{
 				Type: fields.TypeString,
 			},
+			"overlay": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"console_log": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"meta_data": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"disk": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"disk_size": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"firmware": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"cpu_pinning": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"numa": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"arch": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"machine": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"accelerator_fallback": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
 			"port_map": &fields.FieldSchema{
 				Type: fields.TypeArray,
 			},
 			"args": &fields.FieldSchema{
 				Type: fields.TypeArray,
 			},
+			"user_data": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"tcg_threads": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"tcg_tb_size": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"ssh_keys": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"snapshot": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"readonly": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"vm_name": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"disk_format": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"convert_format": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"disk_mb": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"raw_device": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"image_mode": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"rtc_base": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"rtc_clock": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"run_as_user": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"balloon": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"guest_agent": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"memory": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"max_memory": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"memory_slots": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"oom_score_adj": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"nice": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"ionice_class": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"ionice_level": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"dry_run": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"save_state": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"hugepages": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"share_alloc_dir": &fields.FieldSchema{
+				Type: fields.TypeBool,
+			},
+			"pre_start_command": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"post_stop_command": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"hook_timeout": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"pci_passthrough": &fields.FieldSchema{
+				Type: fields.TypeArray,
+			},
+			"network_mode": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"bridge": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"network_rate_limit": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"mac_address": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"guest_address": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"vnc": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"spice": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"display_password": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"readiness_port": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"readiness_timeout": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"health_check": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"health_port": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"health_interval": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
+			"health_failures": &fields.FieldSchema{
+				Type: fields.TypeInt,
+			},
+			"health_grace_period": &fields.FieldSchema{
+				Type: fields.TypeString,
+			},
 		},
 	}
 
@@ -99,202 +495,1532 @@ func (d *QemuDriver) Validate(config map[string]interface{}) error {
 
 func (d *QemuDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
-		SendSignals: false,
+		SendSignals: true,
 	}
 }
 
+func (d *QemuDriver) Periodic() (bool, time.Duration) {
+	return true, 15 * time.Second
+}
+
 func (d *QemuDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
 	// Get the current status so that we can log any debug messages only if the
 	// state changes
 	_, currentlyEnabled := node.Attributes[qemuDriverAttr]
 
-	bin := "qemu-system-x86_64"
+	// Publish the version of every installed system emulator so tasks can
+	// constrain themselves to hosts with specific architectures and versions.
+	dir := cfg.Read(qemuPathConfigOption)
+	d.fingerprintSystemBinaries(node, dir)
+
+	bin := qemuBinary(dir, "qemu-system-x86_64")
 	if runtime.GOOS == "windows" {
 		// On windows, the "qemu-system-x86_64" command does not respond to the
 		// version flag.
-		bin = "qemu-img"
+		bin = qemuBinary(dir, "qemu-img")
+	} else if bins := qemuSystemBinaries(dir); bins["x86_64"] == "" && len(bins) != 0 {
+		// Hosts may only have emulators for other architectures installed
+		arches := make([]string, 0, len(bins))
+		for arch := range bins {
+			arches = append(arches, arch)
+		}
+		sort.Strings(arches)
+		bin = bins[arches[0]]
 	}
-	outBytes, err := exec.Command(bin, "--version").Output()
+	version, err := qemuVersion(bin)
 	if err != nil {
 		delete(node.Attributes, qemuDriverAttr)
-		return false, nil
+		delete(node.Attributes, qemuKVMAttr)
+		delete(node.Attributes, qemuWHPXAttr)
+		delete(node.Attributes, qemuHugepagesAttr)
+		delete(node.Attributes, qemuVFIODevicesAttr)
+		if _, ok := err.(*exec.Error); ok {
+			return false, nil
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !currentlyEnabled {
+		d.logger.Printf("[DEBUG] driver.qemu: enabling driver")
+	}
+	node.Attributes[qemuDriverAttr] = "1"
+	node.Attributes["driver.qemu.version"] = version
+
+	if qemuVFIOAvailable() {
+		node.Attributes[qemuVFIOAttr] = "1"
+	} else {
+		delete(node.Attributes, qemuVFIOAttr)
+	}
+	if devices := qemuVFIODevices(); len(devices) != 0 && qemuVFIOAvailable() {
+		node.Attributes[qemuVFIODevicesAttr] = strings.Join(devices, ",")
+	} else {
+		delete(node.Attributes, qemuVFIODevicesAttr)
+	}
+	node.Attributes[qemuKVMAttr] = strconv.FormatBool(qemuKVMAvailable())
+	if runtime.GOOS == "windows" {
+		node.Attributes[qemuWHPXAttr] = strconv.FormatBool(qemuWHPXAvailable())
+	} else {
+		delete(node.Attributes, qemuWHPXAttr)
+	}
+
+	// Advertise if this node allows passing arguments to qemu
+	if cfg.ReadBoolDefault(qemuArgsConfigOption, qemuArgsConfigDefault) {
+		node.Attributes["driver."+qemuArgsConfigOption] = "1"
+	} else {
+		delete(node.Attributes, "driver."+qemuArgsConfigOption)
+	}
+	if cfg.ReadBoolDefault(qemuHooksConfigOption, qemuHooksConfigDefault) {
+		node.Attributes["driver."+qemuHooksConfigOption] = "1"
+	} else {
+		delete(node.Attributes, "driver."+qemuHooksConfigOption)
+	}
+
+	if qemuFindFirmware("x86_64") != nil {
+		node.Attributes[qemuUEFIAttr] = "1"
+	} else {
+		delete(node.Attributes, qemuUEFIAttr)
+	}
+
+	if _, err := qemuHostHugepages(); err == nil {
+		node.Attributes[qemuHugepagesAttr] = "1"
+	} else {
+		delete(node.Attributes, qemuHugepagesAttr)
+	}
+	return true, nil
+}
+
+// qemuVFIOAvailable returns whether the VFIO driver is loaded and the IOMMU is
+// enabled, both of which are required for PCI passthrough.
+func qemuVFIOAvailable() bool {
+	if _, err := os.Stat(qemuVFIODevice); err != nil {
+		return false
+	}
+	groups, err := ioutil.ReadDir(qemuIOMMUGroupsDir)
+	return err == nil && len(groups) != 0
+}
+
+// qemuVerifyProcess returns an error if a process with the given pid exists
+// but isn't the VM's qemu process, which is identified by the QMP socket it
+// listens on and by its start time. Handles that predate either being
+// recorded are only checked for the other. A process that no longer exists
+// hasn't been reused: the VM exited while the client was down, and its
+// executor reports how it exited.
+func qemuVerifyProcess(pid int, qmpPath string, start time.Time) error {
+	if !processExists(pid) {
+		return nil
+	}
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return fmt.Errorf("process %d doesn't exist", pid)
+	}
+	if !start.IsZero() {
+		if err := verifyProcessStart(pid, start); err != nil {
+			return err
+		}
+	}
+	if qmpPath != "" {
+		ok, err := qemuHasSocket(p, qmpPath)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("process %d isn't the VM's qemu process", pid)
+		}
+	}
+	return nil
+}
+
+// qemuKVMAvailable returns whether the KVM device can be opened, which qemu
+// needs to use the KVM accelerator.
+func qemuKVMAvailable() bool {
+	f, err := os.OpenFile(qemuKVMDevice, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// fingerprintSystemBinaries sets a driver.qemu.<arch>.version attribute for
+// each qemu-system-<arch> binary found in dir or the PATH and removes the
+// attributes of binaries that are no longer installed.
+func (d *QemuDriver) fingerprintSystemBinaries(node *structs.Node, dir string) {
+	versions := make(map[string]string)
+	if runtime.GOOS != "windows" {
+		for arch, bin := range qemuSystemBinaries(dir) {
+			version, err := qemuVersion(bin)
+			if err != nil {
+				d.logger.Printf("[DEBUG] driver.qemu: failed to fingerprint %q: %v", bin, err)
+				continue
+			}
+			versions[qemuArchVersionAttr(arch)] = version
+		}
+	}
+
+	for attr := range node.Attributes {
+		if reQemuArchVersionAttr.MatchString(attr) {
+			if _, ok := versions[attr]; !ok {
+				delete(node.Attributes, attr)
+			}
+		}
+	}
+	for attr, version := range versions {
+		node.Attributes[attr] = version
+	}
+}
+
+// qemuArchVersionAttr returns the node attribute holding the version of the
+// system emulator for the given architecture.
+func qemuArchVersionAttr(arch string) string {
+	return fmt.Sprintf("%s.%s.version", qemuDriverAttr, arch)
+}
+
+// qemuSystemBinaries returns the qemu-system-<arch> binaries found in qemuDir,
+// if it is set, and the PATH keyed by architecture. If an architecture is
+// found in several directories, qemuDir wins and then the first one in the
+// PATH, as it would when executed.
+func qemuSystemBinaries(qemuDir string) map[string]string {
+	bins := make(map[string]string)
+	dirs := filepath.SplitList(os.Getenv("PATH"))
+	if qemuDir != "" {
+		dirs = append([]string{qemuDir}, dirs...)
+	}
+	for _, dir := range dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "qemu-system-*"))
+		if err != nil {
+			continue
+		}
+		for _, bin := range matches {
+			arch := strings.TrimPrefix(filepath.Base(bin), "qemu-system-")
+			if _, ok := bins[arch]; ok {
+				continue
+			}
+			if fi, err := os.Stat(bin); err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+				continue
+			}
+			bins[arch] = bin
+		}
+	}
+	return bins
+}
+
+// qemuVersion returns the version reported by the given qemu binary.
+func qemuVersion(bin string) (string, error) {
+	outBytes, err := exec.Command(bin, "--version").Output()
+	if err != nil {
+		return "", err
 	}
 	out := strings.TrimSpace(string(outBytes))
 
 	matches := reQemuVersion.FindStringSubmatch(out)
 	if len(matches) != 2 {
-		delete(node.Attributes, qemuDriverAttr)
-		return false, fmt.Errorf("Unable to parse Qemu version string: %#v", matches)
+		return "", fmt.Errorf("Unable to parse Qemu version string: %#v", matches)
+	}
+	return matches[1], nil
+}
+
+// Run an existing Qemu image. Start() will pull down an existing, valid Qemu
+// image and save it to the Drivers Allocation Dir
+func (d *QemuDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	var driverConfig QemuDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
+		return nil, err
+	}
+
+	if len(driverConfig.PortMap) > 1 {
+		return nil, fmt.Errorf("Only one port_map block is allowed in the qemu driver config")
+	}
+	if len(driverConfig.PortMap) == 1 {
+		for label, guest := range driverConfig.PortMap[0] {
+			if err := qemuValidatePort(guest); err != nil {
+				return nil, fmt.Errorf("Invalid guest port for port_map label %q: %v", label, err)
+			}
+		}
+	}
+
+	switch driverConfig.TCGThreads {
+	case "", "single", "multi":
+	default:
+		return nil, fmt.Errorf("Invalid tcg_threads %q: must be \"single\" or \"multi\"", driverConfig.TCGThreads)
+	}
+	if driverConfig.TCGTBSize < 0 {
+		return nil, fmt.Errorf("Invalid tcg_tb_size %d: must be a positive number of MB", driverConfig.TCGTBSize)
+	}
+
+	if driverConfig.DiskFormat != "" {
+		if _, ok := qemuDiskFormats[driverConfig.DiskFormat]; !ok {
+			return nil, fmt.Errorf("Invalid disk_format %q", driverConfig.DiskFormat)
+		}
+	}
+	switch driverConfig.ConvertFormat {
+	case "", "raw", "qcow2":
+	default:
+		return nil, fmt.Errorf("Invalid convert_format %q: must be \"raw\" or \"qcow2\"", driverConfig.ConvertFormat)
+	}
+	if driverConfig.ConvertFormat != "" && driverConfig.Overlay {
+		return nil, fmt.Errorf("convert_format can't be combined with overlay, which always boots from qcow2")
+	}
+
+	switch driverConfig.RTCBase {
+	case "", "utc", "localtime":
+	default:
+		return nil, fmt.Errorf("Invalid rtc_base %q: must be \"utc\" or \"localtime\"", driverConfig.RTCBase)
+	}
+
+	switch driverConfig.RTCClock {
+	case "", "host", "rt", "vm":
+	default:
+		return nil, fmt.Errorf("Invalid rtc_clock %q: must be \"host\", \"rt\" or \"vm\"", driverConfig.RTCClock)
+	}
+
+	mem, memMB, maxMemMB, err := qemuMemoryArg(&driverConfig, task)
+	if err != nil {
+		return nil, err
+	}
+	var hugepages *qemuHugepages
+	if driverConfig.Hugepages {
+		// Hotplugged memory isn't backed by hugepages
+		if maxMemMB != 0 {
+			return nil, fmt.Errorf("hugepages can't be combined with max_memory")
+		}
+		if hugepages, err = qemuHostHugepages(); err != nil {
+			return nil, fmt.Errorf("hugepages are unavailable: %v", err)
+		}
+		if err := hugepages.check(memMB); err != nil {
+			return nil, err
+		}
+	}
+
+	if s := driverConfig.OOMScoreAdj; s != nil && (*s < -1000 || *s > 1000) {
+		return nil, fmt.Errorf("Invalid oom_score_adj %d: must be between -1000 and 1000", *s)
+	}
+	if n := driverConfig.Nice; n != nil && (*n < -20 || *n > 19) {
+		return nil, fmt.Errorf("Invalid nice %d: must be between -20 and 19", *n)
+	}
+	if _, _, err := qemuIONice(&driverConfig); err != nil {
+		return nil, err
+	}
+
+	var imageMode *os.FileMode
+	if driverConfig.ImageMode != "" {
+		mode, err := strconv.ParseUint(driverConfig.ImageMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("Invalid image_mode %q: must be octal permissions such as \"0640\"", driverConfig.ImageMode)
+		}
+		m := os.FileMode(mode)
+		imageMode = &m
+	}
+
+	// Ports are only forwarded by user networking, in bridge mode the guest is
+	// reached on its own address
+	switch driverConfig.NetworkMode {
+	case "", "user":
+	case "bridge":
+		if len(driverConfig.PortMap) != 0 {
+			return nil, fmt.Errorf("port_map is only supported with network_mode \"user\"")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid network_mode %q: must be \"user\" or \"bridge\"", driverConfig.NetworkMode)
+	}
+	if driverConfig.NetworkRateLimit < 0 {
+		return nil, fmt.Errorf("Invalid network_rate_limit %d: must be a positive number of Mbit/s", driverConfig.NetworkRateLimit)
+	}
+	if driverConfig.NetworkRateLimit > 0 && driverConfig.NetworkMode != "bridge" {
+		// User networking doesn't pass the guest's traffic through a host
+		// device that can be shaped
+		return nil, fmt.Errorf("network_rate_limit requires network_mode \"bridge\"")
+	}
+
+	// Every VM on a bridge gets its own MAC address unless the task sets one
+	mac := qemuMACAddress(ctx.AllocID, task.Name)
+	if driverConfig.MACAddress != "" {
+		if driverConfig.NetworkMode != "bridge" {
+			return nil, fmt.Errorf("mac_address requires network_mode \"bridge\"")
+		}
+		if mac, err = qemuParseMAC(driverConfig.MACAddress); err != nil {
+			return nil, err
+		}
+	}
+	if driverConfig.GuestAddress != "" {
+		if driverConfig.NetworkMode != "bridge" {
+			return nil, fmt.Errorf("guest_address requires network_mode \"bridge\"")
+		}
+		if net.ParseIP(driverConfig.GuestAddress) == nil {
+			return nil, fmt.Errorf("Invalid guest_address %q: must be an IP address", driverConfig.GuestAddress)
+		}
+	}
+
+	arch, machine, err := qemuArchMachine(&driverConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.config.ReadBoolDefault(qemuArgsConfigOption, qemuArgsConfigDefault) {
+		if err := qemuCheckHostAccess(&driverConfig); err != nil {
+			return nil, err
+		}
+	}
+	if (len(driverConfig.PreStartCommand) != 0 || len(driverConfig.PostStopCommand) != 0) &&
+		!d.config.ReadBoolDefault(qemuHooksConfigOption, qemuHooksConfigDefault) {
+		return nil, fmt.Errorf("Qemu pre_start_command and post_stop_command are disabled on this Nomad agent; see the %q option", qemuHooksConfigOption)
+	}
+
+	if err := qemuValidatePinning(driverConfig.CPUPinning, runtime.NumCPU()); err != nil {
+		return nil, err
+	}
+
+	var firmware *qemuFirmware
+	switch driverConfig.Firmware {
+	case "", "bios":
+	case "uefi":
+		if firmware = qemuFindFirmware(arch); firmware == nil {
+			return nil, fmt.Errorf("No UEFI firmware found for arch %q", arch)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid firmware %q: must be \"bios\" or \"uefi\"", driverConfig.Firmware)
+	}
+
+	readinessAddr, readinessTimeout, err := qemuReadiness(&driverConfig, task)
+	if err != nil {
+		return nil, err
+	}
+	healthCheck, err := qemuHealthCheckConfig(&driverConfig, task)
+	if err != nil {
+		return nil, err
+	}
+	display, err := qemuDisplayConfig(&driverConfig, task)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pass through the VFIO devices assigned to the task by the scheduler
+	driverConfig.PCIPassthrough = append(driverConfig.PCIPassthrough, qemuAssignedDevices(task.Resources)...)
+
+	// Get the image source
+	vmPath := driverConfig.ImagePath
+	if vmPath == "" {
+		return nil, ErrQemuMissingImagePath
+	}
+	vmID := filepath.Base(vmPath)
+	if driverConfig.Overlay && filepath.IsAbs(vmPath) {
+		return nil, fmt.Errorf("overlay requires image_path to be relative to the task directory")
+	}
+	// Guest writes discarded by snapshot would be missing from the disks of a
+	// restored VM, and passed through devices can't be saved
+	if driverConfig.SaveState && driverConfig.Snapshot {
+		return nil, fmt.Errorf("save_state can't be set for a snapshot image")
+	}
+	if driverConfig.SaveState && len(driverConfig.PCIPassthrough) != 0 {
+		return nil, fmt.Errorf("save_state can't be set for a VM with pci_passthrough devices")
+	}
+	if driverConfig.SaveState && driverConfig.ShareAllocDir {
+		return nil, fmt.Errorf("save_state can't be set for a VM with share_alloc_dir")
+	}
+	d.emitEvent(DriverEventStartRequested, map[string]string{"vm_id": vmID})
+
+	// Get the tasks local directory.
+	taskDir, ok := ctx.AllocDir.TaskDirs[d.DriverContext.taskName]
+	if !ok {
+		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
+	}
+
+	// Fail early rather than letting the VM's disks fill up the node. A dry
+	// run only validates the sizes as it uses no space.
+	if driverConfig.DiskMB < 0 {
+		return nil, fmt.Errorf("disk_mb must not be negative")
+	}
+	var diskSize uint64
+	if driverConfig.DiskSize != "" {
+		kb, err := parseQemuMemory("disk_size", driverConfig.DiskSize)
+		if err != nil {
+			return nil, err
+		}
+		diskSize = kb * 1024
+		if driverConfig.ReadOnly {
+			return nil, fmt.Errorf("disk_size can't be set for a readonly image")
+		}
+		if driverConfig.DiskMB > 0 && diskSize > uint64(driverConfig.DiskMB)*1024*1024 {
+			return nil, fmt.Errorf("disk_size %q must not exceed disk_mb", driverConfig.DiskSize)
+		}
+	}
+	if required := qemuRequiredDisk(driverConfig.DiskMB, diskSize); required > 0 && !driverConfig.DryRun {
+		imagePath := vmPath
+		if !filepath.IsAbs(imagePath) {
+			imagePath = filepath.Join(taskDir, imagePath)
+		}
+		var used uint64
+		if fi, err := os.Stat(imagePath); err == nil {
+			used = uint64(fi.Size())
+		}
+		// Space may be freed up by other allocations, so it is worth retrying
+		if err := qemuCheckDiskSpace(ctx.AllocDir.AllocDir, required, used); err != nil {
+			return nil, structs.NewRecoverableError(err, true)
+		}
+	}
+
+	// Qemu is looked up in the PATH unless the client configures where it is
+	// installed
+	qemuDir := d.config.Read(qemuPathConfigOption)
+	qemuImg := qemuBinary(qemuDir, "qemu-img")
+
+	if !driverConfig.DryRun {
+		imagePath := vmPath
+		if !filepath.IsAbs(imagePath) {
+			imagePath = filepath.Join(taskDir, imagePath)
+		}
+		if driverConfig.ConvertFormat != "" {
+			// Images downloaded into the task directory are replaced by
+			// their converted copy rather than taking up space twice
+			convertedPath := filepath.Join(taskDir, qemuConvertedImage(driverConfig.ConvertFormat))
+			removeSource := !filepath.IsAbs(vmPath)
+			if err := qemuConvertImage(qemuImg, imagePath, driverConfig.DiskFormat, convertedPath, driverConfig.ConvertFormat, removeSource); err != nil {
+				return nil, err
+			}
+			imagePath = convertedPath
+		}
+		if driverConfig.Overlay {
+			// A restarted task keeps booting from its overlay, the image has
+			// already been moved to the base images
+			overlayPath := filepath.Join(taskDir, qemuOverlayImage)
+			if _, err := os.Stat(overlayPath); os.IsNotExist(err) {
+				base := filepath.Join(taskDir, qemuBaseImageLink)
+				sum := qemuImageChecksum(task, d.taskEnv, taskDir, imagePath)
+				if err := qemuBaseImage(filepath.Join(d.config.AllocDir, qemuBaseImageDir), imagePath, base, sum); err != nil {
+					return nil, err
+				}
+				if err := qemuCreateOverlay(qemuImg, base, overlayPath, driverConfig.DiskFormat); err != nil {
+					return nil, err
+				}
+				if err := chownToUser(overlayPath, qemuExecUser(task, &driverConfig)); err != nil {
+					return nil, fmt.Errorf("failed to prepare overlay: %v", err)
+				}
+			}
+			imagePath = overlayPath
+		}
+		if diskSize > 0 {
+			format := driverConfig.DiskFormat
+			if driverConfig.Overlay {
+				format = "qcow2"
+			} else if driverConfig.ConvertFormat != "" {
+				format = driverConfig.ConvertFormat
+			}
+			if err := qemuResizeImage(qemuImg, imagePath, format, diskSize); err != nil {
+				return nil, fmt.Errorf("failed to resize image: %v", err)
+			}
+		}
+		writeProtect := driverConfig.Snapshot || driverConfig.ReadOnly
+		if err := qemuProtectImage(imagePath, imageMode, writeProtect); err != nil {
+			return nil, err
+		}
+	}
+	if driverConfig.Overlay {
+		// The VM boots from the overlay, whose format is always qcow2
+		vmPath = qemuOverlayImage
+		driverConfig.DiskFormat = "qcow2"
+	}
+	if driverConfig.ConvertFormat != "" {
+		vmPath = qemuConvertedImage(driverConfig.ConvertFormat)
+		driverConfig.DiskFormat = driverConfig.ConvertFormat
+	}
+
+	// Run the hooks with the task directory as their working directory
+	preStart, err := newQemuHook(driverConfig.PreStartCommand, driverConfig.HookTimeout, taskDir, d.taskEnv)
+	if err != nil {
+		return nil, err
+	}
+	postStop, err := newQemuHook(driverConfig.PostStopCommand, driverConfig.HookTimeout, taskDir, d.taskEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse configuration arguments
+	// Create the base arguments
+	accelerator := "tcg"
+	if driverConfig.Accelerator != "" {
+		accelerator = driverConfig.Accelerator
+	}
+	if driverConfig.AcceleratorFallback != "" && !qemuAcceleratorAvailable(accelerator) {
+		d.logger.Printf("[WARN] driver.qemu: accelerator %q is not available, falling back to accelerator %q for VM %s",
+			accelerator, driverConfig.AcceleratorFallback, vmID)
+		accelerator = driverConfig.AcceleratorFallback
+	}
+
+	absPath, err := GetAbsolutePath(qemuBinary(qemuDir, "qemu-system-"+arch))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{absPath}
+	args = append(args, qemuMachineArgs(accelerator, machine, &driverConfig)...)
+	args = append(args,
+		"-name", qemuNameArg(vmID, &driverConfig),
+		"-m", mem,
+		"-drive", qemuDriveArg(vmPath, &driverConfig),
+		"-nographic",
+	)
+	if firmware != nil {
+		args = append(args, qemuFirmwareArgs(firmware, filepath.Join(taskDir, qemuNVRAMFile))...)
+	}
+	// Pinned VMs get a vCPU for every core they are pinned to
+	vcpus := qemuVCPUs(task.Resources.CPU, d.node)
+	if len(driverConfig.CPUPinning) != 0 {
+		vcpus = len(driverConfig.CPUPinning)
+	}
+	if vcpus > 1 {
+		args = append(args, "-smp", strconv.Itoa(vcpus))
+	}
+	if len(driverConfig.NUMA) != 0 {
+		var hugepagesPath string
+		if hugepages != nil {
+			hugepagesPath = hugepages.Path
+		}
+		numa, err := qemuNUMAArgs(driverConfig.NUMA, vcpus, memMB, hugepagesPath)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, numa...)
+	} else if hugepages != nil {
+		args = append(args, "-mem-path", hugepages.Path, "-mem-prealloc")
+	}
+	if rtc := qemuRTCArg(&driverConfig); rtc != "" {
+		args = append(args, "-rtc", rtc)
+	}
+
+	// The balloon lets the VM's memory be shrunk below -m without a restart
+	if driverConfig.Balloon {
+		args = append(args, "-device", "virtio-balloon,id="+qemuBalloonID)
+	}
+
+	// Expose a QMP monitor so the VM can be controlled and queried while it
+	// runs
+	qmpPath, err := qemuSocketAddress(taskDir, qemuMonitorSocket)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "-qmp", qemuQMPArg(qmpPath))
+
+	if driverConfig.ConsoleLog {
+		consolePath := filepath.Join(ctx.AllocDir.LogDir(), task.Name+qemuConsoleLogSuffix)
+		args = append(args, qemuConsoleArgs(consolePath)...)
+	}
+	if display != nil {
+		args = append(args, display.args(driverConfig.DisplayPassword != "")...)
+	}
+
+	var agentPath string
+	if driverConfig.GuestAgent {
+		agentPath, err = qemuSocketAddress(taskDir, qemuAgentSocket)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, qemuAgentArgs(agentPath)...)
+	}
+
+	// Add pass through arguments to qemu executable. A user can specify
+	// these arguments in driver task configuration. These arguments are
+	// passed directly to the qemu driver as command line options.
+	// For example, args = [ "-nodefconfig", "-nodefaults" ]
+	// This will allow a VM with embedded configuration to boot successfully.
+	args = append(args, driverConfig.Args...)
+
+	// Render the cloud-init user-data and meta-data and attach them to the VM
+	// as a NoCloud seed ISO. A dry run only renders them, without writing
+	// the ISO.
+	if driverConfig.UserData != "" || len(driverConfig.SSHKeys) != 0 || len(driverConfig.MetaData) != 0 {
+		data := newQemuUserDataContext(ctx, task, d.node, d.taskEnv)
+		files, err := qemuSeedFiles(&driverConfig, data)
+		if err != nil {
+			return nil, err
+		}
+		seedPath := filepath.Join(taskDir, qemuSeedISO)
+		if !driverConfig.DryRun {
+			if seedPath, err = createSeedISO(taskDir, files); err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, "-cdrom", seedPath)
+	}
+
+	// Attach pre-existing host storage as a second disk. A dry run doesn't
+	// open the device to check it is accessible.
+	if driverConfig.RawDevice != "" {
+		drive, err := qemuRawDeviceArg(driverConfig.RawDevice)
+		if err != nil {
+			return nil, err
+		}
+		if !driverConfig.DryRun {
+			if err := qemuCheckRawDevice(driverConfig.RawDevice); err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, "-drive", drive)
+	}
+
+	dataDisks, err := qemuDataDisks(driverConfig.Disks, taskDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, disk := range dataDisks {
+		args = append(args, "-drive", disk.driveArg())
+	}
+
+	// Give the guest access to the allocation directory like tasks of other
+	// drivers have
+	if driverConfig.ShareAllocDir {
+		args = append(args, qemuShareArgs(ctx.AllocDir.SharedDir, qemuAllocDirTag)...)
+	}
+
+	// Pass through the requested host PCI devices
+	pciArgs, err := qemuPCIPassthroughArgs(driverConfig.PCIPassthrough)
+	if err != nil {
+		return nil, err
+	}
+	if len(driverConfig.PCIPassthrough) != 0 && !qemuVFIOAvailable() {
+		return nil, fmt.Errorf("pci_passthrough requires VFIO, which isn't available on the host")
+	}
+	for _, addr := range driverConfig.PCIPassthrough {
+		if err := qemuCheckPCIDevice(addr); err != nil {
+			return nil, err
+		}
+	}
+	args = append(args, pciArgs...)
+
+	// Check the Resources required Networks to add port mappings. If no resources
+	// are required, we assume the VM is a purely compute job and does not require
+	// the outside world to be able to reach it. VMs ran without port mappings can
+	// still reach out to the world, but without port mappings it is effectively
+	// firewalled
+	var tap string
+	if driverConfig.NetworkMode == "bridge" {
+		tap = qemuTapName(ctx.AllocID, task.Name)
+		args = append(args, qemuTapArgs(tap, mac)...)
+	} else if len(task.Resources.Networks) > 0 && len(driverConfig.PortMap) == 1 {
+		taskPorts := task.Resources.Networks[0].MapLabelToValues(nil)
+		forwarding, err := qemuPortForwards(driverConfig.PortMap[0], taskPorts)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(forwarding) != 0 {
+			args = append(args,
+				"-netdev",
+				fmt.Sprintf("user,id=user.0,%s", strings.Join(forwarding, ",")),
+				"-device", "virtio-net,netdev=user.0",
+			)
+		}
+	}
+
+	// If using KVM, add optimization args
+	if accelerator == "kvm" {
+		args = append(args,
+			"-enable-kvm",
+			"-cpu", "host",
+		)
+	}
+
+	// A VM whose state was saved when the client shut down resumes from it
+	// instead of booting
+	statePath := filepath.Join(taskDir, qemuStateFile)
+	restore := false
+	if driverConfig.SaveState {
+		if _, err := os.Stat(statePath); err == nil {
+			restore = true
+			args = append(args, qemuIncomingArgs(statePath+qemuRestoreSuffix)...)
+		}
+	}
+
+	if driverConfig.DryRun {
+		d.logger.Printf("[INFO] driver.qemu: dry run of VM %s: %q", vmID, strings.Join(args, " "))
+		return nil, &QemuDryRunError{Args: args}
+	}
+
+	// The pre_start_command runs once the configuration has been validated,
+	// and the post_stop_command undoes it if the VM then fails to launch. The
+	// tap device is removed once the VM exits, or right away if the VM fails
+	// to launch.
+	launched := false
+	if preStart != nil {
+		d.logger.Printf("[DEBUG] driver.qemu: running pre_start_command for VM %s", vmID)
+		if err := preStart.run(); err != nil {
+			return nil, fmt.Errorf("pre_start_command failed: %v", err)
+		}
+		if postStop != nil {
+			defer func() {
+				if !launched {
+					if err := postStop.run(); err != nil {
+						d.logger.Printf("[ERR] driver.qemu: post_stop_command for VM %s failed: %v", vmID, err)
+					}
+				}
+			}()
+		}
+	}
+
+	if err := prepareRestore(taskDir, restore); err != nil {
+		return nil, err
+	}
+
+	// The sockets' names are as long, so the agent socket is next to the
+	// monitor's if they are outside of the task directory
+	if err := qemuCreateSocketDir(qmpPath, taskDir, qemuExecUser(task, &driverConfig)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !launched {
+			if err := qemuRemoveSocketDir(qmpPath); err != nil {
+				d.logger.Printf("[ERR] driver.qemu: failed to remove socket directory of VM %s: %v", vmID, err)
+			}
+		}
+	}()
+
+	if firmware != nil {
+		if err := createNVRAM(firmware, filepath.Join(taskDir, qemuNVRAMFile), qemuExecUser(task, &driverConfig)); err != nil {
+			return nil, err
+		}
+	}
+	for _, disk := range dataDisks {
+		if err := disk.create(qemuImg, qemuExecUser(task, &driverConfig)); err != nil {
+			return nil, fmt.Errorf("failed to create disk %s: %v", filepath.Base(disk.Path), err)
+		}
+	}
+
+	if tap != "" {
+		bridge := qemuDefaultBridge
+		if driverConfig.Bridge != "" {
+			bridge = driverConfig.Bridge
+		}
+		if err := createTap(tap, bridge, qemuExecUser(task, &driverConfig)); err != nil {
+			return nil, fmt.Errorf("failed to create tap device: %v", err)
+		}
+		defer func() {
+			if !launched {
+				if err := deleteTap(tap); err != nil {
+					d.logger.Printf("[ERR] driver.qemu: failed to remove tap device %s: %v", tap, err)
+				}
+			}
+		}()
+		if driverConfig.NetworkRateLimit > 0 {
+			if err := limitTap(tap, driverConfig.NetworkRateLimit); err != nil {
+				return nil, fmt.Errorf("failed to limit network rate: %v", err)
+			}
+		}
+	}
+
+	d.logger.Printf("[DEBUG] Starting QemuVM command: %q", strings.Join(args, " "))
+	bin, err := discover.NomadExecutable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the nomad binary: %v", err)
+	}
+
+	pluginLogFile := filepath.Join(taskDir, fmt.Sprintf("%s-executor.out", task.Name))
+	pluginConfig := &plugin.ClientConfig{
+		Cmd: exec.Command(bin, "executor", pluginLogFile),
+	}
+
+	exec, pluginClient, err := createExecutor(pluginConfig, d.config.LogOutput, d.config)
+	if err != nil {
+		return nil, structs.NewRecoverableError(fmt.Errorf("failed to launch executor: %v", err), true)
+	}
+	executorCtx := &executor.ExecutorContext{
+		TaskEnv:  d.taskEnv,
+		Driver:   "qemu",
+		AllocDir: ctx.AllocDir,
+		AllocID:  ctx.AllocID,
+		Task:     task,
+	}
+	if err := exec.SetContext(executorCtx); err != nil {
+		pluginClient.Kill()
+		return nil, fmt.Errorf("failed to set executor context: %v", err)
+	}
+
+	execCmd := &executor.ExecCommand{
+		Cmd:  args[0],
+		Args: args[1:],
+		User: qemuExecUser(task, &driverConfig),
+	}
+	ps, err := exec.LaunchCmd(execCmd)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+	d.logger.Printf("[INFO] Started new QemuVM: %s", vmID)
+
+	// The sockets' addresses are only known once qemu listens on them on
+	// platforms where it picks them
+	qmpPath, agentPath, err = qemuResolveSockets(ps.Pid, qmpPath, agentPath)
+	if err != nil {
+		exec.Exit()
+		pluginClient.Kill()
+		return nil, fmt.Errorf("failed to find the sockets of VM %s: %v", vmID, err)
+	}
+	d.emitEvent(DriverEventProcessStarted, map[string]string{
+		"vm_id": vmID,
+		"pid":   strconv.Itoa(ps.Pid),
+	})
+
+	// Create and Return Handle
+	maxKill := d.DriverContext.config.MaxKillTimeout
+	h := &qemuHandle{
+		pluginClient:   pluginClient,
+		executor:       exec,
+		userPid:        ps.Pid,
+		allocDir:       ctx.AllocDir,
+		killTimeout:    GetKillTimeout(task.KillTimeout, maxKill),
+		maxKillTimeout: maxKill,
+		version:        d.config.Version,
+		vmID:           vmID,
+		taskName:       task.Name,
+		eventSink:      d.eventSink,
+		qmpPath:        qmpPath,
+		agentPath:      agentPath,
+		tapDevice:      tap,
+		guestAddress:   driverConfig.GuestAddress,
+		display:        display,
+		postStop:       postStop,
+		balloon:        driverConfig.Balloon,
+		memoryMB:       memMB,
+		maxMemoryMB:    maxMemMB,
+		memorySlots:    driverConfig.MemorySlots,
+		healthCheck:    healthCheck,
+		saveState:      driverConfig.SaveState,
+		startTime:      time.Now(),
+		logger:         d.logger,
+		doneCh:         make(chan struct{}),
+		waitCh:         make(chan *dstructs.WaitResult, 1),
+	}
+
+	if err := h.executor.SyncServices(h.consulContext(d.config)); err != nil {
+		h.logger.Printf("[ERR] driver.qemu: error registering services for task: %q: %v", task.Name, err)
+	}
+	go h.run()
+	launched = true
+	if restore {
+		d.logger.Printf("[INFO] driver.qemu: restoring VM %s from its saved state", vmID)
+		go h.finishRestore(statePath + qemuRestoreSuffix)
+	}
+
+	if err := qemuSetPriority(ps.Pid, &driverConfig); err != nil {
+		if e := h.Kill(); e != nil {
+			d.logger.Printf("[ERR] driver.qemu: failed to kill VM %s: %v", vmID, e)
+		}
+		return nil, err
+	}
+
+	if len(driverConfig.CPUPinning) != 0 {
+		// Threads other than the vCPUs, such as I/O threads, share the cores
+		err := setProcessAffinity(ps.Pid, driverConfig.CPUPinning)
+		if err == nil {
+			err = pinVCPUs(qmpPath, driverConfig.CPUPinning, qemuPinningTimeout, h.doneCh)
+		}
+		if err != nil {
+			if e := h.Kill(); e != nil {
+				d.logger.Printf("[ERR] driver.qemu: failed to kill VM %s: %v", vmID, e)
+			}
+			return nil, fmt.Errorf("failed to pin vCPUs of VM %s: %v", vmID, err)
+		}
+	}
+
+	if display != nil {
+		if driverConfig.DisplayPassword != "" {
+			if err := setDisplayPassword(qmpPath, display, driverConfig.DisplayPassword, qemuDisplayPasswordTimeout, h.doneCh); err != nil {
+				if e := h.Kill(); e != nil {
+					d.logger.Printf("[ERR] driver.qemu: failed to kill VM %s: %v", vmID, e)
+				}
+				return nil, fmt.Errorf("failed to set display password of VM %s: %v", vmID, err)
+			}
+		}
+		d.logger.Printf("[DEBUG] driver.qemu: VM %s has a %s display on %s", vmID, display.Protocol, display.Addr())
+		h.emitDisplay()
+	}
+
+	// Block until the guest is reachable so the task isn't reported as running
+	// while the VM is still booting.
+	if readinessAddr != "" {
+		d.logger.Printf("[DEBUG] driver.qemu: waiting up to %v for VM %s to be ready on %s", readinessTimeout, vmID, readinessAddr)
+		if err := waitForReady(tcpProbe(readinessAddr), readinessTimeout, qemuProbeInterval, h.doneCh); err != nil {
+			if e := h.Kill(); e != nil {
+				d.logger.Printf("[ERR] driver.qemu: failed to kill VM %s: %v", vmID, e)
+			}
+			return nil, fmt.Errorf("VM %s failed to become ready: %v", vmID, err)
+		}
+		d.logger.Printf("[DEBUG] driver.qemu: VM %s is ready", vmID)
+	}
+	if h.healthCheck != nil {
+		go h.watchHealth()
+	}
+	if h.agentPath != "" {
+		go h.reportGuestAddresses()
+	}
+	return h, nil
+}
+
+// qemuSetPriority applies the configured OOM score adjustment, scheduling
+// priority and I/O priority to the qemu process. Settings that aren't configured are left
+// untouched.
+func qemuSetPriority(pid int, driverConfig *QemuDriverConfig) error {
+	if driverConfig.OOMScoreAdj != nil {
+		if err := setOOMScoreAdj(pid, *driverConfig.OOMScoreAdj); err != nil {
+			return fmt.Errorf("failed to set oom_score_adj: %v", err)
+		}
+	}
+	if driverConfig.Nice != nil {
+		if err := setNice(pid, *driverConfig.Nice); err != nil {
+			return fmt.Errorf("failed to set nice: %v", err)
+		}
+	}
+	if class, level, _ := qemuIONice(driverConfig); class != 0 {
+		if err := setIOPriority(pid, class, level); err != nil {
+			return fmt.Errorf("failed to set ionice: %v", err)
+		}
+	}
+	return nil
+}
+
+// qemuIONiceClasses are the I/O scheduling classes ionice_class can be set to
+var qemuIONiceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// qemuIONice returns the I/O scheduling class and the priority within it the
+// qemu process is set to, or a zero class if the I/O priority is left
+// untouched. A level without a class is in the best-effort class, and the idle
+// class has no levels.
+func qemuIONice(driverConfig *QemuDriverConfig) (int, int, error) {
+	if driverConfig.IONiceClass == "" && driverConfig.IONiceLevel == nil {
+		return 0, 0, nil
+	}
+
+	name := driverConfig.IONiceClass
+	if name == "" {
+		name = "best-effort"
+	}
+	class, ok := qemuIONiceClasses[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("Invalid ionice_class %q: must be realtime, best-effort or idle", name)
+	}
+
+	// Like ionice, the level defaults to the middle of the range
+	level := 4
+	if l := driverConfig.IONiceLevel; l != nil {
+		if name == "idle" {
+			return 0, 0, fmt.Errorf("ionice_level can't be set with the idle ionice_class")
+		}
+		if *l < 0 || *l > 7 {
+			return 0, 0, fmt.Errorf("Invalid ionice_level %d: must be between 0 and 7", *l)
+		}
+		level = *l
+	}
+	if name == "idle" {
+		level = 0
+	}
+	return class, level, nil
+}
+
+// qemuReadiness returns the host address that is probed before the VM is
+// considered started, and how long to wait for it. The address is empty if no
+// readiness port is configured.
+func qemuReadiness(driverConfig *QemuDriverConfig, task *structs.Task) (string, time.Duration, error) {
+	if driverConfig.ReadinessPort == "" {
+		return "", 0, nil
+	}
+	addr, err := qemuPortAddr(driverConfig, task, "readiness_port", driverConfig.ReadinessPort)
+	if err != nil {
+		return "", 0, err
+	}
+
+	timeout := qemuDefaultReadinessTimeout
+	if driverConfig.ReadinessTimeout != "" {
+		t, err := time.ParseDuration(driverConfig.ReadinessTimeout)
+		if err != nil {
+			return "", 0, fmt.Errorf("Invalid readiness_timeout %q: %v", driverConfig.ReadinessTimeout, err)
+		}
+		if t <= 0 {
+			return "", 0, fmt.Errorf("readiness_timeout must be positive")
+		}
+		timeout = t
+	}
+
+	return addr, timeout, nil
+}
+
+// qemuPortAddr returns the host address forwarded to the guest port with the
+// given port_map label. option names the setting the label came from.
+func qemuPortAddr(driverConfig *QemuDriverConfig, task *structs.Task, option, label string) (string, error) {
+	if len(driverConfig.PortMap) != 1 {
+		return "", fmt.Errorf("%s %q must be a port_map label", option, label)
+	}
+	if _, ok := driverConfig.PortMap[0][label]; !ok {
+		return "", fmt.Errorf("%s %q must be a port_map label", option, label)
+	}
+	if len(task.Resources.Networks) == 0 {
+		return "", fmt.Errorf("%s %q requires a network resource", option, label)
+	}
+	host, ok := task.Resources.Networks[0].MapLabelToValues(nil)[label]
+	if !ok {
+		return "", fmt.Errorf("Unknown port label %q", label)
+	}
+	return fmt.Sprintf("127.0.0.1:%d", host), nil
+}
+
+// qemuHealthCheckConfig returns the health check configured for the task, or
+// nil if health checking is disabled.
+func qemuHealthCheckConfig(driverConfig *QemuDriverConfig, task *structs.Task) (*qemuHealthCheck, error) {
+	if driverConfig.HealthCheck == "" {
+		return nil, nil
+	}
+
+	check := &qemuHealthCheck{
+		Type:     driverConfig.HealthCheck,
+		Interval: qemuDefaultHealthInterval,
+		Failures: qemuDefaultHealthFailures,
+	}
+	switch check.Type {
+	case "tcp":
+		if driverConfig.HealthPort == "" {
+			return nil, fmt.Errorf("health_port must be set for tcp health checks")
+		}
+		addr, err := qemuPortAddr(driverConfig, task, "health_port", driverConfig.HealthPort)
+		if err != nil {
+			return nil, err
+		}
+		check.Addr = addr
+	case "qmp":
+	default:
+		return nil, fmt.Errorf("Invalid health_check %q: must be \"tcp\" or \"qmp\"", check.Type)
+	}
+
+	if driverConfig.HealthInterval != "" {
+		t, err := time.ParseDuration(driverConfig.HealthInterval)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid health_interval %q: %v", driverConfig.HealthInterval, err)
+		}
+		if t <= 0 {
+			return nil, fmt.Errorf("health_interval must be positive")
+		}
+		check.Interval = t
+	}
+	if driverConfig.HealthFailures < 0 {
+		return nil, fmt.Errorf("health_failures must not be negative")
+	}
+	if driverConfig.HealthFailures > 0 {
+		check.Failures = driverConfig.HealthFailures
+	}
+	if driverConfig.HealthGrace != "" {
+		t, err := time.ParseDuration(driverConfig.HealthGrace)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid health_grace_period %q: %v", driverConfig.HealthGrace, err)
+		}
+		if t < 0 {
+			return nil, fmt.Errorf("health_grace_period must not be negative")
+		}
+		check.Grace = t
+	}
+	return check, nil
+}
+
+// qemuValidatePort returns an error if port can't be used in a hostfwd rule
+func qemuValidatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%d is not between 1 and 65535", port)
+	}
+	return nil
+}
+
+// qemuPortForwards returns the hostfwd options of the user netdev that map the
+// host ports of the task's port labels to the guest ports in portMap, e.g.
+// hostfwd=tcp::22000-:22. Both TCP and UDP are forwarded. It is an error for a
+// label to be unknown or for two labels to claim the same host port, as Qemu
+// can only forward a host port to one guest port.
+func qemuPortForwards(portMap map[string]int, taskPorts map[string]int) ([]string, error) {
+	labels := make([]string, 0, len(portMap))
+	for label := range portMap {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var forwarding []string
+	hostLabels := make(map[int]string, len(labels))
+	for _, label := range labels {
+		host, ok := taskPorts[label]
+		if !ok {
+			return nil, fmt.Errorf("Unknown port label %q", label)
+		}
+		if err := qemuValidatePort(host); err != nil {
+			return nil, fmt.Errorf("Invalid host port for port label %q: %v", label, err)
+		}
+		if other, ok := hostLabels[host]; ok {
+			return nil, fmt.Errorf("Port labels %q and %q both map host port %d", other, label, host)
+		}
+		hostLabels[host] = label
+
+		for _, p := range []string{"udp", "tcp"} {
+			forwarding = append(forwarding, fmt.Sprintf("hostfwd=%s::%d-:%d", p, host, portMap[label]))
+		}
+	}
+	return forwarding, nil
+}
+
+// qemuRequiredDisk returns the bytes the VM's disks may grow to, given disk_mb
+// and the size the image is resized to. disk_mb covers all disks and takes
+// precedence.
+func qemuRequiredDisk(diskMB int, diskSize uint64) uint64 {
+	if diskMB > 0 {
+		return uint64(diskMB) * 1024 * 1024
+	}
+	return diskSize
+}
+
+// qemuCheckDiskSpace returns an error if the filesystem holding the allocation
+// directory doesn't have room for the VM's disks to grow to the required size,
+// given the bytes they already use. The check is skipped on platforms where
+// the free disk space can't be determined.
+func qemuCheckDiskSpace(allocDir string, required, used uint64) error {
+	if required <= used {
+		return nil
+	}
+
+	free, err := qemuFreeDiskBytes(allocDir)
+	if err == errFreeDiskUnsupported {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to determine free disk space for %q: %v", allocDir, err)
+	}
+	if needed := required - used; free < needed {
+		return fmt.Errorf("insufficient disk space in allocation directory: need %d MB, %d MB available",
+			needed/(1024*1024), free/(1024*1024))
+	}
+	return nil
+}
+
+// qemuArchMachine returns the architecture of the system emulator and the
+// machine type the task runs with.
+func qemuArchMachine(driverConfig *QemuDriverConfig) (string, string, error) {
+	arch := driverConfig.Arch
+	if arch == "" {
+		arch = "x86_64"
+	}
+	if !reQemuArch.MatchString(arch) {
+		return "", "", fmt.Errorf("Invalid arch %q: must be the suffix of a qemu-system-<arch> binary such as \"aarch64\"", arch)
+	}
+
+	machine := driverConfig.Machine
+	if machine == "" {
+		var ok bool
+		if machine, ok = qemuDefaultMachines[arch]; !ok {
+			return "", "", fmt.Errorf("machine must be set for arch %q", arch)
+		}
+	}
+	if strings.Contains(machine, ",") {
+		return "", "", fmt.Errorf("Invalid machine %q: set machine properties through args", machine)
+	}
+	return arch, machine, nil
+}
+
+// qemuMachineArgs returns the arguments selecting the machine type and
+// accelerator. Accelerator properties, such as multi-threaded TCG, can only be
+// set through -accel, in which case -machine no longer selects the
+// accelerator.
+func qemuMachineArgs(accelerator, machine string, driverConfig *QemuDriverConfig) []string {
+	var props []string
+	if accelerator == "tcg" && driverConfig.TCGThreads == "multi" {
+		props = append(props, "thread=multi")
+	}
+	if accelerator == "tcg" && driverConfig.TCGTBSize > 0 {
+		props = append(props, fmt.Sprintf("tb-size=%d", driverConfig.TCGTBSize))
+	}
+
+	if len(props) == 0 {
+		return []string{"-machine", "type=" + machine + ",accel=" + accelerator}
+	}
+	return []string{
+		"-machine", "type=" + machine,
+		"-accel", accelerator + "," + strings.Join(props, ","),
+	}
+}
+
+// qemuNameArg returns the -name argument. By default the VM is named after its
+// image. A configured vm_name, which may interpolate the job and allocation
+// through the task environment, names both the guest and the qemu process so
+// the VM can be found in ps.
+func qemuNameArg(vmID string, driverConfig *QemuDriverConfig) string {
+	if driverConfig.VMName == "" {
+		return vmID
+	}
+
+	name := qemuEscapeOption(driverConfig.VMName)
+	return fmt.Sprintf("%s,process=%s", name, name)
+}
+
+// qemuExecUser returns the user the qemu process is run as. The driver
+// prepares the task directory, seed ISO and image as the client's user and
+// only the VM itself drops to run_as_user, falling back to the task's user.
+func qemuExecUser(task *structs.Task, driverConfig *QemuDriverConfig) string {
+	if driverConfig.RunAsUser != "" {
+		return driverConfig.RunAsUser
+	}
+	return task.User
+}
+
+// qemuMemoryArg returns the -m argument, the VM's memory in whole MB and the
+// memory in MB it can be grown to with hotplug, which is zero if memory
+// hotplug isn't enabled. The memory comes from the task's memory resource
+// unless the memory option overrides it.
+func qemuMemoryArg(driverConfig *QemuDriverConfig, task *structs.Task) (string, int, int, error) {
+	// TODO: Check a lower bounds, e.g. the default 128 of Qemu
+	kb := uint64(task.Resources.MemoryMB) * 1024
+	if driverConfig.Memory != "" {
+		var err error
+		if kb, err = parseQemuMemory("memory", driverConfig.Memory); err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	mem := fmt.Sprintf("%dM", kb/1024)
+	if kb%1024 != 0 {
+		mem = fmt.Sprintf("%dK", kb)
+	}
+
+	// Reserve slots and address space for memory added by updates
+	if driverConfig.MemorySlots < 0 {
+		return "", 0, 0, fmt.Errorf("memory_slots must not be negative")
+	}
+	if (driverConfig.MaxMemory == "") != (driverConfig.MemorySlots == 0) {
+		return "", 0, 0, fmt.Errorf("max_memory and memory_slots must be set together")
+	}
+	if driverConfig.MaxMemory == "" {
+		return mem, int(kb / 1024), 0, nil
 	}
-
-	if !currentlyEnabled {
-		d.logger.Printf("[DEBUG] driver.qemu: enabling driver")
+	maxKB, err := parseQemuMemory("max_memory", driverConfig.MaxMemory)
+	if err != nil {
+		return "", 0, 0, err
 	}
-	node.Attributes[qemuDriverAttr] = "1"
-	node.Attributes["driver.qemu.version"] = matches[1]
-	return true, nil
+	if maxKB <= kb {
+		return "", 0, 0, fmt.Errorf("max_memory %q must be larger than the VM's memory", driverConfig.MaxMemory)
+	}
+	mem = fmt.Sprintf("%s,slots=%d,maxmem=%dM", mem, driverConfig.MemorySlots, maxKB/1024)
+	return mem, int(kb / 1024), int(maxKB / 1024), nil
 }
 
-// Run an existing Qemu image. Start() will pull down an existing, valid Qemu
-// image and save it to the Drivers Allocation Dir
-func (d *QemuDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
-	var driverConfig QemuDriverConfig
-	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
-		return nil, err
+// parseQemuMemory parses the memory size of the given option into KB
+func parseQemuMemory(option, value string) (uint64, error) {
+	matches := reQemuMemory.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("Invalid %s %q: must be a size such as \"512M\" or \"2G\"", option, value)
 	}
-
-	if len(driverConfig.PortMap) > 1 {
-		return nil, fmt.Errorf("Only one port_map block is allowed in the qemu driver config")
+	size, err := strconv.ParseUint(matches[1], 10, 32)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("Invalid %s %q: must be a positive size", option, value)
 	}
 
-	// Get the image source
-	vmPath := driverConfig.ImagePath
-	if vmPath == "" {
-		return nil, fmt.Errorf("image_path must be set")
+	switch strings.ToUpper(matches[2]) {
+	case "K":
+		return size, nil
+	case "G":
+		return size * 1024 * 1024, nil
+	case "T":
+		return size * 1024 * 1024 * 1024, nil
+	default:
+		return size * 1024, nil
 	}
-	vmID := filepath.Base(vmPath)
+}
 
-	// Get the tasks local directory.
-	taskDir, ok := ctx.AllocDir.TaskDirs[d.DriverContext.taskName]
-	if !ok {
-		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
+// qemuVCPUs returns the number of virtual CPUs to give a VM with the given CPU
+// resource in MHz, based on the node's per-core frequency. The count is
+// rounded up so that the VM can use all of its share, but never exceeds the
+// node's core count.
+func qemuVCPUs(cpuMHz int, node *structs.Node) int {
+	if node == nil {
+		return 1
 	}
-
-	// Parse configuration arguments
-	// Create the base arguments
-	accelerator := "tcg"
-	if driverConfig.Accelerator != "" {
-		accelerator = driverConfig.Accelerator
+	mhz, err := strconv.ParseFloat(node.Attributes["cpu.frequency"], 64)
+	if err != nil || mhz <= 0 {
+		return 1
 	}
-	// TODO: Check a lower bounds, e.g. the default 128 of Qemu
-	mem := fmt.Sprintf("%dM", task.Resources.MemoryMB)
 
-	absPath, err := GetAbsolutePath("qemu-system-x86_64")
-	if err != nil {
-		return nil, err
+	vcpus := int(math.Ceil(float64(cpuMHz) / mhz))
+	if cores, err := strconv.Atoi(node.Attributes["cpu.numcores"]); err == nil && cores > 0 && vcpus > cores {
+		vcpus = cores
 	}
-
-	args := []string{
-		absPath,
-		"-machine", "type=pc,accel=" + accelerator,
-		"-name", vmID,
-		"-m", mem,
-		"-drive", "file=" + vmPath,
-		"-nographic",
+	if vcpus < 1 {
+		vcpus = 1
 	}
+	return vcpus
+}
 
-	// Add pass through arguments to qemu executable. A user can specify
-	// these arguments in driver task configuration. These arguments are
-	// passed directly to the qemu driver as command line options.
-	// For example, args = [ "-nodefconfig", "-nodefaults" ]
-	// This will allow a VM with embedded configuration to boot successfully.
-	args = append(args, driverConfig.Args...)
+// qemuRTCArg returns the -rtc argument setting the guest's clock base and
+// source, or an empty string to keep Qemu's defaults.
+func qemuRTCArg(driverConfig *QemuDriverConfig) string {
+	var props []string
+	if driverConfig.RTCBase != "" {
+		props = append(props, "base="+driverConfig.RTCBase)
+	}
+	if driverConfig.RTCClock != "" {
+		props = append(props, "clock="+driverConfig.RTCClock)
+	}
+	return strings.Join(props, ",")
+}
 
-	// Check the Resources required Networks to add port mappings. If no resources
-	// are required, we assume the VM is a purely compute job and does not require
-	// the outside world to be able to reach it. VMs ran without port mappings can
-	// still reach out to the world, but without port mappings it is effectively
-	// firewalled
-	protocols := []string{"udp", "tcp"}
-	if len(task.Resources.Networks) > 0 && len(driverConfig.PortMap) == 1 {
-		// Loop through the port map and construct the hostfwd string, to map
-		// reserved ports to the ports listenting in the VM
-		// Ex: hostfwd=tcp::22000-:22,hostfwd=tcp::80-:8080
-		var forwarding []string
-		taskPorts := task.Resources.Networks[0].MapLabelToValues(nil)
-		for label, guest := range driverConfig.PortMap[0] {
-			host, ok := taskPorts[label]
-			if !ok {
-				return nil, fmt.Errorf("Unknown port label %q", label)
-			}
+// qemuCheckHostAccess returns an error if the config sets any of the options
+// giving the VM access to host resources outside of the task's directories, or
+// running commands on the host, which are disabled along with args. Data disk sources and the shared alloc
+// dir are confined to the task's directories and aren't checked. Devices the
+// scheduler assigns to the task aren't checked either, as the operator
+// grants them through the client's fingerprinted devices.
+func qemuCheckHostAccess(driverConfig *QemuDriverConfig) error {
+	if len(driverConfig.Args) != 0 {
+		return fmt.Errorf("Qemu args are disabled on this Nomad agent")
+	}
+	if driverConfig.RawDevice != "" {
+		return fmt.Errorf("Qemu raw_device is disabled on this Nomad agent along with args")
+	}
+	if len(driverConfig.PCIPassthrough) != 0 {
+		return fmt.Errorf("Qemu pci_passthrough is disabled on this Nomad agent along with args")
+	}
+	if len(driverConfig.PreStartCommand) != 0 {
+		return fmt.Errorf("Qemu pre_start_command is disabled on this Nomad agent along with args")
+	}
+	if len(driverConfig.PostStopCommand) != 0 {
+		return fmt.Errorf("Qemu post_stop_command is disabled on this Nomad agent along with args")
+	}
+	return nil
+}
 
-			for _, p := range protocols {
-				forwarding = append(forwarding, fmt.Sprintf("hostfwd=%s::%d-:%d", p, host, guest))
-			}
+// qemuPCIPassthroughArgs returns a vfio-pci device for each of the given host
+// PCI addresses.
+func qemuPCIPassthroughArgs(addrs []string) ([]string, error) {
+	var args []string
+	for _, addr := range addrs {
+		if !rePCIAddress.MatchString(addr) {
+			return nil, fmt.Errorf("Invalid PCI address %q in pci_passthrough: must be in [domain:]bus:slot.function form", addr)
 		}
+		args = append(args, "-device", "vfio-pci,host="+addr)
+	}
+	return args, nil
+}
 
-		if len(forwarding) != 0 {
-			args = append(args,
-				"-netdev",
-				fmt.Sprintf("user,id=user.0,%s", strings.Join(forwarding, ",")),
-				"-device", "virtio-net,netdev=user.0",
-			)
+// qemuProtectImage sets the permissions of the image. The image is never left
+// world-writable, is set to mode if given, and is write-protected on disk if
+// the guest never writes to it so neither the VM nor a stray host process can
+// corrupt a shared base image. A missing image is left for qemu to report
+// unless its permissions were explicitly configured.
+func qemuProtectImage(path string, mode *os.FileMode, writeProtect bool) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if mode == nil && !writeProtect {
+			return nil
 		}
+		return fmt.Errorf("failed to set image permissions: %v", err)
 	}
 
-	// If using KVM, add optimization args
-	if accelerator == "kvm" {
-		args = append(args,
-			"-enable-kvm",
-			"-cpu", "host",
-			// Do we have cores information available to the Driver?
-			// "-smp", fmt.Sprintf("%d", cores),
-		)
+	perm := fi.Mode().Perm() &^ 0002
+	if mode != nil {
+		perm = *mode
 	}
-
-	d.logger.Printf("[DEBUG] Starting QemuVM command: %q", strings.Join(args, " "))
-	bin, err := discover.NomadExecutable()
-	if err != nil {
-		return nil, fmt.Errorf("unable to find the nomad binary: %v", err)
+	if writeProtect {
+		perm &^= 0222
 	}
+	if perm == fi.Mode().Perm() {
+		return nil
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("failed to set image permissions: %v", err)
+	}
+	return nil
+}
 
-	pluginLogFile := filepath.Join(taskDir, fmt.Sprintf("%s-executor.out", task.Name))
-	pluginConfig := &plugin.ClientConfig{
-		Cmd: exec.Command(bin, "executor", pluginLogFile),
+// qemuRawDeviceArg returns the -drive argument attaching the host block device
+// or raw image at path as a virtio disk
+func qemuRawDeviceArg(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("raw_device %q must be an absolute path", path)
 	}
+	return fmt.Sprintf("file=%s,if=virtio,format=raw", qemuEscapeOption(path)), nil
+}
 
-	exec, pluginClient, err := createExecutor(pluginConfig, d.config.LogOutput, d.config)
+// qemuCheckRawDevice returns an error if the host block device or raw image at
+// path can't be attached to a VM by the driver
+func qemuCheckRawDevice(path string) error {
+	fi, err := os.Stat(path)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid raw_device: %v", err)
 	}
-	executorCtx := &executor.ExecutorContext{
-		TaskEnv:  d.taskEnv,
-		Driver:   "qemu",
-		AllocDir: ctx.AllocDir,
-		AllocID:  ctx.AllocID,
-		Task:     task,
+	if fi.IsDir() {
+		return fmt.Errorf("raw_device %q must be a block device or file, not a directory", path)
 	}
-	if err := exec.SetContext(executorCtx); err != nil {
-		pluginClient.Kill()
-		return nil, fmt.Errorf("failed to set executor context: %v", err)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("raw_device %q is not accessible: %v", path, err)
 	}
+	return f.Close()
+}
 
-	execCmd := &executor.ExecCommand{
-		Cmd:  args[0],
-		Args: args[1:],
-		User: task.User,
-	}
-	ps, err := exec.LaunchCmd(execCmd)
-	if err != nil {
-		pluginClient.Kill()
-		return nil, err
+// qemuConsoleArgs returns the arguments connecting the guest's serial console
+// to stdout, where it is captured by the task's logs as with -nographic, and
+// also writing it to the file at path. The file outlives log rotation, so the
+// guest's boot messages are kept. As the VM is always given a QMP monitor,
+// -nographic doesn't also claim stdio for the human monitor.
+func qemuConsoleArgs(path string) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("stdio,id=console0,signal=off,logfile=%s", qemuEscapeOption(path)),
+		"-serial", "chardev:console0",
 	}
-	d.logger.Printf("[INFO] Started new QemuVM: %s", vmID)
+}
 
-	// Create and Return Handle
-	maxKill := d.DriverContext.config.MaxKillTimeout
-	h := &qemuHandle{
-		pluginClient:   pluginClient,
-		executor:       exec,
-		userPid:        ps.Pid,
-		allocDir:       ctx.AllocDir,
-		killTimeout:    GetKillTimeout(task.KillTimeout, maxKill),
-		maxKillTimeout: maxKill,
-		version:        d.config.Version,
-		logger:         d.logger,
-		doneCh:         make(chan struct{}),
-		waitCh:         make(chan *dstructs.WaitResult, 1),
+// qemuShareArgs returns the arguments exporting the host directory at path to
+// the guest as a virtio-9p share the guest mounts by its tag. Files are
+// created with the permissions of the qemu process, so that other tasks can
+// access what the guest writes.
+func qemuShareArgs(path, tag string) []string {
+	return []string{
+		"-fsdev", fmt.Sprintf("local,id=fs-%s,path=%s,security_model=none", tag, qemuEscapeOption(path)),
+		"-device", fmt.Sprintf("virtio-9p-pci,fsdev=fs-%s,mount_tag=%s", tag, tag),
 	}
+}
 
-	if err := h.executor.SyncServices(consulContext(d.config, "")); err != nil {
-		h.logger.Printf("[ERR] driver.qemu: error registering services for task: %q: %v", task.Name, err)
+// qemuDriveArg returns the -drive argument attaching the image.
+func qemuDriveArg(vmPath string, driverConfig *QemuDriverConfig) string {
+	drive := "file=" + qemuEscapeOption(vmPath)
+	if driverConfig.DiskFormat != "" {
+		drive += ",format=" + driverConfig.DiskFormat
 	}
-	go h.run()
-	return h, nil
+	if driverConfig.Snapshot {
+		drive += ",snapshot=on"
+	}
+	if driverConfig.ReadOnly {
+		drive += ",readonly=on"
+	}
+	return drive
+}
+
+// qemuEscapeOption escapes a value, such as a path, for use as a property of
+// an option like -drive, -chardev or -netdev. Commas separate the properties
+// and are escaped by doubling them.
+func qemuEscapeOption(value string) string {
+	return strings.Replace(value, ",", ",,", -1)
 }
 
 type qemuId struct {
 	Version        string
+	VmID           string
+	QMPSocketPath  string
+	AgentPath      string
+	TapDevice      string
+	GuestAddress   string
+	Display        *qemuDisplay
+	PostStopHook   *qemuHook
+	Balloon        bool
+	MemoryMB       int
+	MaxMemoryMB    int
+	MemorySlots    int
+	UsedSlots      int
+	HealthCheck    *qemuHealthCheck
+	SaveState      bool
+	StartTime      time.Time
 	KillTimeout    time.Duration
 	MaxKillTimeout time.Duration
 	UserPid        int
@@ -312,6 +2038,16 @@ func (d *QemuDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 		Reattach: id.PluginConfig.PluginConfig(),
 	}
 
+	// After the host has been restarted the PIDs of the handle may have been
+	// reused by unrelated processes, which must neither be adopted nor killed
+	if err := qemuVerifyProcess(id.UserPid, id.QMPSocketPath, id.StartTime); err != nil {
+		// An executor that can still be reached belongs to the VM
+		if _, pluginClient, e := createExecutor(pluginConfig, d.config.LogOutput, d.config); e == nil {
+			pluginClient.Kill()
+		}
+		return nil, structs.NewRecoverableError(fmt.Errorf("VM %s is no longer running: %v", id.VmID, err), true)
+	}
+
 	exec, pluginClient, err := createExecutor(pluginConfig, d.config.LogOutput, d.config)
 	if err != nil {
 		d.logger.Println("[ERR] driver.qemu: error connecting to plugin so destroying plugin pid and user pid")
@@ -333,20 +2069,86 @@ func (d *QemuDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 		killTimeout:    id.KillTimeout,
 		maxKillTimeout: id.MaxKillTimeout,
 		version:        id.Version,
+		vmID:           id.VmID,
+		qmpPath:        id.QMPSocketPath,
+		agentPath:      id.AgentPath,
+		tapDevice:      id.TapDevice,
+		guestAddress:   id.GuestAddress,
+		display:        id.Display,
+		postStop:       id.PostStopHook,
+		balloon:        id.Balloon,
+		memoryMB:       id.MemoryMB,
+		maxMemoryMB:    id.MaxMemoryMB,
+		memorySlots:    id.MemorySlots,
+		usedSlots:      id.UsedSlots,
+		healthCheck:    id.HealthCheck,
+		saveState:      id.SaveState,
+		startTime:      id.StartTime,
+		taskName:       d.taskName,
+		eventSink:      d.eventSink,
 		doneCh:         make(chan struct{}),
 		waitCh:         make(chan *dstructs.WaitResult, 1),
 	}
-	if err := h.executor.SyncServices(consulContext(d.config, "")); err != nil {
+	if err := h.executor.SyncServices(h.consulContext(d.config)); err != nil {
 		h.logger.Printf("[ERR] driver.qemu: error registering services: %v", err)
 	}
+	// Handles created before the start time was recorded recover it from the
+	// process
+	if h.startTime.IsZero() {
+		if start, err := processStartTime(id.UserPid); err != nil {
+			d.logger.Printf("[WARN] driver.qemu: failed to determine start time of VM %s: %v", id.VmID, err)
+		} else {
+			h.startTime = start
+		}
+	}
+	if h.postStop != nil && d.taskEnv != nil {
+		h.postStop.Env = qemuHookEnv(d.taskEnv)
+	}
+	// The VM is left paused if its state was saved as the client shut down
+	if h.saveState {
+		if err := h.resumeSuspended(); err != nil {
+			d.logger.Printf("[ERR] driver.qemu: failed to resume VM %s: %v", id.VmID, err)
+		}
+	}
 	go h.run()
+	if h.healthCheck != nil {
+		go h.watchHealth()
+	}
 	return h, nil
 }
 
+// consulContext returns the context the VM's services are registered with.
+// Services of a VM with a static address are registered with the guest's
+// address rather than the host's.
+func (h *qemuHandle) consulContext(cfg *config.Config) *executor.ConsulContext {
+	ctx := consulContext(cfg, "")
+	ctx.ServiceAddress = h.guestAddress
+	return ctx
+}
+
 func (h *qemuHandle) ID() string {
+	h.updateLock.Lock()
+	killTimeout, memoryMB, usedSlots := h.killTimeout, h.memoryMB, h.usedSlots
+	h.updateLock.Unlock()
+
 	id := qemuId{
 		Version:        h.version,
-		KillTimeout:    h.killTimeout,
+		VmID:           h.vmID,
+		QMPSocketPath:  h.qmpPath,
+		AgentPath:      h.agentPath,
+		TapDevice:      h.tapDevice,
+		GuestAddress:   h.guestAddress,
+		Display:        h.display,
+		PostStopHook:   h.postStop,
+		Balloon:        h.balloon,
+		MemoryMB:       memoryMB,
+		MaxMemoryMB:    h.maxMemoryMB,
+		MemorySlots:    h.memorySlots,
+		UsedSlots:      usedSlots,
+		HealthCheck:    h.healthCheck,
+		SaveState:      h.saveState,
+		StartTime:      h.startTime,
+		KillTimeout:    killTimeout,
 		MaxKillTimeout: h.maxKillTimeout,
 		PluginConfig:   NewPluginReattachConfig(h.pluginClient.ReattachConfig()),
 		UserPid:        h.userPid,
@@ -365,22 +2167,165 @@ func (h *qemuHandle) WaitCh() chan *dstructs.WaitResult {
 }
 
 func (h *qemuHandle) Update(task *structs.Task) error {
+	// The fields updated are read by ID while the update runs
+	h.updateLock.Lock()
+	defer h.updateLock.Unlock()
+
 	// Store the updated kill timeout.
 	h.killTimeout = GetKillTimeout(task.KillTimeout, h.maxKillTimeout)
 	h.executor.UpdateTask(task)
 
-	// Update is not possible
+	if task.Resources == nil {
+		return nil
+	}
+	target := task.Resources.MemoryMB
+
+	// Memory is grown by hotplugging it, if slots were reserved for it, and can
+	// be shrunk by inflating the balloon
+	if target > h.memoryMB && h.maxMemoryMB != 0 {
+		if err := h.hotplugMemory(target - h.memoryMB); err != nil {
+			return err
+		}
+	}
+	if !h.balloon {
+		return nil
+	}
+	return h.setBalloon(target)
+}
+
+// getKillTimeout returns the kill timeout, which Update may change while the
+// VM is killed by its health check
+func (h *qemuHandle) getKillTimeout() time.Duration {
+	h.updateLock.Lock()
+	defer h.updateLock.Unlock()
+	return h.killTimeout
+}
+
+// hotplugMemory adds a DIMM of sizeMB to the VM using one of its reserved
+// memory slots. It must be called with the updateLock held.
+func (h *qemuHandle) hotplugMemory(sizeMB int) error {
+	if h.memoryMB+sizeMB > h.maxMemoryMB {
+		return fmt.Errorf("memory of VM %s can't be grown to %d MB, beyond its max_memory of %d MB",
+			h.vmID, h.memoryMB+sizeMB, h.maxMemoryMB)
+	}
+	if h.usedSlots >= h.memorySlots {
+		return fmt.Errorf("memory of VM %s can't be grown, all %d memory_slots are used", h.vmID, h.memorySlots)
+	}
+
+	// The properties of objects are nested in props in the QMP versions the
+	// driver supports
+	memdev := fmt.Sprintf("nomad-mem%d", h.usedSlots)
+	backend := map[string]interface{}{
+		"qom-type": "memory-backend-ram",
+		"id":       memdev,
+		"props":    map[string]interface{}{"size": int64(sizeMB) * 1024 * 1024},
+	}
+	if err := qmpExecute(h.qmpPath, "object_add", backend, nil); err != nil {
+		return fmt.Errorf("failed to add memory to VM %s: %v", h.vmID, err)
+	}
+
+	dimm := map[string]interface{}{
+		"driver": "pc-dimm",
+		"id":     fmt.Sprintf("nomad-dimm%d", h.usedSlots),
+		"memdev": memdev,
+	}
+	if err := qmpExecute(h.qmpPath, "device_add", dimm, nil); err != nil {
+		if e := qmpExecute(h.qmpPath, "object_del", map[string]interface{}{"id": memdev}, nil); e != nil {
+			h.logger.Printf("[ERR] driver.qemu: failed to remove unused memory of VM %s: %v", h.vmID, e)
+		}
+		return fmt.Errorf("failed to add memory to VM %s: %v", h.vmID, err)
+	}
+
+	h.usedSlots++
+	h.memoryMB += sizeMB
+	return nil
+}
+
+// setBalloon inflates or deflates the balloon so that the guest has memoryMB
+// of memory available. It must be called with the updateLock held.
+func (h *qemuHandle) setBalloon(memoryMB int) error {
+	if memoryMB <= 0 {
+		return fmt.Errorf("invalid memory target of %d MB", memoryMB)
+	}
+	if memoryMB > h.memoryMB {
+		return fmt.Errorf("memory of VM %s can't be grown to %d MB, beyond the %d MB plugged into it",
+			h.vmID, memoryMB, h.memoryMB)
+	}
+
+	args := map[string]interface{}{"value": int64(memoryMB) * 1024 * 1024}
+	if err := qmpExecute(h.qmpPath, "balloon", args, nil); err != nil {
+		return fmt.Errorf("failed to resize memory of VM %s: %v", h.vmID, err)
+	}
 	return nil
 }
 
+// Signal forwards the signal to the qemu process, e.g. SIGHUP for tooling that
+// reacts to it.
 func (h *qemuHandle) Signal(s os.Signal) error {
-	return fmt.Errorf("Qemu driver can't send signals")
+	// Only syscall signals can be sent to the executor
+	sig, ok := s.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", s)
+	}
+
+	select {
+	case <-h.doneCh:
+		return fmt.Errorf("qemu process has already exited")
+	default:
+	}
+
+	if cmd, ok := qemuSignalCommands[sig]; ok && h.qmpPath != "" {
+		if err := qmpExecute(h.qmpPath, cmd, nil, nil); err != nil {
+			return fmt.Errorf("failed to translate %v to %s: %v", sig, cmd, err)
+		}
+		return nil
+	}
+	return h.executor.Signal(sig)
 }
 
-// TODO: allow a 'shutdown_command' that can be executed over a ssh connection
-// to the VM
+// Kill asks the guest to power down through the QMP monitor, so that it can
+// flush its disks, and kills the VM if it hasn't shut down within the kill
+// timeout. The powerdown and the kill share the kill timeout, so the VM is
+// gone within it, but the qemu process is always left part of the timeout to
+// exit before the executor is told to exit as well.
 func (h *qemuHandle) Kill() error {
-	if err := h.executor.ShutDown(); err != nil {
+	if h.qmpPath == "" {
+		return h.kill(h.getKillTimeout())
+	}
+
+	powerdown, grace := qemuSplitKillTimeout(h.getKillTimeout())
+	if h.powerdown(powerdown) {
+		return nil
+	}
+	h.logger.Printf("[WARN] driver.qemu: VM %s did not shut down within %v, killing it", h.vmID, powerdown)
+	return h.kill(grace)
+}
+
+// qemuSplitKillTimeout splits the kill timeout into the time the guest is
+// given to power down and the time the qemu process is then given to exit
+// once interrupted. The qemu process gets qemuKillGrace, or half the timeout
+// if it is shorter than twice that.
+func qemuSplitKillTimeout(timeout time.Duration) (powerdown, grace time.Duration) {
+	grace = qemuKillGrace
+	if grace > timeout/2 {
+		grace = timeout / 2
+	}
+	return timeout - grace, grace
+}
+
+// kill stops the qemu process without giving the guest a chance to shut down.
+// The executor is told to exit if qemu hasn't stopped within the timeout.
+func (h *qemuHandle) kill(timeout time.Duration) error {
+	// Processes can't be interrupted on Windows, so qemu is terminated right
+	// away and the executor is told to exit if that fails
+	if runtime.GOOS == "windows" {
+		if err := qemuTerminate(h.userPid); err != nil {
+			h.logger.Printf("[WARN] driver.qemu: failed to terminate VM %s: %v", h.vmID, err)
+			if err := h.executor.Exit(); err != nil {
+				return fmt.Errorf("executor Exit failed: %v", err)
+			}
+		}
+	} else if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
 			return nil
 		}
@@ -390,7 +2335,7 @@ func (h *qemuHandle) Kill() error {
 	select {
 	case <-h.doneCh:
 		return nil
-	case <-time.After(h.killTimeout):
+	case <-time.After(timeout):
 		if h.pluginClient.Exited() {
 			return nil
 		}
@@ -402,8 +2347,169 @@ func (h *qemuHandle) Kill() error {
 	}
 }
 
+// Shutdown asks the guest to power down through the QMP monitor and waits up
+// to the timeout for it to do so, either by the qemu process exiting or the
+// monitor reporting the shutdown state. Unlike Kill, a nil error confirms the
+// guest shut down cleanly. If the guest doesn't shut down in time the VM is
+// killed and an error is returned.
+func (h *qemuHandle) Shutdown(timeout time.Duration) error {
+	// Handles created before the QMP monitor was added can't request a
+	// powerdown
+	if h.qmpPath == "" {
+		h.logger.Printf("[WARN] driver.qemu: VM %s has no QMP monitor, killing it instead of shutting it down", h.vmID)
+		return h.kill(h.getKillTimeout())
+	}
+
+	if h.powerdown(timeout) {
+		return nil
+	}
+	if err := h.kill(h.getKillTimeout()); err != nil {
+		return fmt.Errorf("VM did not shut down within %v and killing it failed: %v", timeout, err)
+	}
+	return fmt.Errorf("VM did not shut down within %v and was killed", timeout)
+}
+
+// powerdown requests the guest to power down through the QMP monitor and
+// returns whether the VM shut down within the timeout. It returns false right
+// away if the request couldn't be made.
+func (h *qemuHandle) powerdown(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	if h.agentPath != "" {
+		h.syncGuest()
+	}
+	if err := qmpExecute(h.qmpPath, "system_powerdown", nil, nil); err != nil {
+		h.logger.Printf("[WARN] driver.qemu: failed to request powerdown of VM %s: %v", h.vmID, err)
+		return false
+	}
+
+	for {
+		select {
+		case <-h.doneCh:
+			return true
+		case <-deadline:
+			return false
+		case <-time.After(qemuShutdownPollInterval):
+		}
+
+		// A VM started with -no-shutdown stays around after the guest powers
+		// off, so stop it once the guest is down.
+		if status, err := h.QueryStatus(); err == nil && status == "shutdown" {
+			if err := qmpExecute(h.qmpPath, "quit", nil, nil); err != nil {
+				h.logger.Printf("[WARN] driver.qemu: failed to quit VM %s after shutdown: %v", h.vmID, err)
+			}
+		}
+	}
+}
+
+// syncGuest flushes the guest's filesystems through the guest agent by
+// freezing and thawing them, so that no writes are lost if the guest doesn't
+// shut down cleanly. Failures are only logged as the agent may not be running.
+func (h *qemuHandle) syncGuest() {
+	if err := h.GuestAgent("guest-fsfreeze-freeze", nil, nil); err != nil {
+		h.logger.Printf("[WARN] driver.qemu: failed to sync filesystems of VM %s: %v", h.vmID, err)
+		return
+	}
+	if err := h.GuestAgent("guest-fsfreeze-thaw", nil, nil); err != nil {
+		h.logger.Printf("[ERR] driver.qemu: failed to thaw filesystems of VM %s: %v", h.vmID, err)
+	}
+}
+
+// GuestAgent runs a qemu-guest-agent command in the guest and decodes its
+// return value into result, if result is non-nil. The VM must have been
+// started with guest_agent set.
+func (h *qemuHandle) GuestAgent(command string, args interface{}, result interface{}) error {
+	return qgaExecute(h.agentPath, command, args, result)
+}
+
+// Exec runs the command in the guest through the guest agent. The VM must have
+// been started with guest_agent set, and the guest must be running
+// qemu-guest-agent 2.5 or later.
+func (h *qemuHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return guestExec(h.agentPath, cmd, args)
+}
+
+// GuestAddresses returns the IP addresses of the guest's network interfaces
+// as reported by the guest agent, keyed by interface name.
+func (h *qemuHandle) GuestAddresses() (map[string]string, error) {
+	return guestAddresses(h.agentPath)
+}
+
+// reportGuestAddresses waits for the guest agent to report the guest's IP
+// addresses and emits them as an event.
+func (h *qemuHandle) reportGuestAddresses() {
+	addrs := waitForGuestAddresses(h.agentPath, qemuProbeInterval, h.doneCh)
+	if addrs == nil {
+		return
+	}
+	h.logger.Printf("[DEBUG] driver.qemu: VM %s has addresses %v", h.vmID, addrs)
+	emitDriverEvent(h.eventSink, h.taskName, qemuEventGuestAddresses, addrs)
+}
+
+// StartTime returns when the qemu process was started, or the zero time if it
+// couldn't be determined for a reopened handle.
+func (h *qemuHandle) StartTime() time.Time {
+	return h.startTime
+}
+
+// Uptime returns how long the qemu process has been running
+func (h *qemuHandle) Uptime() time.Duration {
+	if h.startTime.IsZero() {
+		return 0
+	}
+	return time.Since(h.startTime)
+}
+
+// QueryStatus returns the run state of the VM as reported by Qemu, e.g.
+// "running", "paused" or "shutdown".
+func (h *qemuHandle) QueryStatus() (string, error) {
+	var status qmpStatus
+	if err := qmpExecute(h.qmpPath, "query-status", nil, &status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// Stats returns the resource usage of the qemu process. The memory in use by
+// the guest is added if it is reported through the balloon device.
 func (h *qemuHandle) Stats() (*cstructs.TaskResourceUsage, error) {
-	return h.executor.Stats()
+	ru, err := h.executor.Stats()
+	if err != nil || !h.balloon || ru.ResourceUsage == nil || ru.ResourceUsage.MemoryStats == nil {
+		return ru, err
+	}
+
+	usage, ok, err := h.guestMemoryUsage()
+	if err != nil {
+		h.logger.Printf("[DEBUG] driver.qemu: failed to get guest memory stats of VM %s: %v", h.vmID, err)
+		return ru, nil
+	}
+	if ok {
+		ms := ru.ResourceUsage.MemoryStats
+		ms.GuestUsage = usage
+		ms.Measured = append(append([]string{}, ms.Measured...), QemuMeasuredGuestMemStats...)
+	}
+	return ru, nil
+}
+
+// watchHealth runs the health check until the VM exits, and restarts the VM
+// by killing it once the guest is unhealthy.
+func (h *qemuHandle) watchHealth() {
+	check := h.healthCheck
+	err := watchHealth(check.probe(h.qmpPath), check.Interval, check.Failures, h.startTime.Add(check.Grace), h.doneCh)
+	if err == nil {
+		return
+	}
+
+	h.healthLock.Lock()
+	if h.suspended {
+		h.healthLock.Unlock()
+		return
+	}
+	h.logger.Printf("[ERR] driver.qemu: VM %s is unhealthy, killing it: %v", h.vmID, err)
+	h.healthErr = fmt.Errorf("VM failed its health check: %v", err)
+	h.healthLock.Unlock()
+	if err := h.Kill(); err != nil {
+		h.logger.Printf("[ERR] driver.qemu: failed to kill unhealthy VM %s: %v", h.vmID, err)
+	}
 }
 
 func (h *qemuHandle) run() {
@@ -417,6 +2523,32 @@ func (h *qemuHandle) run() {
 		}
 	}
 	close(h.doneCh)
+
+	// Clean up after the VM before reporting it as exited, so a restarted
+	// task doesn't race the cleanup
+	if h.tapDevice != "" {
+		if err := deleteTap(h.tapDevice); err != nil {
+			h.logger.Printf("[ERR] driver.qemu: failed to remove tap device %s of VM %s: %v", h.tapDevice, h.vmID, err)
+		}
+	}
+	if err := qemuRemoveSocketDir(h.qmpPath); err != nil {
+		h.logger.Printf("[ERR] driver.qemu: failed to remove socket directory of VM %s: %v", h.vmID, err)
+	}
+	if h.postStop != nil {
+		if err := h.postStop.run(); err != nil {
+			h.logger.Printf("[ERR] driver.qemu: post_stop_command for VM %s failed: %v", h.vmID, err)
+		}
+	}
+	emitDriverEvent(h.eventSink, h.taskName, DriverEventProcessExited, map[string]string{
+		"vm_id":     h.vmID,
+		"exit_code": strconv.Itoa(ps.ExitCode),
+		"signal":    strconv.Itoa(ps.Signal),
+	})
+	h.healthLock.Lock()
+	if h.healthErr != nil {
+		err = h.healthErr
+	}
+	h.healthLock.Unlock()
 	h.waitCh <- &dstructs.WaitResult{ExitCode: ps.ExitCode, Signal: ps.Signal, Err: err}
 	close(h.waitCh)
 	// Remove services
@@ -0,0 +1,192 @@
+package driver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
+)
+
+const (
+	// qemuAgentSocket is the name of the unix socket in the task directory
+	// the qemu-guest-agent channel is exposed on. On Windows the channel is
+	// exposed on a loopback TCP port picked by qemu instead.
+	qemuAgentSocket = "qga.sock"
+
+	// qemuAgentChardev is the id of the chardev the guest agent channel is
+	// exposed on
+	qemuAgentChardev = "qga0"
+
+	// qemuAgentName is the virtio-serial port name qemu-guest-agent listens on
+	// in the guest
+	qemuAgentName = "org.qemu.guest_agent.0"
+
+	// qemuEventGuestAddresses is emitted once the guest agent reports the
+	// guest's IP addresses
+	qemuEventGuestAddresses = "Guest Addresses"
+
+	// qemuExecTimeout is how long commands run in the guest may run before
+	// Nomad stops waiting for them
+	qemuExecTimeout = 30 * time.Second
+
+	// qemuExecPollInterval is the interval at which commands run in the guest
+	// are checked for having exited
+	qemuExecPollInterval = 100 * time.Millisecond
+)
+
+// qemuAgentArgs returns the arguments attaching a qemu-guest-agent channel
+// that is exposed on the unix socket at path.
+func qemuAgentArgs(path string) []string {
+	return []string{
+		"-chardev", qemuChardevSocket(path) + ",id=" + qemuAgentChardev,
+		"-device", "virtio-serial",
+		"-device", fmt.Sprintf("virtserialport,chardev=%s,name=%s", qemuAgentChardev, qemuAgentName),
+	}
+}
+
+// qgaExecute connects to the guest agent at path, runs a single command and
+// disconnects. The agent speaks the same protocol as the QMP monitor but
+// doesn't greet clients, and may still hold a response meant for a previous
+// client, so the connection is synchronized with guest-sync first.
+func qgaExecute(path, command string, args interface{}, result interface{}) error {
+	if path == "" {
+		return fmt.Errorf("VM has no guest agent")
+	}
+
+	conn, err := dialQemuSocket(path, qmpTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to guest agent: %v", err)
+	}
+	c := &qmpClient{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+	defer c.Close()
+
+	id := rand.Int63()
+	var synced int64
+	if err := c.execute("guest-sync", map[string]interface{}{"id": id}, &synced); err != nil {
+		return err
+	}
+	if synced != id {
+		return fmt.Errorf("guest agent out of sync")
+	}
+	return c.execute(command, args, result)
+}
+
+// qgaInterface is a network interface as reported by the
+// guest-network-get-interfaces command
+type qgaInterface struct {
+	Name        string `json:"name"`
+	IPAddresses []struct {
+		Address string `json:"ip-address"`
+	} `json:"ip-addresses"`
+}
+
+// guestAddresses returns the IP addresses of the guest's network interfaces,
+// keyed by interface name. Loopback addresses are left out.
+func guestAddresses(path string) (map[string]string, error) {
+	var ifaces []qgaInterface
+	if err := qgaExecute(path, "guest-network-get-interfaces", nil, &ifaces); err != nil {
+		return nil, err
+	}
+
+	addrs := make(map[string]string)
+	for _, iface := range ifaces {
+		var ips []string
+		for _, a := range iface.IPAddresses {
+			if ip := net.ParseIP(a.Address); ip != nil && !ip.IsLoopback() {
+				ips = append(ips, a.Address)
+			}
+		}
+		if len(ips) != 0 {
+			sort.Strings(ips)
+			addrs[iface.Name] = strings.Join(ips, ",")
+		}
+	}
+	return addrs, nil
+}
+
+// waitForGuestAddresses polls the guest agent at path every interval until it
+// reports at least one address, which is returned. It returns nil once doneCh
+// is closed.
+func waitForGuestAddresses(path string, interval time.Duration, doneCh <-chan struct{}) map[string]string {
+	for {
+		if addrs, err := guestAddresses(path); err == nil && len(addrs) != 0 {
+			return addrs
+		}
+
+		select {
+		case <-doneCh:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// qgaExecStatus is the status of a command started with guest-exec, as
+// reported by the guest-exec-status command. The output is base64 encoded.
+type qgaExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+// guestExec runs a command in the guest through the guest agent at path and
+// waits for it to exit. The agent only hands out the command's output once it
+// has exited, so the stdout and stderr of the command are concatenated.
+func guestExec(path, cmd string, args []string) (*dstructs.ExecResult, error) {
+	var started struct {
+		Pid int `json:"pid"`
+	}
+	execArgs := map[string]interface{}{
+		"path":           cmd,
+		"arg":            args,
+		"capture-output": true,
+	}
+	if err := qgaExecute(path, "guest-exec", execArgs, &started); err != nil {
+		return nil, err
+	}
+
+	deadline := time.After(qemuExecTimeout)
+	for {
+		var status qgaExecStatus
+		if err := qgaExecute(path, "guest-exec-status", map[string]interface{}{"pid": started.Pid}, &status); err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			var output []byte
+			for _, data := range []string{status.OutData, status.ErrData} {
+				decoded, err := base64.StdEncoding.DecodeString(data)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decode output of guest command: %v", err)
+				}
+				output = append(output, decoded...)
+			}
+			if len(output) > dstructs.ExecBufSize {
+				output = output[len(output)-dstructs.ExecBufSize:]
+			}
+
+			res := &dstructs.ExecResult{ExitCode: status.ExitCode, Output: string(output)}
+			if status.Signal != 0 {
+				res.ExitCode = 128 + status.Signal
+			}
+			return res, nil
+		}
+
+		select {
+		case <-deadline:
+			return nil, fmt.Errorf("command did not exit within %v", qemuExecTimeout)
+		case <-time.After(qemuExecPollInterval):
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// qemuSeedDir is the directory inside the task directory in which the
+	// cloud-init NoCloud files are staged before being written to the seed ISO.
+	qemuSeedDir = "cloud-init"
+
+	// qemuSeedISO is the name of the generated cloud-init seed ISO.
+	qemuSeedISO = "seed.iso"
+)
+
+// qemuSeedISOTools are the binaries, in order of preference, that can be used
+// to generate the cloud-init seed ISO.
+var qemuSeedISOTools = []string{"genisoimage", "mkisofs"}
+
+// qemuUserDataContext is the data user_data templates are rendered against.
+type qemuUserDataContext struct {
+	AllocID    string
+	AllocName  string
+	AllocIndex string
+	JobName    string
+	TaskName   string
+	NodeID     string
+	NodeName   string
+	Env        map[string]string
+	Meta       map[string]string
+}
+
+// newQemuUserDataContext builds the user_data template context for the task.
+func newQemuUserDataContext(ctx *ExecContext, task *structs.Task, node *structs.Node,
+	taskEnv *env.TaskEnvironment) *qemuUserDataContext {
+
+	data := &qemuUserDataContext{
+		AllocID:  ctx.AllocID,
+		TaskName: task.Name,
+		Env:      map[string]string{},
+		Meta:     map[string]string{},
+	}
+	for k, v := range task.Meta {
+		data.Meta[k] = v
+	}
+	if taskEnv != nil {
+		data.Env = taskEnv.Build().EnvMap()
+		data.AllocName = data.Env[env.AllocName]
+		data.AllocIndex = data.Env[env.AllocIndex]
+		data.JobName = data.Env[env.JobName]
+	}
+	if node != nil {
+		data.NodeID = node.ID
+		data.NodeName = node.Name
+	}
+	return data
+}
+
+// renderUserData renders the user_data template against the given context.
+// Referencing a field or key that doesn't exist is an error.
+func renderUserData(userData string, data *qemuUserDataContext) ([]byte, error) {
+	tmpl, err := template.New("user_data").Option("missingkey=error").Parse(userData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse user_data template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render user_data template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// qemuSeedFiles returns the cloud-init NoCloud user-data and meta-data files
+// for the task. The meta-data grants the configured SSH keys to the image's
+// default user, which allows simple images to be accessed without a full
+// user-data config. Keys set in meta_data are added to the meta-data and may
+// override the default instance-id and local-hostname.
+func qemuSeedFiles(driverConfig *QemuDriverConfig, data *qemuUserDataContext) (map[string][]byte, error) {
+	userData := []byte("#cloud-config\n")
+	if driverConfig.UserData != "" {
+		rendered, err := renderUserData(driverConfig.UserData, data)
+		if err != nil {
+			return nil, err
+		}
+		userData = rendered
+	}
+
+	meta := map[string]string{
+		"instance-id":    data.AllocID,
+		"local-hostname": data.TaskName,
+	}
+	for k, v := range mapMergeStrStr(driverConfig.MetaData...) {
+		if k == "" || strings.ContainsAny(k, ":\n") {
+			return nil, fmt.Errorf("Invalid meta_data key %q", k)
+		}
+		if k == "public-keys" {
+			return nil, fmt.Errorf("meta_data must not set public-keys, use ssh_keys instead")
+		}
+		meta[k] = v
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var metaData bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&metaData, "%s: %q\n", k, meta[k])
+	}
+	if len(driverConfig.SSHKeys) != 0 {
+		metaData.WriteString("public-keys:\n")
+		for _, key := range driverConfig.SSHKeys {
+			fmt.Fprintf(&metaData, "  - %q\n", strings.TrimSpace(key))
+		}
+	}
+
+	return map[string][]byte{
+		"user-data": userData,
+		"meta-data": metaData.Bytes(),
+	}, nil
+}
+
+// createSeedISO writes the given cloud-init NoCloud files into the task
+// directory and packs them into an ISO with the "cidata" volume label so that
+// cloud-init picks them up on boot. It returns the path to the ISO.
+func createSeedISO(taskDir string, files map[string][]byte) (string, error) {
+	seedDir := filepath.Join(taskDir, qemuSeedDir)
+	if err := os.MkdirAll(seedDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cloud-init directory: %v", err)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{"-output", filepath.Join(taskDir, qemuSeedISO), "-volid", "cidata", "-joliet", "-rock"}
+	for _, name := range names {
+		path := filepath.Join(seedDir, name)
+		if err := ioutil.WriteFile(path, files[name], 0644); err != nil {
+			return "", fmt.Errorf("failed to write cloud-init %s: %v", name, err)
+		}
+		args = append(args, path)
+	}
+
+	var tool string
+	for _, t := range qemuSeedISOTools {
+		if path, err := exec.LookPath(t); err == nil {
+			tool = path
+			break
+		}
+	}
+	if tool == "" {
+		return "", fmt.Errorf("unable to create seed ISO: none of %v found", qemuSeedISOTools)
+	}
+
+	if out, err := exec.Command(tool, args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create seed ISO: %v: %s", err, out)
+	}
+	return filepath.Join(taskDir, qemuSeedISO), nil
+}
@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// qemuPinningTimeout bounds waiting for the QMP monitor to report the
+	// VM's vCPU threads so they can be pinned
+	qemuPinningTimeout = 30 * time.Second
+)
+
+// qemuValidatePinning returns an error if the host cores vCPUs are pinned to
+// aren't distinct cores of the host, which has numCPU of them.
+func qemuValidatePinning(cores []int, numCPU int) error {
+	seen := make(map[int]struct{}, len(cores))
+	for _, core := range cores {
+		if core < 0 || core >= numCPU {
+			return fmt.Errorf("Invalid cpu_pinning core %d: the host has %d cores", core, numCPU)
+		}
+		if _, ok := seen[core]; ok {
+			return fmt.Errorf("Invalid cpu_pinning: core %d is listed more than once", core)
+		}
+		seen[core] = struct{}{}
+	}
+	return nil
+}
+
+// qmpCPU is a vCPU as reported by the query-cpus command. Newer versions of
+// Qemu report the thread in thread-id.
+type qmpCPU struct {
+	CPU          int `json:"CPU"`
+	ThreadID     int `json:"thread_id"`
+	FastThreadID int `json:"thread-id"`
+	FastIndex    int `json:"cpu-index"`
+}
+
+// qemuVCPUThreads returns the host thread IDs of the VM's vCPUs, in vCPU
+// order, as reported by the QMP monitor at path.
+func qemuVCPUThreads(path string) ([]int, error) {
+	var cpus []qmpCPU
+	if err := qmpExecute(path, "query-cpus-fast", nil, &cpus); err != nil {
+		cpus = nil
+		if err := qmpExecute(path, "query-cpus", nil, &cpus); err != nil {
+			return nil, err
+		}
+	}
+
+	threads := make(map[int]int, len(cpus))
+	indexes := make([]int, 0, len(cpus))
+	for _, cpu := range cpus {
+		index, tid := cpu.CPU, cpu.ThreadID
+		if tid == 0 {
+			index, tid = cpu.FastIndex, cpu.FastThreadID
+		}
+		threads[index] = tid
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	tids := make([]int, len(indexes))
+	for i, index := range indexes {
+		tids[i] = threads[index]
+	}
+	return tids, nil
+}
+
+// pinVCPUs pins each of the VM's vCPU threads to its own host core, in the
+// order the cores are given. The monitor at path is retried until it is up,
+// giving up once the timeout elapses or doneCh is closed.
+func pinVCPUs(path string, cores []int, timeout time.Duration, doneCh <-chan struct{}) error {
+	probe := func() error {
+		tids, err := qemuVCPUThreads(path)
+		if err != nil {
+			return err
+		}
+		if len(tids) != len(cores) {
+			return fmt.Errorf("VM has %d vCPUs, expected %d", len(tids), len(cores))
+		}
+		for i, tid := range tids {
+			if err := setAffinity(tid, []int{cores[i]}); err != nil {
+				return fmt.Errorf("failed to pin vCPU %d to core %d: %v", i, cores[i], err)
+			}
+		}
+		return nil
+	}
+	return waitForReady(probe, timeout, qemuProbeInterval, doneCh)
+}
+
+// parseCPUList parses a list of CPUs such as "0-3,6" into its CPUs
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// qemuNUMAArgs returns the arguments laying out the guest's NUMA nodes. Every
+// vCPU of the VM must be assigned to exactly one node, and the memory of the
+// nodes must add up to the VM's memory. A node's memory is bound to a host
+// NUMA node if the node sets one, and backed by hugepages mounted at
+// hugepagesPath if it is set.
+func qemuNUMAArgs(nodes []QemuNUMANode, vcpus, memMB int, hugepagesPath string) ([]string, error) {
+	var args []string
+	assigned := make(map[int]int, vcpus)
+	var totalKB uint64
+	for i, node := range nodes {
+		cpus, err := parseCPUList(node.CPUs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cpus of numa node %d: %v", i, err)
+		}
+		for _, cpu := range cpus {
+			if cpu >= vcpus {
+				return nil, fmt.Errorf("numa node %d has vCPU %d, but the VM has %d vCPUs", i, cpu, vcpus)
+			}
+			if other, ok := assigned[cpu]; ok {
+				return nil, fmt.Errorf("vCPU %d is assigned to numa nodes %d and %d", cpu, other, i)
+			}
+			assigned[cpu] = i
+		}
+
+		kb, err := parseQemuMemory("numa memory", node.Memory)
+		if err != nil {
+			return nil, err
+		}
+		totalKB += kb
+
+		backend := fmt.Sprintf("memory-backend-ram,id=numa%d,size=%dK", i, kb)
+		if hugepagesPath != "" {
+			backend = fmt.Sprintf("memory-backend-file,id=numa%d,size=%dK,mem-path=%s,prealloc=on",
+				i, kb, qemuEscapeOption(hugepagesPath))
+		}
+		if node.HostNode != nil {
+			if *node.HostNode < 0 {
+				return nil, fmt.Errorf("Invalid host_node %d of numa node %d", *node.HostNode, i)
+			}
+			backend += fmt.Sprintf(",host-nodes=%d,policy=bind", *node.HostNode)
+		}
+
+		// Qemu takes a list of CPUs as repeated cpus properties
+		numa := fmt.Sprintf("node,nodeid=%d", i)
+		for _, r := range strings.Split(node.CPUs, ",") {
+			numa += ",cpus=" + strings.Replace(r, " ", "", -1)
+		}
+		numa += fmt.Sprintf(",memdev=numa%d", i)
+
+		args = append(args, "-object", backend, "-numa", numa)
+	}
+
+	if len(assigned) != vcpus {
+		return nil, fmt.Errorf("numa nodes must assign all %d vCPUs, %d are assigned", vcpus, len(assigned))
+	}
+	if totalKB != uint64(memMB)*1024 {
+		return nil, fmt.Errorf("memory of the numa nodes must add up to the VM's %d MB", memMB)
+	}
+	return args, nil
+}
@@ -0,0 +1,196 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// qemuDataDisk is an additional disk attached to the VM besides its image
+type qemuDataDisk struct {
+	// Path is where the disk file is created
+	Path   string
+	Format string
+
+	// Size is the size of the disk in qemu-img notation, or empty to keep the
+	// size of the source
+	Size string
+
+	// Source is the image the disk is created from, or empty for a blank disk
+	Source       string
+	SourceFormat string
+}
+
+// qemuDataDisks returns the data disks configured for the task. The disk
+// files are created in the task directory, numbered in the order the disks
+// are configured. Sources must be within the task directory.
+func qemuDataDisks(disks []QemuDisk, taskDir string) ([]*qemuDataDisk, error) {
+	var dataDisks []*qemuDataDisk
+	for i, disk := range disks {
+		format := disk.Format
+		if format == "" {
+			format = "qcow2"
+		}
+		if _, ok := qemuDiskFormats[format]; !ok {
+			return nil, fmt.Errorf("Invalid format %q of disk %d", format, i+1)
+		}
+		if disk.Size == "" && disk.Source == "" {
+			return nil, fmt.Errorf("disk %d must set a size or a source", i+1)
+		}
+
+		d := &qemuDataDisk{
+			Path:   filepath.Join(taskDir, fmt.Sprintf("disk%d.%s", i+1, format)),
+			Format: format,
+		}
+		if disk.Size != "" {
+			kb, err := parseQemuMemory("disk size", disk.Size)
+			if err != nil {
+				return nil, err
+			}
+			d.Size = fmt.Sprintf("%dK", kb)
+		}
+		if disk.Source != "" {
+			source, err := qemuTaskDirPath(taskDir, disk.Source)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid source of disk %d: %v", i+1, err)
+			}
+			d.Source = source
+
+			d.SourceFormat = disk.SourceFormat
+			if d.SourceFormat == "" {
+				d.SourceFormat = "raw"
+			}
+			if _, ok := qemuDiskFormats[d.SourceFormat]; !ok {
+				return nil, fmt.Errorf("Invalid source format %q of disk %d", d.SourceFormat, i+1)
+			}
+		}
+		dataDisks = append(dataDisks, d)
+	}
+	return dataDisks, nil
+}
+
+// qemuTaskDirPath returns the path relative to the task directory as an
+// absolute path, or an error if it is absolute or escapes the task directory
+func qemuTaskDirPath(taskDir, path string) (string, error) {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %q must be relative to the task directory", path)
+	}
+	if path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes the task directory", path)
+	}
+	return filepath.Join(taskDir, path), nil
+}
+
+// driveArg returns the -drive argument attaching the disk as a virtio disk
+func (d *qemuDataDisk) driveArg() string {
+	return fmt.Sprintf("file=%s,if=virtio,format=%s", qemuEscapeOption(d.Path), d.Format)
+}
+
+// create creates the disk file, either blank or as a copy of the source
+// resized to the disk's size, owned by the user the VM runs as. A disk that
+// already exists, because the task has been restarted, is kept along with the
+// data written to it. The disk is created with the qemu-img binary qemuImg.
+func (d *qemuDataDisk) create(qemuImg, user string) error {
+	if _, err := os.Stat(d.Path); err == nil {
+		return nil
+	}
+
+	// The disk is created under a temporary name so that a failure doesn't
+	// leave a partial disk behind to be reused
+	tmp := d.Path + ".tmp"
+	os.Remove(tmp)
+	var err error
+	if d.Source == "" {
+		err = runQemuImg(qemuImg, "create", "-f", d.Format, tmp, d.Size)
+	} else {
+		err = runQemuImg(qemuImg, "convert", "-f", d.SourceFormat, "-O", d.Format, d.Source, tmp)
+		if err == nil && d.Size != "" {
+			err = runQemuImg(qemuImg, "resize", "-f", d.Format, tmp, d.Size)
+		}
+	}
+	if err == nil {
+		err = qemuPrivateFile(tmp, user)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, d.Path)
+}
+
+// qemuPrivateFile makes the file at path only accessible to the user the VM
+// runs as, or to the client if the VM runs as the client's user
+func qemuPrivateFile(path, user string) error {
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	return chownToUser(path, user)
+}
+
+// qemuResizeImage grows the image at path to size bytes before the VM boots.
+// Images that are already at least as large, e.g. because the task has been
+// restarted, are left alone as shrinking would destroy the guest's data.
+func qemuResizeImage(qemuImg, path, format string, size uint64) error {
+	info, err := qemuImageInfo(qemuImg, path)
+	if err != nil {
+		return err
+	}
+	if info.VirtualSize >= size {
+		return nil
+	}
+	if format == "" {
+		format = info.Format
+	}
+	return runQemuImg(qemuImg, "resize", "-f", format, path, strconv.FormatUint(size, 10))
+}
+
+// qemuConvertedImage returns the name of the image converted to format in the
+// task directory
+func qemuConvertedImage(format string) string {
+	return "converted." + format
+}
+
+// qemuConvertImage converts the image at src, of format srcFormat or raw if it
+// is empty, to an image of format at dst. The source format is never probed
+// as a raw image could then be misdetected from the guest's data. An image that has already been
+// converted, because the task has been restarted, is kept along with the data
+// written to it. If removeSource is set the source is removed once converted.
+func qemuConvertImage(qemuImg, src, srcFormat, dst, format string, removeSource bool) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	// The image is converted under a temporary name so that a failure doesn't
+	// leave a partial image behind to be booted from
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	if srcFormat == "" {
+		srcFormat = "raw"
+	}
+	if err := runQemuImg(qemuImg, "convert", "-O", format, "-f", srcFormat, src, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to convert image to %s: %v", format, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to convert image to %s: %v", format, err)
+	}
+	if removeSource {
+		if err := os.Remove(src); err != nil {
+			return fmt.Errorf("failed to remove converted image: %v", err)
+		}
+	}
+	return nil
+}
+
+// runQemuImg runs the qemu-img binary qemuImg with the given arguments
+func runQemuImg(qemuImg string, args ...string) error {
+	if out, err := exec.Command(qemuImg, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu-img %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
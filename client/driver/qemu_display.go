@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// qemuEventDisplay is emitted once the VM's remote display is listening
+	qemuEventDisplay = "Display"
+
+	// qemuVNCBasePort is the port of VNC display 0. Qemu selects VNC ports
+	// by display number.
+	qemuVNCBasePort = 5900
+
+	// qemuDisplayPasswordTimeout bounds waiting for the QMP monitor to set the
+	// display password
+	qemuDisplayPasswordTimeout = 30 * time.Second
+)
+
+// qemuDisplay is a remote VNC or SPICE display of the VM
+type qemuDisplay struct {
+	// Protocol is either "vnc" or "spice"
+	Protocol string
+	IP       string
+	Port     int
+}
+
+// Addr returns the host address the display listens on
+func (d *qemuDisplay) Addr() string {
+	return fmt.Sprintf("%s:%d", d.IP, d.Port)
+}
+
+// args returns the arguments enabling the display. If the display has a
+// password it is set through the monitor once the VM runs. Until then clients
+// are refused, so the password never shows up on the command line.
+func (d *qemuDisplay) args(password bool) []string {
+	if d.Protocol == "vnc" {
+		display := fmt.Sprintf("%s:%d", d.IP, d.Port-qemuVNCBasePort)
+		if password {
+			display += ",password"
+		}
+		return []string{"-vnc", display}
+	}
+
+	spice := fmt.Sprintf("port=%d,addr=%s", d.Port, d.IP)
+	if !password {
+		spice += ",disable-ticketing"
+	}
+	return []string{"-spice", spice}
+}
+
+// qemuDisplayConfig returns the remote display configured for the task, or nil
+// if it has none. The display listens on the host port of a port label of the
+// task's network, which mustn't be forwarded to the guest as well.
+func qemuDisplayConfig(driverConfig *QemuDriverConfig, task *structs.Task) (*qemuDisplay, error) {
+	protocol, label := "vnc", driverConfig.VNC
+	if driverConfig.SPICE != "" {
+		if label != "" {
+			return nil, fmt.Errorf("Only one of vnc and spice may be set")
+		}
+		protocol, label = "spice", driverConfig.SPICE
+	}
+	if label == "" {
+		if driverConfig.DisplayPassword != "" {
+			return nil, fmt.Errorf("display_password requires vnc or spice to be set")
+		}
+		return nil, nil
+	}
+
+	for _, portMap := range driverConfig.PortMap {
+		if _, ok := portMap[label]; ok {
+			return nil, fmt.Errorf("%s port label %q must not be forwarded with port_map", protocol, label)
+		}
+	}
+	if len(task.Resources.Networks) == 0 {
+		return nil, fmt.Errorf("%s %q requires a network resource", protocol, label)
+	}
+	network := task.Resources.Networks[0]
+	port, ok := network.MapLabelToValues(nil)[label]
+	if !ok {
+		return nil, fmt.Errorf("Unknown port label %q", label)
+	}
+	if err := qemuValidatePort(port); err != nil {
+		return nil, fmt.Errorf("Invalid host port for port label %q: %v", label, err)
+	}
+	if protocol == "vnc" && port < qemuVNCBasePort {
+		return nil, fmt.Errorf("vnc port label %q maps port %d, VNC ports must be at least %d", label, port, qemuVNCBasePort)
+	}
+
+	return &qemuDisplay{
+		Protocol: protocol,
+		IP:       network.IP,
+		Port:     port,
+	}, nil
+}
+
+// setDisplayPassword sets the password of the display through the QMP monitor
+// at path, retrying until the monitor is up. It gives up once the timeout
+// elapses or doneCh is closed.
+func setDisplayPassword(path string, display *qemuDisplay, password string, timeout time.Duration, doneCh <-chan struct{}) error {
+	args := map[string]string{
+		"protocol": display.Protocol,
+		"password": password,
+	}
+	probe := func() error {
+		return qmpExecute(path, "set_password", args, nil)
+	}
+	return waitForReady(probe, timeout, qemuProbeInterval, doneCh)
+}
+
+// emitDisplay emits the event announcing where the display listens
+func (h *qemuHandle) emitDisplay() {
+	emitDriverEvent(h.eventSink, h.taskName, qemuEventDisplay, map[string]string{
+		"protocol": h.display.Protocol,
+		"address":  h.display.Addr(),
+		"port":     strconv.Itoa(h.display.Port),
+	})
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// qemuNVRAMFile is the name of the VM's UEFI variable store in the task
+	// directory
+	qemuNVRAMFile = "nvram.fd"
+)
+
+// qemuFirmware is a UEFI firmware image along with the template of the
+// variable store each VM gets a copy of
+type qemuFirmware struct {
+	Code string
+	Vars string
+}
+
+// qemuUEFIFirmwares are the locations UEFI firmware is installed to by common
+// distributions, keyed by architecture and in order of preference.
+var qemuUEFIFirmwares = map[string][]qemuFirmware{
+	"x86_64": {
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+		{"/usr/share/qemu/ovmf-x86_64-code.bin", "/usr/share/qemu/ovmf-x86_64-vars.bin"},
+	},
+	"aarch64": {
+		{"/usr/share/AAVMF/AAVMF_CODE.fd", "/usr/share/AAVMF/AAVMF_VARS.fd"},
+		{"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+	},
+}
+
+// qemuFindFirmware returns the UEFI firmware installed for the architecture,
+// or nil if there is none.
+func qemuFindFirmware(arch string) *qemuFirmware {
+	for _, fw := range qemuUEFIFirmwares[arch] {
+		if qemuIsFile(fw.Code) && qemuIsFile(fw.Vars) {
+			fw := fw
+			return &fw
+		}
+	}
+	return nil
+}
+
+// qemuIsFile returns whether path is a regular file
+func qemuIsFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// qemuFirmwareArgs returns the arguments booting the VM from the firmware,
+// with the variable store at nvram.
+func qemuFirmwareArgs(fw *qemuFirmware, nvram string) []string {
+	return []string{
+		"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", qemuEscapeOption(fw.Code)),
+		"-drive", fmt.Sprintf("if=pflash,format=raw,file=%s", qemuEscapeOption(nvram)),
+	}
+}
+
+// createNVRAM creates the VM's variable store at path from the firmware's
+// template, owned by the user the VM runs as. An existing store, e.g. of a
+// restarted task, is kept so that boot entries written by the guest persist.
+func createNVRAM(fw *qemuFirmware, path, user string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := qemuCopyImage(fw.Vars, path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to create UEFI variable store: %v", err)
+	}
+	if err := qemuPrivateFile(path, user); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to create UEFI variable store: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+)
+
+const (
+	// qemuDefaultHookTimeout is used if a hook command is set without a
+	// timeout
+	qemuDefaultHookTimeout = 1 * time.Minute
+)
+
+// qemuHook is a command run on the host around the lifetime of the VM, e.g. to
+// create a bridge before the VM starts and remove it once it has exited.
+type qemuHook struct {
+	Command []string
+	Dir     string
+	Timeout time.Duration
+
+	// Env isn't persisted in the handle ID as it may contain secrets and is
+	// rebuilt from the task environment when the handle is reopened.
+	Env []string `json:"-"`
+}
+
+// newQemuHook returns the hook running command in the task directory, or nil
+// if command is empty. The command is interpolated with the task environment.
+func newQemuHook(command []string, timeout string, taskDir string, taskEnv *env.TaskEnvironment) (*qemuHook, error) {
+	if len(command) == 0 {
+		return nil, nil
+	}
+
+	hook := &qemuHook{
+		Command: command,
+		Dir:     taskDir,
+		Timeout: qemuDefaultHookTimeout,
+	}
+	if timeout != "" {
+		t, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hook_timeout %q: %v", timeout, err)
+		}
+		if t <= 0 {
+			return nil, fmt.Errorf("hook_timeout must be positive")
+		}
+		hook.Timeout = t
+	}
+	if taskEnv != nil {
+		hook.Command = taskEnv.ParseAndReplace(command)
+		hook.Env = qemuHookEnv(taskEnv)
+	}
+	return hook, nil
+}
+
+// qemuHookEnv returns the environment of hook commands. Hooks run on the host,
+// so they inherit the client's environment in addition to the task's.
+func qemuHookEnv(taskEnv *env.TaskEnvironment) []string {
+	return append(os.Environ(), taskEnv.Build().EnvList()...)
+}
+
+// run runs the hook command and returns an error if it doesn't exit
+// successfully within the timeout
+func (h *qemuHook) run() error {
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Dir = h.Dir
+	cmd.Env = h.Env
+	return RunCommand(cmd, h.Timeout, nil)
+}
@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// qemuPathConfigOption is the key for the directory qemu is installed
+	// to. The Windows installer doesn't add it to the PATH.
+	qemuPathConfigOption = "qemu.path"
+
+	// The key populated in Node Attributes to indicate whether VMs can use the
+	// WHPX accelerator of Windows hosts
+	qemuWHPXAttr = "driver.qemu.whpx"
+)
+
+var (
+	// qemuWHPXLibrary is the library of the Windows Hypervisor Platform, which
+	// is only installed if the platform is enabled. qemu needs it to use the
+	// WHPX accelerator.
+	qemuWHPXLibrary = filepath.Join(os.Getenv("SystemRoot"), "System32", "WinHvPlatform.dll")
+)
+
+// qemuBinary returns the name of the qemu binary to execute, which is looked
+// up in dir if it is set and in the PATH otherwise. Windows finds the binary
+// without its .exe extension either way.
+func qemuBinary(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// qemuWHPXAvailable returns whether the Windows Hypervisor Platform is enabled
+func qemuWHPXAvailable() bool {
+	return runtime.GOOS == "windows" && qemuIsFile(qemuWHPXLibrary)
+}
+
+// qemuAcceleratorAvailable returns whether VMs can use the accelerator.
+// Accelerators that can't be detected, such as tcg, are assumed to be
+// available.
+func qemuAcceleratorAvailable(accelerator string) bool {
+	switch accelerator {
+	case "kvm":
+		return qemuKVMAvailable()
+	case "whpx":
+		return qemuWHPXAvailable()
+	default:
+		return true
+	}
+}
+
+// qemuTerminate forcibly terminates the qemu process on Windows, which can't
+// be interrupted, along with the processes it started.
+func qemuTerminate(pid int) error {
+	out, err := exec.Command("taskkill", "/F", "/T", "/PID", strconv.Itoa(pid)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("taskkill of process %d failed: %v: %s", pid, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The key populated in Node Attributes to indicate that VMs can back their
+	// memory with hugepages
+	qemuHugepagesAttr = "driver.qemu.hugepages"
+)
+
+var (
+	// qemuMeminfoPath and qemuMountsPath are where the host's hugepages are
+	// reported
+	qemuMeminfoPath = "/proc/meminfo"
+	qemuMountsPath  = "/proc/mounts"
+)
+
+// qemuHugepages describes the hugepages reserved on the host
+type qemuHugepages struct {
+	// Path is where hugetlbfs is mounted
+	Path string
+
+	// Total and Free are the number of hugepages, each of SizeKB
+	Total  uint64
+	Free   uint64
+	SizeKB uint64
+}
+
+// FreeMB returns the memory of the free hugepages in MB
+func (h *qemuHugepages) FreeMB() uint64 {
+	return h.Free * h.SizeKB / 1024
+}
+
+// qemuHostHugepages returns the hugepages of the host. Hugepages are only
+// usable if some are reserved and hugetlbfs is mounted.
+func qemuHostHugepages() (*qemuHugepages, error) {
+	hp := &qemuHugepages{}
+	f, err := os.Open(qemuMeminfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read memory info: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "HugePages_Total:":
+			hp.Total = value
+		case "HugePages_Free:":
+			hp.Free = value
+		case "Hugepagesize:":
+			hp.SizeKB = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read memory info: %v", err)
+	}
+	if hp.Total == 0 || hp.SizeKB == 0 {
+		return nil, fmt.Errorf("no hugepages are reserved on the host")
+	}
+
+	path, err := qemuHugetlbfsMount()
+	if err != nil {
+		return nil, err
+	}
+	hp.Path = path
+	return hp, nil
+}
+
+// qemuHugetlbfsMount returns where hugetlbfs is mounted on the host
+func qemuHugetlbfsMount() (string, error) {
+	f, err := os.Open(qemuMountsPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mounts: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 3 && fields[2] == "hugetlbfs" {
+			return fields[1], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("failed to read mounts: %v", err)
+	}
+	return "", fmt.Errorf("hugetlbfs is not mounted on the host")
+}
+
+// check returns an error if there aren't enough free hugepages to back the
+// VM's memory of memMB. The VM's memory is allocated up front so that it fails
+// to start rather than running short of hugepages later.
+func (h *qemuHugepages) check(memMB int) error {
+	if free := h.FreeMB(); uint64(memMB) > free {
+		return fmt.Errorf("not enough free hugepages for the VM's %d MB of memory, %d MB are free", memMB, free)
+	}
+	return nil
+}
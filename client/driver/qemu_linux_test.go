@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	ctestutils "github.com/hashicorp/nomad/client/testutil"
+	"github.com/hashicorp/nomad/helper/testtask"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+func TestQemuDriver_Priority(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["oom_score_adj"] = 500
+	task.Config["nice"] = 5
+	task.Config["ionice_class"] = "best-effort"
+	task.Config["ionice_level"] = 6
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+	pid := handle.(*qemuHandle).userPid
+
+	out, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if score := strings.TrimSpace(string(out)); score != "500" {
+		t.Fatalf("oom_score_adj %s; want 500", score)
+	}
+
+	// The raw priority returned by the kernel is 20 - nice
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, pid)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if nice := 20 - prio; nice != 5 {
+		t.Fatalf("nice %d; want 5", nice)
+	}
+	if ioprio := testIOPriority(t, pid); ioprio != 2<<13|6 {
+		t.Fatalf("ioprio %#x; want best-effort level 6", ioprio)
+	}
+
+	for key, value := range map[string]interface{}{
+		"nice":         20,
+		"ionice_class": "none",
+		"ionice_level": 8,
+	} {
+		task.Config = testQemuShutdownTask().Config
+		task.Config[key] = value
+		if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), key) {
+			t.Fatalf("expected %s error; got %v", key, err)
+		}
+	}
+	task.Config = testQemuShutdownTask().Config
+	task.Config["ionice_class"] = "idle"
+	task.Config["ionice_level"] = 0
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "ionice_level") {
+		t.Fatalf("expected ionice_level error; got %v", err)
+	}
+}
+
+func TestQemuDriver_Priority_AllThreads(t *testing.T) {
+	// The test binary runs several threads by the time it sleeps
+	cmd := exec.Command(testtask.Path(), "sleep", "10s")
+	testtask.SetCmdEnv(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+	var tids []int
+	testutil.WaitForResult(func() (bool, error) {
+		tids = nil
+		forEachThread(pid, func(tid int) error {
+			tids = append(tids, tid)
+			return nil
+		})
+		return len(tids) > 1, fmt.Errorf("process has %d threads", len(tids))
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	if err := setNice(pid, 7); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := setIOPriority(pid, 3, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, tid := range tids {
+		prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if nice := 20 - prio; nice != 7 {
+			t.Fatalf("thread %d nice %d; want 7", tid, nice)
+		}
+		if ioprio := testIOPriority(t, tid); ioprio != 3<<13 {
+			t.Fatalf("thread %d ioprio %#x; want idle", tid, ioprio)
+		}
+	}
+}
+
+// testIOPriority returns the raw I/O priority of the thread
+func testIOPriority(t *testing.T, tid int) int {
+	prio, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_GET, 1, uintptr(tid), 0)
+	if errno != 0 {
+		t.Fatalf("err: %v", errno)
+	}
+	return int(prio)
+}
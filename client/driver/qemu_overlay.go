@@ -0,0 +1,292 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-getter"
+	"github.com/hashicorp/nomad/client/driver/env"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// qemuOverlayImage is the name of the overlay a VM boots from in its task
+	// directory when overlay is set
+	qemuOverlayImage = "overlay.qcow2"
+
+	// qemuBaseImageLink is the name of the link to the base image in the task
+	// directory that the overlay is backed by
+	qemuBaseImageLink = "base.img"
+
+	// qemuBaseImageDir is the directory in the client's allocation directory
+	// that holds the base images shared by overlays. It is kept out of the
+	// state directory, which only the client can access, so that VMs running
+	// as another user can read their base image.
+	qemuBaseImageDir = "qemu-images"
+)
+
+var (
+	// baseImageLocks holds a lock per base image so that tasks starting with
+	// the same image at once don't race to add it. baseImageLocksLock guards
+	// access to the map.
+	baseImageLocks     = make(map[string]*sync.Mutex)
+	baseImageLocksLock sync.Mutex
+)
+
+// baseImageLock returns the lock guarding the base image at path
+func baseImageLock(path string) *sync.Mutex {
+	baseImageLocksLock.Lock()
+	defer baseImageLocksLock.Unlock()
+
+	l, ok := baseImageLocks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		baseImageLocks[path] = l
+	}
+	return l
+}
+
+// qemuBaseImage moves the image at path into dir, where it is kept read-only
+// as the base image of overlays, and hard links the base image to link in the
+// task directory. Images are stored under the hash of their contents, so
+// allocations of the same image share a single base image and the task's own
+// copy is removed. sum is the verified SHA-256 of the image if it is known,
+// otherwise the image is hashed.
+//
+// Base images are removed once they are no longer linked from a task
+// directory, i.e. once the allocations booting from them have been garbage
+// collected.
+func qemuBaseImage(dir, path, link, sum string) error {
+	if sum == "" {
+		var err error
+		if sum, err = qemuHashFile(path); err != nil {
+			return fmt.Errorf("failed to hash image: %v", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create base image directory: %v", err)
+	}
+	qemuCollectBaseImages(dir)
+	base := filepath.Join(dir, sum)
+
+	l := baseImageLock(base)
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		if err := qemuAddBaseImage(path, base); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to stat base image: %v", err)
+	} else if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove image: %v", err)
+	}
+
+	// Without a link the task gets its own copy of the base image, which
+	// would otherwise be removed while the VM still uses it
+	os.Remove(link)
+	if err := os.Link(base, link); err != nil {
+		if err := qemuCopyImage(base, link); err != nil {
+			os.Remove(link)
+			return fmt.Errorf("failed to link base image: %v", err)
+		}
+		if err := os.Chmod(link, 0444); err != nil {
+			return fmt.Errorf("failed to set base image permissions: %v", err)
+		}
+	}
+	return nil
+}
+
+// qemuAddBaseImage moves the image at path to the base image at base
+func qemuAddBaseImage(path, base string) error {
+	// The task and base image directories may be on different filesystems,
+	// in which case the image can't be renamed into place
+	tmp := base + ".tmp"
+	if err := os.Rename(path, tmp); err != nil {
+		if err := qemuCopyImage(path, tmp); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to copy image: %v", err)
+		}
+		os.Remove(path)
+	}
+	if err := os.Chmod(tmp, 0444); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to set base image permissions: %v", err)
+	}
+	if err := os.Rename(tmp, base); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to add base image: %v", err)
+	}
+	return nil
+}
+
+// qemuCollectBaseImages removes the base images in dir that aren't linked
+// from any task directory. Base images are kept if their links can't be
+// counted on the platform.
+func qemuCollectBaseImages(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		base := filepath.Join(dir, entry.Name())
+		l := baseImageLock(base)
+		l.Lock()
+		if fi, err := os.Stat(base); err == nil {
+			if links, ok := fileLinks(fi); ok && links == 1 {
+				os.Remove(base)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+// qemuImageChecksum returns the SHA-256 of the image at imagePath if the task
+// downloaded it as an artifact with a sha256 checksum, which go-getter has
+// verified, or an empty string otherwise. Images unpacked from an archive
+// aren't covered by the checksum of the artifact.
+func qemuImageChecksum(task *structs.Task, taskEnv *env.TaskEnvironment, taskDir, imagePath string) string {
+	for _, artifact := range task.Artifacts {
+		source := artifact.GetterSource
+		checksum := artifact.GetterOptions["checksum"]
+		if taskEnv != nil {
+			source = taskEnv.ReplaceEnv(source)
+			checksum = taskEnv.ReplaceEnv(checksum)
+		}
+		parts := strings.SplitN(checksum, ":", 2)
+		if len(parts) != 2 || parts[0] != "sha256" {
+			continue
+		}
+		if _, ok := artifact.GetterOptions["archive"]; ok {
+			continue
+		}
+
+		if i := strings.Index(source, "::"); i != -1 {
+			source = source[i+2:]
+		}
+		u, err := url.Parse(source)
+		if err != nil {
+			continue
+		}
+		name := path.Base(u.Path)
+		if qemuArchiveName(name) {
+			continue
+		}
+		if filepath.Join(taskDir, artifact.RelativeDest, name) != filepath.Clean(imagePath) {
+			continue
+		}
+
+		sum := strings.ToLower(parts[1])
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			continue
+		}
+		return sum
+	}
+	return ""
+}
+
+// qemuArchiveName returns whether go-getter unpacks a file of the given name
+func qemuArchiveName(name string) bool {
+	for ext := range getter.Decompressors {
+		if strings.HasSuffix(name, "."+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// qemuHashFile returns the hex encoded SHA-256 of the file at path
+func qemuHashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// qemuCopyImage copies the image at src to dst
+func qemuCopyImage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// qemuCreateOverlay creates a qcow2 overlay at path backed by the base image
+// using the qemu-img binary qemuImg. If format is empty, the format of the
+// base image is probed, as newer versions of qemu-img require it to be given.
+// A base image next to the overlay is referred to by a path relative to the
+// overlay, so that the overlay keeps working when the allocation directory is
+// moved.
+func qemuCreateOverlay(qemuImg, base, path, format string) error {
+	if format == "" {
+		info, err := qemuImageInfo(qemuImg, base)
+		if err != nil {
+			return err
+		}
+		format = info.Format
+	}
+
+	backing := base
+	if rel, err := filepath.Rel(filepath.Dir(path), base); err == nil && !strings.HasPrefix(rel, "..") {
+		backing = rel
+	}
+	out, err := exec.Command(qemuImg, "create", "-f", "qcow2", "-b", backing, "-F", format, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create overlay: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// qemuImage is the information qemu-img reports about an image
+type qemuImage struct {
+	Format      string `json:"format"`
+	VirtualSize uint64 `json:"virtual-size"`
+}
+
+// qemuImageInfo returns the format and size of the image at path as detected
+// by the qemu-img binary qemuImg
+func qemuImageInfo(qemuImg, path string) (*qemuImage, error) {
+	out, err := exec.Command(qemuImg, "info", "--output=json", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image: %v", err)
+	}
+
+	var info qemuImage
+	if err := json.Unmarshal(out, &info); err != nil || info.Format == "" {
+		return nil, fmt.Errorf("failed to inspect image: unexpected qemu-img output %q", out)
+	}
+	return &info, nil
+}
@@ -0,0 +1,147 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// qemuProbeInterval is the interval at which readiness probes are retried
+	qemuProbeInterval = 1 * time.Second
+
+	// qemuProbeDialTimeout bounds connecting to a probed port
+	qemuProbeDialTimeout = 1 * time.Second
+
+	// qemuProbeReadTimeout is how long a probe waits to learn whether the
+	// guest accepted the forwarded connection
+	qemuProbeReadTimeout = 500 * time.Millisecond
+
+	// qemuDefaultReadinessTimeout is used if a readiness port is set without
+	// a timeout
+	qemuDefaultReadinessTimeout = 5 * time.Minute
+
+	// qemuDefaultHealthInterval is the default interval between health checks
+	qemuDefaultHealthInterval = 30 * time.Second
+
+	// qemuDefaultHealthFailures is the default number of consecutive failed
+	// health checks after which the VM is considered unhealthy
+	qemuDefaultHealthFailures = 3
+)
+
+// qemuProbe checks the guest once and returns an error if it isn't ready.
+type qemuProbe func() error
+
+// tcpProbe returns a probe that checks that addr accepts connections. With
+// user networking, Qemu itself listens on forwarded host ports and closes
+// the connection when the guest refuses it, so a connection that is closed
+// right away is treated as not ready.
+func tcpProbe(addr string) qemuProbe {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, qemuProbeDialTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(qemuProbeReadTimeout))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("connection to %s closed by guest", addr)
+			}
+			if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// waitForReady runs the probe every interval until it succeeds. It gives up
+// once the timeout elapses or doneCh is closed.
+func waitForReady(probe qemuProbe, timeout, interval time.Duration, doneCh <-chan struct{}) error {
+	deadline := time.After(timeout)
+	for {
+		err := probe()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-doneCh:
+			return fmt.Errorf("VM exited before becoming ready")
+		case <-deadline:
+			return fmt.Errorf("timed out after %v: %v", timeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// qmpStatusProbe returns a probe that checks that the VM is running according
+// to its QMP monitor. A guest that has panicked or been shut down while Qemu
+// keeps running is reported as not running.
+func qmpStatusProbe(path string) qemuProbe {
+	return func() error {
+		var status qmpStatus
+		if err := qmpExecute(path, "query-status", nil, &status); err != nil {
+			return err
+		}
+		if !status.Running {
+			return fmt.Errorf("VM is %s", status.Status)
+		}
+		return nil
+	}
+}
+
+// qemuHealthCheck periodically checks that the guest is alive once the VM has
+// started.
+type qemuHealthCheck struct {
+	// Type is either "tcp", to probe Addr, or "qmp", to query the VM status
+	Type     string
+	Addr     string
+	Interval time.Duration
+
+	// Failures is the number of consecutive failures after which the VM is
+	// unhealthy
+	Failures int
+
+	// Grace is how long after the VM started failures are ignored, to give
+	// the guest time to boot
+	Grace time.Duration
+}
+
+// probe returns the probe the health check runs
+func (c *qemuHealthCheck) probe(qmpPath string) qemuProbe {
+	if c.Type == "tcp" {
+		return tcpProbe(c.Addr)
+	}
+	return qmpStatusProbe(qmpPath)
+}
+
+// watchHealth runs the probe every interval until doneCh is closed, in which
+// case it returns nil, or until the probe fails the given number of times in
+// a row, in which case the last error is returned. Failures before graceUntil
+// are ignored.
+func watchHealth(probe qemuProbe, interval time.Duration, failures int, graceUntil time.Time, doneCh <-chan struct{}) error {
+	failed := 0
+	for {
+		select {
+		case <-doneCh:
+			return nil
+		case <-time.After(interval):
+		}
+
+		if err := probe(); err != nil {
+			if time.Now().Before(graceUntil) {
+				continue
+			}
+			failed++
+			if failed >= failures {
+				return fmt.Errorf("%d consecutive health checks failed: %v", failed, err)
+			}
+			continue
+		}
+		failed = 0
+	}
+}
@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// qemuMonitorSocket is the name of the QMP monitor socket created in the
+	// task directory. On Windows the monitor listens on a loopback TCP port
+	// picked by qemu instead.
+	qemuMonitorSocket = "qmp.sock"
+
+	// qmpTimeout bounds a single QMP command, including connecting to the
+	// monitor
+	qmpTimeout = 5 * time.Second
+)
+
+// qmpCommand is a command sent to the QMP monitor
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// qmpResponse is a message received from the QMP monitor. Asynchronous
+// events are delivered on the same connection and are distinguished by the
+// Event field.
+type qmpResponse struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *qmpError       `json:"error"`
+	Event  string          `json:"event"`
+}
+
+// qmpError is an error returned by the QMP monitor
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// qmpStatus is the result of the query-status command
+type qmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// qmpClient is a connection to a VM's QMP monitor
+type qmpClient struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// dialQMP connects to the QMP monitor listening on the socket at path and
+// negotiates capabilities so that commands can be executed.
+func dialQMP(path string) (*qmpClient, error) {
+	conn, err := dialQemuSocket(path, qmpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP monitor: %v", err)
+	}
+	c := &qmpClient{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+
+	// The monitor greets every new connection
+	conn.SetDeadline(time.Now().Add(qmpTimeout))
+	var greeting qmpResponse
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read QMP greeting: %v", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+
+	if err := c.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// execute runs the command and decodes its return value into result, if
+// result is non-nil.
+func (c *qmpClient) execute(command string, args interface{}, result interface{}) error {
+	c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if err := c.enc.Encode(&qmpCommand{Execute: command, Arguments: args}); err != nil {
+		return fmt.Errorf("failed to send QMP command %q: %v", command, err)
+	}
+
+	for {
+		var resp qmpResponse
+		if err := c.dec.Decode(&resp); err != nil {
+			return fmt.Errorf("failed to read QMP response to %q: %v", command, err)
+		}
+
+		// Skip asynchronous events
+		if resp.Event != "" {
+			continue
+		}
+
+		if resp.Error != nil {
+			return fmt.Errorf("QMP command %q failed: %v", command, resp.Error)
+		}
+		if result != nil && resp.Return != nil {
+			if err := json.Unmarshal(resp.Return, result); err != nil {
+				return fmt.Errorf("failed to decode QMP response to %q: %v", command, err)
+			}
+		}
+		return nil
+	}
+}
+
+// Close closes the connection to the monitor
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
+
+// qmpExecute connects to the QMP monitor at path, runs a single command and
+// disconnects. The monitor only serves one client at a time, so connections
+// aren't held open between commands.
+func qmpExecute(path, command string, args interface{}, result interface{}) error {
+	if path == "" {
+		return fmt.Errorf("VM has no QMP monitor")
+	}
+
+	c, err := dialQMP(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.execute(command, args, result)
+}
@@ -0,0 +1,14 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package driver
+
+import "syscall"
+
+// qemuSignalCommands are the QMP commands signals sent to the task are
+// translated to if the VM has a monitor, as qemu would terminate on them.
+// SIGQUIT injects an NMI, which guests can be configured to dump their state
+// on, and SIGUSR1 resets the VM.
+var qemuSignalCommands = map[syscall.Signal]string{
+	syscall.SIGQUIT: "inject-nmi",
+	syscall.SIGUSR1: "system_reset",
+}
@@ -0,0 +1,10 @@
+package driver
+
+import "syscall"
+
+// qemuSignalCommands are the QMP commands signals sent to the task are
+// translated to if the VM has a monitor. Windows has no SIGUSR1 to reset the
+// VM with.
+var qemuSignalCommands = map[syscall.Signal]string{
+	syscall.SIGQUIT: "inject-nmi",
+}
@@ -0,0 +1,114 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+const (
+	// qemuMaxSocketPath is the longest path a unix socket can have, as
+	// sun_path holds 108 bytes on Linux and 104 on the BSDs and macOS,
+	// including the terminating NUL
+	qemuMaxSocketPath = 103
+
+	// qemuSocketDirPrefix names the directories in the temp directory holding
+	// the sockets of tasks whose directory is too deep for them
+	qemuSocketDirPrefix = "nomad-qemu-"
+)
+
+// qemuSocketAddress returns the address of the socket qemu listens on for the
+// QMP monitor or guest agent, which is the unix socket of the given name in
+// the task directory. If the path would be too long for a unix socket, the
+// socket is in a directory of the task in the temp directory instead, which
+// qemuCreateSocketDir creates.
+func qemuSocketAddress(taskDir, name string) (string, error) {
+	path := filepath.Join(taskDir, name)
+	if len(path) <= qemuMaxSocketPath {
+		return path, nil
+	}
+	path = filepath.Join(qemuSocketDir(taskDir), name)
+	if len(path) > qemuMaxSocketPath {
+		return "", fmt.Errorf("path of socket %s is too long: %s", name, path)
+	}
+	return path, nil
+}
+
+// qemuSocketDir returns the directory in the temp directory holding the
+// sockets of the task whose directory is too deep for them
+func qemuSocketDir(taskDir string) string {
+	sum := sha256.Sum256([]byte(taskDir))
+	return filepath.Join(os.TempDir(), qemuSocketDirPrefix+hex.EncodeToString(sum[:8]))
+}
+
+// qemuCreateSocketDir creates the directory of the socket at addr, owned by
+// the user the VM runs as and private to it, if the socket isn't in the task
+// directory. Anything already at its path, e.g. left by an earlier VM of the
+// task or created by another user, is removed first.
+func qemuCreateSocketDir(addr, taskDir, user string) error {
+	dir := filepath.Dir(addr)
+	if dir == taskDir {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove socket directory: %v", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	if err := chownToUser(dir, user); err != nil {
+		os.Remove(dir)
+		return fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	return nil
+}
+
+// qemuRemoveSocketDir removes the directory of the socket at addr if it was
+// created by qemuCreateSocketDir
+func qemuRemoveSocketDir(addr string) error {
+	dir := filepath.Dir(addr)
+	if filepath.Dir(dir) != filepath.Clean(os.TempDir()) || !strings.HasPrefix(filepath.Base(dir), qemuSocketDirPrefix) {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+// qemuQMPArg returns the value of the -qmp argument listening on addr
+func qemuQMPArg(addr string) string {
+	return fmt.Sprintf("unix:%s,server,nowait", qemuEscapeOption(addr))
+}
+
+// qemuChardevSocket returns the options of a socket chardev listening on addr
+func qemuChardevSocket(addr string) string {
+	return fmt.Sprintf("socket,path=%s,server,nowait", qemuEscapeOption(addr))
+}
+
+// qemuResolveSockets returns the addresses of the QMP monitor and guest agent
+// of the qemu process, which listens on the unix sockets it was launched with
+func qemuResolveSockets(pid int, qmpAddr, agentAddr string) (string, string, error) {
+	return qmpAddr, agentAddr, nil
+}
+
+// qemuHasSocket returns whether the process listens on the QMP socket at addr,
+// which is on its command line
+func qemuHasSocket(p *process.Process, addr string) (bool, error) {
+	cmdline, err := p.Cmdline()
+	if err != nil {
+		return false, fmt.Errorf("failed to read command line of process %d: %v", p.Pid, err)
+	}
+	return strings.Contains(cmdline, qemuEscapeOption(addr)), nil
+}
+
+// dialQemuSocket connects to the socket qemu listens on at addr
+func dialQemuSocket(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
+}
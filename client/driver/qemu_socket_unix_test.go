@@ -0,0 +1,108 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQemuDriver_SocketAddress(t *testing.T) {
+	short := "/var/lib/nomad/alloc/1234/web"
+	addr, err := qemuSocketAddress(short, qemuMonitorSocket)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr != filepath.Join(short, qemuMonitorSocket) {
+		t.Fatalf("bad address: %s", addr)
+	}
+
+	long := "/var/lib/nomad/" + strings.Repeat("a", qemuMaxSocketPath)
+	qmp, err := qemuSocketAddress(long, qemuMonitorSocket)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	agent, err := qemuSocketAddress(long, qemuAgentSocket)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(qmp) > qemuMaxSocketPath || len(agent) > qemuMaxSocketPath {
+		t.Fatalf("addresses too long: %s, %s", qmp, agent)
+	}
+	if filepath.Dir(filepath.Dir(qmp)) != filepath.Clean(os.TempDir()) {
+		t.Fatalf("address not in the temp dir: %s", qmp)
+	}
+	if filepath.Dir(qmp) != filepath.Dir(agent) {
+		t.Fatalf("sockets in different dirs: %s, %s", qmp, agent)
+	}
+	if again, _ := qemuSocketAddress(long, qemuMonitorSocket); again != qmp {
+		t.Fatalf("address changed: %s, %s", qmp, again)
+	}
+	if other, _ := qemuSocketAddress(long+"b", qemuMonitorSocket); other == qmp {
+		t.Fatalf("tasks share the address %s", qmp)
+	}
+}
+
+func TestQemuDriver_SocketDir(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Sockets in the task dir need no directory of their own
+	taskDir, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+	addr := filepath.Join(taskDir, qemuMonitorSocket)
+	if err := qemuCreateSocketDir(addr, taskDir, u.Username); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := qemuRemoveSocketDir(addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(taskDir); err != nil {
+		t.Fatalf("task dir removed: %v", err)
+	}
+
+	// Whatever is left in the socket dir is removed
+	long := filepath.Join(taskDir, strings.Repeat("a", qemuMaxSocketPath))
+	addr, err = qemuSocketAddress(long, qemuMonitorSocket)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dir := filepath.Dir(addr)
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(addr, []byte("stale"), 0666); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := qemuCreateSocketDir(addr, long, u.Username); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Fatalf("bad socket dir mode: %v", fi.Mode())
+	}
+	if _, err := os.Lstat(addr); !os.IsNotExist(err) {
+		t.Fatalf("stale socket not removed: %v", err)
+	}
+
+	if err := qemuRemoveSocketDir(addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Fatalf("socket dir not removed: %v", err)
+	}
+}
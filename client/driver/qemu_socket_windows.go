@@ -0,0 +1,214 @@
+package driver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/process"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// qemuSocketTimeout bounds waiting for qemu to start listening on its
+	// sockets after it has been launched
+	qemuSocketTimeout = 30 * time.Second
+
+	// tcpTableOwnerPidListener and errorInsufficientBuffer are the
+	// TCP_TABLE_OWNER_PID_LISTENER table class and ERROR_INSUFFICIENT_BUFFER
+	// status of GetExtendedTcpTable
+	tcpTableOwnerPidListener = 3
+	errorInsufficientBuffer  = 122
+)
+
+var procGetExtendedTcpTable = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("GetExtendedTcpTable")
+
+// qemuSocketAddress returns the address of the socket qemu listens on for the
+// QMP monitor or guest agent. Qemu can't listen on unix sockets on Windows,
+// and its named pipes block qemu from starting until a client connects and
+// can't be reconnected to, so qemu listens on a port of the loopback
+// interface instead. Qemu picks the port itself, so that no other process can
+// take it before qemu binds it, and qemuResolveSockets looks it up once qemu
+// has started. Any local process can connect to the port.
+func qemuSocketAddress(taskDir, name string) (string, error) {
+	return "127.0.0.1:0", nil
+}
+
+// qemuCreateSocketDir is a no-op as qemu listens on TCP ports on Windows
+func qemuCreateSocketDir(addr, taskDir, user string) error {
+	return nil
+}
+
+// qemuRemoveSocketDir is a no-op as qemu listens on TCP ports on Windows
+func qemuRemoveSocketDir(addr string) error {
+	return nil
+}
+
+// qemuQMPArg returns the value of the -qmp argument listening on addr
+func qemuQMPArg(addr string) string {
+	return fmt.Sprintf("tcp:%s,server,nowait", qemuEscapeOption(addr))
+}
+
+// qemuChardevSocket returns the options of a socket chardev listening on addr
+func qemuChardevSocket(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return fmt.Sprintf("socket,host=%s,port=%s,server,nowait", qemuEscapeOption(host), port)
+}
+
+// dialQemuSocket connects to the socket qemu listens on at addr
+func dialQemuSocket(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// qemuResolveSockets returns the addresses of the QMP monitor and guest agent
+// of the qemu process with the given pid, which listens on the ports it picked
+// for them. The monitor is the port greeting clients with QMP, and the address
+// of the agent, if the VM has one, is queried from the monitor.
+func qemuResolveSockets(pid int, qmpAddr, agentAddr string) (string, string, error) {
+	deadline := time.Now().Add(qemuSocketTimeout)
+	for {
+		ports, err := qemuListeningPorts(pid)
+		if err != nil {
+			return "", "", err
+		}
+		for _, port := range ports {
+			addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+			if !qemuGreetsQMP(addr) {
+				continue
+			}
+			if agentAddr == "" {
+				return addr, "", nil
+			}
+			agent, err := qemuChardevAddress(addr, qemuAgentChardev)
+			if err != nil {
+				return "", "", err
+			}
+			return addr, agent, nil
+		}
+
+		if !processExists(pid) {
+			return "", "", fmt.Errorf("qemu exited before listening on its QMP monitor")
+		}
+		if time.Now().After(deadline) {
+			return "", "", fmt.Errorf("qemu didn't listen on its QMP monitor within %v", qemuSocketTimeout)
+		}
+		time.Sleep(qemuProbeInterval)
+	}
+}
+
+// qemuHasSocket returns whether the process listens on the QMP monitor at addr
+func qemuHasSocket(p *process.Process, addr string) (bool, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false, err
+	}
+	ports, err := qemuListeningPorts(int(p.Pid))
+	if err != nil {
+		return false, err
+	}
+	for _, p := range ports {
+		if p == port {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// qemuGreetsQMP returns whether the socket at addr greets clients like a QMP
+// monitor does
+func qemuGreetsQMP(addr string) bool {
+	conn, err := dialQemuSocket(addr, qmpTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(qemuProbeReadTimeout))
+	var greeting qmpResponse
+	return json.NewDecoder(conn).Decode(&greeting) == nil && greeting.QMP != nil
+}
+
+// qmpChardev is a character device as reported by query-chardev
+type qmpChardev struct {
+	Label    string `json:"label"`
+	Filename string `json:"filename"`
+}
+
+// qemuChardevAddress returns the address the socket chardev with the given
+// label listens on, as reported by the QMP monitor at qmpAddr
+func qemuChardevAddress(qmpAddr, label string) (string, error) {
+	var chardevs []qmpChardev
+	if err := qmpExecute(qmpAddr, "query-chardev", nil, &chardevs); err != nil {
+		return "", err
+	}
+	for _, c := range chardevs {
+		if c.Label == label {
+			return parseQemuChardevFilename(c.Filename)
+		}
+	}
+	return "", fmt.Errorf("qemu has no chardev %q", label)
+}
+
+// parseQemuChardevFilename returns the address of a TCP socket chardev from
+// its filename as reported by query-chardev, e.g.
+// "disconnected:tcp:127.0.0.1:50123,server"
+func parseQemuChardevFilename(filename string) (string, error) {
+	addr := strings.TrimPrefix(filename, "disconnected:")
+	if !strings.HasPrefix(addr, "tcp:") {
+		return "", fmt.Errorf("chardev %q isn't a TCP socket", filename)
+	}
+	addr = strings.TrimPrefix(addr, "tcp:")
+	if i := strings.Index(addr, ","); i != -1 {
+		addr = addr[:i]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("chardev %q has an invalid address: %v", filename, err)
+	}
+	return addr, nil
+}
+
+// qemuListeningPorts returns the TCP ports the process with the given pid
+// listens on on the loopback interface
+func qemuListeningPorts(pid int) ([]int, error) {
+	size := uint32(4096)
+	for {
+		buf := make([]byte, size)
+		r, _, _ := procGetExtendedTcpTable.Call(
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)),
+			0, syscall.AF_INET, tcpTableOwnerPidListener, 0)
+		if r == errorInsufficientBuffer {
+			continue
+		}
+		if r != 0 {
+			return nil, fmt.Errorf("failed to list TCP listeners: %v", syscall.Errno(r))
+		}
+		return parseTCPListenerTable(buf, pid), nil
+	}
+}
+
+// parseTCPListenerTable returns the loopback ports of the given pid in a
+// MIB_TCPTABLE_OWNER_PID, whose rows hold the state, local address, local
+// port, remote address, remote port and owning pid as 32-bit words. Addresses
+// and ports are in network byte order.
+func parseTCPListenerTable(buf []byte, pid int) []int {
+	const rowSize = 24
+	var ports []int
+	n := int(binary.LittleEndian.Uint32(buf))
+	for i := 0; i < n && 4+(i+1)*rowSize <= len(buf); i++ {
+		row := buf[4+i*rowSize : 4+(i+1)*rowSize]
+		if int(binary.LittleEndian.Uint32(row[20:24])) != pid || !net.IP(row[4:8]).IsLoopback() {
+			continue
+		}
+		ports = append(ports, int(binary.BigEndian.Uint16(row[8:10])))
+	}
+	return ports
+}
@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestQemuDriver_ParseChardevFilename(t *testing.T) {
+	cases := []struct {
+		filename string
+		addr     string
+		err      bool
+	}{
+		{"disconnected:tcp:127.0.0.1:50123,server", "127.0.0.1:50123", false},
+		{"tcp:127.0.0.1:50123,server=on", "127.0.0.1:50123", false},
+		{"unix:/tmp/qga.sock,server", "", true},
+		{"tcp:127.0.0.1", "", true},
+	}
+	for _, c := range cases {
+		addr, err := parseQemuChardevFilename(c.filename)
+		if c.err {
+			if err == nil {
+				t.Fatalf("%q: expected error", c.filename)
+			}
+			continue
+		}
+		if err != nil || addr != c.addr {
+			t.Fatalf("%q: got %q, %v; want %q", c.filename, addr, err, c.addr)
+		}
+	}
+}
+
+func TestQemuDriver_ParseTCPListenerTable(t *testing.T) {
+	row := func(addr [4]byte, port uint16, pid uint32) []byte {
+		b := make([]byte, 24)
+		copy(b[4:8], addr[:])
+		binary.BigEndian.PutUint16(b[8:10], port)
+		binary.LittleEndian.PutUint32(b[20:24], pid)
+		return b
+	}
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, 3)
+	buf = append(buf, row([4]byte{127, 0, 0, 1}, 50123, 42)...)
+	buf = append(buf, row([4]byte{0, 0, 0, 0}, 5900, 42)...)
+	buf = append(buf, row([4]byte{127, 0, 0, 1}, 50124, 7)...)
+
+	// Only the loopback ports of the process are returned
+	if ports := parseTCPListenerTable(buf, 42); !reflect.DeepEqual(ports, []int{50123}) {
+		t.Fatalf("got ports %v; want [50123]", ports)
+	}
+}
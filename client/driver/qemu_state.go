@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// qemuStateFile is the name of the file in the task directory the VM's
+	// state is saved to when the client shuts down
+	qemuStateFile = "vmstate"
+
+	// qemuRestoreSuffix is appended to the saved state while the VM is being
+	// restored from it
+	qemuRestoreSuffix = ".restore"
+
+	// qemuRestoreTimeout bounds waiting for the VM to resume from its saved
+	// state
+	qemuRestoreTimeout = 5 * time.Minute
+
+	// qemuEventRestored is emitted once the VM has resumed from its saved state
+	qemuEventRestored = "Restored"
+)
+
+// qmpMigration is the result of the query-migrate command
+type qmpMigration struct {
+	Status    string `json:"status"`
+	ErrorDesc string `json:"error-desc"`
+}
+
+// qemuShellQuote quotes s for the shell that runs exec: migration commands
+func qemuShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// qemuIncomingArgs returns the arguments loading the VM's state from path
+// instead of booting it
+func qemuIncomingArgs(path string) []string {
+	return []string{"-incoming", "exec:cat " + qemuShellQuote(path)}
+}
+
+// prepareRestore moves the VM's saved state in the task directory aside to be
+// restored from if restore is set. The state is moved so that a VM failing to
+// load it isn't restored from it again, and state left behind by such a
+// restore is removed so that the VM cold boots instead.
+func prepareRestore(taskDir string, restore bool) error {
+	state := filepath.Join(taskDir, qemuStateFile)
+	if !restore {
+		if err := os.Remove(state + qemuRestoreSuffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale VM state: %v", err)
+		}
+		return nil
+	}
+	if err := os.Rename(state, state+qemuRestoreSuffix); err != nil {
+		return fmt.Errorf("failed to prepare restoring VM state: %v", err)
+	}
+	return nil
+}
+
+// qemuSaveState saves the state of the VM with the QMP monitor at qmpPath to
+// path. Once saved the VM is paused, so that its disks stay consistent with
+// the saved state. If saving fails the VM is resumed.
+func qemuSaveState(qmpPath, path string, timeout time.Duration) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+
+	err := qemuMigrate(qmpPath, "exec:cat > "+qemuShellQuote(tmp), timeout)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if e := qmpExecute(qmpPath, "cont", nil, nil); e != nil {
+			return fmt.Errorf("%v, and failed to resume VM: %v", err, e)
+		}
+		return err
+	}
+	return nil
+}
+
+// qemuMigrate migrates the VM to uri and waits for the migration to complete
+func qemuMigrate(qmpPath, uri string, timeout time.Duration) error {
+	if err := qmpExecute(qmpPath, "migrate", map[string]string{"uri": uri}, nil); err != nil {
+		return fmt.Errorf("failed to save VM state: %v", err)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		var m qmpMigration
+		if err := qmpExecute(qmpPath, "query-migrate", nil, &m); err != nil {
+			return fmt.Errorf("failed to save VM state: %v", err)
+		}
+		switch m.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("failed to save VM state: migration %s: %s", m.Status, m.ErrorDesc)
+		}
+
+		select {
+		case <-deadline:
+			qmpExecute(qmpPath, "migrate_cancel", nil, nil)
+			return fmt.Errorf("timed out saving VM state after %v", timeout)
+		case <-time.After(qemuProbeInterval):
+		}
+	}
+}
+
+// Suspend saves the VM's state to the task directory, from where it is
+// restored if the VM has to be started again, e.g. because the host was
+// restarted before the client came back. The VM stays paused until the client
+// reattaches to it. Saving takes as long as writing out the guest's memory,
+// and is cancelled once the timeout elapses.
+func (h *qemuHandle) Suspend(timeout time.Duration) error {
+	if !h.saveState {
+		return nil
+	}
+
+	// Pausing the VM fails its health check
+	h.healthLock.Lock()
+	h.suspended = true
+	h.healthLock.Unlock()
+
+	path := filepath.Join(h.allocDir.TaskDirs[h.taskName], qemuStateFile)
+	h.logger.Printf("[INFO] driver.qemu: saving state of VM %s", h.vmID)
+	if err := qemuSaveState(h.qmpPath, path, timeout); err != nil {
+		h.healthLock.Lock()
+		h.suspended = false
+		h.healthLock.Unlock()
+		return fmt.Errorf("failed to save state of VM %s: %v", h.vmID, err)
+	}
+	return nil
+}
+
+// resumeSuspended resumes the VM if it was paused when its state was saved by
+// a client that has since been restarted while the VM kept running. The saved
+// state is removed once the VM runs, as its disks no longer match the state.
+func (h *qemuHandle) resumeSuspended() error {
+	path := filepath.Join(h.allocDir.TaskDirs[h.taskName], qemuStateFile)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	var status qmpStatus
+	if err := qmpExecute(h.qmpPath, "query-status", nil, &status); err != nil {
+		return err
+	}
+	if !status.Running {
+		if err := qmpExecute(h.qmpPath, "cont", nil, nil); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// finishRestore removes the state the VM is restored from at path once the VM
+// runs.
+func (h *qemuHandle) finishRestore(path string) {
+	if err := waitForReady(qmpStatusProbe(h.qmpPath), qemuRestoreTimeout, qemuProbeInterval, h.doneCh); err != nil {
+		h.logger.Printf("[WARN] driver.qemu: VM %s failed to resume from its saved state: %v", h.vmID, err)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		h.logger.Printf("[ERR] driver.qemu: failed to remove saved state of VM %s: %v", h.vmID, err)
+	}
+	h.logger.Printf("[INFO] driver.qemu: VM %s resumed from its saved state", h.vmID)
+	emitDriverEvent(h.eventSink, h.taskName, qemuEventRestored, nil)
+}
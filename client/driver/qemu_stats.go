@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// qemuBalloonID is the ID of the VM's balloon device, through which the
+	// guest reports its memory statistics
+	qemuBalloonID = "balloon0"
+
+	// qemuGuestStatsInterval is how often, in seconds, the guest is asked to
+	// report its memory statistics
+	qemuGuestStatsInterval = 10
+)
+
+var (
+	// QemuMeasuredGuestMemStats are the memory stats measured by the guest of
+	// VMs with a balloon device
+	QemuMeasuredGuestMemStats = []string{"Guest Usage"}
+)
+
+// qmpGuestStats is the guest-stats property of the balloon device. Stats the
+// guest hasn't reported are set to the maximum value.
+type qmpGuestStats struct {
+	Stats struct {
+		TotalMemory     uint64 `json:"stat-total-memory"`
+		FreeMemory      uint64 `json:"stat-free-memory"`
+		AvailableMemory uint64 `json:"stat-available-memory"`
+	} `json:"stats"`
+	LastUpdate int64 `json:"last-update"`
+}
+
+// used returns the bytes of memory in use by the guest, and false if the
+// guest hasn't reported its memory yet. Older guests don't report available
+// memory, in which case only free memory is considered unused.
+func (s *qmpGuestStats) used() (uint64, bool) {
+	total := s.Stats.TotalMemory
+	if s.LastUpdate == 0 || total == math.MaxUint64 {
+		return 0, false
+	}
+
+	unused := s.Stats.AvailableMemory
+	if unused == math.MaxUint64 {
+		unused = s.Stats.FreeMemory
+	}
+	if unused == math.MaxUint64 || unused > total {
+		return 0, false
+	}
+	return total - unused, true
+}
+
+// qemuGuestMemoryUsage returns the bytes of memory in use as reported by the
+// guest through the balloon device of the VM with the QMP monitor at path, and
+// false if the guest hasn't reported it yet. If enable is set the guest is
+// first asked to start reporting.
+func qemuGuestMemoryUsage(path string, enable bool) (uint64, bool, error) {
+	device := "/machine/peripheral/" + qemuBalloonID
+	if enable {
+		args := map[string]interface{}{
+			"path":     device,
+			"property": "guest-stats-polling-interval",
+			"value":    qemuGuestStatsInterval,
+		}
+		if err := qmpExecute(path, "qom-set", args, nil); err != nil {
+			return 0, false, fmt.Errorf("failed to enable guest stats: %v", err)
+		}
+	}
+
+	args := map[string]string{
+		"path":     device,
+		"property": "guest-stats",
+	}
+	var stats qmpGuestStats
+	if err := qmpExecute(path, "qom-get", args, &stats); err != nil {
+		return 0, false, err
+	}
+	usage, ok := stats.used()
+	return usage, ok, nil
+}
+
+// guestMemoryUsage returns the memory usage reported by the guest, enabling
+// the reports the first time it is called.
+func (h *qemuHandle) guestMemoryUsage() (uint64, bool, error) {
+	h.guestStatsLock.Lock()
+	defer h.guestStatsLock.Unlock()
+
+	usage, ok, err := qemuGuestMemoryUsage(h.qmpPath, !h.guestStats)
+	if err != nil {
+		return 0, false, err
+	}
+	h.guestStats = true
+	return usage, ok, nil
+}
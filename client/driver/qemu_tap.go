@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// qemuDefaultBridge is the host bridge tap devices are attached to if the
+	// task doesn't configure one
+	qemuDefaultBridge = "br0"
+
+	// qemuTapMinBurstKB is the smallest burst in KB the traffic of tap devices
+	// is shaped with
+	qemuTapMinBurstKB = 32
+)
+
+// qemuTapName returns the name of the tap device of the task. Interface names
+// are limited to 15 characters, so it is derived from a hash of the alloc ID
+// and task name rather than containing them.
+func qemuTapName(allocID, taskName string) string {
+	sum := sha1.Sum([]byte(allocID + "/" + taskName))
+	return fmt.Sprintf("nomad%x", sum[:5])
+}
+
+// qemuMACAddress returns the MAC address of the task's NIC in bridge mode.
+// Every VM on a bridge needs its own address, whereas Qemu would give them all
+// the same one, so it is derived from the same hash as the tap device name.
+func qemuMACAddress(allocID, taskName string) string {
+	sum := sha1.Sum([]byte(allocID + "/" + taskName))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[5], sum[6], sum[7])
+}
+
+// qemuParseMAC returns the MAC address set for the task's NIC in its canonical
+// form, or an error if it isn't the address of a single NIC.
+func qemuParseMAC(addr string) (string, error) {
+	hw, err := net.ParseMAC(addr)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("Invalid mac_address %q: must be a MAC-48 address such as \"52:54:00:12:34:56\"", addr)
+	}
+	if hw[0]&1 != 0 {
+		return "", fmt.Errorf("Invalid mac_address %q: must not be a multicast address", addr)
+	}
+	return hw.String(), nil
+}
+
+// qemuTapArgs returns the arguments attaching a NIC backed by the tap device
+func qemuTapArgs(tap, mac string) []string {
+	return []string{
+		"-netdev", fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no", qemuEscapeOption(tap)),
+		"-device", fmt.Sprintf("virtio-net,netdev=net0,mac=%s", mac),
+	}
+}
+
+// createTap creates the tap device, attaches it to the bridge and brings it
+// up. If user is set the device is owned by that user, so that a qemu process
+// that doesn't run as root can open it. The device is removed again on
+// failure.
+func createTap(name, bridge, user string) error {
+	args := []string{"tuntap", "add", "dev", name, "mode", "tap"}
+	if user != "" {
+		args = append(args, "user", user)
+	}
+	if err := runIP(args...); err != nil {
+		return err
+	}
+
+	if err := runIP("link", "set", "dev", name, "master", bridge); err != nil {
+		deleteTap(name)
+		return err
+	}
+	if err := runIP("link", "set", "dev", name, "up"); err != nil {
+		deleteTap(name)
+		return err
+	}
+	return nil
+}
+
+// deleteTap removes the tap device
+func deleteTap(name string) error {
+	return runIP("tuntap", "del", "dev", name, "mode", "tap")
+}
+
+// limitTap shapes the traffic through the tap device to rateMbit Mbit/s in
+// each direction. Traffic to the guest leaves the host through the device and
+// is shaped by an htb qdisc, whereas traffic from the guest enters the host
+// through it and is policed. The shaping is removed along with the device.
+func limitTap(name string, rateMbit int) error {
+	rate := fmt.Sprintf("%dmbit", rateMbit)
+
+	// The burst allows for 10ms of traffic at the rate, but no less than a
+	// few full sized packets
+	burstKB := rateMbit * 10 / 8
+	if burstKB < qemuTapMinBurstKB {
+		burstKB = qemuTapMinBurstKB
+	}
+	burst := fmt.Sprintf("%dk", burstKB)
+
+	cmds := [][]string{
+		{"qdisc", "add", "dev", name, "root", "handle", "1:", "htb", "default", "1"},
+		{"class", "add", "dev", name, "parent", "1:", "classid", "1:1", "htb", "rate", rate, "burst", burst},
+		{"qdisc", "add", "dev", name, "handle", "ffff:", "ingress"},
+		{"filter", "add", "dev", name, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0",
+			"police", "rate", rate, "burst", burst, "drop", "flowid", ":1"},
+	}
+	for _, args := range cmds {
+		if err := runTC(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTC runs the iproute2 tc command with the given arguments
+func runTC(args ...string) error {
+	if out, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runIP runs the iproute2 ip command with the given arguments
+func runIP(args ...string) error {
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
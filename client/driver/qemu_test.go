@@ -1,18 +1,174 @@
 package driver
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
 
 	ctestutils "github.com/hashicorp/nomad/client/testutil"
 )
 
+// setupFakeQemu installs a stand-in qemu-system-x86_64 that runs the given
+// shell script, at the front of the PATH. The returned function restores the
+// PATH and removes the stand-in.
+func setupFakeQemu(t *testing.T, script string) func() {
+	return setupFakeBinaries(t, map[string]string{"qemu-system-x86_64": script}, true)
+}
+
+// setupFakeBinaries installs stand-in binaries running the given shell scripts
+// into a temporary directory which is added to the front of the PATH, or
+// replaces it if keepPath is false. The returned function restores the PATH
+// and removes the stand-ins.
+func setupFakeBinaries(t *testing.T, bins map[string]string, keepPath bool) func() {
+	dir, err := ioutil.TempDir("", "fakeqemu")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for name, script := range bins {
+		bin := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	oldPath := os.Getenv("PATH")
+	path := dir
+	if keepPath {
+		path += string(os.PathListSeparator) + oldPath
+	}
+	os.Setenv("PATH", path)
+	return func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeQMP is a QMP monitor that answers commands using a handler
+type fakeQMP struct {
+	l        net.Listener
+	handler  func(command string, args json.RawMessage) (interface{}, *qmpError)
+	lock     sync.Mutex
+	commands []string
+
+	// agent makes it behave like a guest agent, which doesn't greet clients
+	// and answers guest-sync itself
+	agent bool
+}
+
+// newFakeQMP serves a fake QMP monitor on the unix socket at path. The handler
+// returns the result of every command other than qmp_capabilities.
+func newFakeQMP(t *testing.T, path string, handler func(string, json.RawMessage) (interface{}, *qmpError)) *fakeQMP {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f := &fakeQMP{l: l, handler: handler}
+	go f.serve()
+	return f
+}
+
+// newFakeQGA serves a fake guest agent on the unix socket at path. The handler
+// returns the result of every command other than guest-sync.
+func newFakeQGA(t *testing.T, path string, handler func(string, json.RawMessage) (interface{}, *qmpError)) *fakeQMP {
+	f := newFakeQMP(t, path, handler)
+	f.lock.Lock()
+	f.agent = true
+	f.lock.Unlock()
+	return f
+}
+
+func (f *fakeQMP) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		f.handle(conn)
+	}
+}
+
+func (f *fakeQMP) handle(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	f.lock.Lock()
+	agent := f.agent
+	f.lock.Unlock()
+	if !agent {
+		enc.Encode(map[string]interface{}{
+			"QMP": map[string]interface{}{"version": map[string]interface{}{}, "capabilities": []string{}},
+		})
+	}
+	for {
+		var cmd struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := dec.Decode(&cmd); err != nil {
+			return
+		}
+		if cmd.Execute == "qmp_capabilities" {
+			enc.Encode(map[string]interface{}{"return": map[string]interface{}{}})
+			continue
+		}
+		if agent && cmd.Execute == "guest-sync" {
+			var args struct {
+				ID int64 `json:"id"`
+			}
+			json.Unmarshal(cmd.Arguments, &args)
+			enc.Encode(map[string]interface{}{"return": args.ID})
+			continue
+		}
+
+		f.lock.Lock()
+		f.commands = append(f.commands, cmd.Execute)
+		f.lock.Unlock()
+
+		// Interleave an event to check that clients skip them
+		enc.Encode(map[string]interface{}{"event": "FAKE", "data": map[string]interface{}{}})
+		result, qerr := f.handler(cmd.Execute, cmd.Arguments)
+		if qerr != nil {
+			enc.Encode(map[string]interface{}{"error": qerr})
+			continue
+		}
+		if result == nil {
+			result = map[string]interface{}{}
+		}
+		enc.Encode(map[string]interface{}{"return": result})
+	}
+}
+
+// Commands returns the commands the monitor received
+func (f *fakeQMP) Commands() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func (f *fakeQMP) Close() {
+	f.l.Close()
+}
+
 // The fingerprinter test should always pass, even if QEMU is not installed.
 func TestQemuDriver_Fingerprint(t *testing.T) {
 	ctestutils.QemuCompatible(t)
@@ -41,6 +197,89 @@ func TestQemuDriver_Fingerprint(t *testing.T) {
 	}
 }
 
+func TestQemuDriver_Fingerprint_SystemBinaries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows fingerprints qemu using qemu-img")
+	}
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-x86_64":  "echo 'QEMU emulator version 2.5.0, Copyright (c) 2003-2008 Fabrice Bellard'",
+		"qemu-system-aarch64": "echo 'QEMU emulator version 2.7.1'",
+		"qemu-system-arm":     "echo 'QEMU emulator version 1.7.0'",
+		"qemu-system-broken":  "exit 1",
+	}, false)()
+
+	task := &structs.Task{
+		Name:      "foo",
+		Resources: structs.DefaultResources(),
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+	node := &structs.Node{
+		Attributes: map[string]string{
+			"driver.qemu.mips.version": "1.0.0",
+		},
+	}
+	apply, err := d.Fingerprint(&config.Config{}, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !apply {
+		t.Fatalf("should apply")
+	}
+
+	// VFIO, KVM, UEFI and hugepages availability depend on the host
+	delete(node.Attributes, qemuVFIOAttr)
+	delete(node.Attributes, qemuKVMAttr)
+	delete(node.Attributes, qemuUEFIAttr)
+	delete(node.Attributes, qemuHugepagesAttr)
+
+	expected := map[string]string{
+		"driver.qemu":                 "1",
+		"driver.qemu.version":         "2.5.0",
+		"driver.qemu.x86_64.version":  "2.5.0",
+		"driver.qemu.aarch64.version": "2.7.1",
+		"driver.qemu.arm.version":     "1.7.0",
+		"driver.qemu.args.enabled":    "1",
+	}
+	if !reflect.DeepEqual(node.Attributes, expected) {
+		t.Fatalf("got attributes %#v; want %#v", node.Attributes, expected)
+	}
+}
+
+func TestQemuDriver_Fingerprint_OtherArch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows fingerprints qemu using qemu-img")
+	}
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-aarch64": "echo 'QEMU emulator version 2.7.1'",
+	}, false)()
+
+	task := &structs.Task{
+		Name:      "foo",
+		Resources: structs.DefaultResources(),
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+	node := &structs.Node{
+		Attributes: make(map[string]string),
+	}
+	apply, err := d.Fingerprint(&config.Config{}, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !apply {
+		t.Fatalf("should apply without qemu-system-x86_64")
+	}
+	if v := node.Attributes["driver.qemu.version"]; v != "2.7.1" {
+		t.Fatalf("got version %q; want %q", v, "2.7.1")
+	}
+	if v := node.Attributes["driver.qemu.aarch64.version"]; v != "2.7.1" {
+		t.Fatalf("got aarch64 version %q; want %q", v, "2.7.1")
+	}
+}
+
 func TestQemuDriver_StartOpen_Wait(t *testing.T) {
 	ctestutils.QemuCompatible(t)
 	task := &structs.Task{
@@ -85,11 +324,6 @@ func TestQemuDriver_StartOpen_Wait(t *testing.T) {
 		t.Fatalf("missing handle")
 	}
 
-	// Ensure that sending a Signal returns an error
-	if err := handle.Signal(syscall.SIGINT); err == nil {
-		t.Fatalf("Expect an error when signalling")
-	}
-
 	// Attempt to open
 	handle2, err := d.Open(execCtx, handle.ID())
 	if err != nil {
@@ -148,3 +382,4228 @@ func TestQemuDriverUser(t *testing.T) {
 		t.Fatalf("Expecting '%v' in '%v'", msg, err)
 	}
 }
+
+func TestQemuDriver_RenderUserData(t *testing.T) {
+	task := &structs.Task{
+		Name:      "linux",
+		Resources: structs.DefaultResources(),
+		Meta: map[string]string{
+			"role": "web",
+		},
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+
+	data := newQemuUserDataContext(execCtx, task, driverCtx.node, driverCtx.taskEnv)
+	out, err := renderUserData("#cloud-config\nhostname: {{.TaskName}}-{{.AllocID}}\nrole: {{.Meta.role}}\n", data)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	exp := fmt.Sprintf("#cloud-config\nhostname: linux-%s\nrole: web\n", execCtx.AllocID)
+	if string(out) != exp {
+		t.Fatalf("got %q; want %q", out, exp)
+	}
+
+	// Unknown fields and keys should fail rendering
+	if _, err := renderUserData("{{.Nope}}", data); err == nil {
+		t.Fatalf("expected error rendering unknown field")
+	}
+	if _, err := renderUserData("{{.Meta.nope}}", data); err == nil {
+		t.Fatalf("expected error rendering unknown meta key")
+	}
+}
+
+func TestQemuDriver_MachineArgs(t *testing.T) {
+	cases := []struct {
+		accelerator string
+		threads     string
+		tbSize      int
+		expected    []string
+	}{
+		{"tcg", "", 0, []string{"-machine", "type=pc,accel=tcg"}},
+		{"tcg", "single", 0, []string{"-machine", "type=pc,accel=tcg"}},
+		{"tcg", "multi", 0, []string{"-machine", "type=pc", "-accel", "tcg,thread=multi"}},
+		{"kvm", "multi", 0, []string{"-machine", "type=pc,accel=kvm"}},
+		{"tcg", "", 512, []string{"-machine", "type=pc", "-accel", "tcg,tb-size=512"}},
+		{"tcg", "multi", 512, []string{"-machine", "type=pc", "-accel", "tcg,thread=multi,tb-size=512"}},
+		{"kvm", "", 512, []string{"-machine", "type=pc,accel=kvm"}},
+	}
+
+	for _, c := range cases {
+		cfg := &QemuDriverConfig{TCGThreads: c.threads, TCGTBSize: c.tbSize}
+		if act := qemuMachineArgs(c.accelerator, "pc", cfg); !reflect.DeepEqual(act, c.expected) {
+			t.Fatalf("qemuMachineArgs(%q, %q, %d) returned %v; want %v", c.accelerator, c.threads, c.tbSize, act, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_ArchMachine(t *testing.T) {
+	cases := []struct {
+		arch    string
+		machine string
+		expArch string
+		expMach string
+		err     bool
+	}{
+		{"", "", "x86_64", "pc", false},
+		{"x86_64", "q35", "x86_64", "q35", false},
+		{"aarch64", "", "aarch64", "virt", false},
+		{"riscv64", "", "riscv64", "virt", false},
+		{"ppc64", "pseries", "ppc64", "pseries", false},
+		{"ppc64", "", "", "", true},
+		{"../x86_64", "", "", "", true},
+		{"aarch64", "virt,gic-version=3", "", "", true},
+	}
+
+	for _, c := range cases {
+		cfg := &QemuDriverConfig{Arch: c.arch, Machine: c.machine}
+		arch, machine, err := qemuArchMachine(cfg)
+		if c.err {
+			if err == nil {
+				t.Fatalf("qemuArchMachine(%q, %q) should fail", c.arch, c.machine)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("qemuArchMachine(%q, %q) failed: %v", c.arch, c.machine, err)
+		}
+		if arch != c.expArch || machine != c.expMach {
+			t.Fatalf("qemuArchMachine(%q, %q) returned %q, %q; want %q, %q",
+				c.arch, c.machine, arch, machine, c.expArch, c.expMach)
+		}
+	}
+}
+
+func TestQemuDriver_Arch(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	args := qemuDryRunArgs(t, map[string]interface{}{"arch": "aarch64"})
+	if bin := filepath.Base(args[0]); bin != "qemu-system-aarch64" {
+		t.Fatalf("expected qemu-system-aarch64 to be launched; got %q", bin)
+	}
+}
+
+func TestQemuDriver_Events(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "exit 3")()
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path": "linux-0.2.img",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+
+	var l sync.Mutex
+	var events []*DriverEvent
+	driverCtx.eventSink = func(e *DriverEvent) {
+		l.Lock()
+		defer l.Unlock()
+		events = append(events, e)
+	}
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if res.ExitCode != 3 {
+			t.Fatalf("unexpected exit code: %v", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	expected := []string{DriverEventStartRequested, DriverEventProcessStarted, DriverEventProcessExited}
+	if len(events) != len(expected) {
+		t.Fatalf("got %d events; want %d: %#v", len(events), len(expected), events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Fatalf("event %d has type %q; want %q", i, e.Type, expected[i])
+		}
+		if e.TaskName != task.Name {
+			t.Fatalf("event %d has task name %q; want %q", i, e.TaskName, task.Name)
+		}
+		if e.Time.IsZero() {
+			t.Fatalf("event %d has no time", i)
+		}
+		if e.Details["vm_id"] != "linux-0.2.img" {
+			t.Fatalf("event %d has vm_id %q", i, e.Details["vm_id"])
+		}
+	}
+	if code := events[2].Details["exit_code"]; code != "3" {
+		t.Fatalf("exit event has exit code %q; want %q", code, "3")
+	}
+}
+
+func TestQemuDriver_Signaled(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "kill -KILL $$")()
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path": "linux-0.2.img",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A VM killed e.g. by the OOM killer reports the signal it was killed with
+	select {
+	case res := <-handle.WaitCh():
+		if res.Signal != int(syscall.SIGKILL) || res.ExitCode != 128+int(syscall.SIGKILL) {
+			t.Fatalf("unexpected wait result: %v", res)
+		}
+		if res.Successful() {
+			t.Fatalf("expected an unsuccessful result: %v", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestQemuDriver_SeedFiles_SSHKeys(t *testing.T) {
+	keys := []string{
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFoo alice@example.com",
+		"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQBar bob@example.com",
+	}
+	cfg := &QemuDriverConfig{SSHKeys: keys}
+	data := &qemuUserDataContext{AllocID: "1234", TaskName: "linux"}
+
+	files, err := qemuSeedFiles(cfg, data)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ud := string(files["user-data"]); ud != "#cloud-config\n" {
+		t.Fatalf("unexpected user-data: %q", ud)
+	}
+
+	md := string(files["meta-data"])
+	if !strings.Contains(md, `instance-id: "1234"`) {
+		t.Fatalf("meta-data missing instance-id: %q", md)
+	}
+	if !strings.Contains(md, "public-keys:\n") {
+		t.Fatalf("meta-data missing public-keys: %q", md)
+	}
+	for _, key := range keys {
+		if !strings.Contains(md, fmt.Sprintf("  - %q\n", key)) {
+			t.Fatalf("meta-data missing key %q: %q", key, md)
+		}
+	}
+}
+
+func TestQemuDriver_SeedFiles_MetaData(t *testing.T) {
+	cfg := &QemuDriverConfig{
+		MetaData: []map[string]string{{
+			"local-hostname": "web-1",
+			"region":         "eu-west",
+		}},
+	}
+	data := &qemuUserDataContext{AllocID: "1234", TaskName: "linux"}
+
+	files, err := qemuSeedFiles(cfg, data)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "instance-id: \"1234\"\nlocal-hostname: \"web-1\"\nregion: \"eu-west\"\n"
+	if md := string(files["meta-data"]); md != expected {
+		t.Fatalf("got meta-data %q; want %q", md, expected)
+	}
+
+	for _, key := range []string{"", "a:b", "public-keys"} {
+		cfg := &QemuDriverConfig{MetaData: []map[string]string{{key: "x"}}}
+		if _, err := qemuSeedFiles(cfg, data); err == nil {
+			t.Fatalf("expected error for meta_data key %q", key)
+		}
+	}
+}
+
+func TestQemuDriver_Signal(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "trap 'echo hup; exit 5' HUP\nwhile true; do /bin/sleep 0.1; done")()
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path": "linux-0.2.img",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Give the shell time to install the trap
+	time.Sleep(500 * time.Millisecond)
+	if err := handle.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if res.ExitCode != 5 {
+			t.Fatalf("unexpected exit: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	outputFile := filepath.Join(execCtx.AllocDir.LogDir(), "linux.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if strings.TrimSpace(string(act)) != "hup" {
+		t.Fatalf("Command outputted %q; want %q", act, "hup")
+	}
+
+	// Signalling a process that has exited should fail
+	if err := handle.Signal(syscall.SIGHUP); err == nil {
+		t.Fatalf("expected an error signalling an exited process")
+	}
+}
+
+func TestQemuDriver_Signal_QMP(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM would exit if it received the signals itself
+	defer setupFakeQemu(t, "trap 'exit 5' QUIT USR1\nwhile true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "query-status" {
+			return &qmpStatus{Running: true, Status: "running"}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// Give the shell time to install the trap
+	time.Sleep(500 * time.Millisecond)
+	for _, sig := range []os.Signal{syscall.SIGQUIT, syscall.SIGUSR1} {
+		if err := handle.Signal(sig); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		t.Fatalf("unexpected exit: %v", res)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	var cmds []string
+	for _, cmd := range qmp.Commands() {
+		if cmd != "query-status" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	if !reflect.DeepEqual(cmds, []string{"inject-nmi", "system_reset"}) {
+		t.Fatalf("expected inject-nmi and system_reset; got %v", cmds)
+	}
+}
+
+func TestQemuDriver_WriteProtectImage(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "exit 0")()
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path": "linux-0.2.img",
+			"snapshot":   true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	image := filepath.Join(execCtx.AllocDir.TaskDirs[task.Name], "linux-0.2.img")
+	if err := ioutil.WriteFile(image, []byte("image"), 0666); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	fi, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0444 {
+		t.Fatalf("image has mode %v; want %v", perm, os.FileMode(0444))
+	}
+}
+
+func TestQemuDriver_DriveArg(t *testing.T) {
+	cases := []struct {
+		config   *QemuDriverConfig
+		expected string
+	}{
+		{&QemuDriverConfig{}, "file=linux.img"},
+		{&QemuDriverConfig{Snapshot: true}, "file=linux.img,snapshot=on"},
+		{&QemuDriverConfig{ReadOnly: true}, "file=linux.img,readonly=on"},
+		{&QemuDriverConfig{DiskFormat: "qcow2", Snapshot: true}, "file=linux.img,format=qcow2,snapshot=on"},
+	}
+
+	for _, c := range cases {
+		if act := qemuDriveArg("linux.img", c.config); act != c.expected {
+			t.Fatalf("qemuDriveArg(%#v) returned %q; want %q", c.config, act, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_NameArg(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"", "linux.img"},
+		{"web-${NOMAD_ALLOC_ID}", "web-${NOMAD_ALLOC_ID},process=web-${NOMAD_ALLOC_ID}"},
+		{"a,b", "a,,b,process=a,,b"},
+	}
+
+	for _, c := range cases {
+		cfg := &QemuDriverConfig{VMName: c.name}
+		if act := qemuNameArg("linux.img", cfg); act != c.expected {
+			t.Fatalf("qemuNameArg(%q) returned %q; want %q", c.name, act, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_EscapeOption(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("qemu sockets are TCP addresses on windows")
+	}
+
+	// Paths with commas are escaped wherever they are passed as properties
+	cases := []struct {
+		arg      string
+		expected string
+	}{
+		{qemuDriveArg("/a,b/linux.img", &QemuDriverConfig{}), "file=/a,,b/linux.img"},
+		{qemuQMPArg("/a,b/qmp.sock"), "unix:/a,,b/qmp.sock,server,nowait"},
+		{qemuChardevSocket("/a,b/qga.sock"), "socket,path=/a,,b/qga.sock,server,nowait"},
+		{qemuConsoleArgs("/a,b/console.log")[1], "stdio,id=console0,signal=off,logfile=/a,,b/console.log"},
+		{qemuTapArgs("tap,0", "52:54:00:12:34:56")[1], "tap,id=net0,ifname=tap,,0,script=no,downscript=no"},
+	}
+	for _, c := range cases {
+		if c.arg != c.expected {
+			t.Fatalf("got %q; want %q", c.arg, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_ExecUser(t *testing.T) {
+	task := &structs.Task{Name: "linux"}
+	if user := qemuExecUser(task, &QemuDriverConfig{}); user != "" {
+		t.Fatalf("expected no user; got %q", user)
+	}
+
+	task.User = "alice"
+	if user := qemuExecUser(task, &QemuDriverConfig{}); user != "alice" {
+		t.Fatalf("expected task user; got %q", user)
+	}
+	if user := qemuExecUser(task, &QemuDriverConfig{RunAsUser: "nobody"}); user != "nobody" {
+		t.Fatalf("expected run_as_user; got %q", user)
+	}
+}
+
+func TestQemuDriver_RTCArg(t *testing.T) {
+	cases := []struct {
+		base     string
+		clock    string
+		expected string
+	}{
+		{"", "", ""},
+		{"utc", "", "base=utc"},
+		{"localtime", "", "base=localtime"},
+		{"localtime", "host", "base=localtime,clock=host"},
+		{"", "vm", "clock=vm"},
+	}
+
+	for _, c := range cases {
+		cfg := &QemuDriverConfig{RTCBase: c.base, RTCClock: c.clock}
+		if act := qemuRTCArg(cfg); act != c.expected {
+			t.Fatalf("qemuRTCArg(%q, %q) returned %q; want %q", c.base, c.clock, act, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_VCPUs(t *testing.T) {
+	node := &structs.Node{
+		Attributes: map[string]string{
+			"cpu.frequency": "2000",
+			"cpu.numcores":  "4",
+		},
+	}
+	cases := []struct {
+		cpu      int
+		node     *structs.Node
+		expected int
+	}{
+		{250, node, 1},
+		{2000, node, 1},
+		{2001, node, 2},
+		{6000, node, 3},
+		{20000, node, 4},
+		{0, node, 1},
+		{6000, nil, 1},
+		{6000, &structs.Node{}, 1},
+	}
+
+	for _, c := range cases {
+		if act := qemuVCPUs(c.cpu, c.node); act != c.expected {
+			t.Fatalf("qemuVCPUs(%d, %v) returned %d; want %d", c.cpu, c.node, act, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_SMP(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "/bin/true")()
+
+	task := testQemuShutdownTask()
+	task.Resources = basicResources.Copy()
+	task.Resources.CPU = 3000
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.node = &structs.Node{
+		Attributes: map[string]string{
+			"cpu.frequency": "1000",
+			"cpu.numcores":  "8",
+		},
+	}
+	d := NewQemuDriver(driverCtx)
+
+	if args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " "); !strings.Contains(args, " -smp 3 ") {
+		t.Fatalf("expected -smp 3 in %q", args)
+	}
+}
+
+func TestQemuDriver_WaitForReady(t *testing.T) {
+	// Reserve a port to listen on later
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	// Start listening after a delay, like a booting guest would
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+	}()
+
+	if err := waitForReady(tcpProbe(addr), 5*time.Second, 50*time.Millisecond, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestQemuDriver_WaitForReady_Timeout(t *testing.T) {
+	// A listener that immediately closes connections behaves like Qemu's user
+	// networking forwarding to a port the guest isn't listening on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	err = waitForReady(tcpProbe(l.Addr().String()), 300*time.Millisecond, 50*time.Millisecond, nil)
+	if err == nil {
+		t.Fatalf("expected timeout")
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("took %v to time out", elapsed)
+	}
+
+	// Closing doneCh aborts the wait
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := waitForReady(tcpProbe(l.Addr().String()), time.Minute, 50*time.Millisecond, doneCh); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestQemuDriver_Fingerprint_VFIO(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows fingerprints qemu using qemu-img")
+	}
+	defer setupFakeQemu(t, "echo 'QEMU emulator version 2.5.0'")()
+
+	dir, err := ioutil.TempDir("", "vfio")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDevice, oldGroups := qemuVFIODevice, qemuIOMMUGroupsDir
+	defer func() {
+		qemuVFIODevice, qemuIOMMUGroupsDir = oldDevice, oldGroups
+	}()
+	qemuVFIODevice = filepath.Join(dir, "vfio")
+	qemuIOMMUGroupsDir = filepath.Join(dir, "iommu_groups")
+
+	task := &structs.Task{
+		Name:      "foo",
+		Resources: structs.DefaultResources(),
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+	node := &structs.Node{
+		Attributes: make(map[string]string),
+	}
+
+	// No VFIO device
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := node.Attributes[qemuVFIOAttr]; ok {
+		t.Fatalf("unexpected %s attribute", qemuVFIOAttr)
+	}
+
+	// VFIO device and an IOMMU group
+	if err := ioutil.WriteFile(qemuVFIODevice, nil, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(qemuIOMMUGroupsDir, "0"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node.Attributes[qemuVFIOAttr] != "1" {
+		t.Fatalf("missing %s attribute: %#v", qemuVFIOAttr, node.Attributes)
+	}
+}
+
+func TestQemuDriver_Fingerprint_KVM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows fingerprints qemu using qemu-img")
+	}
+	defer setupFakeQemu(t, "echo 'QEMU emulator version 2.5.0'")()
+
+	dir, err := ioutil.TempDir("", "kvm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDevice := qemuKVMDevice
+	defer func() { qemuKVMDevice = oldDevice }()
+	qemuKVMDevice = filepath.Join(dir, "kvm")
+
+	task := &structs.Task{
+		Name:      "foo",
+		Resources: structs.DefaultResources(),
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+	node := &structs.Node{
+		Attributes: make(map[string]string),
+	}
+
+	// No KVM device
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v := node.Attributes[qemuKVMAttr]; v != "false" {
+		t.Fatalf("got %s = %q; want %q", qemuKVMAttr, v, "false")
+	}
+
+	// Accessible KVM device
+	if err := ioutil.WriteFile(qemuKVMDevice, nil, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v := node.Attributes[qemuKVMAttr]; v != "true" {
+		t.Fatalf("got %s = %q; want %q", qemuKVMAttr, v, "true")
+	}
+}
+
+func TestQemuDriver_PCIPassthroughArgs(t *testing.T) {
+	args, err := qemuPCIPassthroughArgs([]string{"0000:01:00.0", "02:00.1"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{
+		"-device", "vfio-pci,host=0000:01:00.0",
+		"-device", "vfio-pci,host=02:00.1",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("got %v; want %v", args, expected)
+	}
+
+	for _, addr := range []string{"", "01:00", "0000:01:00.8", "zz:00.0", "01:00.0,x-vga=on"} {
+		if _, err := qemuPCIPassthroughArgs([]string{addr}); err == nil {
+			t.Fatalf("expected error for PCI address %q", addr)
+		}
+	}
+}
+
+// fakePCIDevice is a host PCI device bound to driver, or to none if it is
+// empty, in the given IOMMU group, or in none if it is empty
+type fakePCIDevice struct {
+	driver string
+	group  string
+}
+
+// setupFakePCIDevices lists the given devices, keyed by address, as the host's
+// PCI devices along with the VFIO device. The returned function restores the
+// host's devices.
+func setupFakePCIDevices(t *testing.T, devices map[string]fakePCIDevice) func() {
+	dir, err := ioutil.TempDir("", "pci")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	oldDevice, oldGroups, oldDevices := qemuVFIODevice, qemuIOMMUGroupsDir, qemuPCIDevicesDir
+	cleanup := func() {
+		qemuVFIODevice, qemuIOMMUGroupsDir, qemuPCIDevicesDir = oldDevice, oldGroups, oldDevices
+		os.RemoveAll(dir)
+	}
+	qemuVFIODevice = filepath.Join(dir, "vfio")
+	qemuIOMMUGroupsDir = filepath.Join(dir, "iommu_groups")
+	qemuPCIDevicesDir = filepath.Join(dir, "devices")
+
+	must := func(err error) {
+		if err != nil {
+			cleanup()
+			t.Fatalf("err: %v", err)
+		}
+	}
+	must(ioutil.WriteFile(qemuVFIODevice, nil, 0600))
+	must(os.MkdirAll(qemuIOMMUGroupsDir, 0755))
+	for addr, device := range devices {
+		path := filepath.Join(qemuPCIDevicesDir, addr)
+		must(os.MkdirAll(path, 0755))
+		if device.driver != "" {
+			must(os.Symlink(filepath.Join(dir, "drivers", device.driver), filepath.Join(path, "driver")))
+		}
+		if device.group != "" {
+			group := filepath.Join(qemuIOMMUGroupsDir, device.group)
+			must(os.MkdirAll(filepath.Join(group, "devices"), 0755))
+			must(os.Symlink(path, filepath.Join(group, "devices", addr)))
+			must(os.Symlink(group, filepath.Join(path, "iommu_group")))
+		}
+	}
+	return cleanup
+}
+
+func TestQemuDriver_AssignedDevices(t *testing.T) {
+	resources := &structs.Resources{
+		Devices: []*structs.DeviceResource{
+			{Vendor: "nvidia", Type: "gpu", IDs: []string{"GPU-1"}},
+			{Vendor: "nvidia", Type: "vfio", IDs: []string{"0000:01:00.0", "0000:02:00.0"}},
+			{Vendor: "intel", Type: "vfio", IDs: []string{"0000:03:00.0"}},
+		},
+	}
+	expected := []string{"0000:01:00.0", "0000:02:00.0", "0000:03:00.0"}
+	if addrs := qemuAssignedDevices(resources); !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("got %v; want %v", addrs, expected)
+	}
+	if addrs := qemuAssignedDevices(nil); len(addrs) != 0 {
+		t.Fatalf("unexpected devices %v", addrs)
+	}
+}
+
+func TestQemuDriver_CheckPCIDevice(t *testing.T) {
+	defer setupFakePCIDevices(t, map[string]fakePCIDevice{
+		"0000:01:00.0": {qemuVFIODriver, "1"},
+		"0000:01:00.1": {qemuVFIODriver, "1"},
+		"0000:00:01.0": {"pcieport", "1"},
+		"0000:02:00.0": {qemuVFIODriver, "2"},
+		"0000:02:00.1": {"snd_hda_intel", "2"},
+		"0000:03:00.0": {"nvidia", "3"},
+		"0000:04:00.0": {"", "4"},
+		"0000:05:00.0": {qemuVFIODriver, ""},
+	})()
+
+	cases := []struct {
+		addr string
+		err  string
+	}{
+		{"0000:01:00.0", ""},
+		{"01:00.1", ""},
+		{"0000:06:00.0", "doesn't exist"},
+		{"0000:02:00.0", "shares its IOMMU group with device 0000:02:00.1"},
+		{"0000:03:00.0", "it is bound to nvidia"},
+		{"0000:04:00.0", "it isn't bound to a driver"},
+		{"0000:05:00.0", "isn't in an IOMMU group"},
+	}
+	for _, c := range cases {
+		err := qemuCheckPCIDevice(c.addr)
+		if c.err == "" {
+			if err != nil {
+				t.Fatalf("%s: err: %v", c.addr, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expected error containing %q; got %v", c.addr, c.err, err)
+		}
+	}
+
+	expected := []string{"0000:01:00.0", "0000:01:00.1", "0000:02:00.0", "0000:05:00.0"}
+	if devices := qemuVFIODevices(); !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("got devices %v; want %v", devices, expected)
+	}
+}
+
+func TestQemuDriver_PCIPassthrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows fingerprints qemu using qemu-img")
+	}
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "echo 'QEMU emulator version 2.5.0'")()
+	defer setupFakePCIDevices(t, map[string]fakePCIDevice{
+		"0000:01:00.0": {qemuVFIODriver, "1"},
+		"0000:03:00.0": {"nvidia", "3"},
+	})()
+
+	task := testQemuShutdownTask()
+	task.Config["pci_passthrough"] = []string{"01:00.0"}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	node := &structs.Node{Attributes: make(map[string]string)}
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v := node.Attributes[qemuVFIODevicesAttr]; v != "0000:01:00.0" {
+		t.Fatalf("got %s = %q; want %q", qemuVFIODevicesAttr, v, "0000:01:00.0")
+	}
+
+	if args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " "); !strings.Contains(args, "-device vfio-pci,host=01:00.0") {
+		t.Fatalf("expected the device to be passed through: %q", args)
+	}
+
+	// A device in use by the host is rejected
+	task.Config["pci_passthrough"] = []string{"0000:03:00.0"}
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "must be bound to vfio-pci") {
+		t.Fatalf("expected the device to be rejected; got %v", err)
+	}
+
+	// As are devices on hosts without VFIO
+	os.Remove(qemuVFIODevice)
+	task.Config["pci_passthrough"] = []string{"01:00.0"}
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "requires VFIO") {
+		t.Fatalf("expected VFIO to be required; got %v", err)
+	}
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := node.Attributes[qemuVFIODevicesAttr]; ok {
+		t.Fatalf("unexpected %s attribute", qemuVFIODevicesAttr)
+	}
+}
+
+func TestQemuDriver_InvalidDiskFormat(t *testing.T) {
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path":  "linux-0.2.img",
+			"disk_format": "cow",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err == nil {
+		handle.Kill()
+		t.Fatalf("Should've failed")
+	}
+	if !strings.Contains(err.Error(), "disk_format") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// testQemuShutdownTask returns a task for testing Shutdown with a fake qemu
+func TestQemuHandle_QueryStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, qemuMonitorSocket)
+
+	var lock sync.Mutex
+	var status string
+	setStatus := func(s string) {
+		lock.Lock()
+		defer lock.Unlock()
+		status = s
+	}
+	qmp := newFakeQMP(t, path, func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		lock.Lock()
+		defer lock.Unlock()
+		if cmd != "query-status" {
+			return nil, &qmpError{Class: "CommandNotFound", Desc: cmd}
+		}
+		if status == "" {
+			return nil, &qmpError{Class: "GenericError", Desc: "no status"}
+		}
+		return &qmpStatus{Running: status == "running", Status: status}, nil
+	})
+	defer qmp.Close()
+
+	h := &qemuHandle{qmpPath: path}
+	for _, expected := range []string{"running", "paused", "shutdown", "inmigrate"} {
+		setStatus(expected)
+		act, err := h.QueryStatus()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if act != expected {
+			t.Fatalf("QueryStatus() returned %q; want %q", act, expected)
+		}
+	}
+
+	setStatus("")
+	if _, err := h.QueryStatus(); err == nil || !strings.Contains(err.Error(), "no status") {
+		t.Fatalf("expected error; got %v", err)
+	}
+
+	// A handle without a monitor can't be queried
+	if _, err := (&qemuHandle{}).QueryStatus(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func testQemuShutdownTask() *structs.Task {
+	return &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path": "linux-0.2.img",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+}
+
+// qemuDryRun dry runs testQemuShutdownTask with the given config added to its
+// own, against stand-in qemu binaries, and returns the error Start returns.
+func qemuDryRun(t *testing.T, config map[string]interface{}) error {
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-x86_64":  "echo 'QEMU emulator version 2.5.0'",
+		"qemu-system-aarch64": "echo 'QEMU emulator version 2.5.0'",
+	}, true)()
+
+	task := testQemuShutdownTask()
+	for k, v := range config {
+		task.Config[k] = v
+	}
+	task.Config["dry_run"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	_, err := NewQemuDriver(driverCtx).Start(execCtx, task)
+	return err
+}
+
+// qemuDryRunArgs returns the qemu command line qemuDryRun renders for the
+// config, failing the test if the task is rejected.
+func qemuDryRunArgs(t *testing.T, config map[string]interface{}) []string {
+	err := qemuDryRun(t, config)
+	derr, ok := err.(*QemuDryRunError)
+	if !ok {
+		t.Fatalf("%v: expected a dry run error; got %v", config, err)
+	}
+	return derr.Args
+}
+
+// qemuStartDryRun dry runs the task with a driver the test has set up, e.g. by
+// fingerprinting it, and returns the qemu command line. The task is left set
+// to dry run.
+func qemuStartDryRun(t *testing.T, d Driver, execCtx *ExecContext, task *structs.Task) []string {
+	task.Config["dry_run"] = true
+	_, err := d.Start(execCtx, task)
+	derr, ok := err.(*QemuDryRunError)
+	if !ok {
+		t.Fatalf("expected a dry run error; got %v", err)
+	}
+	return derr.Args
+}
+
+func TestQemuDriver_Shutdown(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM exits once it has been asked to power down
+	defer setupFakeQemu(t, "while [ ! -f powerdown ]; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		switch cmd {
+		case "system_powerdown":
+			ioutil.WriteFile(filepath.Join(taskDir, "powerdown"), nil, 0644)
+		case "query-status":
+			return &qmpStatus{Running: true, Status: "running"}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := handle.(*qemuHandle).Shutdown(time.Duration(testutil.TestMultiplier()*5) * time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("unexpected exit: %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if cmds := qmp.Commands(); len(cmds) == 0 || cmds[0] != "system_powerdown" {
+		t.Fatalf("expected system_powerdown; got %v", cmds)
+	}
+}
+
+func TestQemuDriver_Shutdown_Escalate(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM ignores the powerdown request and being interrupted
+	defer setupFakeQemu(t, "trap '' INT; while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "query-status" {
+			return &qmpStatus{Running: true, Status: "running"}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err = handle.(*qemuHandle).Shutdown(1 * time.Second)
+	if err == nil || !strings.Contains(err.Error(), "was killed") {
+		t.Fatalf("expected the VM to be killed; got %v", err)
+	}
+
+	select {
+	case <-handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestQemuDriver_Kill_Powerdown(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM exits once it has been asked to power down
+	defer setupFakeQemu(t, "while [ ! -f powerdown ]; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.KillTimeout = time.Duration(testutil.TestMultiplier()*5) * time.Second
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		switch cmd {
+		case "system_powerdown":
+			ioutil.WriteFile(filepath.Join(taskDir, "powerdown"), nil, 0644)
+		case "query-status":
+			return &qmpStatus{Running: true, Status: "running"}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("expected the guest to power down; got %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if cmds := qmp.Commands(); len(cmds) == 0 || cmds[0] != "system_powerdown" {
+		t.Fatalf("expected system_powerdown; got %v", cmds)
+	}
+}
+
+func TestQemuDriver_Kill_Escalate(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM ignores the powerdown request and being interrupted
+	defer setupFakeQemu(t, "trap '' INT; while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.KillTimeout = 1 * time.Second
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "query-status" {
+			return &qmpStatus{Running: true, Status: "running"}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The powerdown and the kill share the kill timeout
+	start := time.Now()
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 2*task.KillTimeout {
+		t.Fatalf("Kill took %v; want less than %v", elapsed, 2*task.KillTimeout)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if res.Successful() {
+			t.Fatalf("expected the VM to be killed; got %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestQemuDriver_Kill_Grace(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM ignores the powerdown request but exits cleanly once it is
+	// interrupted
+	defer setupFakeQemu(t, "trap 'exit 0' INT; while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.KillTimeout = 2 * time.Second
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "query-status" {
+			return &qmpStatus{Running: true, Status: "running"}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The VM is left part of the kill timeout to exit after the powerdown
+	// timed out, rather than the executor exiting right away
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("expected the VM to exit once interrupted; got %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestQemuSplitKillTimeout(t *testing.T) {
+	cases := []struct {
+		timeout   time.Duration
+		powerdown time.Duration
+		grace     time.Duration
+	}{
+		{30 * time.Second, 25 * time.Second, qemuKillGrace},
+		{2 * qemuKillGrace, qemuKillGrace, qemuKillGrace},
+		{2 * time.Second, 1 * time.Second, 1 * time.Second},
+		{0, 0, 0},
+	}
+	for _, c := range cases {
+		powerdown, grace := qemuSplitKillTimeout(c.timeout)
+		if powerdown != c.powerdown || grace != c.grace {
+			t.Fatalf("qemuSplitKillTimeout(%v) = %v, %v; want %v, %v",
+				c.timeout, powerdown, grace, c.powerdown, c.grace)
+		}
+	}
+}
+
+func TestQemuDriver_CheckDiskSpace(t *testing.T) {
+	old := qemuFreeDiskBytes
+	defer func() { qemuFreeDiskBytes = old }()
+	qemuFreeDiskBytes = func(string) (uint64, error) {
+		return 100 * 1024 * 1024, nil
+	}
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]interface{}{
+			"image_path": "linux-0.2.img",
+			"disk_mb":    200,
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err == nil {
+		handle.Kill()
+		t.Fatalf("Should've failed")
+	}
+	if !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rerr, ok := err.(*structs.RecoverableError); !ok || !rerr.Recoverable {
+		t.Fatalf("expected a recoverable error; got %#v", err)
+	}
+
+	// Space already used by the disks counts towards the requirement
+	if err := qemuCheckDiskSpace("/", 200*1024*1024, 150*1024*1024); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := qemuCheckDiskSpace("/", 200*1024*1024, 50*1024*1024); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The check is skipped where the free space can't be determined
+	qemuFreeDiskBytes = func(string) (uint64, error) {
+		return 0, errFreeDiskUnsupported
+	}
+	if err := qemuCheckDiskSpace("/", 200*1024*1024, 50*1024*1024); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestQemuDriver_StartErrors(t *testing.T) {
+	task := &structs.Task{
+		Name:      "linux",
+		Config:    map[string]interface{}{},
+		Resources: basicResources,
+	}
+
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	if _, err := d.Start(execCtx, task); err != ErrQemuMissingImagePath {
+		t.Fatalf("expected ErrQemuMissingImagePath; got %v", err)
+	}
+
+	// Invalid configuration won't fix itself on a retry
+	task.Config = map[string]interface{}{
+		"image_path":  "linux-0.2.img",
+		"disk_format": "iso",
+	}
+	_, err := d.Start(execCtx, task)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if rerr, ok := err.(*structs.RecoverableError); ok && rerr.Recoverable {
+		t.Fatalf("expected a fatal error; got %#v", err)
+	}
+}
+
+func TestQemuDriver_Bridge(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	logDir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+	ipLog := filepath.Join(logDir, "ip.log")
+
+	// The fake VM exits as soon as it's started
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-x86_64": "exit 0",
+		"ip":                 fmt.Sprintf("echo \"$@\" >> %s", ipLog),
+	}, true)()
+
+	task := testQemuShutdownTask()
+	task.Config["network_mode"] = "bridge"
+	task.Config["bridge"] = "nomadbr0"
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case <-handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	tap := qemuTapName(execCtx.AllocID, task.Name)
+	data, err := ioutil.ReadFile(ipLog)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{
+		fmt.Sprintf("tuntap add dev %s mode tap", tap),
+		fmt.Sprintf("link set dev %s master nomadbr0", tap),
+		fmt.Sprintf("link set dev %s up", tap),
+		fmt.Sprintf("tuntap del dev %s mode tap", tap),
+	}
+	if act := strings.Split(strings.TrimSpace(string(data)), "\n"); !reflect.DeepEqual(act, expected) {
+		t.Fatalf("ip commands %q; want %q", act, expected)
+	}
+}
+
+func TestQemuDriver_ParseMAC(t *testing.T) {
+	mac, err := qemuParseMAC("52:54:00:AB:cd:01")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mac != "52:54:00:ab:cd:01" {
+		t.Fatalf("got %q; want %q", mac, "52:54:00:ab:cd:01")
+	}
+
+	for _, addr := range []string{"", "52:54:00:ab:cd", "00:00:5e:00:53:00:00:01", "01:00:5e:00:00:01", "nomad"} {
+		if _, err := qemuParseMAC(addr); err == nil {
+			t.Fatalf("expected error for MAC address %q", addr)
+		}
+	}
+}
+
+func TestQemuDriver_GuestAddress(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-x86_64": "while true; do /bin/sleep 0.1; done",
+		"ip":                 "exit 0",
+	}, true)()
+
+	task := testQemuShutdownTask()
+	task.Config["network_mode"] = "bridge"
+	task.Config["mac_address"] = "52:54:00:AB:CD:01"
+	task.Config["guest_address"] = "10.0.0.5"
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	if args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " "); !strings.Contains(args, "virtio-net,netdev=net0,mac=52:54:00:ab:cd:01") {
+		t.Fatalf("expected the configured MAC address in %q", args)
+	}
+
+	// Services are registered with the guest's address, also once reopened
+	delete(task.Config, "dry_run")
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+	if addr := handle.(*qemuHandle).consulContext(driverCtx.config).ServiceAddress; addr != "10.0.0.5" {
+		t.Fatalf("got service address %q; want %q", addr, "10.0.0.5")
+	}
+
+	handle2, err := d.Open(execCtx, handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr := handle2.(*qemuHandle).consulContext(driverCtx.config).ServiceAddress; addr != "10.0.0.5" {
+		t.Fatalf("got service address %q after reopening; want %q", addr, "10.0.0.5")
+	}
+}
+
+func TestQemuDriver_NetworkRateLimit(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	logDir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+	tcLog := filepath.Join(logDir, "tc.log")
+
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-x86_64": "exit 0",
+		"ip":                 "exit 0",
+		"tc":                 fmt.Sprintf("echo \"$@\" >> %s", tcLog),
+	}, true)()
+
+	task := testQemuShutdownTask()
+	task.Config["network_mode"] = "bridge"
+	task.Config["network_rate_limit"] = 100
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case <-handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	tap := qemuTapName(execCtx.AllocID, task.Name)
+	data, err := ioutil.ReadFile(tcLog)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{
+		fmt.Sprintf("qdisc add dev %s root handle 1: htb default 1", tap),
+		fmt.Sprintf("class add dev %s parent 1: classid 1:1 htb rate 100mbit burst 125k", tap),
+		fmt.Sprintf("qdisc add dev %s handle ffff: ingress", tap),
+		fmt.Sprintf("filter add dev %s parent ffff: protocol all u32 match u32 0 0 police rate 100mbit burst 125k drop flowid :1", tap),
+	}
+	if act := strings.Split(strings.TrimSpace(string(data)), "\n"); !reflect.DeepEqual(act, expected) {
+		t.Fatalf("tc commands %q; want %q", act, expected)
+	}
+
+	// User networking can't be limited
+	invalid := []map[string]interface{}{
+		{"network_rate_limit": 100},
+		{"network_mode": "bridge", "network_rate_limit": -1},
+	}
+	for _, config := range invalid {
+		task := testQemuShutdownTask()
+		for k, v := range config {
+			task.Config[k] = v
+		}
+		if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "network_rate_limit") {
+			t.Fatalf("expected network_rate_limit error for %v; got %v", config, err)
+		}
+	}
+}
+
+func TestQemuDriver_BridgeArgs(t *testing.T) {
+	tap := qemuTapName("a8198d79-cfdb-6593-a999-1e9adabcba2e", "web")
+	if len(tap) > 15 {
+		t.Fatalf("tap device name %q is longer than 15 characters", tap)
+	}
+	if other := qemuTapName("a8198d79-cfdb-6593-a999-1e9adabcba2e", "db"); other == tap {
+		t.Fatalf("tasks share the tap device name %q", tap)
+	}
+
+	mac := qemuMACAddress("a8198d79-cfdb-6593-a999-1e9adabcba2e", "web")
+	if _, err := net.ParseMAC(mac); err != nil || !strings.HasPrefix(mac, "52:54:00:") {
+		t.Fatalf("invalid MAC address %q: %v", mac, err)
+	}
+
+	expected := []string{
+		"-netdev", fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no", tap),
+		"-device", fmt.Sprintf("virtio-net,netdev=net0,mac=%s", mac),
+	}
+	if args := qemuTapArgs(tap, mac); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("args %q; want %q", args, expected)
+	}
+
+	cases := []struct {
+		config map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"network_mode": "nat"}, "Invalid network_mode"},
+		{map[string]interface{}{
+			"network_mode": "bridge",
+			"port_map":     []map[string]interface{}{{"main": 22}},
+		}, "port_map is only supported"},
+		{map[string]interface{}{"mac_address": "52:54:00:12:34:56"}, "mac_address requires"},
+		{map[string]interface{}{"network_mode": "bridge", "mac_address": "52:54:00:12:34"}, "Invalid mac_address"},
+		{map[string]interface{}{"guest_address": "10.0.0.5"}, "guest_address requires"},
+		{map[string]interface{}{"network_mode": "bridge", "guest_address": "10.0.0"}, "Invalid guest_address"},
+	}
+	for _, c := range cases {
+		task := testQemuShutdownTask()
+		for k, v := range c.config {
+			task.Config[k] = v
+		}
+		driverCtx, execCtx := testDriverContexts(task)
+		d := NewQemuDriver(driverCtx)
+		_, err := d.Start(execCtx, task)
+		execCtx.AllocDir.Destroy()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("config %v: expected error %q; got %v", c.config, c.err, err)
+		}
+	}
+}
+
+func TestQemuDriver_Hooks(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The fake VM exits as soon as it's started
+	defer setupFakeQemu(t, "exit 0")()
+
+	task := testQemuShutdownTask()
+	task.Config["pre_start_command"] = []string{"/bin/sh", "-c", "echo $NOMAD_TASK_NAME > pre_start"}
+	task.Config["post_stop_command"] = []string{"/bin/touch", "post_stop"}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{qemuHooksConfigOption: "true"}
+	d := NewQemuDriver(driverCtx)
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(taskDir, "pre_start"))
+	if err != nil {
+		t.Fatalf("pre_start_command didn't run: %v", err)
+	}
+	if act := strings.TrimSpace(string(out)); act != task.Name {
+		t.Fatalf("pre_start_command saw task name %q; want %q", act, task.Name)
+	}
+
+	select {
+	case <-handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "post_stop")); err != nil {
+		t.Fatalf("post_stop_command didn't run before the VM was reported exited: %v", err)
+	}
+}
+
+func TestQemuDriver_PreStartFailure(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "exit 0")()
+
+	task := testQemuShutdownTask()
+	task.Config["pre_start_command"] = []string{"/bin/sh", "-c", "echo no bridge; exit 3"}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{qemuHooksConfigOption: "true"}
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err == nil {
+		handle.Kill()
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "pre_start_command failed") || !strings.Contains(err.Error(), "no bridge") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestQemuDriver_LaunchFailure_PostStop(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The data disk fails to be created after pre_start_command has run
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-system-x86_64": "exit 0",
+		"qemu-img":           "echo disk full; exit 1",
+	}, true)()
+
+	task := testQemuShutdownTask()
+	task.Config["pre_start_command"] = []string{"/bin/touch", "pre_start"}
+	task.Config["post_stop_command"] = []string{"/bin/touch", "post_stop"}
+	task.Config["disk"] = []map[string]interface{}{
+		{"size": "1G"},
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{qemuHooksConfigOption: "true"}
+	d := NewQemuDriver(driverCtx)
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+
+	handle, err := d.Start(execCtx, task)
+	if err == nil {
+		handle.Kill()
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "pre_start")); err != nil {
+		t.Fatalf("pre_start_command didn't run: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "post_stop")); err != nil {
+		t.Fatalf("post_stop_command didn't run after the VM failed to launch: %v", err)
+	}
+}
+
+func TestQemuDriver_InvalidConfig_PreStart(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	task := testQemuShutdownTask()
+	task.Config["pre_start_command"] = []string{"/bin/touch", "pre_start"}
+	task.Config["disk"] = []map[string]interface{}{
+		{"size": "huge"},
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{qemuHooksConfigOption: "true"}
+	d := NewQemuDriver(driverCtx)
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+
+	handle, err := d.Start(execCtx, task)
+	if err == nil {
+		handle.Kill()
+		t.Fatalf("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "pre_start")); !os.IsNotExist(err) {
+		t.Fatalf("pre_start_command ran for an invalid configuration: %v", err)
+	}
+}
+
+func TestQemuDriver_HooksDisabled(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "exit 0")()
+
+	for _, key := range []string{"pre_start_command", "post_stop_command"} {
+		task := testQemuShutdownTask()
+		task.Config[key] = []string{"/bin/touch", "hook"}
+		driverCtx, execCtx := testDriverContexts(task)
+		d := NewQemuDriver(driverCtx)
+		taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+
+		handle, err := d.Start(execCtx, task)
+		if err == nil {
+			handle.Kill()
+		}
+		_, statErr := os.Stat(filepath.Join(taskDir, "hook"))
+		execCtx.AllocDir.Destroy()
+		if err == nil || !strings.Contains(err.Error(), qemuHooksConfigOption) {
+			t.Fatalf("%s: expected hooks to be disabled by default; got %v", key, err)
+		}
+		if !os.IsNotExist(statErr) {
+			t.Fatalf("%s: hook ran while disabled: %v", key, statErr)
+		}
+	}
+}
+
+func TestQemuHook_Timeout(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The processes the hook starts are killed along with it, as they would
+	// otherwise keep its output open
+	hook, err := newQemuHook([]string{"/bin/sh", "-c", "/bin/sleep 10; true"}, "100ms", os.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	start := time.Now()
+	if err := hook.run(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("hook wasn't killed on timeout: took %v", elapsed)
+	}
+
+	if _, err := newQemuHook([]string{"/bin/true"}, "soon", "", nil); err == nil {
+		t.Fatalf("expected error for invalid hook_timeout")
+	}
+}
+
+func TestQemuDriver_PortForwards(t *testing.T) {
+	taskPorts := map[string]int{"ssh": 22000, "http": 22080, "dup": 22000}
+
+	forwarding, err := qemuPortForwards(map[string]int{"ssh": 22, "http": 80}, taskPorts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{
+		"hostfwd=udp::22080-:80", "hostfwd=tcp::22080-:80",
+		"hostfwd=udp::22000-:22", "hostfwd=tcp::22000-:22",
+	}
+	if !reflect.DeepEqual(forwarding, expected) {
+		t.Fatalf("forwarding %q; want %q", forwarding, expected)
+	}
+
+	cases := []struct {
+		portMap map[string]int
+		err     string
+	}{
+		{map[string]int{"ssh": 22, "missing": 80}, `Unknown port label "missing"`},
+		{map[string]int{"ssh": 22, "dup": 80}, `Port labels "dup" and "ssh" both map host port 22000`},
+	}
+	for _, c := range cases {
+		_, err := qemuPortForwards(c.portMap, taskPorts)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("port map %v: expected error %q; got %v", c.portMap, c.err, err)
+		}
+	}
+}
+
+func TestQemuDriver_PortMapValidation(t *testing.T) {
+	cases := []struct {
+		guest interface{}
+		err   string
+	}{
+		{"abc", "port_map"},
+		{0, "not between 1 and 65535"},
+		{-22, "not between 1 and 65535"},
+		{65536, "not between 1 and 65535"},
+	}
+
+	for _, c := range cases {
+		task := &structs.Task{
+			Name: "linux",
+			Config: map[string]interface{}{
+				"image_path": "linux-0.2.img",
+				"port_map": []map[string]interface{}{{
+					"main": c.guest,
+				}},
+			},
+			Resources: &structs.Resources{
+				MemoryMB: 512,
+				Networks: []*structs.NetworkResource{
+					&structs.NetworkResource{
+						ReservedPorts: []structs.Port{{Label: "main", Value: 22000}},
+					},
+				},
+			},
+		}
+
+		driverCtx, execCtx := testDriverContexts(task)
+		d := NewQemuDriver(driverCtx)
+		handle, err := d.Start(execCtx, task)
+		execCtx.AllocDir.Destroy()
+		if err == nil {
+			handle.Kill()
+			t.Fatalf("guest port %v: expected error", c.guest)
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("guest port %v: unexpected error: %v", c.guest, err)
+		}
+	}
+
+	for _, port := range []int{1, 22, 65535} {
+		if err := qemuValidatePort(port); err != nil {
+			t.Fatalf("port %d: err: %v", port, err)
+		}
+	}
+}
+
+func TestQemuDriver_Balloon(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, `echo "$@" > args; while true; do /bin/sleep 0.1; done`)()
+
+	task := testQemuShutdownTask()
+	task.Config["balloon"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	var lock sync.Mutex
+	var values []int64
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "balloon" {
+			var a struct {
+				Value int64 `json:"value"`
+			}
+			json.Unmarshal(args, &a)
+			lock.Lock()
+			values = append(values, a.Value)
+			lock.Unlock()
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	testutil.WaitForResult(func() (bool, error) {
+		out, err := ioutil.ReadFile(filepath.Join(taskDir, "args"))
+		if err != nil {
+			return false, err
+		}
+		if !strings.Contains(string(out), "-device virtio-balloon") {
+			return false, fmt.Errorf("missing balloon device in %q", out)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Shrink the VM
+	updated := testQemuShutdownTask()
+	updated.Config["balloon"] = true
+	updated.Resources = &structs.Resources{MemoryMB: 128}
+	if err := handle.Update(updated); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Growing beyond the memory the VM was started with is rejected
+	updated.Resources = &structs.Resources{MemoryMB: basicResources.MemoryMB * 2}
+	if err := handle.Update(updated); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if expected := []int64{128 * 1024 * 1024}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("balloon values %v; want %v", values, expected)
+	}
+}
+
+func TestQemuDriver_WatchHealth(t *testing.T) {
+	// A probe that recovers before reaching the threshold keeps the VM healthy
+	results := []error{nil, fmt.Errorf("down"), nil, fmt.Errorf("down"), fmt.Errorf("down")}
+	calls := 0
+	probe := func() error {
+		err := results[calls]
+		calls++
+		return err
+	}
+
+	err := watchHealth(probe, time.Millisecond, 2, time.Time{}, make(chan struct{}))
+	if err == nil || !strings.Contains(err.Error(), "2 consecutive health checks failed: down") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != len(results) {
+		t.Fatalf("probe called %d times; want %d", calls, len(results))
+	}
+
+	// The check stops once the VM exits
+	doneCh := make(chan struct{})
+	close(doneCh)
+	healthy := func() error { return nil }
+	if err := watchHealth(healthy, time.Hour, 1, time.Time{}, doneCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestQemuDriver_HealthCheck(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["health_check"] = "qmp"
+	task.Config["health_interval"] = "50ms"
+	task.Config["health_failures"] = 2
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	// The guest panics after a few checks
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	var lock sync.Mutex
+	checks := 0
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		lock.Lock()
+		defer lock.Unlock()
+		checks++
+		if checks > 3 {
+			return &qmpStatus{Running: false, Status: "guest-panicked"}, nil
+		}
+		return &qmpStatus{Running: true, Status: "running"}, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if res.Successful() {
+			t.Fatalf("expected the unhealthy VM to fail")
+		}
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "guest-panicked") {
+			t.Fatalf("unexpected result: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		handle.Kill()
+		t.Fatalf("timeout")
+	}
+}
+
+func TestQemuDriver_HealthCheckConfig(t *testing.T) {
+	task := &structs.Task{Resources: basicResources}
+	cfg := &QemuDriverConfig{
+		PortMap:     []map[string]int{{"main": 22}},
+		HealthCheck: "tcp",
+		HealthPort:  "main",
+	}
+	check, err := qemuHealthCheckConfig(cfg, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := &qemuHealthCheck{
+		Type:     "tcp",
+		Addr:     "127.0.0.1:12345",
+		Interval: qemuDefaultHealthInterval,
+		Failures: qemuDefaultHealthFailures,
+	}
+	if !reflect.DeepEqual(check, expected) {
+		t.Fatalf("got %#v; want %#v", check, expected)
+	}
+
+	for _, c := range []*QemuDriverConfig{
+		{HealthCheck: "tcp"},
+		{HealthCheck: "tcp", HealthPort: "web"},
+		{HealthCheck: "http"},
+		{HealthCheck: "qmp", HealthInterval: "often"},
+		{HealthCheck: "qmp", HealthFailures: -1},
+	} {
+		if _, err := qemuHealthCheckConfig(c, task); err == nil {
+			t.Fatalf("expected error for %#v", c)
+		}
+	}
+}
+
+func TestQemuDriver_MemoryArg(t *testing.T) {
+	task := &structs.Task{Resources: basicResources}
+	cases := []struct {
+		memory string
+		arg    string
+		mb     int
+	}{
+		{"", "256M", 256},
+		{"512M", "512M", 512},
+		{"512", "512M", 512},
+		{"2G", "2048M", 2048},
+		{"2gb", "2048M", 2048},
+		{"1536k", "1536K", 1},
+	}
+	for _, c := range cases {
+		arg, mb, _, err := qemuMemoryArg(&QemuDriverConfig{Memory: c.memory}, task)
+		if err != nil {
+			t.Fatalf("memory %q: err: %v", c.memory, err)
+		}
+		if arg != c.arg || mb != c.mb {
+			t.Fatalf("memory %q: got (%q, %d); want (%q, %d)", c.memory, arg, mb, c.arg, c.mb)
+		}
+	}
+
+	for _, memory := range []string{"lots", "2X", "-1G", "0M", "1.5G"} {
+		if _, _, _, err := qemuMemoryArg(&QemuDriverConfig{Memory: memory}, task); err == nil {
+			t.Fatalf("memory %q: expected error", memory)
+		}
+	}
+}
+
+func TestQemuDriver_DryRun(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "/bin/touch launched")()
+
+	task := testQemuShutdownTask()
+	task.Config["dry_run"] = true
+	task.Config["snapshot"] = true
+	task.Config["pre_start_command"] = []string{"/bin/touch", "pre_start"}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{qemuHooksConfigOption: "true"}
+	d := NewQemuDriver(driverCtx)
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+
+	handle, err := d.Start(execCtx, task)
+	if err == nil {
+		handle.Kill()
+		t.Fatalf("expected error")
+	}
+	derr, ok := err.(*QemuDryRunError)
+	if !ok {
+		t.Fatalf("expected a dry run error; got %v", err)
+	}
+
+	bin, err := GetAbsolutePath("qemu-system-x86_64")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{
+		bin,
+		"-machine", "type=pc,accel=tcg",
+		"-name", "linux-0.2.img",
+		"-m", "256M",
+		"-drive", "file=linux-0.2.img,snapshot=on",
+		"-nographic",
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", filepath.Join(taskDir, qemuMonitorSocket)),
+	}
+	if !reflect.DeepEqual(derr.Args, expected) {
+		t.Fatalf("args %q; want %q", derr.Args, expected)
+	}
+
+	for _, name := range []string{"launched", "pre_start"} {
+		if _, err := os.Stat(filepath.Join(taskDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s exists after a dry run: %v", name, err)
+		}
+	}
+}
+
+func TestQemuDriver_DryRun_NoSideEffects(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// Only qemu is on the PATH, so the seed ISO can't be created
+	defer setupFakeBinaries(t, map[string]string{"qemu-system-x86_64": "/bin/touch launched"}, false)()
+
+	// The node has no space left for the VM's disks
+	old := qemuFreeDiskBytes
+	defer func() { qemuFreeDiskBytes = old }()
+	qemuFreeDiskBytes = func(string) (uint64, error) {
+		return 0, nil
+	}
+
+	task := testQemuShutdownTask()
+	task.Config["dry_run"] = true
+	task.Config["user_data"] = "#cloud-config\n"
+	task.Config["raw_device"] = "/nonexistent/disk"
+	task.Config["disk_mb"] = 1024
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+
+	_, err := d.Start(execCtx, task)
+	derr, ok := err.(*QemuDryRunError)
+	if !ok {
+		t.Fatalf("expected a dry run error; got %v", err)
+	}
+	args := strings.Join(derr.Args, " ")
+	for _, expected := range []string{
+		" -cdrom " + filepath.Join(taskDir, qemuSeedISO),
+		" -drive file=/nonexistent/disk,if=virtio,format=raw",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Fatalf("expected %q in %q", expected, args)
+		}
+	}
+
+	for _, name := range []string{"launched", qemuSeedDir, qemuSeedISO} {
+		if _, err := os.Stat(filepath.Join(taskDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s exists after a dry run: %v", name, err)
+		}
+	}
+}
+
+func TestQemuDriver_DryRunArgs(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	cases := []struct {
+		config   map[string]interface{}
+		expected string
+	}{
+		{
+			map[string]interface{}{"arch": "aarch64"},
+			" -machine type=virt,",
+		},
+		{
+			map[string]interface{}{"overlay": true, "disk_format": "raw"},
+			" -drive file=overlay.qcow2,format=qcow2 ",
+		},
+		{
+			map[string]interface{}{"convert_format": "qcow2"},
+			" -drive file=converted.qcow2,format=qcow2 ",
+		},
+		// WHPX is only available on windows
+		{
+			map[string]interface{}{"accelerator": "whpx", "accelerator_fallback": "tcg"},
+			" -machine type=pc,accel=tcg ",
+		},
+	}
+	for _, c := range cases {
+		if args := strings.Join(qemuDryRunArgs(t, c.config), " "); !strings.Contains(args, c.expected) {
+			t.Fatalf("%v: expected %q in %q", c.config, c.expected, args)
+		}
+	}
+}
+
+func TestQemuDriver_DryRun_Invalid(t *testing.T) {
+	cases := []struct {
+		config map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"overlay": true, "image_path": "/images/linux.img"}, "overlay"},
+		{map[string]interface{}{"convert_format": "vmdk"}, "convert_format"},
+		{map[string]interface{}{"convert_format": "raw", "overlay": true}, "convert_format"},
+		{map[string]interface{}{"disk_size": "big"}, "Invalid disk_size"},
+		{map[string]interface{}{"disk_size": "10G", "readonly": true}, "readonly"},
+		{map[string]interface{}{"disk_size": "10G", "disk_mb": 1024}, "must not exceed disk_mb"},
+		{map[string]interface{}{"save_state": true, "snapshot": true}, "save_state"},
+		{map[string]interface{}{"save_state": true, "pci_passthrough": []string{"0000:01:00.0"}}, "save_state"},
+	}
+	for _, c := range cases {
+		if err := qemuDryRun(t, c.config); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%v: expected error containing %q; got %v", c.config, c.err, err)
+		}
+	}
+}
+
+func TestQemuDriver_GuestAgent(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["guest_agent"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+
+	addrCh := make(chan map[string]string, 1)
+	driverCtx.eventSink = func(e *DriverEvent) {
+		if e.Type == qemuEventGuestAddresses {
+			addrCh <- e.Details
+		}
+	}
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qga := newFakeQGA(t, filepath.Join(taskDir, qemuAgentSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		switch cmd {
+		case "guest-network-get-interfaces":
+			return []map[string]interface{}{
+				{"name": "lo", "ip-addresses": []map[string]string{{"ip-address": "127.0.0.1"}}},
+				{"name": "eth0", "ip-addresses": []map[string]string{{"ip-address": "fe80::1"}, {"ip-address": "10.0.2.15"}}},
+			}, nil
+		case "guest-info":
+			return map[string]string{"version": "2.5.0"}, nil
+		}
+		return nil, nil
+	})
+	defer qga.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	expected := map[string]string{"eth0": "10.0.2.15,fe80::1"}
+	select {
+	case addrs := <-addrCh:
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Fatalf("addresses %v; want %v", addrs, expected)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout waiting for the guest addresses")
+	}
+
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := handle.(*qemuHandle).GuestAgent("guest-info", nil, &info); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if info.Version != "2.5.0" {
+		t.Fatalf("unexpected guest-info: %#v", info)
+	}
+
+	// The guest's filesystems are synced before it is powered down
+	handle.(*qemuHandle).powerdown(0)
+	cmds := qga.Commands()
+	if n := len(cmds); n < 2 || cmds[n-2] != "guest-fsfreeze-freeze" || cmds[n-1] != "guest-fsfreeze-thaw" {
+		t.Fatalf("expected the filesystems to be frozen and thawed; got %v", cmds)
+	}
+}
+
+func TestQemuDriver_GuestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad-qemu")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The command only reports its output once it has exited
+	polls := 0
+	path := filepath.Join(dir, qemuAgentSocket)
+	qga := newFakeQGA(t, path, func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		switch cmd {
+		case "guest-exec":
+			var a struct {
+				Path          string   `json:"path"`
+				Arg           []string `json:"arg"`
+				CaptureOutput bool     `json:"capture-output"`
+			}
+			json.Unmarshal(args, &a)
+			if a.Path != "uname" || !reflect.DeepEqual(a.Arg, []string{"-a"}) || !a.CaptureOutput {
+				return nil, &qmpError{Class: "GenericError", Desc: fmt.Sprintf("bad guest-exec: %s", args)}
+			}
+			return map[string]int{"pid": 42}, nil
+		case "guest-exec-status":
+			if polls++; polls < 3 {
+				return map[string]interface{}{"exited": false}, nil
+			}
+			return map[string]interface{}{
+				"exited":   true,
+				"exitcode": 2,
+				"out-data": base64.StdEncoding.EncodeToString([]byte("Linux\n")),
+				"err-data": base64.StdEncoding.EncodeToString([]byte("warning\n")),
+			}, nil
+		}
+		return nil, nil
+	})
+	defer qga.Close()
+
+	res, err := guestExec(path, "uname", []string{"-a"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 2 || res.Output != "Linux\nwarning\n" {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// VMs without a guest agent can't run commands
+	if _, err := guestExec("", "uname", nil); err == nil {
+		t.Fatalf("expected an error without a guest agent")
+	}
+}
+
+func TestQemuDriver_GuestAgentArgs(t *testing.T) {
+	path := "/tmp/qga.sock"
+	expected := []string{
+		"-chardev", "socket,path=/tmp/qga.sock,server,nowait,id=qga0",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+	}
+	if args := qemuAgentArgs(path); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("args %q; want %q", args, expected)
+	}
+}
+
+func TestQemuDriver_AcceleratorFallback(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	dir, err := ioutil.TempDir("", "kvm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDevice := qemuKVMDevice
+	defer func() { qemuKVMDevice = oldDevice }()
+	qemuKVMDevice = filepath.Join(dir, "kvm")
+
+	cases := []struct {
+		fallback string
+		kvm      bool
+		machine  string
+	}{
+		// Fallback taken
+		{"tcg", false, "type=pc,accel=tcg"},
+		// KVM available
+		{"tcg", true, "type=pc,accel=kvm"},
+		// Fallback disabled, qemu fails to use KVM as before
+		{"", false, "type=pc,accel=kvm"},
+	}
+
+	for _, c := range cases {
+		os.Remove(qemuKVMDevice)
+		if c.kvm {
+			if err := ioutil.WriteFile(qemuKVMDevice, nil, 0600); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+
+		args := strings.Join(qemuDryRunArgs(t, map[string]interface{}{
+			"accelerator":          "kvm",
+			"accelerator_fallback": c.fallback,
+		}), " ")
+		if !strings.Contains(args, "-machine "+c.machine+" ") {
+			t.Fatalf("fallback %q, kvm %v: unexpected args %q", c.fallback, c.kvm, args)
+		}
+		if enabled := strings.Contains(args, "-enable-kvm"); enabled != (c.machine == "type=pc,accel=kvm") {
+			t.Fatalf("fallback %q, kvm %v: unexpected args %q", c.fallback, c.kvm, args)
+		}
+	}
+}
+
+func TestQemuDriver_StartTime(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	before := time.Now()
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	h := handle.(*qemuHandle)
+	start := h.StartTime()
+	if start.Before(before) || start.After(time.Now()) {
+		t.Fatalf("start time %v not between %v and now", start, before)
+	}
+	uptime := h.Uptime()
+	time.Sleep(10 * time.Millisecond)
+	if h.Uptime() <= uptime {
+		t.Fatalf("uptime didn't increase from %v", uptime)
+	}
+
+	// The start time round-trips through the handle ID
+	handle2, err := d.Open(execCtx, handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if act := handle2.(*qemuHandle).StartTime(); !act.Equal(start) {
+		t.Fatalf("reopened start time %v; want %v", act, start)
+	}
+
+	// Handle IDs without a start time recover it from the process
+	var id qemuId
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id.StartTime = time.Time{}
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle3, err := d.Open(execCtx, string(data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	act := handle3.(*qemuHandle).StartTime()
+	if diff := act.Sub(start); diff > 2*time.Second || diff < -2*time.Second {
+		t.Fatalf("recovered start time %v; want about %v", act, start)
+	}
+}
+
+func TestQemuDriver_RawDeviceArg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raw")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data,1.raw")
+	if err := ioutil.WriteFile(path, make([]byte, 1024), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	drive, err := qemuRawDeviceArg(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := fmt.Sprintf("file=%s,if=virtio,format=raw", filepath.Join(dir, "data,,1.raw"))
+	if drive != expected {
+		t.Fatalf("qemuRawDeviceArg returned %q; want %q", drive, expected)
+	}
+
+	if _, err := qemuRawDeviceArg("data.raw"); err == nil {
+		t.Fatalf("expected error for a relative path")
+	}
+
+	if err := qemuCheckRawDevice(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.raw"), dir} {
+		if err := qemuCheckRawDevice(path); err == nil {
+			t.Fatalf("%q: expected error", path)
+		}
+	}
+}
+
+func TestQemuDriver_ProtectImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "linux.img")
+
+	mode := func(m os.FileMode) *os.FileMode { return &m }
+	cases := []struct {
+		initial      os.FileMode
+		mode         *os.FileMode
+		writeProtect bool
+		expected     os.FileMode
+	}{
+		// Never world-writable
+		{0666, nil, false, 0664},
+		{0644, nil, false, 0644},
+		{0666, mode(0640), false, 0640},
+		{0644, mode(0600), true, 0400},
+		{0666, nil, true, 0444},
+	}
+
+	for _, c := range cases {
+		if err := ioutil.WriteFile(image, nil, 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.Chmod(image, c.initial); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := qemuProtectImage(image, c.mode, c.writeProtect); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		fi, err := os.Stat(image)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if perm := fi.Mode().Perm(); perm != c.expected {
+			t.Fatalf("%#v: image has mode %v; want %v", c, perm, c.expected)
+		}
+		os.Remove(image)
+	}
+
+	// A missing image is only an error if permissions were requested
+	if err := qemuProtectImage(image, nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := qemuProtectImage(image, mode(0600), false); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestQemuDriver_ImageMode(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	defer setupFakeQemu(t, "exit 0")()
+
+	task := testQemuShutdownTask()
+	task.Config["image_mode"] = "0640"
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	image := filepath.Join(execCtx.AllocDir.TaskDirs[task.Name], "linux-0.2.img")
+	if err := ioutil.WriteFile(image, []byte("image"), 0666); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	fi, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0640 {
+		t.Fatalf("image has mode %v; want %v", perm, os.FileMode(0640))
+	}
+
+	task.Config["image_mode"] = "rw-r-----"
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "image_mode") {
+		t.Fatalf("expected image_mode error; got %v", err)
+	}
+}
+
+func TestQemuDriver_Open_HandleFormats(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["balloon"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+	h := handle.(*qemuHandle)
+
+	// Handles of the current format keep all of their state
+	h2, err := d.Open(execCtx, handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reopened := h2.(*qemuHandle)
+	if reopened.vmID != h.vmID || reopened.qmpPath != h.qmpPath || !reopened.balloon ||
+		reopened.memoryMB != h.memoryMB || !reopened.StartTime().Equal(h.StartTime()) {
+		t.Fatalf("reopened handle %#v doesn't match %#v", reopened, h)
+	}
+
+	// Handles of older versions only had the fields shared with the other
+	// executor based drivers
+	var id map[string]interface{}
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	old := make(map[string]interface{})
+	for _, k := range []string{"Version", "KillTimeout", "MaxKillTimeout", "UserPid", "PluginConfig", "AllocDir"} {
+		old[k] = id[k]
+	}
+	data, err := json.Marshal(old)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	h3, err := d.Open(execCtx, string(data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	oldHandle := h3.(*qemuHandle)
+	if oldHandle.qmpPath != "" || oldHandle.balloon || oldHandle.healthCheck != nil || oldHandle.postStop != nil {
+		t.Fatalf("unexpected state in handle of an old ID: %#v", oldHandle)
+	}
+	if oldHandle.StartTime().IsZero() {
+		t.Fatalf("expected the start time to be recovered")
+	}
+
+	// Features needing the monitor degrade instead of failing
+	if _, err := oldHandle.QueryStatus(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := oldHandle.Shutdown(time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-h3.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestQemuDriver_MemoryHotplugArg(t *testing.T) {
+	task := &structs.Task{Resources: basicResources}
+	arg, mb, maxMB, err := qemuMemoryArg(&QemuDriverConfig{MaxMemory: "1G", MemorySlots: 2}, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if arg != "256M,slots=2,maxmem=1024M" || mb != 256 || maxMB != 1024 {
+		t.Fatalf("got (%q, %d, %d)", arg, mb, maxMB)
+	}
+
+	for _, c := range []*QemuDriverConfig{
+		{MaxMemory: "1G"},
+		{MemorySlots: 2},
+		{MaxMemory: "128M", MemorySlots: 2},
+		{MaxMemory: "1G", MemorySlots: -1},
+	} {
+		if _, _, _, err := qemuMemoryArg(c, task); err == nil {
+			t.Fatalf("expected error for %#v", c)
+		}
+	}
+}
+
+func TestQemuDriver_MemoryHotplug(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["max_memory"] = "1G"
+	task.Config["memory_slots"] = 2
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	var lock sync.Mutex
+	var commands []string
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, cmd+" "+string(args))
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	updated := testQemuShutdownTask()
+	updated.Resources = &structs.Resources{MemoryMB: 512}
+	if err := handle.Update(updated); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Beyond max_memory
+	updated.Resources = &structs.Resources{MemoryMB: 2048}
+	if err := handle.Update(updated); err == nil || !strings.Contains(err.Error(), "max_memory") {
+		t.Fatalf("expected max_memory error; got %v", err)
+	}
+
+	updated.Resources = &structs.Resources{MemoryMB: 768}
+	if err := handle.Update(updated); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Out of slots
+	updated.Resources = &structs.Resources{MemoryMB: 1024}
+	if err := handle.Update(updated); err == nil || !strings.Contains(err.Error(), "memory_slots") {
+		t.Fatalf("expected memory_slots error; got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{
+		`object_add {"id":"nomad-mem0","props":{"size":268435456},"qom-type":"memory-backend-ram"}`,
+		`device_add {"driver":"pc-dimm","id":"nomad-dimm0","memdev":"nomad-mem0"}`,
+		`object_add {"id":"nomad-mem1","props":{"size":268435456},"qom-type":"memory-backend-ram"}`,
+		`device_add {"driver":"pc-dimm","id":"nomad-dimm1","memdev":"nomad-mem1"}`,
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("commands %q; want %q", commands, expected)
+	}
+	if h := handle.(*qemuHandle); h.memoryMB != 768 || h.usedSlots != 2 {
+		t.Fatalf("handle has %d MB in %d slots", h.memoryMB, h.usedSlots)
+	}
+}
+
+func TestQemuDriver_MemoryHotplug_Concurrent(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["max_memory"] = "1G"
+	task.Config["memory_slots"] = 2
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// The ID is read, e.g. to persist the handle, while memory is plugged in
+	doneCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-doneCh:
+					return
+				default:
+					handle.ID()
+				}
+			}
+		}()
+	}
+
+	updated := testQemuShutdownTask()
+	for _, memoryMB := range []int{512, 768} {
+		updated.Resources = &structs.Resources{MemoryMB: memoryMB}
+		if err := handle.Update(updated); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	close(doneCh)
+	wg.Wait()
+
+	var id qemuId
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id.MemoryMB != 768 || id.UsedSlots != 2 {
+		t.Fatalf("ID has %d MB in %d slots", id.MemoryMB, id.UsedSlots)
+	}
+}
+
+func TestQemuDriver_WatchHealth_GracePeriod(t *testing.T) {
+	graceUntil := time.Now().Add(100 * time.Millisecond)
+	var failedAt time.Time
+	probe := func() error {
+		failedAt = time.Now()
+		return fmt.Errorf("booting")
+	}
+
+	err := watchHealth(probe, 10*time.Millisecond, 2, graceUntil, make(chan struct{}))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if failedAt.Before(graceUntil) {
+		t.Fatalf("failure at %v was reported during the grace period ending at %v", failedAt, graceUntil)
+	}
+
+	// A guest that becomes healthy within the grace period isn't reported
+	doneCh := make(chan struct{})
+	graceUntil = time.Now().Add(time.Hour)
+	calls := 0
+	flaky := func() error {
+		calls++
+		if calls == 10 {
+			close(doneCh)
+		}
+		return fmt.Errorf("booting")
+	}
+	if err := watchHealth(flaky, time.Millisecond, 1, graceUntil, doneCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cfg := &QemuDriverConfig{HealthCheck: "qmp", HealthGrace: "2m"}
+	check, err := qemuHealthCheckConfig(cfg, &structs.Task{Resources: basicResources})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if check.Grace != 2*time.Minute {
+		t.Fatalf("grace period %v; want 2m", check.Grace)
+	}
+	cfg.HealthGrace = "-1s"
+	if _, err := qemuHealthCheckConfig(cfg, &structs.Task{Resources: basicResources}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestQemuDriver_BaseImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baseimage")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	baseDir := filepath.Join(dir, "images")
+
+	writeImage := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return path
+	}
+	baseImages := func() []string {
+		entries, err := ioutil.ReadDir(baseDir)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	// Images with the same contents share a base image
+	first := filepath.Join(dir, "first.base")
+	if err := qemuBaseImage(baseDir, writeImage("first.img", "image"), first, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second := filepath.Join(dir, "second.base")
+	if err := qemuBaseImage(baseDir, writeImage("second.img", "image"), second, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fi1, err := os.Stat(first)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fi2, err := os.Stat(second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Fatalf("expected a shared base image")
+	}
+	if names := baseImages(); len(names) != 1 {
+		t.Fatalf("got base images %q; want one", names)
+	}
+	for _, name := range []string{"first.img", "second.img"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed; got %v", name, err)
+		}
+	}
+	if perm := fi1.Mode().Perm(); perm != 0444 {
+		t.Fatalf("base image has mode %o; want 0444", perm)
+	}
+
+	// Images with a known checksum aren't hashed again
+	sum := strings.Repeat("ab", sha256.Size)
+	other := filepath.Join(dir, "other.base")
+	if err := qemuBaseImage(baseDir, writeImage("other.img", "other"), other, sum); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, sum)); err != nil {
+		t.Fatalf("base image not stored under its checksum: %v", err)
+	}
+
+	// Base images no longer linked from a task directory are removed
+	os.Remove(first)
+	os.Remove(second)
+	if err := qemuBaseImage(baseDir, writeImage("third.img", "third"), filepath.Join(dir, "third.base"), ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, sum)); err != nil {
+		t.Fatalf("linked base image was removed: %v", err)
+	}
+	if names := baseImages(); len(names) != 2 {
+		t.Fatalf("got base images %q; want the linked two", names)
+	}
+}
+
+func TestQemuDriver_ImageChecksum(t *testing.T) {
+	sum := strings.Repeat("ab", sha256.Size)
+	task := &structs.Task{
+		Artifacts: []*structs.TaskArtifact{
+			{
+				GetterSource:  "https://example.com/linux.img?foo=bar",
+				GetterOptions: map[string]string{"checksum": "sha256:" + sum},
+				RelativeDest:  "local/",
+			},
+			{
+				GetterSource:  "https://example.com/md5.img",
+				GetterOptions: map[string]string{"checksum": "md5:bce963762aa2dbfed13caf492a45fb72"},
+			},
+			{
+				GetterSource:  "https://example.com/linux.img.gz",
+				GetterOptions: map[string]string{"checksum": "sha256:" + sum},
+			},
+			{
+				GetterSource:  "https://example.com/invalid.img",
+				GetterOptions: map[string]string{"checksum": "sha256:../../etc"},
+			},
+		},
+	}
+
+	cases := map[string]string{
+		"/task/local/linux.img": sum,
+		"/task/md5.img":         "",
+		"/task/linux.img":       "",
+		"/task/invalid.img":     "",
+		"/task/other.img":       "",
+	}
+	for path, expected := range cases {
+		if act := qemuImageChecksum(task, nil, "/task", path); act != expected {
+			t.Fatalf("%s: got checksum %q; want %q", path, act, expected)
+		}
+	}
+}
+
+func TestQemuDriver_CreateOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "qemu-img.log")
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-img": fmt.Sprintf(`echo "$@" >> %s
+if [ "$1" = info ]; then echo '{"format": "qcow2"}'; fi`, log),
+	}, true)()
+
+	if err := qemuCreateOverlay("qemu-img", "/base/raw", "/task/overlay.qcow2", "raw"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := qemuCreateOverlay("qemu-img", "/base/probed", "/task/overlay.qcow2", ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Base images next to the overlay are referred to by a relative path
+	if err := qemuCreateOverlay("qemu-img", filepath.Join(dir, "base.img"), filepath.Join(dir, "overlay.qcow2"), "raw"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "create -f qcow2 -b /base/raw -F raw /task/overlay.qcow2\n" +
+		"info --output=json /base/probed\n" +
+		"create -f qcow2 -b /base/probed -F qcow2 /task/overlay.qcow2\n" +
+		fmt.Sprintf("create -f qcow2 -b base.img -F raw %s/overlay.qcow2\n", dir)
+	if string(out) != expected {
+		t.Fatalf("got qemu-img calls %q; want %q", out, expected)
+	}
+}
+
+func TestQemuDriver_ConsoleLog(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "/bin/true")()
+
+	task := testQemuShutdownTask()
+	task.Config["console_log"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " ")
+	path := filepath.Join(execCtx.AllocDir.LogDir(), task.Name+".console.log")
+	expected := fmt.Sprintf(" -chardev stdio,id=console0,signal=off,logfile=%s -serial chardev:console0", path)
+	if !strings.Contains(args, expected) {
+		t.Fatalf("expected %q in %q", expected, args)
+	}
+}
+
+func TestQemuDriver_DisplayConfig(t *testing.T) {
+	task := &structs.Task{Resources: &structs.Resources{
+		Networks: []*structs.NetworkResource{{
+			IP:            "10.0.0.1",
+			ReservedPorts: []structs.Port{{Label: "low", Value: 22}},
+			DynamicPorts:  []structs.Port{{Label: "console", Value: 23000}, {Label: "ssh", Value: 23001}},
+		}},
+	}}
+
+	cases := []struct {
+		config   QemuDriverConfig
+		expected *qemuDisplay
+		err      string
+	}{
+		{QemuDriverConfig{}, nil, ""},
+		{QemuDriverConfig{VNC: "console"}, &qemuDisplay{Protocol: "vnc", IP: "10.0.0.1", Port: 23000}, ""},
+		{QemuDriverConfig{SPICE: "console", DisplayPassword: "secret"}, &qemuDisplay{Protocol: "spice", IP: "10.0.0.1", Port: 23000}, ""},
+		{QemuDriverConfig{SPICE: "low"}, &qemuDisplay{Protocol: "spice", IP: "10.0.0.1", Port: 22}, ""},
+		{QemuDriverConfig{VNC: "console", SPICE: "console"}, nil, "Only one"},
+		{QemuDriverConfig{DisplayPassword: "secret"}, nil, "requires vnc or spice"},
+		{QemuDriverConfig{VNC: "nope"}, nil, "Unknown port label"},
+		{QemuDriverConfig{VNC: "low"}, nil, "at least 5900"},
+		{QemuDriverConfig{VNC: "ssh", PortMap: []map[string]int{{"ssh": 22}}}, nil, "port_map"},
+	}
+
+	for _, c := range cases {
+		display, err := qemuDisplayConfig(&c.config, task)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%+v: expected error containing %q; got %v", c.config, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: err: %v", c.config, err)
+		}
+		if !reflect.DeepEqual(display, c.expected) {
+			t.Fatalf("%+v: got display %+v; want %+v", c.config, display, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_DisplayArgs(t *testing.T) {
+	vnc := &qemuDisplay{Protocol: "vnc", IP: "10.0.0.1", Port: 23000}
+	spice := &qemuDisplay{Protocol: "spice", IP: "10.0.0.1", Port: 23000}
+
+	cases := []struct {
+		display  *qemuDisplay
+		password bool
+		expected []string
+	}{
+		{vnc, false, []string{"-vnc", "10.0.0.1:17100"}},
+		{vnc, true, []string{"-vnc", "10.0.0.1:17100,password"}},
+		{spice, false, []string{"-spice", "port=23000,addr=10.0.0.1,disable-ticketing"}},
+		{spice, true, []string{"-spice", "port=23000,addr=10.0.0.1"}},
+	}
+	for _, c := range cases {
+		if args := c.display.args(c.password); !reflect.DeepEqual(args, c.expected) {
+			t.Fatalf("args(%v) of %+v returned %q; want %q", c.password, c.display, args, c.expected)
+		}
+	}
+}
+
+func TestQemuDriver_Display(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	task := testQemuShutdownTask()
+	task.Config["vnc"] = "HTTP"
+	task.Config["display_password"] = "secret"
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+
+	eventCh := make(chan map[string]string, 1)
+	driverCtx.eventSink = func(e *DriverEvent) {
+		if e.Type == qemuEventDisplay {
+			eventCh <- e.Details
+		}
+	}
+	d := NewQemuDriver(driverCtx)
+
+	var password map[string]string
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "set_password" {
+			json.Unmarshal(args, &password)
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	expected := map[string]string{"protocol": "vnc", "password": "secret"}
+	if !reflect.DeepEqual(password, expected) {
+		t.Fatalf("set_password arguments %v; want %v", password, expected)
+	}
+
+	select {
+	case details := <-eventCh:
+		expected := map[string]string{"protocol": "vnc", "address": "0.0.0.0:43330", "port": "43330"}
+		if !reflect.DeepEqual(details, expected) {
+			t.Fatalf("display event %v; want %v", details, expected)
+		}
+	default:
+		t.Fatalf("expected a display event")
+	}
+}
+
+func TestQemuDriver_DataDisks(t *testing.T) {
+	disks, err := qemuDataDisks([]QemuDisk{
+		{Size: "10G"},
+		{Size: "512M", Format: "raw"},
+		{Source: "data.img"},
+		{Source: "images/../data.qcow2", SourceFormat: "qcow2", Size: "20G"},
+	}, "/task")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []*qemuDataDisk{
+		{Path: "/task/disk1.qcow2", Format: "qcow2", Size: "10485760K"},
+		{Path: "/task/disk2.raw", Format: "raw", Size: "524288K"},
+		{Path: "/task/disk3.qcow2", Format: "qcow2", Source: "/task/data.img", SourceFormat: "raw"},
+		{Path: "/task/disk4.qcow2", Format: "qcow2", Size: "20971520K", Source: "/task/data.qcow2", SourceFormat: "qcow2"},
+	}
+	if !reflect.DeepEqual(disks, expected) {
+		t.Fatalf("got disks %+v; want %+v", disks, expected)
+	}
+	if arg := disks[1].driveArg(); arg != "file=/task/disk2.raw,if=virtio,format=raw" {
+		t.Fatalf("unexpected drive argument %q", arg)
+	}
+
+	invalid := [][]QemuDisk{
+		{{}},
+		{{Size: "huge"}},
+		{{Size: "1G", Format: "iso"}},
+		{{Source: "/images/data.img"}},
+		{{Source: "../data.img"}},
+		{{Source: "local/../../data.img"}},
+		{{Source: "data.img", SourceFormat: "iso"}},
+	}
+	for _, disks := range invalid {
+		if _, err := qemuDataDisks(disks, "/task"); err == nil {
+			t.Fatalf("expected error for disks %+v", disks)
+		}
+	}
+}
+
+// testQemuPrivateFile fails the test unless the file at path exists and is
+// only accessible to the user, which only owns it if the test runs as root
+func testQemuPrivateFile(t *testing.T, path, username string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("file not created: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("%s has mode %o; want 0600", filepath.Base(path), perm)
+	}
+	if os.Geteuid() != 0 {
+		return
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if uid := fmt.Sprint(fi.Sys().(*syscall.Stat_t).Uid); uid != u.Uid {
+		t.Fatalf("%s is owned by uid %s; want %s", filepath.Base(path), uid, u.Uid)
+	}
+}
+
+func TestQemuDriver_DataDiskCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disks")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "qemu-img.log")
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-img": fmt.Sprintf(`echo "$@" >> %s
+case "$1" in
+create) touch "$4" ;;
+convert) touch "$7" ;;
+esac`, log),
+	}, true)()
+
+	blank := &qemuDataDisk{Path: filepath.Join(dir, "disk1.qcow2"), Format: "qcow2", Size: "1024K"}
+	copied := &qemuDataDisk{Path: filepath.Join(dir, "disk2.raw"), Format: "raw", Size: "2048K", Source: "/images/data.img", SourceFormat: "raw"}
+	for _, disk := range []*qemuDataDisk{blank, copied} {
+		if err := disk.create("qemu-img", "nobody"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testQemuPrivateFile(t, disk.Path, "nobody")
+	}
+
+	// Existing disks are kept
+	if err := blank.create("qemu-img", "nobody"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := fmt.Sprintf("create -f qcow2 %[1]s/disk1.qcow2.tmp 1024K\n"+
+		"convert -f raw -O raw /images/data.img %[1]s/disk2.raw.tmp\n"+
+		"resize -f raw %[1]s/disk2.raw.tmp 2048K\n", dir)
+	if string(out) != expected {
+		t.Fatalf("got qemu-img calls %q; want %q", out, expected)
+	}
+}
+
+func TestQemuDriver_DataDisks_DryRun(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "/bin/true")()
+
+	task := testQemuShutdownTask()
+	task.Config["disk"] = []map[string]interface{}{
+		{"size": "10G"},
+		{"size": "1G", "format": "raw"},
+	}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " ")
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	expected := fmt.Sprintf(" -drive file=%[1]s/disk1.qcow2,if=virtio,format=qcow2 -drive file=%[1]s/disk2.raw,if=virtio,format=raw", taskDir)
+	if !strings.Contains(args, expected) {
+		t.Fatalf("expected %q in %q", expected, args)
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "disk1.qcow2")); !os.IsNotExist(err) {
+		t.Fatalf("dry run should not create disks; got %v", err)
+	}
+}
+
+func TestQemuDriver_ConvertImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "qemu-img.log")
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-img": fmt.Sprintf(`echo "$@" >> %s
+for last; do :; done
+touch "$last"`, log),
+	}, true)()
+
+	src := filepath.Join(dir, "linux.img")
+	if err := ioutil.WriteFile(src, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dst := filepath.Join(dir, qemuConvertedImage("qcow2"))
+	if err := qemuConvertImage("qemu-img", src, "raw", dst, "qcow2", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		t.Fatalf("image not converted: %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("source should be removed; got %v", err)
+	}
+
+	// A converted image is kept
+	if err := qemuConvertImage("qemu-img", src, "raw", dst, "qcow2", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Images without a format are read as raw rather than probed
+	if err := ioutil.WriteFile(src, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dst = filepath.Join(dir, qemuConvertedImage("raw"))
+	if err := qemuConvertImage("qemu-img", src, "", dst, "raw", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := fmt.Sprintf("convert -O qcow2 -f raw %[1]s/linux.img %[1]s/converted.qcow2.tmp\n"+
+		"convert -O raw -f raw %[1]s/linux.img %[1]s/converted.raw.tmp\n", dir)
+	if string(out) != expected {
+		t.Fatalf("got qemu-img calls %q; want %q", out, expected)
+	}
+}
+
+func TestQemuDriver_ResizeImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resize")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "qemu-img.log")
+	defer setupFakeBinaries(t, map[string]string{
+		"qemu-img": fmt.Sprintf(`echo "$@" >> %s
+if [ "$1" = info ]; then echo '{"format": "raw", "virtual-size": 2048}'; fi`, log),
+	}, true)()
+
+	// Images are grown but never shrunk
+	if err := qemuResizeImage("qemu-img", "/task/linux.img", "", 4096); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := qemuResizeImage("qemu-img", "/task/linux.img", "qcow2", 8192); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := qemuResizeImage("qemu-img", "/task/linux.img", "", 1024); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "info --output=json /task/linux.img\n" +
+		"resize -f raw /task/linux.img 4096\n" +
+		"info --output=json /task/linux.img\n" +
+		"resize -f qcow2 /task/linux.img 8192\n" +
+		"info --output=json /task/linux.img\n"
+	if string(out) != expected {
+		t.Fatalf("got qemu-img calls %q; want %q", out, expected)
+	}
+}
+
+// setupFakeFirmware installs fake UEFI firmware for x86_64 into dir and
+// returns a function restoring the firmware locations.
+func setupFakeFirmware(t *testing.T, dir string) (*qemuFirmware, func()) {
+	fw := &qemuFirmware{
+		Code: filepath.Join(dir, "OVMF_CODE.fd"),
+		Vars: filepath.Join(dir, "OVMF_VARS.fd"),
+	}
+	if err := ioutil.WriteFile(fw.Code, []byte("code"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(fw.Vars, []byte("vars"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	old := qemuUEFIFirmwares
+	qemuUEFIFirmwares = map[string][]qemuFirmware{
+		"x86_64": {{filepath.Join(dir, "missing"), filepath.Join(dir, "missing")}, *fw},
+	}
+	return fw, func() { qemuUEFIFirmwares = old }
+}
+
+func TestQemuDriver_Firmware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firmware")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fw, restore := setupFakeFirmware(t, dir)
+	defer restore()
+
+	if found := qemuFindFirmware("x86_64"); !reflect.DeepEqual(found, fw) {
+		t.Fatalf("found firmware %+v; want %+v", found, fw)
+	}
+	if found := qemuFindFirmware("aarch64"); found != nil {
+		t.Fatalf("unexpected firmware %+v", found)
+	}
+
+	expected := []string{
+		"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", fw.Code),
+		"-drive", "if=pflash,format=raw,file=/task/nvram.fd",
+	}
+	if args := qemuFirmwareArgs(fw, "/task/nvram.fd"); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("args %q; want %q", args, expected)
+	}
+
+	// The variable store is created from the template and kept afterwards
+	nvram := filepath.Join(dir, "nvram.fd")
+	if err := createNVRAM(fw, nvram, "nobody"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testQemuPrivateFile(t, nvram, "nobody")
+	if err := ioutil.WriteFile(nvram, []byte("boot entries"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := createNVRAM(fw, nvram, "nobody"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out, _ := ioutil.ReadFile(nvram); string(out) != "boot entries" {
+		t.Fatalf("variable store was overwritten: %q", out)
+	}
+}
+
+func TestQemuDriver_Firmware_Start(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	dir, err := ioutil.TempDir("", "firmware")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fw, restore := setupFakeFirmware(t, dir)
+	defer restore()
+	defer setupFakeQemu(t, "echo 'QEMU emulator version 2.5.0'")()
+
+	task := testQemuShutdownTask()
+	task.Config["firmware"] = "uefi"
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	node := &structs.Node{Attributes: make(map[string]string)}
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node.Attributes[qemuUEFIAttr] != "1" {
+		t.Fatalf("missing %s attribute: %#v", qemuUEFIAttr, node.Attributes)
+	}
+
+	expected := fmt.Sprintf(" -drive if=pflash,format=raw,readonly=on,file=%s ", fw.Code)
+	if args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " "); !strings.Contains(args, expected) {
+		t.Fatalf("expected %q in %q", expected, args)
+	}
+
+	task.Config["arch"] = "aarch64"
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "No UEFI firmware") {
+		t.Fatalf("expected missing firmware error; got %v", err)
+	}
+
+	task.Config["firmware"] = "coreboot"
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "Invalid firmware") {
+		t.Fatalf("expected invalid firmware error; got %v", err)
+	}
+}
+
+func TestQemuDriver_ValidatePinning(t *testing.T) {
+	if err := qemuValidatePinning([]int{0, 2, 3}, 4); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, cores := range [][]int{{4}, {-1}, {1, 1}} {
+		if err := qemuValidatePinning(cores, 4); err == nil {
+			t.Fatalf("expected error for cores %v", cores)
+		}
+	}
+}
+
+func TestQemuDriver_ParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-2, 5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := []int{0, 1, 2, 5}; !reflect.DeepEqual(cpus, expected) {
+		t.Fatalf("got %v; want %v", cpus, expected)
+	}
+	for _, list := range []string{"", "a", "3-1", "-1", "1-"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Fatalf("expected error for %q", list)
+		}
+	}
+}
+
+func TestQemuDriver_NUMAArgs(t *testing.T) {
+	host := 1
+	nodes := []QemuNUMANode{
+		{CPUs: "0-1", Memory: "512M"},
+		{CPUs: "2,3", Memory: "512M", HostNode: &host},
+	}
+	args, err := qemuNUMAArgs(nodes, 4, 1024, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{
+		"-object", "memory-backend-ram,id=numa0,size=524288K",
+		"-numa", "node,nodeid=0,cpus=0-1,memdev=numa0",
+		"-object", "memory-backend-ram,id=numa1,size=524288K,host-nodes=1,policy=bind",
+		"-numa", "node,nodeid=1,cpus=2,cpus=3,memdev=numa1",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("args %q; want %q", args, expected)
+	}
+
+	cases := []struct {
+		nodes []QemuNUMANode
+		err   string
+	}{
+		{[]QemuNUMANode{{CPUs: "0-4", Memory: "1G"}}, "the VM has 4 vCPUs"},
+		{[]QemuNUMANode{{CPUs: "0-3", Memory: "512M"}, {CPUs: "3", Memory: "512M"}}, "assigned to numa nodes 0 and 1"},
+		{[]QemuNUMANode{{CPUs: "0-2", Memory: "1G"}}, "must assign all 4 vCPUs"},
+		{[]QemuNUMANode{{CPUs: "0-3", Memory: "512M"}}, "must add up"},
+		{[]QemuNUMANode{{CPUs: "0-3", Memory: "lots"}}, "Invalid numa memory"},
+	}
+	for _, c := range cases {
+		if _, err := qemuNUMAArgs(c.nodes, 4, 1024, ""); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%+v: expected error containing %q; got %v", c.nodes, c.err, err)
+		}
+	}
+}
+
+func TestQemuDriver_VCPUThreads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Older versions of Qemu only support query-cpus
+	path := filepath.Join(dir, qemuMonitorSocket)
+	qmp := newFakeQMP(t, path, func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "query-cpus" {
+			return []map[string]int{{"CPU": 1, "thread_id": 101}, {"CPU": 0, "thread_id": 100}}, nil
+		}
+		return nil, &qmpError{Class: "CommandNotFound", Desc: "The command " + cmd + " has not been found"}
+	})
+	defer qmp.Close()
+
+	tids, err := qemuVCPUThreads(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := []int{100, 101}; !reflect.DeepEqual(tids, expected) {
+		t.Fatalf("got threads %v; want %v", tids, expected)
+	}
+}
+
+func TestQemuDriver_CPUPinning(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "while true; do /bin/sleep 0.1; done")()
+
+	// A stand-in for the VM's vCPU thread
+	vcpu := exec.Command("/bin/sleep", "30")
+	if err := vcpu.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer vcpu.Process.Kill()
+
+	task := testQemuShutdownTask()
+	task.Config["cpu_pinning"] = []int{0}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "query-cpus-fast" {
+			return []map[string]int{{"cpu-index": 0, "thread-id": vcpu.Process.Pid}}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	for _, pid := range []int{handle.(*qemuHandle).userPid, vcpu.Process.Pid} {
+		status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !strings.Contains(string(status), "Cpus_allowed_list:\t0\n") {
+			t.Fatalf("process %d isn't pinned to core 0: %s", pid, status)
+		}
+	}
+}
+
+func TestQemuDriver_ArgsDisabled(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, "echo 'QEMU emulator version 2.5.0'")()
+
+	task := testQemuShutdownTask()
+	task.Config["dry_run"] = true
+	task.Config["args"] = []string{"-nodefaults"}
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{
+		qemuArgsConfigOption: "false",
+		// Enabling hooks doesn't override disabling access to the host
+		qemuHooksConfigOption: "true",
+	}
+	d := NewQemuDriver(driverCtx)
+
+	node := &structs.Node{Attributes: make(map[string]string)}
+	if _, err := d.Fingerprint(driverCtx.config, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := node.Attributes["driver."+qemuArgsConfigOption]; ok {
+		t.Fatalf("unexpected driver.%s attribute", qemuArgsConfigOption)
+	}
+
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "args are disabled") {
+		t.Fatalf("expected args to be rejected; got %v", err)
+	}
+	delete(task.Config, "args")
+
+	// The other options giving access to host resources are disabled as well
+	for key, value := range map[string]interface{}{
+		"raw_device":        "/dev/sdb",
+		"pci_passthrough":   []string{"0000:01:00.0"},
+		"pre_start_command": []string{"/bin/touch", "pre_start"},
+		"post_stop_command": []string{"/bin/touch", "post_stop"},
+	} {
+		task.Config[key] = value
+		if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), key+" is disabled") {
+			t.Fatalf("expected %s to be rejected; got %v", key, err)
+		}
+		delete(task.Config, key)
+	}
+
+	// Options confined to the task's directories are unaffected
+	task.Config["share_alloc_dir"] = true
+	qemuStartDryRun(t, d, execCtx, task)
+}
+
+func TestQemuDriver_GuestStatsUsed(t *testing.T) {
+	unset := uint64(math.MaxUint64)
+	cases := []struct {
+		total, free, available uint64
+		lastUpdate             int64
+		used                   uint64
+		ok                     bool
+	}{
+		{1000, 300, 400, 1, 600, true},
+		{1000, 300, unset, 1, 700, true},
+		{1000, 300, 400, 0, 0, false},
+		{unset, unset, unset, 1, 0, false},
+		{1000, unset, unset, 1, 0, false},
+		{1000, 2000, unset, 1, 0, false},
+	}
+	for i, c := range cases {
+		var s qmpGuestStats
+		s.Stats.TotalMemory = c.total
+		s.Stats.FreeMemory = c.free
+		s.Stats.AvailableMemory = c.available
+		s.LastUpdate = c.lastUpdate
+		used, ok := s.used()
+		if used != c.used || ok != c.ok {
+			t.Fatalf("case %d: got %d, %v; want %d, %v", i, used, ok, c.used, c.ok)
+		}
+	}
+}
+
+func TestQemuDriver_Stats_GuestUsage(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, `while true; do /bin/sleep 0.1; done`)()
+
+	task := testQemuShutdownTask()
+	task.Config["balloon"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		if cmd == "qom-get" {
+			return map[string]interface{}{
+				"stats": map[string]interface{}{
+					"stat-total-memory":     uint64(256 * 1024 * 1024),
+					"stat-free-memory":      uint64(64 * 1024 * 1024),
+					"stat-available-memory": uint64(math.MaxUint64),
+				},
+				"last-update": 1,
+			}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	ru, err := handle.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ms := ru.ResourceUsage.MemoryStats
+	if ms.GuestUsage != 192*1024*1024 {
+		t.Fatalf("guest usage %d; want %d", ms.GuestUsage, 192*1024*1024)
+	}
+	found := false
+	for _, m := range ms.Measured {
+		found = found || m == "Guest Usage"
+	}
+	if !found {
+		t.Fatalf("guest usage not measured: %v", ms.Measured)
+	}
+
+	// Reporting is only enabled once
+	if _, err := handle.Stats(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sets := 0
+	for _, cmd := range qmp.Commands() {
+		if cmd == "qom-set" {
+			sets++
+		}
+	}
+	if sets != 1 {
+		t.Fatalf("qom-set sent %d times; want 1: %v", sets, qmp.Commands())
+	}
+}
+
+func TestQemuDriver_PrepareRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmstate")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, qemuStateFile)
+
+	// The saved state is moved aside to be restored from
+	if err := ioutil.WriteFile(state, []byte("state"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := prepareRestore(dir, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("state not moved: %v", err)
+	}
+	if _, err := os.Stat(state + qemuRestoreSuffix); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// State left behind by a failed restore is removed
+	if err := prepareRestore(dir, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(state + qemuRestoreSuffix); !os.IsNotExist(err) {
+		t.Fatalf("stale state not removed: %v", err)
+	}
+	if err := prepareRestore(dir, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if act := qemuIncomingArgs("/a/it's"); !reflect.DeepEqual(act, []string{"-incoming", `exec:cat '/a/it'\''s'`}) {
+		t.Fatalf("bad: %q", act)
+	}
+}
+
+func TestQemuDriver_SaveState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmstate")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, qemuStateFile)
+
+	var lock sync.Mutex
+	status := "active"
+	qmp := newFakeQMP(t, filepath.Join(dir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch cmd {
+		case "migrate":
+			var a struct {
+				URI string `json:"uri"`
+			}
+			json.Unmarshal(args, &a)
+			if a.URI != "exec:cat > "+qemuShellQuote(state+".tmp") {
+				return nil, &qmpError{Class: "GenericError", Desc: "bad uri " + a.URI}
+			}
+			ioutil.WriteFile(state+".tmp", []byte("state"), 0644)
+		case "query-migrate":
+			s := status
+			status = "completed"
+			return map[string]string{"status": s}, nil
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	if err := qemuSaveState(filepath.Join(dir, qemuMonitorSocket), state, time.Minute); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if data, err := ioutil.ReadFile(state); err != nil || string(data) != "state" {
+		t.Fatalf("bad state %q: %v", data, err)
+	}
+	for _, cmd := range qmp.Commands() {
+		if cmd == "cont" {
+			t.Fatalf("VM resumed after saving its state")
+		}
+	}
+
+	// A failed migration resumes the VM
+	lock.Lock()
+	status = "failed"
+	lock.Unlock()
+	os.Remove(state)
+	if err := qemuSaveState(filepath.Join(dir, qemuMonitorSocket), state, time.Minute); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("state saved by failed migration: %v", err)
+	}
+	if _, err := os.Stat(state + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("partial state left behind: %v", err)
+	}
+	cmds := qmp.Commands()
+	if cmds[len(cmds)-1] != "cont" {
+		t.Fatalf("VM not resumed: %v", cmds)
+	}
+}
+
+func TestQemuDriver_Restore(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, `echo "$@" > args; while true; do /bin/sleep 0.1; done`)()
+
+	task := testQemuShutdownTask()
+	task.Config["save_state"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	eventCh := make(chan struct{}, 1)
+	driverCtx.eventSink = func(e *DriverEvent) {
+		if e.Type == qemuEventRestored {
+			eventCh <- struct{}{}
+		}
+	}
+	d := NewQemuDriver(driverCtx)
+
+	taskDir := execCtx.AllocDir.TaskDirs[task.Name]
+	state := filepath.Join(taskDir, qemuStateFile)
+	if err := ioutil.WriteFile(state, []byte("state"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var lock sync.Mutex
+	status := qmpStatus{Running: true, Status: "running"}
+	qmp := newFakeQMP(t, filepath.Join(taskDir, qemuMonitorSocket), func(cmd string, args json.RawMessage) (interface{}, *qmpError) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch cmd {
+		case "query-status":
+			return status, nil
+		case "cont":
+			status = qmpStatus{Running: true, Status: "running"}
+		}
+		return nil, nil
+	})
+	defer qmp.Close()
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	select {
+	case <-eventCh:
+	case <-time.After(5 * time.Second * time.Duration(testutil.TestMultiplier())):
+		t.Fatalf("VM not restored")
+	}
+	out, err := ioutil.ReadFile(filepath.Join(taskDir, "args"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(string(out), "-incoming exec:cat '"+state+qemuRestoreSuffix+"'") {
+		t.Fatalf("VM not restored from its saved state: %q", out)
+	}
+	if _, err := os.Stat(state + qemuRestoreSuffix); !os.IsNotExist(err) {
+		t.Fatalf("restored state not removed: %v", err)
+	}
+
+	// A VM left paused by a client that has been restarted is resumed once
+	// the client reattaches to it
+	lock.Lock()
+	status = qmpStatus{Running: false, Status: "postmigrate"}
+	lock.Unlock()
+	if err := ioutil.WriteFile(state, []byte("state"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := d.Open(execCtx, handle.ID()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lock.Lock()
+	running := status.Running
+	lock.Unlock()
+	if !running {
+		t.Fatalf("VM not resumed")
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("stale state not removed: %v", err)
+	}
+}
+
+// setupFakeHugepages points the driver at host memory info reporting free
+// hugepages of 2 MB each and at mounts with hugetlbfs mounted at path,
+// returning a func to restore the defaults
+func setupFakeHugepages(t *testing.T, total, free int, path string) func() {
+	dir, err := ioutil.TempDir("", "hugepages")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meminfo := fmt.Sprintf("MemTotal:        8000000 kB\nHugePages_Total:    %d\nHugePages_Free:     %d\nHugepagesize:       2048 kB\n", total, free)
+	if err := ioutil.WriteFile(filepath.Join(dir, "meminfo"), []byte(meminfo), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mounts := "proc /proc proc rw 0 0\n"
+	if path != "" {
+		mounts += fmt.Sprintf("hugetlbfs %s hugetlbfs rw,relatime,pagesize=2M 0 0\n", path)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "mounts"), []byte(mounts), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	oldMeminfo, oldMounts := qemuMeminfoPath, qemuMountsPath
+	qemuMeminfoPath = filepath.Join(dir, "meminfo")
+	qemuMountsPath = filepath.Join(dir, "mounts")
+	return func() {
+		qemuMeminfoPath, qemuMountsPath = oldMeminfo, oldMounts
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQemuDriver_HostHugepages(t *testing.T) {
+	cases := []struct {
+		total, free int
+		path        string
+		err         string
+	}{
+		{512, 256, "/dev/hugepages", ""},
+		{0, 0, "/dev/hugepages", "no hugepages"},
+		{512, 256, "", "not mounted"},
+	}
+	for _, c := range cases {
+		restore := setupFakeHugepages(t, c.total, c.free, c.path)
+		hp, err := qemuHostHugepages()
+		restore()
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%+v: expected error containing %q; got %v", c, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: err: %v", c, err)
+		}
+		expected := &qemuHugepages{Path: c.path, Total: 512, Free: 256, SizeKB: 2048}
+		if !reflect.DeepEqual(hp, expected) {
+			t.Fatalf("got %+v; want %+v", hp, expected)
+		}
+		if hp.FreeMB() != 512 {
+			t.Fatalf("free %d MB; want 512", hp.FreeMB())
+		}
+		if err := hp.check(512); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := hp.check(513); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+}
+
+func TestQemuDriver_Hugepages(t *testing.T) {
+	defer setupFakeQemu(t, "echo 'QEMU emulator version 2.5.0'")()
+	defer setupFakeHugepages(t, 512, 256, "/dev/hugepages")()
+
+	bin, err := GetAbsolutePath("qemu-system-x86_64")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node advertises hugepages
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+	node := &structs.Node{Attributes: make(map[string]string)}
+	if _, err := d.Fingerprint(&config.Config{}, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node.Attributes[qemuHugepagesAttr] != "1" {
+		t.Fatalf("missing %s: %v", qemuHugepagesAttr, node.Attributes)
+	}
+
+	task.Config["hugepages"] = true
+	task.Resources.MemoryMB = 256
+	args := qemuStartDryRun(t, d, execCtx, task)
+	if args[0] != bin || !strings.Contains(strings.Join(args, " "), "-mem-path /dev/hugepages -mem-prealloc") {
+		t.Fatalf("memory not backed by hugepages: %q", args)
+	}
+
+	// NUMA nodes are backed by hugepages themselves
+	task.Config["numa"] = []map[string]interface{}{
+		{"cpus": "0", "memory": "256M"},
+	}
+	numaArgs := strings.Join(qemuStartDryRun(t, d, execCtx, task), " ")
+	if strings.Contains(numaArgs, "-mem-path") ||
+		!strings.Contains(numaArgs, "memory-backend-file,id=numa0,size=262144K,mem-path=/dev/hugepages,prealloc=on") {
+		t.Fatalf("numa memory not backed by hugepages: %q", numaArgs)
+	}
+	delete(task.Config, "numa")
+
+	// VMs needing more than the free hugepages don't start
+	task.Resources.MemoryMB = 1024
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "not enough free hugepages") {
+		t.Fatalf("expected hugepages error; got %v", err)
+	}
+
+	// Hotplugged memory isn't backed by hugepages
+	task.Resources.MemoryMB = 256
+	task.Config["max_memory"] = "512M"
+	task.Config["memory_slots"] = 1
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "max_memory") {
+		t.Fatalf("expected max_memory error; got %v", err)
+	}
+}
+
+func TestQemuDriver_ShareAllocDir(t *testing.T) {
+	defer setupFakeQemu(t, "exit 0")()
+
+	task := testQemuShutdownTask()
+	task.Config["share_alloc_dir"] = true
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	args := strings.Join(qemuStartDryRun(t, d, execCtx, task), " ")
+	expected := fmt.Sprintf("-fsdev local,id=fs-alloc,path=%s,security_model=none -device virtio-9p-pci,fsdev=fs-alloc,mount_tag=alloc",
+		execCtx.AllocDir.SharedDir)
+	if !strings.Contains(args, expected) {
+		t.Fatalf("alloc dir not shared: %q", args)
+	}
+
+	if act := qemuShareArgs("/a,b", "data"); !reflect.DeepEqual(act, []string{
+		"-fsdev", "local,id=fs-data,path=/a,,b,security_model=none",
+		"-device", "virtio-9p-pci,fsdev=fs-data,mount_tag=data",
+	}) {
+		t.Fatalf("bad: %q", act)
+	}
+
+	// The share can't be saved along with the VM's state
+	task.Config["save_state"] = true
+	if _, err := d.Start(execCtx, task); err == nil || !strings.Contains(err.Error(), "share_alloc_dir") {
+		t.Fatalf("expected share_alloc_dir error; got %v", err)
+	}
+}
+
+func TestQemuDriver_VerifyProcess(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	qmpPath := "/tmp/vm/" + qemuMonitorSocket
+	cmd := exec.Command("/bin/sh", "-c", "sleep 30", "-qmp", "unix:"+qmpPath+",server,nowait")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	start := time.Now()
+	defer cmd.Process.Kill()
+
+	// The command line is only replaced once the child has exec'ed
+	testutil.WaitForResult(func() (bool, error) {
+		err := qemuVerifyProcess(cmd.Process.Pid, qmpPath, start)
+		return err == nil, err
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if err := qemuVerifyProcess(cmd.Process.Pid, "", time.Time{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A process of another VM, or one started at another time, isn't the VM's
+	if err := qemuVerifyProcess(cmd.Process.Pid, "/tmp/other/"+qemuMonitorSocket, start); err == nil {
+		t.Fatalf("expected error for another VM's process")
+	}
+	if err := qemuVerifyProcess(cmd.Process.Pid, qmpPath, start.Add(-time.Hour)); err == nil {
+		t.Fatalf("expected error for a process started at another time")
+	}
+
+	// An exited process hasn't been reused, its exit is reported by the
+	// executor
+	cmd.Process.Kill()
+	cmd.Wait()
+	if err := qemuVerifyProcess(cmd.Process.Pid, "/tmp/other/"+qemuMonitorSocket, start.Add(-time.Hour)); err != nil {
+		t.Fatalf("unexpected error for an exited process: %v", err)
+	}
+}
+
+func TestQemuDriver_Open_ExitedVM(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, `while true; do /bin/sleep 0.1; done`)()
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// A handle whose process no longer exists refers to a VM that exited
+	// while the client was down, and is reattached to so that the executor
+	// reports how the VM exited
+	exited := exec.Command("/bin/true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var id qemuId
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id.UserPid = exited.Process.Pid
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle2, err := d.Open(execCtx, string(data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle2.Kill()
+}
+
+func TestQemuDriver_Open_ReusedPid(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	defer setupFakeQemu(t, `while true; do /bin/sleep 0.1; done`)()
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// A handle whose process was started at another time refers to a process
+	// that has reused the VM's PID
+	var id qemuId
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id.StartTime = id.StartTime.Add(-time.Hour)
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = d.Open(execCtx, string(data))
+	rerr, ok := err.(*structs.RecoverableError)
+	if !ok || !rerr.Recoverable {
+		t.Fatalf("expected a recoverable error; got %v", err)
+	}
+
+	// The process isn't killed
+	if err := syscall.Kill(id.UserPid, 0); err != nil {
+		t.Fatalf("process was killed: %v", err)
+	}
+}
+
+func TestQemuDriver_QemuPath(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// Qemu isn't in the PATH, only in the configured directory
+	defer setupFakeBinaries(t, map[string]string{"true": "exit 0"}, false)()
+	dir, err := ioutil.TempDir("", "qemupath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "qemu-system-x86_64")
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\necho 'QEMU emulator version 2.5.0'\n"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	task := testQemuShutdownTask()
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	driverCtx.config.Options = map[string]string{qemuPathConfigOption: dir}
+	d := NewQemuDriver(driverCtx)
+
+	node := &structs.Node{Attributes: make(map[string]string)}
+	apply, err := d.Fingerprint(driverCtx.config, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !apply || node.Attributes[qemuDriverAttr] != "1" {
+		t.Fatalf("expected the driver to be detected: %v", node.Attributes)
+	}
+	if v := node.Attributes[qemuArchVersionAttr("x86_64")]; v != "2.5.0" {
+		t.Fatalf("unexpected x86_64 version %q", v)
+	}
+	if _, ok := node.Attributes[qemuWHPXAttr]; ok {
+		t.Fatalf("unexpected %s attribute on %s", qemuWHPXAttr, runtime.GOOS)
+	}
+
+	if args := qemuStartDryRun(t, d, execCtx, task); args[0] != bin {
+		t.Fatalf("expected %q to be launched; got %q", bin, args[0])
+	}
+}
+
+func TestQemuDriver_QemuBinary(t *testing.T) {
+	if bin := qemuBinary("", "qemu-img"); bin != "qemu-img" {
+		t.Fatalf("got %q; want %q", bin, "qemu-img")
+	}
+	if bin := qemuBinary("/opt/qemu/bin", "qemu-img"); bin != filepath.Join("/opt/qemu/bin", "qemu-img") {
+		t.Fatalf("got %q", bin)
+	}
+}
+
+func TestQemuDriver_AcceleratorAvailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whpx")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldLibrary := qemuWHPXLibrary
+	defer func() { qemuWHPXLibrary = oldLibrary }()
+	qemuWHPXLibrary = filepath.Join(dir, "WinHvPlatform.dll")
+	if err := ioutil.WriteFile(qemuWHPXLibrary, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// WHPX is only available on Windows
+	if available := qemuAcceleratorAvailable("whpx"); available != (runtime.GOOS == "windows") {
+		t.Fatalf("whpx available %v on %s", available, runtime.GOOS)
+	}
+	os.Remove(qemuWHPXLibrary)
+	if qemuAcceleratorAvailable("whpx") {
+		t.Fatalf("expected whpx to be unavailable without its library")
+	}
+	if !qemuAcceleratorAvailable("tcg") {
+		t.Fatalf("expected tcg to be available")
+	}
+}
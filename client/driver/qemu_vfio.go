@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// The key populated in Node Attributes listing the addresses of the PCI
+	// devices bound to vfio-pci, which can be passed through to VMs
+	qemuVFIODevicesAttr = "driver.qemu.vfio.devices"
+
+	// qemuVFIODriver is the host driver devices must be bound to for VFIO to
+	// pass them through
+	qemuVFIODriver = "vfio-pci"
+
+	// qemuVFIODeviceType is the type of the devices fingerprinted as bound to
+	// vfio-pci, which are passed through when assigned to a task
+	qemuVFIODeviceType = "vfio"
+)
+
+var (
+	// qemuPCIDevicesDir is where the host's PCI devices are listed
+	qemuPCIDevicesDir = "/sys/bus/pci/devices"
+
+	// qemuPCIBridgeDrivers are the drivers of PCI bridges, which may share an
+	// IOMMU group with the devices behind them without being bound to
+	// vfio-pci
+	qemuPCIBridgeDrivers = map[string]struct{}{
+		"pcieport": struct{}{},
+	}
+)
+
+// qemuPCIAddress returns the address in the full domain:bus:slot.function form
+// the host lists devices by.
+func qemuPCIAddress(addr string) string {
+	addr = strings.ToLower(addr)
+	if strings.Count(addr, ":") == 1 {
+		addr = "0000:" + addr
+	}
+	return addr
+}
+
+// qemuPCIDriver returns the host driver the PCI device at addr is bound to, or
+// an empty string if it isn't bound to any.
+func qemuPCIDriver(addr string) (string, error) {
+	link, err := os.Readlink(filepath.Join(qemuPCIDevicesDir, addr, "driver"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+// qemuCheckPCIDevice returns an error if the host PCI device at addr can't be
+// passed through to a VM. VFIO requires the device to be bound to vfio-pci,
+// and every other device in its IOMMU group to be unused by the host.
+func qemuCheckPCIDevice(addr string) error {
+	addr = qemuPCIAddress(addr)
+	if _, err := os.Stat(filepath.Join(qemuPCIDevicesDir, addr)); err != nil {
+		return fmt.Errorf("PCI device %s doesn't exist on the host", addr)
+	}
+
+	driver, err := qemuPCIDriver(addr)
+	if err != nil {
+		return fmt.Errorf("failed to determine driver of PCI device %s: %v", addr, err)
+	}
+	if driver != qemuVFIODriver {
+		if driver == "" {
+			return fmt.Errorf("PCI device %s must be bound to %s, it isn't bound to a driver", addr, qemuVFIODriver)
+		}
+		return fmt.Errorf("PCI device %s must be bound to %s, it is bound to %s", addr, qemuVFIODriver, driver)
+	}
+
+	group := filepath.Join(qemuPCIDevicesDir, addr, "iommu_group")
+	if _, err := os.Stat(group); err != nil {
+		return fmt.Errorf("PCI device %s isn't in an IOMMU group, the IOMMU may not be enabled", addr)
+	}
+	members, err := ioutil.ReadDir(filepath.Join(group, "devices"))
+	if err != nil {
+		return fmt.Errorf("failed to list IOMMU group of PCI device %s: %v", addr, err)
+	}
+	for _, member := range members {
+		other := member.Name()
+		if other == addr {
+			continue
+		}
+		driver, err := qemuPCIDriver(other)
+		if err != nil {
+			return fmt.Errorf("failed to determine driver of PCI device %s: %v", other, err)
+		}
+		if _, ok := qemuPCIBridgeDrivers[driver]; ok || driver == "" || driver == qemuVFIODriver {
+			continue
+		}
+		return fmt.Errorf("PCI device %s shares its IOMMU group with device %s, which is bound to %s rather than %s",
+			addr, other, driver, qemuVFIODriver)
+	}
+	return nil
+}
+
+// qemuVFIODevices returns the addresses of the host's PCI devices that are
+// bound to vfio-pci, in order.
+func qemuVFIODevices() []string {
+	entries, err := ioutil.ReadDir(qemuPCIDevicesDir)
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, entry := range entries {
+		if driver, err := qemuPCIDriver(entry.Name()); err == nil && driver == qemuVFIODriver {
+			addrs = append(addrs, entry.Name())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// qemuAssignedDevices returns the PCI addresses of the devices of type vfio
+// assigned to the task.
+func qemuAssignedDevices(resources *structs.Resources) []string {
+	if resources == nil {
+		return nil
+	}
+	var addrs []string
+	for _, d := range resources.Devices {
+		if d.Type == qemuVFIODeviceType {
+			addrs = append(addrs, d.IDs...)
+		}
+	}
+	return addrs
+}
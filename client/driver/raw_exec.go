@@ -45,6 +45,7 @@ type rawExecHandle struct {
 	version        string
 	pluginClient   *plugin.Client
 	userPid        int
+	startTime      time.Time
 	executor       executor.Executor
 	killTimeout    time.Duration
 	maxKillTimeout time.Duration
@@ -172,6 +173,7 @@ func (d *RawExecDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandl
 		pluginClient:   pluginClient,
 		executor:       exec,
 		userPid:        ps.Pid,
+		startTime:      time.Now(),
 		killTimeout:    GetKillTimeout(task.KillTimeout, maxKill),
 		maxKillTimeout: maxKill,
 		allocDir:       ctx.AllocDir,
@@ -192,6 +194,7 @@ type rawExecId struct {
 	KillTimeout    time.Duration
 	MaxKillTimeout time.Duration
 	UserPid        int
+	StartTime      time.Time
 	PluginConfig   *PluginReattachConfig
 	AllocDir       *allocdir.AllocDir
 }
@@ -205,6 +208,22 @@ func (d *RawExecDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, e
 	pluginConfig := &plugin.ClientConfig{
 		Reattach: id.PluginConfig.PluginConfig(),
 	}
+
+	// After the host has been restarted the PIDs of the handle may have been
+	// reused by unrelated processes, which must neither be adopted nor killed.
+	// Handles created before the start time was recorded can't be checked. A
+	// process that no longer exists hasn't been reused, the task exited while
+	// the client was down and the executor reports how it exited.
+	if !id.StartTime.IsZero() && processExists(id.UserPid) {
+		if err := verifyProcessStart(id.UserPid, id.StartTime); err != nil {
+			// An executor that can still be reached belongs to the task
+			if _, pluginClient, e := createExecutor(pluginConfig, d.config.LogOutput, d.config); e == nil {
+				pluginClient.Kill()
+			}
+			return nil, fmt.Errorf("task process is no longer running: %v", err)
+		}
+	}
+
 	exec, pluginClient, err := createExecutor(pluginConfig, d.config.LogOutput, d.config)
 	if err != nil {
 		d.logger.Println("[ERR] driver.raw_exec: error connecting to plugin so destroying plugin pid and user pid")
@@ -222,6 +241,7 @@ func (d *RawExecDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, e
 		pluginClient:   pluginClient,
 		executor:       exec,
 		userPid:        id.UserPid,
+		startTime:      id.StartTime,
 		logger:         d.logger,
 		killTimeout:    id.KillTimeout,
 		maxKillTimeout: id.MaxKillTimeout,
@@ -244,6 +264,7 @@ func (h *rawExecHandle) ID() string {
 		MaxKillTimeout: h.maxKillTimeout,
 		PluginConfig:   NewPluginReattachConfig(h.pluginClient.ReattachConfig()),
 		UserPid:        h.userPid,
+		StartTime:      h.startTime,
 		AllocDir:       h.allocDir,
 	}
 
@@ -271,6 +292,10 @@ func (h *rawExecHandle) Signal(s os.Signal) error {
 	return h.executor.Signal(s)
 }
 
+func (h *rawExecHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return h.executor.Exec(cmd, args)
+}
+
 func (h *rawExecHandle) Kill() error {
 	if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
@@ -1,8 +1,10 @@
 package driver
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -102,6 +104,99 @@ func TestRawExecDriver_StartOpen_Wait(t *testing.T) {
 	handle2.Kill()
 }
 
+func TestRawExecDriver_Open_ReusedPid(t *testing.T) {
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]interface{}{
+			"command": testtask.Path(),
+			"args":    []string{"sleep", "30s"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+	testtask.SetTaskEnv(task)
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// A handle whose process was started at another time refers to a process
+	// that has reused the task's PID
+	var id rawExecId
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id.StartTime = id.StartTime.Add(-time.Hour)
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := d.Open(execCtx, string(data)); err == nil {
+		t.Fatalf("expected error opening a handle of a reused pid")
+	}
+
+	// The process isn't killed
+	if err := verifyProcessStart(id.UserPid, id.StartTime.Add(time.Hour)); err != nil {
+		t.Fatalf("process was killed: %v", err)
+	}
+}
+
+func TestRawExecDriver_Open_ExitedTask(t *testing.T) {
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]interface{}{
+			"command": testtask.Path(),
+			"args":    []string{"sleep", "30s"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+	testtask.SetTaskEnv(task)
+	driverCtx, execCtx := testDriverContexts(task)
+	defer execCtx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(execCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// A handle whose process no longer exists refers to a task that exited
+	// while the client was down, and is reattached to so that the executor
+	// reports how the task exited
+	exited := exec.Command(testtask.Path(), "sleep", "1ms")
+	testtask.SetCmdEnv(exited)
+	if err := exited.Run(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var id rawExecId
+	if err := json.Unmarshal([]byte(handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id.UserPid = exited.Process.Pid
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle2, err := d.Open(execCtx, string(data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle2.Kill()
+}
+
 func TestRawExecDriver_Start_Wait(t *testing.T) {
 	task := &structs.Task{
 		Name: "sleep",
@@ -527,6 +527,10 @@ func (h *rktHandle) Signal(s os.Signal) error {
 	return fmt.Errorf("Rkt does not support signals")
 }
 
+func (h *rktHandle) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	return nil, fmt.Errorf("Rkt does not support running commands in tasks")
+}
+
 // Kill is used to terminate the task. We send an Interrupt
 // and then provide a 5 second grace period before doing a Kill.
 func (h *rktHandle) Kill() error {
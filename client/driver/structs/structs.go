@@ -11,6 +11,9 @@ const (
 
 	// CheckBufSize is the size of the check output result
 	CheckBufSize = 4 * 1024
+
+	// ExecBufSize is the size of the output kept of commands run in tasks
+	ExecBufSize = 64 * 1024
 )
 
 // WaitResult stores the result of a Wait operation.
@@ -37,6 +40,15 @@ func (r *WaitResult) String() string {
 		r.ExitCode, r.Signal, r.Err)
 }
 
+// ExecResult is the result of a command run in a task
+type ExecResult struct {
+	// ExitCode is the exit code of the command
+	ExitCode int
+
+	// Output is the end of the combined stdout and stderr of the command
+	Output string
+}
+
 // CheckResult encapsulates the result of a check
 type CheckResult struct {
 
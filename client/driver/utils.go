@@ -1,11 +1,13 @@
 package driver
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -16,6 +18,19 @@ import (
 	"github.com/hashicorp/nomad/client/driver/logging"
 	cstructs "github.com/hashicorp/nomad/client/driver/structs"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/shirou/gopsutil/process"
+)
+
+var (
+	// errFreeDiskUnsupported is returned by freeDiskBytes on platforms where
+	// the free disk space can't be determined
+	errFreeDiskUnsupported = fmt.Errorf("determining free disk space is not supported on %s", runtime.GOOS)
+)
+
+const (
+	// processStartTimeSkew is how far the start time of a process may be from
+	// the start time recorded for a task's process for it to be that process
+	processStartTimeSkew = 10 * time.Second
 )
 
 // createExecutor launches an executor plugin and returns an instance of the
@@ -71,6 +86,31 @@ func createLogCollector(config *plugin.ClientConfig, w io.Writer,
 	return logCollector, syslogClient, nil
 }
 
+// createExternalDriver launches the plugin of an external driver, or
+// reattaches to it, and returns an instance of the ExternalDriver interface
+func createExternalDriver(config *plugin.ClientConfig,
+	clientConfig *config.Config) (ExternalDriver, *plugin.Client, error) {
+	config.HandshakeConfig = HandshakeConfig
+	config.Plugins = map[string]plugin.Plugin{externalDriverPlugin: new(ExternalDriverPlugin)}
+	config.MaxPort = clientConfig.ClientMaxPort
+	config.MinPort = clientConfig.ClientMinPort
+	if config.Cmd != nil {
+		isolateCommand(config.Cmd)
+	}
+
+	driverClient := plugin.NewClient(config)
+	rpcClient, err := driverClient.Client()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating rpc client for driver plugin: %v", err)
+	}
+
+	raw, err := rpcClient.Dispense(externalDriverPlugin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to dispense the driver plugin: %v", err)
+	}
+	return raw.(ExternalDriver), driverClient, nil
+}
+
 func consulContext(clientConfig *config.Config, containerID string) *executor.ConsulContext {
 	return &executor.ConsulContext{
 		ConsulConfig:   clientConfig.ConsulConfig,
@@ -82,6 +122,40 @@ func consulContext(clientConfig *config.Config, containerID string) *executor.Co
 	}
 }
 
+// processStartTime returns when the process with the given pid was started
+func processStartTime(pid int) (time.Time, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms, err := p.CreateTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// processExists returns whether a process with the given pid exists. It
+// errs on the side of the process existing if the processes can't be listed.
+func processExists(pid int) bool {
+	exists, err := process.PidExists(int32(pid))
+	return err != nil || exists
+}
+
+// verifyProcessStart returns an error if the process with the given pid wasn't
+// started at start, in which case the pid of the task's process has been
+// reused by another process, e.g. after the host was restarted.
+func verifyProcessStart(pid int, start time.Time) error {
+	created, err := processStartTime(pid)
+	if err != nil {
+		return fmt.Errorf("failed to determine start time of process %d: %v", pid, err)
+	}
+	if skew := created.Sub(start); skew > processStartTimeSkew || skew < -processStartTimeSkew {
+		return fmt.Errorf("process %d was started at %v rather than at %v", pid, created, start)
+	}
+	return nil
+}
+
 // killProcess kills a process with the given pid
 func killProcess(pid int) error {
 	proc, err := os.FindProcess(pid)
@@ -160,6 +234,43 @@ func GetAbsolutePath(bin string) (string, error) {
 	return filepath.EvalSymlinks(lp)
 }
 
+// RunCommand runs the command and returns an error, holding its output, if it
+// doesn't exit successfully within the timeout. A command that times out or
+// is canceled by closing cancel, which may be nil, is killed along with the
+// processes it started, which could otherwise keep its output open.
+func RunCommand(cmd *exec.Cmd, timeout time.Duration, cancel <-chan struct{}) error {
+	setProcessGroup(cmd)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	name := cmd.Args[0]
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %q: %v", name, err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("%q failed: %v: %s", name, err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	case <-time.After(timeout):
+		killProcessGroup(cmd)
+		<-errCh
+		return fmt.Errorf("%q timed out after %v", name, timeout)
+	case <-cancel:
+		killProcessGroup(cmd)
+		<-errCh
+		return fmt.Errorf("%q was canceled", name)
+	}
+}
+
 // getExecutorUser returns the user of the task, defaulting to
 // cstructs.DefaultUnprivilegedUser if none was given.
 func getExecutorUser(task *structs.Task) string {
@@ -0,0 +1,41 @@
+//+build darwin dragonfly freebsd netbsd openbsd solaris windows
+
+package driver
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeDiskBytes returns the number of bytes available to unprivileged users
+// on the filesystem holding path.
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, errFreeDiskUnsupported
+}
+
+// setOOMScoreAdj sets the OOM score adjustment of the process, making the
+// kernel's OOM killer more or less likely to pick it.
+func setOOMScoreAdj(pid, score int) error {
+	return fmt.Errorf("setting the OOM score is not supported on %s", runtime.GOOS)
+}
+
+// setNice sets the scheduling priority of the process
+func setNice(pid, nice int) error {
+	return fmt.Errorf("setting the process priority is not supported on %s", runtime.GOOS)
+}
+
+// setIOPriority sets the I/O scheduling class and priority of the process
+func setIOPriority(pid, class, level int) error {
+	return fmt.Errorf("setting the I/O priority is not supported on %s", runtime.GOOS)
+}
+
+// setAffinity restricts the thread with the given ID, which may be a process
+// ID, to run on the given CPUs.
+func setAffinity(tid int, cpus []int) error {
+	return fmt.Errorf("setting CPU affinity is not supported on %s", runtime.GOOS)
+}
+
+// setProcessAffinity restricts all threads of the process to the given CPUs.
+func setProcessAffinity(pid int, cpus []int) error {
+	return fmt.Errorf("setting CPU affinity is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// freeDiskBytes returns the number of bytes available to unprivileged users
+// on the filesystem holding path.
+func freeDiskBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// setOOMScoreAdj sets the OOM score adjustment of the process, making the
+// kernel's OOM killer more or less likely to pick it.
+func setOOMScoreAdj(pid, score int) error {
+	path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(score)), 0644)
+}
+
+// setNice sets the scheduling priority of all threads of the process, as
+// Linux keeps a priority per thread. Threads the process starts afterwards
+// inherit the priority.
+func setNice(pid, nice int) error {
+	return forEachThread(pid, func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// setIOPriority sets the I/O scheduling class and priority within the class of
+// all threads of the process, like ionice does. Threads the process starts
+// afterwards inherit them.
+func setIOPriority(pid, class, level int) error {
+	const (
+		ioprioWhoProcess = 1
+		ioprioClassShift = 13
+	)
+	prio := class<<ioprioClassShift | level
+	return forEachThread(pid, func(tid int) error {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// setAffinity restricts the thread with the given ID, which may be a process
+// ID, to run on the given CPUs.
+func setAffinity(tid int, cpus []int) error {
+	// The kernel takes a bit mask of CPUs, in words of the native size
+	const wordBits = 32 << (^uint(0) >> 63)
+	var mask [1024 / wordBits]uint
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(mask)*wordBits {
+			return fmt.Errorf("CPU %d out of range", cpu)
+		}
+		mask[cpu/wordBits] |= 1 << uint(cpu%wordBits)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+		uintptr(len(mask)*wordBits/8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setProcessAffinity restricts all threads of the process to the given CPUs.
+// Threads the process starts afterwards inherit the affinity.
+func setProcessAffinity(pid int, cpus []int) error {
+	return forEachThread(pid, func(tid int) error {
+		return setAffinity(tid, cpus)
+	})
+}
+
+// forEachThread calls f with the ID of every thread of the process. Threads
+// that exit before f is called with them are skipped.
+func forEachThread(pid int, f func(tid int) error) error {
+	tasks, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := f(tid); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
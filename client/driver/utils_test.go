@@ -1,8 +1,12 @@
 package driver
 
 import (
+	"os/exec"
+	"strings"
 	"testing"
 	"time"
+
+	ctestutils "github.com/hashicorp/nomad/client/testutil"
 )
 
 func TestDriver_KillTimeout(t *testing.T) {
@@ -20,3 +24,33 @@ func TestDriver_KillTimeout(t *testing.T) {
 		t.Fatalf("KillTimeout() returned %v; want %v", actual, expected)
 	}
 }
+
+func TestDriver_RunCommand(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	if err := RunCommand(exec.Command("/bin/sh", "-c", "true"), time.Second, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := RunCommand(exec.Command("/bin/sh", "-c", "echo oops; exit 1"), time.Second, nil)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("expected error with the output; got %v", err)
+	}
+}
+
+func TestDriver_RunCommand_Cancel(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// The processes the command starts are killed along with it, as they
+	// would otherwise keep its output open
+	cancel := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+
+	start := time.Now()
+	cmd := exec.Command("/bin/sh", "-c", "/bin/sleep 10; true")
+	if err := RunCommand(cmd, time.Minute, cancel); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expected the command to be canceled; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command wasn't killed when canceled: took %v", elapsed)
+	}
+}
@@ -1,9 +1,31 @@
 package driver
 
 import (
+	"os"
 	"os/exec"
 )
 
 // TODO Figure out if this is needed in Wondows
 func isolateCommand(cmd *exec.Cmd) {
 }
+
+// setProcessGroup is a no-op as Windows has no process groups to kill
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills the process of the command. The processes it started
+// aren't killed along with it on Windows.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// fileLinks can't count the hard links to a file on Windows
+func fileLinks(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// chownToUser is a no-op as files aren't owned by the user a task runs as on
+// Windows
+func chownToUser(path, username string) error {
+	return nil
+}
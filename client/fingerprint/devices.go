@@ -0,0 +1,38 @@
+package fingerprint
+
+import (
+	"log"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/devices"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// DeviceFingerprint is used to fingerprint the devices of the node, such as
+// GPUs, through the registered device plugins
+type DeviceFingerprint struct {
+	StaticFingerprinter
+	logger *log.Logger
+}
+
+// NewDeviceFingerprint is used to create a device fingerprint
+func NewDeviceFingerprint(logger *log.Logger) Fingerprint {
+	f := &DeviceFingerprint{logger: logger}
+	return f
+}
+
+func (f *DeviceFingerprint) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	found, attrs := devices.Fingerprint(f.logger)
+	if len(found) == 0 {
+		return false, nil
+	}
+
+	for k, v := range attrs {
+		node.Attributes[k] = v
+	}
+	if node.Resources == nil {
+		node.Resources = &structs.Resources{}
+	}
+	node.Resources.Devices = found
+	return true, nil
+}
@@ -19,6 +19,7 @@ func init() {
 	builtinFingerprintMap["arch"] = NewArchFingerprint
 	builtinFingerprintMap["consul"] = NewConsulFingerprint
 	builtinFingerprintMap["cpu"] = NewCPUFingerprint
+	builtinFingerprintMap["devices"] = NewDeviceFingerprint
 	builtinFingerprintMap["env_aws"] = NewEnvAWSFingerprint
 	builtinFingerprintMap["env_gce"] = NewEnvGCEFingerprint
 	builtinFingerprintMap["host"] = NewHostFingerprint
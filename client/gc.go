@@ -0,0 +1,164 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// allocDirDiskUsage returns the used percentage of the disk the given path is
+// on. It is a variable so tests can fake the disk usage.
+var allocDirDiskUsage = func(path string) (float64, error) {
+	usage, err := disk.Usage(path)
+	if err != nil {
+		return 0, err
+	}
+	return usage.UsedPercent, nil
+}
+
+// gcCandidate is a terminal allocation whose directory can be garbage collected
+type gcCandidate struct {
+	ar           *AllocRunner
+	terminatedAt time.Time
+}
+
+// gcCandidates sorts candidates from the least to the most recently terminated
+type gcCandidates []*gcCandidate
+
+func (g gcCandidates) Len() int           { return len(g) }
+func (g gcCandidates) Less(i, j int) bool { return g[i].terminatedAt.Before(g[j].terminatedAt) }
+func (g gcCandidates) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+// periodicGC is a long lived goroutine used to periodically garbage collect
+// the directories of terminal allocations
+func (c *Client) periodicGC() {
+	if c.config.GCInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.config.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := c.collectAllocs(false); n != 0 {
+				c.logger.Printf("[INFO] client: garbage collected %d allocations", n)
+			}
+		case <-c.shutdownCh:
+			return
+		}
+	}
+}
+
+// CollectAllAllocs garbage collects the directories of all terminal
+// allocations regardless of the thresholds, and returns how many allocations
+// were collected.
+func (c *Client) CollectAllAllocs() int {
+	return c.collectAllocs(true)
+}
+
+// collectAllocs destroys the directories and state of terminal allocations,
+// least recently terminated first, until the age, count and disk usage
+// thresholds are met. If all is set, all terminal allocations are collected.
+// It returns the number of allocations collected.
+func (c *Client) collectAllocs(all bool) int {
+	c.gcLock.Lock()
+	defer c.gcLock.Unlock()
+
+	candidates := c.gcCandidates()
+	collected := 0
+	for ; len(candidates) != 0; candidates = candidates[1:] {
+		candidate := candidates[0]
+
+		var reason string
+		switch {
+		case all:
+			reason = "forced collection"
+		case c.config.GCMaxAge != 0 && time.Since(candidate.terminatedAt) > c.config.GCMaxAge:
+			reason = fmt.Sprintf("terminal for longer than %v", c.config.GCMaxAge)
+		case c.config.GCMaxAllocs != 0 && len(candidates) > c.config.GCMaxAllocs:
+			reason = fmt.Sprintf("more than %d terminal allocations", c.config.GCMaxAllocs)
+		case c.config.GCDiskUsageThreshold != 0 && c.diskUsageExceeded():
+			reason = fmt.Sprintf("disk usage above %.0f%%", c.config.GCDiskUsageThreshold)
+		default:
+			return collected
+		}
+
+		c.logger.Printf("[DEBUG] client: garbage collecting alloc %q: %s", candidate.ar.Alloc().ID, reason)
+		candidate.ar.Destroy()
+		select {
+		case <-candidate.ar.WaitCh():
+		case <-c.shutdownCh:
+			return collected
+		}
+		collected++
+	}
+	return collected
+}
+
+// gcCandidates returns the terminal allocations that haven't been destroyed,
+// least recently terminated first. Allocations whose directory a blocked or
+// running allocation may take over aren't candidates.
+func (c *Client) gcCandidates() []*gcCandidate {
+	c.blockedAllocsLock.RLock()
+	defer c.blockedAllocsLock.RUnlock()
+
+	runners := c.getAllocRunners()
+	previous := make(map[string]struct{})
+	for _, ar := range runners {
+		if alloc := ar.Alloc(); !alloc.Terminated() && alloc.PreviousAllocation != "" {
+			previous[alloc.PreviousAllocation] = struct{}{}
+		}
+	}
+
+	var candidates []*gcCandidate
+	for id, ar := range runners {
+		if ar.isDestroyed() {
+			continue
+		}
+		if _, ok := c.blockedAllocations[id]; ok {
+			continue
+		}
+		if _, ok := previous[id]; ok {
+			continue
+		}
+		alloc := ar.Alloc()
+		if !alloc.Terminated() {
+			continue
+		}
+		candidates = append(candidates, &gcCandidate{
+			ar:           ar,
+			terminatedAt: allocTerminatedAt(alloc),
+		})
+	}
+	sort.Sort(gcCandidates(candidates))
+	return candidates
+}
+
+// diskUsageExceeded returns whether the disk usage of the allocation
+// directory is above the threshold
+func (c *Client) diskUsageExceeded() bool {
+	used, err := allocDirDiskUsage(c.config.AllocDir)
+	if err != nil {
+		c.logger.Printf("[WARN] client: failed to determine disk usage of %q: %v", c.config.AllocDir, err)
+		return false
+	}
+	return used > c.config.GCDiskUsageThreshold
+}
+
+// allocTerminatedAt returns the time of the last event of the allocation's
+// tasks, which for a terminal allocation is when it terminated
+func allocTerminatedAt(alloc *structs.Allocation) time.Time {
+	var last int64
+	for _, state := range alloc.TaskStates {
+		for _, event := range state.Events {
+			if event.Time > last {
+				last = event.Time
+			}
+		}
+	}
+	return time.Unix(0, last)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/vaultclient"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// testGCClient returns a client that only has what garbage collection uses
+func testGCClient(t *testing.T) *Client {
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := config.DefaultConfig()
+	conf.StateDir = dir
+	conf.AllocDir = dir
+	conf.GCMaxAllocs = 0
+	conf.GCDiskUsageThreshold = 0
+	return &Client{
+		config:             conf,
+		logger:             testLogger(),
+		allocs:             make(map[string]*AllocRunner),
+		blockedAllocations: make(map[string]*structs.Allocation),
+		shutdownCh:         make(chan struct{}),
+	}
+}
+
+// testGCAddAlloc adds a running alloc runner for an alloc that terminated the
+// given time ago
+func testGCAddAlloc(c *Client, age time.Duration) *AllocRunner {
+	alloc := mock.Alloc()
+	alloc.DesiredStatus = structs.AllocDesiredStatusStop
+	alloc.ClientStatus = structs.AllocClientStatusComplete
+	alloc.TaskStates = map[string]*structs.TaskState{
+		"web": &structs.TaskState{
+			State: structs.TaskStateDead,
+			Events: []*structs.TaskEvent{
+				{Type: structs.TaskTerminated, Time: time.Now().Add(-age).UnixNano()},
+			},
+		},
+	}
+
+	ar := NewAllocRunner(c.logger, c.config, func(*structs.Allocation) {}, alloc, vaultclient.NewMockVaultClient())
+	go ar.Run()
+	c.allocs[alloc.ID] = ar
+	return ar
+}
+
+func testGCCollected(t *testing.T, ar *AllocRunner, collected bool) {
+	if ar.isDestroyed() != collected {
+		t.Fatalf("alloc %q collected: %v; want %v", ar.Alloc().ID, !collected, collected)
+	}
+	if !collected {
+		return
+	}
+	if _, err := os.Stat(ar.GetAllocDir().AllocDir); !os.IsNotExist(err) {
+		t.Fatalf("alloc dir of %q wasn't removed: %v", ar.Alloc().ID, err)
+	}
+}
+
+func TestClient_GC(t *testing.T) {
+	c := testGCClient(t)
+	defer os.RemoveAll(c.config.AllocDir)
+
+	oldest := testGCAddAlloc(c, 4*time.Hour)
+	old := testGCAddAlloc(c, 3*time.Hour)
+	recent := testGCAddAlloc(c, 2*time.Hour)
+	newest := testGCAddAlloc(c, 1*time.Hour)
+
+	// Terminal allocs blocking another alloc are never collected
+	blocking := testGCAddAlloc(c, 5*time.Hour)
+	c.blockedAllocations[blocking.Alloc().ID] = mock.Alloc()
+
+	// Running allocs are never collected
+	running := mock.Alloc()
+	c.allocs[running.ID] = NewAllocRunner(c.logger, c.config, func(*structs.Allocation) {}, running, vaultclient.NewMockVaultClient())
+
+	if n := c.collectAllocs(false); n != 0 {
+		t.Fatalf("collected %d allocs without thresholds", n)
+	}
+
+	// The least recently terminated allocs are collected over the count
+	c.config.GCMaxAllocs = 3
+	if n := c.collectAllocs(false); n != 1 {
+		t.Fatalf("collected %d allocs; want 1", n)
+	}
+	testGCCollected(t, oldest, true)
+	testGCCollected(t, old, false)
+
+	// Allocs older than the max age are collected
+	c.config.GCMaxAge = 150 * time.Minute
+	if n := c.collectAllocs(false); n != 1 {
+		t.Fatalf("collected %d allocs; want 1", n)
+	}
+	testGCCollected(t, old, true)
+	testGCCollected(t, recent, false)
+
+	// Allocs are collected until the disk usage is below the threshold
+	oldUsage := allocDirDiskUsage
+	defer func() { allocDirDiskUsage = oldUsage }()
+	usage := []float64{95, 50}
+	allocDirDiskUsage = func(string) (float64, error) {
+		used := usage[0]
+		usage = usage[1:]
+		return used, nil
+	}
+	c.config.GCDiskUsageThreshold = 80
+	if n := c.collectAllocs(false); n != 1 {
+		t.Fatalf("collected %d allocs; want 1", n)
+	}
+	testGCCollected(t, recent, true)
+	testGCCollected(t, newest, false)
+
+	// Forced collections ignore the thresholds
+	if n := c.CollectAllAllocs(); n != 1 {
+		t.Fatalf("collected %d allocs; want 1", n)
+	}
+	testGCCollected(t, newest, true)
+	testGCCollected(t, blocking, false)
+	testGCCollected(t, c.allocs[running.ID], false)
+}
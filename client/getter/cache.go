@@ -0,0 +1,350 @@
+package getter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// cacheEntryLock guards a cache entry while tasks use it
+type cacheEntryLock struct {
+	sync.Mutex
+
+	// users is the number of tasks holding or waiting for the lock
+	users int
+}
+
+var (
+	// cacheLocks holds a lock per cache entry in use so that concurrent tasks
+	// fetching the same artifact download it only once, and so that entries
+	// in use aren't evicted. cacheLocksLock guards the map and the users of
+	// the locks in it.
+	cacheLocks     = make(map[string]*cacheEntryLock)
+	cacheLocksLock sync.Mutex
+)
+
+// lockCacheEntry locks the cache entry at path and returns the function
+// unlocking it. The lock is removed once no task uses the entry.
+func lockCacheEntry(path string) func() {
+	cacheLocksLock.Lock()
+	l, ok := cacheLocks[path]
+	if !ok {
+		l = &cacheEntryLock{}
+		cacheLocks[path] = l
+	}
+	l.users++
+	cacheLocksLock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		cacheLocksLock.Lock()
+		defer cacheLocksLock.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(cacheLocks, path)
+		}
+	}
+}
+
+// cacheKey returns the key under which the artifact is cached, or an empty
+// string if the artifact can't be cached. Only artifacts with a checksum are
+// cached, as without one there is no way to tell whether two sources refer to
+// the same content. The base name of the source is part of the key as it
+// names the downloaded file, but the rest of the source isn't so that mirrors
+// of an artifact share an entry. The other getter options are part of the key
+// as they change what is fetched, e.g. whether an archive is unpacked.
+func cacheKey(taskEnv *env.TaskEnvironment, artifact *structs.TaskArtifact) string {
+	checksum := taskEnv.ReplaceEnv(artifact.GetterOptions["checksum"])
+	if checksum == "" {
+		return ""
+	}
+
+	source := taskEnv.ReplaceEnv(artifact.GetterSource)
+	if i := strings.IndexAny(source, "?#"); i != -1 {
+		source = source[:i]
+	}
+
+	keys := make([]string, 0, len(artifact.GetterOptions))
+	for k := range artifact.GetterOptions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", path.Base(source))
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, taskEnv.ReplaceEnv(artifact.GetterOptions[k]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getCached copies the cache entry at entry into dest, downloading url into
+// the entry first if it doesn't exist yet. The entry is only created once the
+// download, including the checksum verification, has succeeded.
+//
+// The contents of the entry are hashed as they are copied and checked against
+// the hash recorded when the entry was first used, so that an entry that has
+// been corrupted since is downloaded again rather than handed to the task.
+// The modification time of the recorded hash tracks when the entry was last
+// used, and adding an entry evicts the entries used longest ago if the cache
+// grows beyond its maximum size.
+func getCached(url, dest, entry string, config *Config) error {
+	unlock := lockCacheEntry(entry)
+	defer unlock()
+
+	sumPath := entry + ".sum"
+	for {
+		added := false
+		if _, err := os.Stat(entry); os.IsNotExist(err) {
+			if err := addCacheEntry(url, entry, config); err != nil {
+				return err
+			}
+			added = true
+		} else if err != nil {
+			return fmt.Errorf("failed to stat cache entry: %v", err)
+		}
+
+		// The entry is copied rather than hard-linked since tasks may modify
+		// their artifacts in place, e.g. a Qemu VM writing to its image.
+		h := sha256.New()
+		if err := copyTree(entry, dest, h); err != nil {
+			return fmt.Errorf("failed to copy artifact from cache: %v", err)
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+
+		// Entries cached before their hash was recorded are trusted
+		expected, err := ioutil.ReadFile(sumPath)
+		if added || os.IsNotExist(err) {
+			if err := ioutil.WriteFile(sumPath, []byte(sum), 0600); err != nil {
+				return fmt.Errorf("failed to record hash of cache entry: %v", err)
+			}
+			if added && config.CacheMaxBytes > 0 {
+				if err := evictCache(filepath.Dir(entry), config.CacheMaxBytes, config.Logger); err != nil && config.Logger != nil {
+					config.Logger.Printf("[WARN] client: failed to evict artifacts from the cache: %v", err)
+				}
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read hash of cache entry: %v", err)
+		}
+		if string(expected) == sum {
+			now := time.Now()
+			os.Chtimes(sumPath, now, now)
+			return nil
+		}
+
+		if config.Logger != nil {
+			config.Logger.Printf("[WARN] client: cached artifact %s is corrupt, downloading it again", filepath.Base(entry))
+		}
+		if err := removeCopy(entry, dest); err != nil {
+			return fmt.Errorf("failed to remove corrupt artifact: %v", err)
+		}
+		if err := os.RemoveAll(entry); err != nil {
+			return fmt.Errorf("failed to remove corrupt cache entry: %v", err)
+		}
+		os.Remove(sumPath)
+	}
+}
+
+// addCacheEntry downloads url into the cache entry at entry
+func addCacheEntry(url, entry string, config *Config) error {
+	tmp := entry + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("failed to clean up cache entry: %v", err)
+	}
+	client, err := newArtifactClient(url, tmp, config)
+	if err != nil {
+		return err
+	}
+	if err := client.Get(); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("GET error: %v", err)
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to add artifact to cache: %v", err)
+	}
+	return nil
+}
+
+// cacheEntry is an entry of the artifact cache
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// cacheEntriesByLastUse sorts cache entries from the one used longest ago
+type cacheEntriesByLastUse []*cacheEntry
+
+func (c cacheEntriesByLastUse) Len() int           { return len(c) }
+func (c cacheEntriesByLastUse) Less(i, j int) bool { return c[i].lastUsed.Before(c[j].lastUsed) }
+func (c cacheEntriesByLastUse) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// evictCache removes the entries of the cache in dir used longest ago until
+// the cache holds at most maxBytes. Entries in use by a task are kept.
+func evictCache(dir string, maxBytes int64, logger *log.Logger) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Entries are the directories named by their key, next to the recorded
+	// hash and the download in progress of each
+	var entries []*cacheEntry
+	var total int64
+	for _, fi := range files {
+		if !fi.IsDir() || filepath.Ext(fi.Name()) != "" {
+			continue
+		}
+		e := &cacheEntry{path: filepath.Join(dir, fi.Name()), lastUsed: fi.ModTime()}
+		if sum, err := os.Stat(e.path + ".sum"); err == nil {
+			e.lastUsed = sum.ModTime()
+		}
+		err := filepath.Walk(e.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				e.size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		total += e.size
+	}
+	sort.Sort(cacheEntriesByLastUse(entries))
+
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+
+		// Entries are only removed while no task can start using them
+		cacheLocksLock.Lock()
+		_, inUse := cacheLocks[e.path]
+		if !inUse {
+			err = os.RemoveAll(e.path)
+			os.Remove(e.path + ".sum")
+		}
+		cacheLocksLock.Unlock()
+		if inUse {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		total -= e.size
+		if logger != nil {
+			logger.Printf("[DEBUG] client: evicted cached artifact %s of %d bytes", filepath.Base(e.path), e.size)
+		}
+	}
+	return nil
+}
+
+// removeCopy removes the files copyTree copied from the tree at src into dst,
+// along with the directories it created that are left empty
+func removeCopy(src, dst string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			if rel != "." {
+				dirs = append(dirs, target)
+			}
+			return nil
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories come before their contents in the walk, and ones that held
+	// more than the copy aren't empty
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
+
+// copyTree copies the directory tree at src into dst, preserving permissions.
+// The path and contents of every file are added to h, if it is non-nil, in the
+// order of the walk.
+func copyTree(src, dst string, h hash.Hash) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if h != nil {
+			fmt.Fprintf(h, "%s\n", filepath.ToSlash(rel))
+		}
+		return copyFile(path, target, info.Mode().Perm(), h)
+	})
+}
+
+// copyFile copies the file at src to dst, creating it with the given
+// permissions, and adds its contents to h if it is non-nil
+func copyFile(src, dst string, perm os.FileMode, h hash.Hash) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	r := io.Reader(in)
+	if h != nil {
+		r = io.TeeReader(in, h)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -2,8 +2,12 @@ package getter
 
 import (
 	"fmt"
+	"log"
 	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 
 	gg "github.com/hashicorp/go-getter"
@@ -18,7 +22,12 @@ var (
 	lock    sync.Mutex
 
 	// supported is the set of download schemes supported by Nomad
-	supported = []string{"http", "https", "s3"}
+	supported = []string{"http", "https", "s3", "git"}
+
+	// gitSchemes is the set of schemes git repositories may be cloned with.
+	// Repositories on the host's filesystem aren't allowed, as they would
+	// bypass the file whitelist.
+	gitSchemes = []string{"http", "https", "ssh"}
 )
 
 // getClient returns a client that is suitable for Nomad downloading artifacts.
@@ -44,6 +53,124 @@ func getClient(src, dst string) *gg.Client {
 	}
 }
 
+// Config configures how artifacts are fetched on the node
+type Config struct {
+	// CacheDir is the directory artifacts with a checksum are cached in. If
+	// empty, artifacts aren't cached.
+	CacheDir string
+
+	// CacheMaxBytes is the size the cache is kept under by evicting the
+	// artifacts used longest ago. If zero, the cache isn't bounded.
+	CacheMaxBytes int64
+
+	// DownloadDir is the directory downloads are shared through by the tasks
+	// fetching the same artifact at the same time, if it isn't cached. If
+	// empty, every task downloads the artifact itself.
+	DownloadDir string
+
+	// FileWhitelist is the list of host directories file:// artifacts may be
+	// fetched from. If empty, file:// artifacts aren't allowed.
+	FileWhitelist []string
+
+	// Logger is used to report the progress of downloads. It may be nil.
+	Logger *log.Logger
+
+	// Cancel aborts HTTP downloads, including their retries, once it is
+	// closed, e.g. when the task is destroyed. It may be nil.
+	Cancel <-chan struct{}
+}
+
+// newArtifactClient returns a client downloading the artifact at src to dst.
+// Sources on the host's filesystem are only allowed from the whitelisted
+// directories and are copied rather than linked into the task directory. HTTP
+// downloads are retried and resumed if they fail, and their checksum is
+// verified as they are downloaded.
+func newArtifactClient(src, dst string, config *Config) (*gg.Client, error) {
+	client := getClient(src, dst)
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return client, nil
+	}
+	switch u.Scheme {
+	case "file":
+		if err := checkFileSource(u, config); err != nil {
+			return nil, err
+		}
+		client.Getters = map[string]gg.Getter{"file": &gg.FileGetter{Copy: true}}
+	case "http", "https":
+		var logger *log.Logger
+		var cancel <-chan struct{}
+		if config != nil {
+			logger, cancel = config.Logger, config.Cancel
+		}
+		getter := newHttpGetter(logger, cancel)
+
+		// The checksum is verified while downloading, rather than by go-getter
+		// reading the whole file again once it has been downloaded
+		q := u.Query()
+		if v := q.Get("checksum"); v != "" {
+			sum, err := parseChecksum(v)
+			if err != nil {
+				return nil, err
+			}
+			getter.checksum = sum
+			q.Del("checksum")
+			u.RawQuery = q.Encode()
+			client.Src = u.String()
+		}
+		client.Getters = map[string]gg.Getter{u.Scheme: getter}
+	case "git":
+		if err := checkGitSource(u); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// checkGitSource returns an error if the git:: source doesn't clone the
+// repository over one of the allowed schemes.
+func checkGitSource(u *url.URL) error {
+	repo, err := url.Parse(strings.TrimPrefix(u.Opaque, ":"))
+	if err != nil {
+		return fmt.Errorf("failed to parse git repository URL: %v", err)
+	}
+	for _, scheme := range gitSchemes {
+		if repo.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("git repositories must be cloned over one of %s, not %q",
+		strings.Join(gitSchemes, ", "), repo.Scheme)
+}
+
+// checkFileSource returns an error if the file:// URL doesn't refer to a file
+// inside one of the whitelisted directories. Symlinks are resolved, so they
+// can't be used to escape the whitelist.
+func checkFileSource(u *url.URL, config *Config) error {
+	if u.Opaque != "" || u.Path == "" || !filepath.IsAbs(u.Path) {
+		return fmt.Errorf("file source must be an absolute path, e.g. file:///path/to/file")
+	}
+	if config == nil || len(config.FileWhitelist) == 0 {
+		return fmt.Errorf("file sources are not enabled on this client")
+	}
+
+	path, err := filepath.EvalSymlinks(u.Path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve file source: %v", err)
+	}
+	for _, dir := range config.FileWhitelist {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("file source %q is not in a whitelisted directory", u.Path)
+}
+
 // getGetterUrl returns the go-getter URL to download the artifact.
 func getGetterUrl(taskEnv *env.TaskEnvironment, artifact *structs.TaskArtifact) (string, error) {
 	taskEnv.Build()
@@ -57,20 +184,68 @@ func getGetterUrl(taskEnv *env.TaskEnvironment, artifact *structs.TaskArtifact)
 	for k, v := range artifact.GetterOptions {
 		q.Add(k, taskEnv.ReplaceEnv(v))
 	}
+
+	// go-getter only understands S3 URLs in their HTTP form, so rewrite
+	// s3://bucket/key into the path-style URL of the bucket on the endpoint of
+	// its region, forcing the S3 getter so that credentials are resolved
+	if u.Scheme == "s3" && u.Host != "" {
+		endpoint := "s3.amazonaws.com"
+		if region := q.Get("region"); region != "" {
+			if !s3RegionRe.MatchString(region) {
+				return "", fmt.Errorf("invalid S3 region %q", region)
+			}
+			if region != "us-east-1" {
+				endpoint = fmt.Sprintf("s3-%s.amazonaws.com", region)
+			}
+		}
+		q.Del("region")
+
+		s3 := fmt.Sprintf("s3::https://%s/%s%s", endpoint, u.Host, u.EscapedPath())
+		if u, err = url.Parse(s3); err != nil {
+			return "", fmt.Errorf("failed to parse source URL %q: %v", artifact.GetterSource, err)
+		}
+	}
 	u.RawQuery = q.Encode()
 	return u.String(), nil
 }
 
-// GetArtifact downloads an artifact into the specified task directory.
-func GetArtifact(taskEnv *env.TaskEnvironment, artifact *structs.TaskArtifact, taskDir string) error {
+// s3RegionRe matches the names of AWS regions, such as eu-west-1
+var s3RegionRe = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// GetArtifact downloads an artifact into the specified task directory. If the
+// config has a cache directory, artifacts with a checksum are downloaded into
+// it once and copied into the task directory from there. Otherwise, if it has
+// a download directory, tasks fetching the same artifact at the same time
+// share a single download. The config may be nil.
+func GetArtifact(taskEnv *env.TaskEnvironment, artifact *structs.TaskArtifact, taskDir string, config *Config) error {
 	url, err := getGetterUrl(taskEnv, artifact)
 	if err != nil {
 		return err
 	}
 
-	// Download the artifact
+	// Validate the source before looking it up in the cache, so that
+	// artifacts cached from sources that are no longer allowed aren't used
 	dest := filepath.Join(taskDir, artifact.RelativeDest)
-	if err := getClient(url, dest).Get(); err != nil {
+	client, err := newArtifactClient(url, dest, config)
+	if err != nil {
+		return err
+	}
+
+	if config != nil && config.CacheDir != "" {
+		if key := cacheKey(taskEnv, artifact); key != "" {
+			if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+				return fmt.Errorf("failed to create artifact cache: %v", err)
+			}
+			return getCached(url, dest, filepath.Join(config.CacheDir, key), config)
+		}
+	}
+
+	if config != nil && config.DownloadDir != "" {
+		return getShared(url, dest, config.DownloadDir, config)
+	}
+
+	// Download the artifact
+	if err := client.Get(); err != nil {
 		return fmt.Errorf("GET error: %v", err)
 	}
 
@@ -5,11 +5,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/nomad/client/driver/env"
 	"github.com/hashicorp/nomad/nomad/mock"
@@ -39,7 +42,7 @@ func TestGetArtifact_FileAndChecksum(t *testing.T) {
 
 	// Download the artifact
 	taskEnv := env.NewTaskEnvironment(mock.Node())
-	if err := GetArtifact(taskEnv, artifact, taskDir); err != nil {
+	if err := GetArtifact(taskEnv, artifact, taskDir, nil); err != nil {
 		t.Fatalf("GetArtifact failed: %v", err)
 	}
 
@@ -74,7 +77,7 @@ func TestGetArtifact_File_RelativeDest(t *testing.T) {
 
 	// Download the artifact
 	taskEnv := env.NewTaskEnvironment(mock.Node())
-	if err := GetArtifact(taskEnv, artifact, taskDir); err != nil {
+	if err := GetArtifact(taskEnv, artifact, taskDir, nil); err != nil {
 		t.Fatalf("GetArtifact failed: %v", err)
 	}
 
@@ -125,7 +128,7 @@ func TestGetArtifact_InvalidChecksum(t *testing.T) {
 
 	// Download the artifact and expect an error
 	taskEnv := env.NewTaskEnvironment(mock.Node())
-	if err := GetArtifact(taskEnv, artifact, taskDir); err == nil {
+	if err := GetArtifact(taskEnv, artifact, taskDir, nil); err == nil {
 		t.Fatalf("GetArtifact should have failed")
 	}
 }
@@ -191,7 +194,7 @@ func TestGetArtifact_Archive(t *testing.T) {
 	}
 
 	taskEnv := env.NewTaskEnvironment(mock.Node())
-	if err := GetArtifact(taskEnv, artifact, taskDir); err != nil {
+	if err := GetArtifact(taskEnv, artifact, taskDir, nil); err != nil {
 		t.Fatalf("GetArtifact failed: %v", err)
 	}
 
@@ -204,3 +207,637 @@ func TestGetArtifact_Archive(t *testing.T) {
 	}
 	checkContents(taskDir, expected, t)
 }
+
+func TestGetArtifact_Cache(t *testing.T) {
+	// Create the test server hosting the file to download, counting the
+	// requests for it
+	var lock sync.Mutex
+	requests := 0
+	fs := http.FileServer(http.Dir(filepath.Dir("./test-fixtures/")))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		fs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// Create the artifact
+	file := "test.sh"
+	artifact := &structs.TaskArtifact{
+		GetterSource: fmt.Sprintf("%s/%s", ts.URL, file),
+		GetterOptions: map[string]string{
+			"checksum": "md5:bce963762aa2dbfed13caf492a45fb72",
+		},
+	}
+
+	// Download the artifact into several task directories at once
+	var taskDirs []string
+	for i := 0; i < 5; i++ {
+		taskDir, err := ioutil.TempDir("", "nomad-test")
+		if err != nil {
+			t.Fatalf("failed to make temp directory: %v", err)
+		}
+		defer os.RemoveAll(taskDir)
+		taskDirs = append(taskDirs, taskDir)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(taskDirs))
+	for _, taskDir := range taskDirs {
+		wg.Add(1)
+		go func(taskDir string) {
+			defer wg.Done()
+			taskEnv := env.NewTaskEnvironment(mock.Node())
+			errCh <- GetArtifact(taskEnv, artifact, taskDir, &Config{CacheDir: cacheDir})
+		}(taskDir)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("GetArtifact failed: %v", err)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("artifact downloaded %d times; want 1", requests)
+	}
+
+	// Verify each task got its own copy of the artifact
+	for _, taskDir := range taskDirs {
+		checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+	}
+	path := filepath.Join(taskDirs[0], file)
+	if err := ioutil.WriteFile(path, []byte("modified"), 0777); err != nil {
+		t.Fatalf("failed to write artifact: %v", err)
+	}
+	checkContents(taskDirs[1], map[string]string{file: "sleep 1\n"}, t)
+}
+
+func TestGetArtifact_Cache_Corrupt(t *testing.T) {
+	// Create the test server hosting the file to download, counting the
+	// requests for it
+	var lock sync.Mutex
+	requests := 0
+	fs := http.FileServer(http.Dir(filepath.Dir("./test-fixtures/")))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		fs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	file := "test.sh"
+	artifact := &structs.TaskArtifact{
+		GetterSource: fmt.Sprintf("%s/%s", ts.URL, file),
+		GetterOptions: map[string]string{
+			"checksum": "md5:bce963762aa2dbfed13caf492a45fb72",
+		},
+	}
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	get := func() string {
+		taskDir, err := ioutil.TempDir("", "nomad-test")
+		if err != nil {
+			t.Fatalf("failed to make temp directory: %v", err)
+		}
+		if err := GetArtifact(taskEnv, artifact, taskDir, &Config{CacheDir: cacheDir}); err != nil {
+			t.Fatalf("GetArtifact failed: %v", err)
+		}
+		return taskDir
+	}
+
+	taskDir := get()
+	defer os.RemoveAll(taskDir)
+	checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+
+	// Corrupt the cached artifact
+	entry := filepath.Join(cacheDir, cacheKey(taskEnv, artifact), file)
+	if err := ioutil.WriteFile(entry, []byte("corrupt"), 0777); err != nil {
+		t.Fatalf("failed to corrupt cache entry: %v", err)
+	}
+
+	// The corrupt entry is downloaded again
+	taskDir = get()
+	defer os.RemoveAll(taskDir)
+	checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+	if requests != 2 {
+		t.Fatalf("artifact downloaded %d times; want 2", requests)
+	}
+
+	// The intact entry is reused
+	taskDir = get()
+	defer os.RemoveAll(taskDir)
+	checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+	if requests != 2 {
+		t.Fatalf("artifact downloaded %d times; want 2", requests)
+	}
+}
+
+func TestGetArtifact_Cache_CorruptExtraFile(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir("./test-fixtures/"))))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	file := "test.sh"
+	artifact := &structs.TaskArtifact{
+		GetterSource: fmt.Sprintf("%s/%s", ts.URL, file),
+		GetterOptions: map[string]string{
+			"checksum": "md5:bce963762aa2dbfed13caf492a45fb72",
+		},
+	}
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	config := &Config{CacheDir: cacheDir}
+	for i := 0; i < 2; i++ {
+		taskDir, err := ioutil.TempDir("", "nomad-test")
+		if err != nil {
+			t.Fatalf("failed to make temp directory: %v", err)
+		}
+		defer os.RemoveAll(taskDir)
+		if err := GetArtifact(taskEnv, artifact, taskDir, config); err != nil {
+			t.Fatalf("GetArtifact failed: %v", err)
+		}
+		checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+
+		// Corrupt the cached artifact with a file that isn't part of it
+		entry := filepath.Join(cacheDir, cacheKey(taskEnv, artifact))
+		if err := os.MkdirAll(filepath.Join(entry, "extra"), 0755); err != nil {
+			t.Fatalf("failed to corrupt cache entry: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(entry, "extra", "file"), []byte("corrupt"), 0644); err != nil {
+			t.Fatalf("failed to corrupt cache entry: %v", err)
+		}
+	}
+
+	// The files copied from the corrupt entry are removed from the task
+	// directory before the entry is downloaded again
+	taskDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+	if err := GetArtifact(taskEnv, artifact, taskDir, config); err != nil {
+		t.Fatalf("GetArtifact failed: %v", err)
+	}
+	checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+	if _, err := os.Stat(filepath.Join(taskDir, "extra")); !os.IsNotExist(err) {
+		t.Fatalf("file of the corrupt entry left in the task directory: %v", err)
+	}
+}
+
+func TestGetArtifact_Cache_Evict(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	fs := http.FileServer(http.Dir(filepath.Dir("./test-fixtures/")))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		fs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// The artifacts are cached separately as their options differ, and the
+	// cache has room for two of them
+	file := "test.sh"
+	artifact := func(name string) *structs.TaskArtifact {
+		return &structs.TaskArtifact{
+			GetterSource: fmt.Sprintf("%s/%s", ts.URL, file),
+			GetterOptions: map[string]string{
+				"checksum": "md5:bce963762aa2dbfed13caf492a45fb72",
+				"name":     name,
+			},
+		}
+	}
+	a, b, c := artifact("a"), artifact("b"), artifact("c")
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	config := &Config{CacheDir: cacheDir, CacheMaxBytes: 2 * int64(len("sleep 1\n"))}
+	get := func(artifact *structs.TaskArtifact) {
+		taskDir, err := ioutil.TempDir("", "nomad-test")
+		if err != nil {
+			t.Fatalf("failed to make temp directory: %v", err)
+		}
+		defer os.RemoveAll(taskDir)
+		if err := GetArtifact(taskEnv, artifact, taskDir, config); err != nil {
+			t.Fatalf("GetArtifact failed: %v", err)
+		}
+		checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+	}
+	cached := func(artifact *structs.TaskArtifact) bool {
+		_, err := os.Stat(filepath.Join(cacheDir, cacheKey(taskEnv, artifact)))
+		return err == nil
+	}
+
+	// Using a makes b the entry used longest ago, which adding c evicts
+	get(a)
+	get(b)
+	get(a)
+	get(c)
+	if !cached(a) || cached(b) || !cached(c) {
+		t.Fatalf("cached a: %v, b: %v, c: %v; want a and c", cached(a), cached(b), cached(c))
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, cacheKey(taskEnv, b)+".sum")); !os.IsNotExist(err) {
+		t.Fatalf("hash of evicted entry left behind: %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("artifacts downloaded %d times; want 3", requests)
+	}
+
+	// Locks of entries no longer in use are removed
+	cacheLocksLock.Lock()
+	defer cacheLocksLock.Unlock()
+	if len(cacheLocks) != 0 {
+		t.Fatalf("%d cache entry locks left", len(cacheLocks))
+	}
+}
+
+func TestGetArtifact_Cache_InvalidChecksum(t *testing.T) {
+	// Create the test server hosting the file to download
+	ts := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir("./test-fixtures/"))))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	taskDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+
+	// Create the artifact with an incorrect checksum
+	artifact := &structs.TaskArtifact{
+		GetterSource: fmt.Sprintf("%s/%s", ts.URL, "test.sh"),
+		GetterOptions: map[string]string{
+			"checksum": "md5:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		},
+	}
+
+	// Download the artifact and expect an error
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	if err := GetArtifact(taskEnv, artifact, taskDir, &Config{CacheDir: cacheDir}); err == nil {
+		t.Fatalf("GetArtifact should have failed")
+	}
+
+	// The failed download must not be cached
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("failed to read cache directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("cache has %d entries; want 0", len(entries))
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	key := func(source string) string {
+		return cacheKey(taskEnv, &structs.TaskArtifact{
+			GetterSource: source,
+			GetterOptions: map[string]string{
+				"checksum": "md5:bce963762aa2dbfed13caf492a45fb72",
+			},
+		})
+	}
+
+	// Mirrors of an artifact share an entry
+	k := key("http://example.com/files/test.sh")
+	if other := key("https://mirror.example.org/test.sh?token=abc"); other != k {
+		t.Fatalf("mirrors have keys %q and %q; want the same", k, other)
+	}
+
+	// Artifacts downloaded under another name don't
+	if other := key("http://example.com/files/other.sh"); other == k {
+		t.Fatalf("artifacts with different names share key %q", k)
+	}
+
+	// Artifacts without a checksum aren't cached
+	if k := cacheKey(taskEnv, &structs.TaskArtifact{GetterSource: "http://example.com/test.sh"}); k != "" {
+		t.Fatalf("got key %q for an artifact without a checksum", k)
+	}
+}
+
+func TestGetGetterUrl_S3(t *testing.T) {
+	cases := []struct {
+		source  string
+		options map[string]string
+		url     string
+	}{
+		{
+			"s3://my-bucket/images/linux.img?version=2", nil,
+			"s3::https://s3.amazonaws.com/my-bucket/images/linux.img?version=2",
+		},
+		{
+			"s3://my-bucket/images/linux.img?region=eu-west-1&version=2", nil,
+			"s3::https://s3-eu-west-1.amazonaws.com/my-bucket/images/linux.img?version=2",
+		},
+		{
+			"s3://my-bucket/images/linux.img", map[string]string{"region": "us-east-1"},
+			"s3::https://s3.amazonaws.com/my-bucket/images/linux.img",
+		},
+		{
+			"s3://my-bucket/images/linux.img", map[string]string{"region": "ap-southeast-2"},
+			"s3::https://s3-ap-southeast-2.amazonaws.com/my-bucket/images/linux.img",
+		},
+		{
+			"s3://my-bucket/images/linux.img?region=evil.com/x", nil,
+			"",
+		},
+	}
+
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	for _, c := range cases {
+		artifact := &structs.TaskArtifact{
+			GetterSource:  c.source,
+			GetterOptions: c.options,
+		}
+		act, err := getGetterUrl(taskEnv, artifact)
+		if c.url == "" {
+			if err == nil {
+				t.Fatalf("getGetterUrl(%q) should have failed; got %q", c.source, act)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("getGetterUrl(%q) failed: %v", c.source, err)
+		}
+		if act != c.url {
+			t.Fatalf("getGetterUrl(%q) returned %q; want %q", c.source, act, c.url)
+		}
+	}
+}
+
+func TestGetArtifact_File(t *testing.T) {
+	// Create a whitelisted directory holding the file to fetch, and a file
+	// outside of it
+	srcDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(srcDir)
+	allowed := filepath.Join(srcDir, "allowed")
+	createContents(srcDir, map[string]string{
+		"allowed/image.img": "image",
+		"secret":            "secret",
+	}, t)
+	if err := os.Symlink(filepath.Join(srcDir, "secret"), filepath.Join(allowed, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	taskDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+
+	config := &Config{FileWhitelist: []string{allowed}}
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	artifact := &structs.TaskArtifact{
+		GetterSource: "file://" + filepath.Join(allowed, "image.img"),
+	}
+	if err := GetArtifact(taskEnv, artifact, taskDir, config); err != nil {
+		t.Fatalf("GetArtifact failed: %v", err)
+	}
+
+	// The file must be copied rather than linked to the host's file
+	checkContents(taskDir, map[string]string{"image.img": "image"}, t)
+	if fi, err := os.Lstat(filepath.Join(taskDir, "image.img")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("expected a regular file: %v, %v", fi, err)
+	}
+
+	cases := []struct {
+		source string
+		config *Config
+	}{
+		{"file://" + filepath.Join(allowed, "image.img"), nil},
+		{"file://" + filepath.Join(srcDir, "secret"), config},
+		{"file://" + filepath.Join(allowed, "..", "secret"), config},
+		{"file://" + filepath.Join(allowed, "link"), config},
+		{"file::" + filepath.Join(srcDir, "secret"), config},
+	}
+	for _, c := range cases {
+		artifact := &structs.TaskArtifact{GetterSource: c.source}
+		if err := GetArtifact(taskEnv, artifact, taskDir, c.config); err == nil {
+			t.Fatalf("GetArtifact(%q) should have failed", c.source)
+		}
+	}
+}
+
+func TestGetArtifact_Git_Source(t *testing.T) {
+	taskDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+
+	// Repositories on the host aren't allowed, even from whitelisted
+	// directories
+	config := &Config{FileWhitelist: []string{taskDir}}
+	taskEnv := env.NewTaskEnvironment(mock.Node())
+	sources := []string{
+		"git::file://" + taskDir,
+		"git::" + taskDir,
+	}
+	for _, source := range sources {
+		artifact := &structs.TaskArtifact{GetterSource: source, RelativeDest: "repo"}
+		err := GetArtifact(taskEnv, artifact, taskDir, config)
+		if err == nil || !strings.Contains(err.Error(), "git repositories must be cloned over") {
+			t.Fatalf("GetArtifact(%q) should have failed: %v", source, err)
+		}
+	}
+
+	for _, source := range []string{"git::https://example.com/repo", "git::ssh://git@example.com/repo"} {
+		u, err := url.Parse(source)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", source, err)
+		}
+		if err := checkGitSource(u); err != nil {
+			t.Fatalf("checkGitSource(%q) failed: %v", source, err)
+		}
+	}
+	if _, ok := getClient("", "").Getters["git"]; !ok {
+		t.Fatalf("git getter isn't supported")
+	}
+}
+
+// testSharedServer serves the test fixtures, holding the nth request until
+// the nth channel of gates is closed. The nth request fails if fail[n] is set.
+func testSharedServer(gates []chan struct{}, fail map[int]bool) (*httptest.Server, func() int) {
+	var lock sync.Mutex
+	requests := 0
+	fs := http.FileServer(http.Dir(filepath.Dir("./test-fixtures/")))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		n := requests
+		requests++
+		lock.Unlock()
+
+		if n < len(gates) {
+			<-gates[n]
+		}
+		if fail[n] {
+			http.NotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	}))
+	return ts, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+// waitForSharedUsers waits until n tasks use the shared download of url
+func waitForSharedUsers(t *testing.T, url string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sharedDownloadsLock.Lock()
+		users := 0
+		if d, ok := sharedDownloads[url]; ok {
+			users = d.users
+		}
+		sharedDownloadsLock.Unlock()
+		if users == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tasks share the download; want %d", users, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testGetShared fetches the artifact into n task directories at once and
+// returns the directories and the errors of the fetches
+func testGetShared(t *testing.T, artifact *structs.TaskArtifact, downloadDir string, n int) ([]string, chan error) {
+	var taskDirs []string
+	for i := 0; i < n; i++ {
+		taskDir, err := ioutil.TempDir("", "nomad-test")
+		if err != nil {
+			t.Fatalf("failed to make temp directory: %v", err)
+		}
+		taskDirs = append(taskDirs, taskDir)
+	}
+
+	errCh := make(chan error, n)
+	for _, taskDir := range taskDirs {
+		go func(taskDir string) {
+			taskEnv := env.NewTaskEnvironment(mock.Node())
+			errCh <- GetArtifact(taskEnv, artifact, taskDir, &Config{DownloadDir: downloadDir})
+		}(taskDir)
+	}
+	return taskDirs, errCh
+}
+
+func TestGetArtifact_Shared(t *testing.T) {
+	gate := make(chan struct{})
+	ts, requests := testSharedServer([]chan struct{}{gate}, nil)
+	defer ts.Close()
+
+	downloadDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(downloadDir)
+
+	// Artifacts without a checksum are shared as well
+	file := "test.sh"
+	source := fmt.Sprintf("%s/%s", ts.URL, file)
+	artifact := &structs.TaskArtifact{GetterSource: source}
+
+	// The download is held until every task waits for it
+	const n = 5
+	taskDirs, errCh := testGetShared(t, artifact, downloadDir, n)
+	for _, taskDir := range taskDirs {
+		defer os.RemoveAll(taskDir)
+	}
+	waitForSharedUsers(t, source, n)
+	close(gate)
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("GetArtifact failed: %v", err)
+		}
+	}
+
+	if r := requests(); r != 1 {
+		t.Fatalf("artifact downloaded %d times; want 1", r)
+	}
+	for _, taskDir := range taskDirs {
+		checkContents(taskDir, map[string]string{file: "sleep 1\n"}, t)
+	}
+
+	// The shared download is removed once every task has copied it
+	if files, err := ioutil.ReadDir(downloadDir); err != nil || len(files) != 0 {
+		t.Fatalf("shared download left behind: %v, %v", files, err)
+	}
+}
+
+func TestGetArtifact_Shared_Failed(t *testing.T) {
+	gates := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	ts, requests := testSharedServer(gates, map[int]bool{0: true})
+	defer ts.Close()
+
+	downloadDir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(downloadDir)
+
+	file := "test.sh"
+	source := fmt.Sprintf("%s/%s", ts.URL, file)
+	artifact := &structs.TaskArtifact{GetterSource: source}
+
+	const n = 5
+	taskDirs, errCh := testGetShared(t, artifact, downloadDir, n)
+	for _, taskDir := range taskDirs {
+		defer os.RemoveAll(taskDir)
+	}
+
+	// The first download fails, and the tasks waiting for it share a second
+	// download rather than failing along with it
+	waitForSharedUsers(t, source, n)
+	close(gates[0])
+	waitForSharedUsers(t, source, n-1)
+	close(gates[1])
+
+	failed := 0
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d downloads failed; want 1", failed)
+	}
+	if r := requests(); r != 2 {
+		t.Fatalf("artifact downloaded %d times; want 2", r)
+	}
+}
@@ -0,0 +1,411 @@
+package getter
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	gg "github.com/hashicorp/go-getter"
+)
+
+const (
+	// httpRetries is the number of times an interrupted download is resumed
+	// before giving up
+	httpRetries = 5
+
+	// httpRetryBackoff is the wait before the first retry of a download. It
+	// doubles with every further retry.
+	httpRetryBackoff = 1 * time.Second
+
+	// httpMaxRetryWait bounds the total time a download waits between its
+	// retries, so that a task whose artifact keeps failing falls back to its
+	// restart policy in good time
+	httpMaxRetryWait = 10 * time.Second
+
+	// httpProgressInterval is the interval at which download progress is
+	// logged
+	httpProgressInterval = 30 * time.Second
+
+	// httpResponseHeaderTimeout bounds waiting for the server to respond to a
+	// request
+	httpResponseHeaderTimeout = 30 * time.Second
+
+	// httpIdleTimeout is how long a download may go without receiving any
+	// data before it is considered stalled and retried
+	httpIdleTimeout = 2 * time.Minute
+)
+
+// httpClient is the client files are downloaded with. Unlike
+// http.DefaultClient it doesn't wait forever on a server that accepts the
+// connection but never responds.
+var httpClient = func() *http.Client {
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.ResponseHeaderTimeout = httpResponseHeaderTimeout
+	return &http.Client{Transport: transport}
+}()
+
+// httpGetter downloads files over HTTP like go-getter's HttpGetter, but
+// retries failed downloads with an exponential backoff. Downloads that are
+// interrupted part way through are resumed with a range request, so large
+// files such as VM images don't have to be downloaded from the start again.
+// If the getter has a checksum, it is verified as the file is downloaded, so
+// the file isn't read again to verify it.
+type httpGetter struct {
+	gg.HttpGetter
+
+	logger   *log.Logger
+	retries  int
+	backoff  time.Duration
+	checksum *fileChecksum
+
+	// cancel aborts the download and its retries once it is closed. It may be
+	// nil.
+	cancel <-chan struct{}
+
+	// idleTimeout is how long a download may stall before it is retried, or
+	// zero to wait indefinitely
+	idleTimeout time.Duration
+}
+
+// fileChecksum is the expected checksum of a downloaded file
+type fileChecksum struct {
+	newHash func() hash.Hash
+	value   []byte
+}
+
+// parseChecksum parses a checksum such as "sha256:<hex>" in the format of
+// go-getter's checksum option
+func parseChecksum(v string) (*fileChecksum, error) {
+	idx := strings.Index(v, ":")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid checksum %q: must be of the form type:value", v)
+	}
+
+	sum := &fileChecksum{}
+	switch t := v[:idx]; t {
+	case "md5":
+		sum.newHash = md5.New
+	case "sha1":
+		sum.newHash = sha1.New
+	case "sha256":
+		sum.newHash = sha256.New
+	case "sha512":
+		sum.newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported checksum type: %s", t)
+	}
+
+	value, err := hex.DecodeString(v[idx+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum: %v", err)
+	}
+	sum.value = value
+	return sum, nil
+}
+
+// verify returns an error if the hash doesn't match the checksum
+func (c *fileChecksum) verify(h hash.Hash) error {
+	if actual := h.Sum(nil); !bytes.Equal(actual, c.value) {
+		return fmt.Errorf("checksums did not match: expected %s, got %s",
+			hex.EncodeToString(c.value), hex.EncodeToString(actual))
+	}
+	return nil
+}
+
+// newHttpGetter returns an HTTP getter logging to the logger and canceled by
+// the cancel channel, both of which may be nil
+func newHttpGetter(logger *log.Logger, cancel <-chan struct{}) *httpGetter {
+	return &httpGetter{
+		logger:      logger,
+		cancel:      cancel,
+		retries:     httpRetries,
+		backoff:     httpRetryBackoff,
+		idleTimeout: httpIdleTimeout,
+	}
+}
+
+// httpError is an error response of the server
+type httpError struct {
+	StatusCode int
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("bad response code: %d", e.StatusCode)
+}
+
+// retryable returns whether a download failing with err may succeed if it is
+// retried. Error responses other than server errors won't change on a retry,
+// and servers that can't be connected to are left to the task's restart
+// policy rather than being waited for here.
+func retryable(err error) bool {
+	switch err := err.(type) {
+	case *httpError:
+		return err.StatusCode >= 500
+	case *url.Error:
+		if oerr, ok := err.Err.(*net.OpError); ok && oerr.Op == "dial" {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *httpGetter) GetFile(dst string, u *url.URL) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The hash covers the parts of the file written by earlier attempts, so a
+	// resumed download is hashed in full
+	var h hash.Hash
+	if g.checksum != nil {
+		h = g.checksum.newHash()
+	}
+
+	backoff, waited := g.backoff, time.Duration(0)
+	for attempt := 0; ; attempt++ {
+		err := g.fetch(f, u, h)
+		if err == nil {
+			if h != nil {
+				return g.checksum.verify(h)
+			}
+			return nil
+		}
+		if !retryable(err) || attempt >= g.retries || waited+backoff > httpMaxRetryWait {
+			return err
+		}
+
+		g.logf("[WARN] client: download of %s failed, retrying in %v: %v", logURL(u), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-g.cancel:
+			return fmt.Errorf("download of %s canceled: %v", logURL(u), err)
+		}
+		waited += backoff
+		backoff *= 2
+	}
+}
+
+// fetch downloads the file at u into f, resuming from the end of f if it
+// already holds part of the file. The downloaded data is added to h, if it is
+// non-nil.
+func (g *httpGetter) fetch(f *os.File, u *url.URL, h hash.Hash) error {
+	offset, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	req.Cancel = g.cancel
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := io.Reader(resp.Body)
+	if g.idleTimeout != 0 {
+		idle := newIdleTimeoutReader(resp.Body, g.idleTimeout)
+		defer idle.stop()
+		body = idle
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Data resumed anywhere but at the end of the file would corrupt it,
+		// so the download is started over instead
+		contentRange := resp.Header.Get("Content-Range")
+		if start, _, err := parseContentRange(contentRange); err != nil || start != offset {
+			if err := resetDownload(f, h); err != nil {
+				return err
+			}
+			return fmt.Errorf("server resumed the download at %q rather than at byte %d", contentRange, offset)
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// An earlier attempt may have received the whole file before failing
+		if _, size, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && size == offset {
+			return nil
+		}
+		if err := resetDownload(f, h); err != nil {
+			return err
+		}
+		return fmt.Errorf("server can't resume the download at byte %d", offset)
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// The server sent the whole file, so start over
+		if err := resetDownload(f, h); err != nil {
+			return err
+		}
+		offset = 0
+	default:
+		return &httpError{StatusCode: resp.StatusCode}
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	p := &progressWriter{
+		w:       f,
+		hash:    h,
+		written: offset,
+		total:   total,
+		log: func(written, total int64) {
+			if total > 0 {
+				g.logf("[INFO] client: downloaded %d of %d bytes (%d%%) of %s", written, total, written*100/total, logURL(u))
+			} else {
+				g.logf("[INFO] client: downloaded %d bytes of %s", written, logURL(u))
+			}
+		},
+		last: time.Now(),
+	}
+	if _, err := io.Copy(p, body); err != nil {
+		return err
+	}
+	if total >= 0 && p.written != total {
+		return fmt.Errorf("download ended after %d of %d bytes", p.written, total)
+	}
+	return nil
+}
+
+// resetDownload discards what has been downloaded into f and added to h, if it
+// is non-nil, so that the download starts over
+func resetDownload(f *os.File, h hash.Hash) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if h != nil {
+		h.Reset()
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header such as "bytes 5-9/10" into
+// the offset of the first byte sent and the size of the whole file. The offset
+// is -1 for an unsatisfiable range ("bytes */10"), and the size is -1 if the
+// server doesn't know it.
+func parseContentRange(v string) (start, size int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, invalid
+	}
+	parts := strings.SplitN(strings.TrimPrefix(v, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, invalid
+	}
+
+	size = -1
+	if parts[1] != "*" {
+		if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil || size < 0 {
+			return 0, 0, invalid
+		}
+	}
+	start = -1
+	if parts[0] != "*" {
+		i := strings.Index(parts[0], "-")
+		if i < 0 {
+			return 0, 0, invalid
+		}
+		if start, err = strconv.ParseInt(parts[0][:i], 10, 64); err != nil || start < 0 {
+			return 0, 0, invalid
+		}
+	}
+	return start, size, nil
+}
+
+// logURL returns the URL without its user info and query, which may hold
+// credentials, for logging
+func logURL(u *url.URL) string {
+	return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path)
+}
+
+func (g *httpGetter) logf(format string, args ...interface{}) {
+	if g.logger != nil {
+		g.logger.Printf(format, args...)
+	}
+}
+
+// idleTimeoutReader reads a response body, closing it if no data is received
+// from it for the timeout so that a stalled download fails instead of hanging
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.expired, 1)
+		body.Close()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	if atomic.LoadInt32(&r.expired) == 1 {
+		return n, fmt.Errorf("no data received for %v", r.timeout)
+	}
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+// stop stops the timeout once the body is no longer read
+func (r *idleTimeoutReader) stop() {
+	r.timer.Stop()
+}
+
+// progressWriter counts the bytes written through it and periodically
+// reports them. The bytes written are also added to the hash, if it is
+// non-nil.
+type progressWriter struct {
+	w       io.Writer
+	hash    hash.Hash
+	written int64
+	total   int64
+	log     func(written, total int64)
+	last    time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if p.hash != nil {
+		p.hash.Write(b[:n])
+	}
+	if now := time.Now(); now.Sub(p.last) >= httpProgressInterval {
+		p.last = now
+		p.log(p.written, p.total)
+	}
+	return n, err
+}
@@ -0,0 +1,435 @@
+package getter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHttpServer serves content, handling the nth request with the handler
+// from handlers or, once they run out, by serving the content
+func testHttpServer(content []byte, handlers ...http.HandlerFunc) (*httptest.Server, func() []*http.Request) {
+	var lock sync.Mutex
+	var requests []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		n := len(requests)
+		requests = append(requests, r)
+		lock.Unlock()
+
+		if n < len(handlers) {
+			handlers[n](w, r)
+			return
+		}
+		http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(content))
+	}))
+	return ts, func() []*http.Request {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]*http.Request(nil), requests...)
+	}
+}
+
+func testHttpGetFile(t *testing.T, ts *httptest.Server) (string, error) {
+	dir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+
+	u, err := url.Parse(ts.URL + "/image.img")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dst := filepath.Join(dir, "image.img")
+	g := &httpGetter{retries: 2, idleTimeout: 500 * time.Millisecond}
+	return dst, g.GetFile(dst, u)
+}
+
+func TestHttpGetter_Resume(t *testing.T) {
+	content := []byte("0123456789")
+
+	// The first response is cut off half way through
+	ts, requests := testHttpServer(content, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(content), content[:5])
+		buf.Flush()
+	})
+	defer ts.Close()
+
+	dst, err := testHttpGetFile(t, ts)
+	defer os.RemoveAll(filepath.Dir(dst))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("downloaded %q; want %q", data, content)
+	}
+
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests; want 2", len(reqs))
+	}
+	if r := reqs[1].Header.Get("Range"); r != "bytes=5-" {
+		t.Fatalf("resumed with range %q; want %q", r, "bytes=5-")
+	}
+}
+
+func TestHttpGetter_Resume_BadRange(t *testing.T) {
+	content := []byte("0123456789")
+
+	// The first response is cut off half way through, and the server then
+	// sends the start of the file again as the resumed range
+	ts, requests := testHttpServer(content,
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(content), content[:5])
+			buf.Flush()
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-4/%d", len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[:5])
+		},
+	)
+	defer ts.Close()
+
+	dst, err := testHttpGetFile(t, ts)
+	defer os.RemoveAll(filepath.Dir(dst))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("downloaded %q; want %q", data, content)
+	}
+
+	// The download is started over rather than appending the wrong range
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests; want 3", len(reqs))
+	}
+	if r := reqs[2].Header.Get("Range"); r != "" {
+		t.Fatalf("restarted with range %q", r)
+	}
+}
+
+func TestHttpGetter_Resume_Complete(t *testing.T) {
+	content := []byte("0123456789")
+
+	// The first response sends the whole file but claims to be longer, so
+	// the resumed range can't be satisfied
+	ts, requests := testHttpServer(content, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(content)+1, content)
+		buf.Flush()
+	})
+	defer ts.Close()
+
+	dst, err := testHttpGetFile(t, ts)
+	defer os.RemoveAll(filepath.Dir(dst))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("downloaded %q; want %q", data, content)
+	}
+	if n := len(requests()); n != 2 {
+		t.Fatalf("got %d requests; want 2", n)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		value string
+		start int64
+		size  int64
+		err   bool
+	}{
+		{"bytes 5-9/10", 5, 10, false},
+		{"bytes 5-9/*", 5, -1, false},
+		{"bytes */10", -1, 10, false},
+		{"bytes 5-9", 0, 0, true},
+		{"items 5-9/10", 0, 0, true},
+		{"bytes x-9/10", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, c := range cases {
+		start, size, err := parseContentRange(c.value)
+		if c.err {
+			if err == nil {
+				t.Fatalf("%q: expected error", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: err: %v", c.value, err)
+		}
+		if start != c.start || size != c.size {
+			t.Fatalf("%q: got %d, %d; want %d, %d", c.value, start, size, c.start, c.size)
+		}
+	}
+}
+
+func TestHttpGetter_Stalled(t *testing.T) {
+	content := []byte("0123456789")
+
+	// The first response stops sending data half way through without closing
+	// the connection
+	done := make(chan struct{})
+	ts, requests := testHttpServer(content, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:5])
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+		}
+	})
+	defer ts.Close()
+	defer close(done)
+
+	start := time.Now()
+	dst, err := testHttpGetFile(t, ts)
+	defer os.RemoveAll(filepath.Dir(dst))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("download took %v; the stall wasn't detected", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("downloaded %q; want %q", data, content)
+	}
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests; want 2", len(reqs))
+	}
+	if r := reqs[1].Header.Get("Range"); r != "bytes=5-" {
+		t.Fatalf("resumed with range %q; want %q", r, "bytes=5-")
+	}
+}
+
+func TestHttpGetter_Retry(t *testing.T) {
+	content := []byte("0123456789")
+
+	// The server fails once and then ignores the range request
+	ts, requests := testHttpServer(content,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		},
+	)
+	defer ts.Close()
+
+	dst, err := testHttpGetFile(t, ts)
+	defer os.RemoveAll(filepath.Dir(dst))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("downloaded %q; want %q", data, content)
+	}
+	if n := len(requests()); n != 2 {
+		t.Fatalf("got %d requests; want 2", n)
+	}
+}
+
+func TestHttpGetter_NoRetry(t *testing.T) {
+	// Client errors aren't retried
+	ts, requests := testHttpServer(nil, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	defer ts.Close()
+
+	dst, err := testHttpGetFile(t, ts)
+	defer os.RemoveAll(filepath.Dir(dst))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if n := len(requests()); n != 1 {
+		t.Fatalf("got %d requests; want 1", n)
+	}
+}
+
+func TestHttpGetter_NoRetry_Dial(t *testing.T) {
+	// Servers that can't be connected to are left to the restart policy
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+
+	dir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	u, err := url.Parse(ts.URL + "/image.img")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	start := time.Now()
+	g := &httpGetter{retries: 2, backoff: time.Minute}
+	if err := g.GetFile(filepath.Join(dir, "image.img"), u); err == nil {
+		t.Fatalf("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("download failed after %v; it was retried", elapsed)
+	}
+}
+
+func TestHttpGetter_Cancel(t *testing.T) {
+	// The server keeps failing, so the download waits to retry
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "nomad-test")
+	if err != nil {
+		t.Fatalf("failed to make temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	u, err := url.Parse(ts.URL + "/image.img")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cancel := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+	start := time.Now()
+	g := &httpGetter{retries: 2, backoff: 5 * time.Second, cancel: cancel}
+	if err := g.GetFile(filepath.Join(dir, "image.img"), u); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expected the download to be canceled; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("download canceled after %v", elapsed)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var reported []int64
+	p := &progressWriter{
+		w:     &buf,
+		total: 10,
+		log: func(written, total int64) {
+			reported = append(reported, written)
+		},
+	}
+
+	// The first write is reported as the last report was long ago
+	p.Write([]byte("01234"))
+	p.Write([]byte("56789"))
+	if p.written != 10 {
+		t.Fatalf("counted %d bytes; want 10", p.written)
+	}
+	if len(reported) != 1 || reported[0] != 5 {
+		t.Fatalf("reported %v; want [5]", reported)
+	}
+}
+
+func TestHttpGetter_Checksum(t *testing.T) {
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+
+	cases := []struct {
+		checksum string
+		fail     bool
+	}{
+		{"sha256:" + hex.EncodeToString(sum[:]), false},
+		{"sha256:" + strings.Repeat("0", 64), true},
+	}
+	for _, c := range cases {
+		// The first response is cut off half way through, so the hash has to
+		// cover both attempts
+		ts, _ := testHttpServer(content, func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(content), content[:5])
+			buf.Flush()
+		})
+
+		dir, err := ioutil.TempDir("", "nomad-test")
+		if err != nil {
+			t.Fatalf("failed to make temp directory: %v", err)
+		}
+		u, err := url.Parse(ts.URL + "/image.img")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		checksum, err := parseChecksum(c.checksum)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		g := &httpGetter{retries: 2, checksum: checksum}
+		err = g.GetFile(filepath.Join(dir, "image.img"), u)
+		ts.Close()
+		os.RemoveAll(dir)
+		if c.fail && err == nil {
+			t.Fatalf("%s: expected error", c.checksum)
+		} else if !c.fail && err != nil {
+			t.Fatalf("%s: err: %v", c.checksum, err)
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	for _, v := range []string{"md5:bce963762aa2dbfed13caf492a45fb72", "sha1:20bab73c72c56490856f913cf594bad9a4d730f6"} {
+		if _, err := parseChecksum(v); err != nil {
+			t.Fatalf("%s: err: %v", v, err)
+		}
+	}
+	for _, v := range []string{"bce963762aa2dbfed13caf492a45fb72", "crc32:aaaa", "md5:xyz"} {
+		if _, err := parseChecksum(v); err == nil {
+			t.Fatalf("%s: expected error", v)
+		}
+	}
+}
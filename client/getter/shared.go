@@ -0,0 +1,120 @@
+package getter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sharedDownload is a download of a source that the tasks fetching the source
+// at the same time wait for and copy, rather than each downloading it
+type sharedDownload struct {
+	// done is closed once the download has finished and path or err is set
+	done chan struct{}
+	path string
+	err  error
+
+	// users is the number of tasks using the download. The last one to be
+	// done with it removes the downloaded files.
+	users int
+}
+
+var (
+	// sharedDownloads holds the downloads in progress or being copied by
+	// source. sharedDownloadsLock guards the map and the users of the
+	// downloads in it.
+	sharedDownloads     = make(map[string]*sharedDownload)
+	sharedDownloadsLock sync.Mutex
+)
+
+// getShared downloads url into dest by sharing the download with the other
+// tasks fetching url at the same time. The first task downloads url into a
+// directory under dir, which the others wait for and copy from as well. If
+// the download fails, the tasks waiting for it start a download of their
+// own rather than failing along with it.
+func getShared(url, dest, dir string, config *Config) error {
+	for {
+		d, first := joinSharedDownload(url)
+		if first {
+			d.path, d.err = downloadShared(url, dir, config)
+			if d.err != nil {
+				// Tasks fetching the source from now on start over
+				sharedDownloadsLock.Lock()
+				delete(sharedDownloads, url)
+				sharedDownloadsLock.Unlock()
+			}
+			close(d.done)
+		} else {
+			<-d.done
+		}
+
+		if d.err != nil {
+			d.release(url)
+			if first {
+				return d.err
+			}
+			continue
+		}
+
+		// The download is copied rather than moved as the other tasks may
+		// still be copying it, and since tasks may modify their artifacts
+		err := copyTree(d.path, dest, nil)
+		d.release(url)
+		if err != nil {
+			return fmt.Errorf("failed to copy shared download: %v", err)
+		}
+		return nil
+	}
+}
+
+// joinSharedDownload returns the download of url in progress, or starts one
+// if there is none, in which case first is true and the caller has to
+// download url
+func joinSharedDownload(url string) (d *sharedDownload, first bool) {
+	sharedDownloadsLock.Lock()
+	defer sharedDownloadsLock.Unlock()
+
+	d, ok := sharedDownloads[url]
+	if !ok {
+		d = &sharedDownload{done: make(chan struct{})}
+		sharedDownloads[url] = d
+	}
+	d.users++
+	return d, !ok
+}
+
+// release marks the task as done with the download, removing the downloaded
+// files once no task uses them
+func (d *sharedDownload) release(url string) {
+	sharedDownloadsLock.Lock()
+	d.users--
+	last := d.users == 0
+	if last && sharedDownloads[url] == d {
+		delete(sharedDownloads, url)
+	}
+	sharedDownloadsLock.Unlock()
+
+	if last && d.path != "" {
+		os.RemoveAll(filepath.Dir(d.path))
+	}
+}
+
+// downloadShared downloads url into a new directory under dir and returns the
+// path of the download in it
+func downloadShared(url, dir string, config *Config) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %v", err)
+	}
+	tmp, err := ioutil.TempDir(dir, "download")
+	if err != nil {
+		return "", fmt.Errorf("failed to create download directory: %v", err)
+	}
+	path := filepath.Join(tmp, "artifact")
+	if err := addCacheEntry(url, path, config); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return path, nil
+}
@@ -9,6 +9,9 @@ type MemoryStats struct {
 	KernelUsage    uint64
 	KernelMaxUsage uint64
 
+	// GuestUsage is the memory in use as reported by the guest of a VM
+	GuestUsage uint64
+
 	// A list of fields whose values were actually sampled
 	Measured []string
 }
@@ -20,6 +23,7 @@ func (ms *MemoryStats) Add(other *MemoryStats) {
 	ms.MaxUsage += other.MaxUsage
 	ms.KernelUsage += other.KernelUsage
 	ms.KernelMaxUsage += other.KernelMaxUsage
+	ms.GuestUsage += other.GuestUsage
 	ms.Measured = joinStringSet(ms.Measured, other.Measured)
 }
 
@@ -46,15 +50,43 @@ func (cs *CpuStats) Add(other *CpuStats) {
 	cs.Measured = joinStringSet(cs.Measured, other.Measured)
 }
 
-// ResourceUsage holds information related to cpu and memory stats
+// IOStats holds disk IO related stats. The values are totals since the task
+// started.
+type IOStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+
+	// A list of fields whose values were actually sampled
+	Measured []string
+}
+
+func (is *IOStats) Add(other *IOStats) {
+	is.ReadBytes += other.ReadBytes
+	is.WriteBytes += other.WriteBytes
+	is.ReadOps += other.ReadOps
+	is.WriteOps += other.WriteOps
+	is.Measured = joinStringSet(is.Measured, other.Measured)
+}
+
+// ResourceUsage holds information related to cpu, memory and disk IO stats.
+// IOStats is nil if the driver doesn't measure disk IO.
 type ResourceUsage struct {
 	MemoryStats *MemoryStats
 	CpuStats    *CpuStats
+	IOStats     *IOStats
 }
 
 func (ru *ResourceUsage) Add(other *ResourceUsage) {
 	ru.MemoryStats.Add(other.MemoryStats)
 	ru.CpuStats.Add(other.CpuStats)
+	if other.IOStats != nil {
+		if ru.IOStats == nil {
+			ru.IOStats = &IOStats{}
+		}
+		ru.IOStats.Add(other.IOStats)
+	}
 }
 
 // TaskResourceUsage holds aggregated resource usage of all processes in a Task
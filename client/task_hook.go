@@ -0,0 +1,73 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// hooksEnabledOption is the client option enabling running the hooks of
+	// tasks. Hooks run on the host as the client's user, so they are disabled
+	// by default.
+	hooksEnabledOption = "hooks.enabled"
+)
+
+// runHooks runs the task's hooks of the given type in order. Failures of hooks
+// that ignore them are emitted as events, and the error of the first hook
+// failure that isn't ignored is returned without running the remaining hooks.
+// Closing cancel, which may be nil, kills the running hook and fails it.
+func (r *TaskRunner) runHooks(hookType, state string, cancel <-chan struct{}) error {
+	for _, hook := range r.task.Hooks {
+		if hook.Type != hookType {
+			continue
+		}
+
+		err := r.runHook(hook, cancel)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s hook failed: %v", hookType, err)
+		r.logger.Printf("[WARN] client: task %q for alloc %q: %v", r.task.Name, r.alloc.ID, err)
+		if !hook.IgnoreFailure {
+			return err
+		}
+		r.setState(state, structs.NewTaskEvent(structs.TaskHookFailed).SetHookError(err))
+	}
+	return nil
+}
+
+// runHook runs the hook command on the host in the task directory, with the
+// task's environment and the client's environment minus the blacklisted
+// variables.
+func (r *TaskRunner) runHook(hook *structs.TaskHook, cancel <-chan struct{}) error {
+	taskEnv := r.getTaskEnv()
+	taskDir := r.ctx.AllocDir.TaskDirs[r.task.Name]
+	command := taskEnv.ReplaceEnv(hook.Command)
+	if !filepath.IsAbs(command) && strings.ContainsRune(command, filepath.Separator) {
+		command = filepath.Join(taskDir, command)
+	}
+	cmd := exec.Command(command, taskEnv.ParseAndReplace(hook.Args)...)
+	cmd.Dir = taskDir
+
+	filter := r.config.ReadStringListToMapDefault("env.blacklist", config.DefaultEnvBlacklist)
+	for _, e := range os.Environ() {
+		key := strings.SplitN(e, "=", 2)[0]
+		if _, filtered := filter[key]; !filtered {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env, taskEnv.EnvList()...)
+
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = structs.DefaultTaskHookTimeout
+	}
+	return driver.RunCommand(cmd, timeout, cancel)
+}
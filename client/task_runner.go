@@ -8,6 +8,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,7 @@ import (
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver"
 	"github.com/hashicorp/nomad/client/getter"
@@ -50,6 +53,9 @@ const (
 	// vaultTokenFile is the name of the file holding the Vault token inside the
 	// task's secret directory
 	vaultTokenFile = "vault_token"
+
+	// artifactCacheMaxMB is the default size the artifact cache is kept under
+	artifactCacheMaxMB = 10 * 1024
 )
 
 // TaskRunner is used to wrap a task within an allocation and provide the execution context.
@@ -339,6 +345,28 @@ func (r *TaskRunner) getTaskEnv() *env.TaskEnvironment {
 	return r.taskEnv
 }
 
+// getterConfig returns the configuration of the node's artifact downloads
+func (r *TaskRunner) getterConfig() *getter.Config {
+	c := &getter.Config{
+		DownloadDir: filepath.Join(r.config.StateDir, "downloads"),
+		Logger:      r.logger,
+		Cancel:      r.destroyCh,
+	}
+	if r.config.ReadBoolDefault("artifact.cache", false) {
+		c.CacheDir = filepath.Join(r.config.StateDir, "artifacts")
+		maxMB, err := strconv.ParseInt(r.config.ReadDefault("artifact.cache.max_mb", strconv.Itoa(artifactCacheMaxMB)), 10, 64)
+		if err != nil || maxMB < 0 {
+			r.logger.Printf("[WARN] client: invalid artifact.cache.max_mb, using the default of %d MB", artifactCacheMaxMB)
+			maxMB = artifactCacheMaxMB
+		}
+		c.CacheMaxBytes = maxMB * 1024 * 1024
+	}
+	for dir := range r.config.ReadStringListToMap("artifact.file_whitelist") {
+		c.FileWhitelist = append(c.FileWhitelist, dir)
+	}
+	return c
+}
+
 // createDriver makes a driver for the task
 func (r *TaskRunner) createDriver() (driver.Driver, error) {
 	env := r.getTaskEnv()
@@ -346,7 +374,7 @@ func (r *TaskRunner) createDriver() (driver.Driver, error) {
 		return nil, fmt.Errorf("task environment not made for task %q in allocation %q", r.task.Name, r.alloc.ID)
 	}
 
-	driverCtx := driver.NewDriverContext(r.task.Name, r.config, r.config.Node, r.logger, env)
+	driverCtx := driver.NewDriverContext(r.task.Name, r.config, r.config.Node, r.logger, env, r.driverEvent)
 	driver, err := driver.NewDriver(r.task.Driver, driverCtx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create driver '%s' for alloc %s: %v",
@@ -355,6 +383,49 @@ func (r *TaskRunner) createDriver() (driver.Driver, error) {
 	return driver, err
 }
 
+// driverEvent receives the events emitted by the task's driver and records
+// them as task events. The process lifecycle events are only logged as the
+// task runner records its own events for the task starting and exiting.
+func (r *TaskRunner) driverEvent(event *driver.DriverEvent) {
+	r.logger.Printf("[DEBUG] client: driver event %q for task %q in alloc %q at %v: %v",
+		event.Type, event.TaskName, r.alloc.ID, event.Time, event.Details)
+	switch event.Type {
+	case driver.DriverEventStartRequested, driver.DriverEventProcessStarted, driver.DriverEventProcessExited:
+		return
+	}
+
+	// Events emitted while the driver is still starting the task precede the
+	// task being marked as running
+	r.runningLock.Lock()
+	state := structs.TaskStatePending
+	if r.running {
+		state = structs.TaskStateRunning
+	}
+	r.runningLock.Unlock()
+
+	taskEvent := structs.NewTaskEvent(structs.TaskDriverMessage).SetDriverMessage(driverEventMessage(event))
+	taskEvent.Time = event.Time.UnixNano()
+	r.setState(state, taskEvent)
+}
+
+// driverEventMessage returns the message of the task event recording a driver
+// event, e.g. "Display: address=127.0.0.1, port=5900"
+func driverEventMessage(event *driver.DriverEvent) string {
+	if len(event.Details) == 0 {
+		return event.Type
+	}
+	keys := make([]string, 0, len(event.Details))
+	for k := range event.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	details := make([]string, len(keys))
+	for i, k := range keys {
+		details[i] = fmt.Sprintf("%s=%s", k, event.Details[k])
+	}
+	return fmt.Sprintf("%s: %s", event.Type, strings.Join(details, ", "))
+}
+
 // Run is a long running routine used to manage the task
 func (r *TaskRunner) Run() {
 	defer close(r.waitCh)
@@ -408,6 +479,11 @@ func (r *TaskRunner) validateTask() error {
 		}
 	}
 
+	// Validate that hooks are allowed to run.
+	if len(r.task.Hooks) != 0 && !r.config.ReadBoolDefault(hooksEnabledOption, false) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("task hooks are disabled on this client; see the %q option", hooksEnabledOption))
+	}
+
 	// Validate the artifacts
 	for i, artifact := range r.task.Artifacts {
 		// Verify the artifact doesn't escape the task directory.
@@ -703,13 +779,24 @@ func (r *TaskRunner) prestart(resultCh chan bool) {
 		return
 	}
 
+	// Write the job's payload for the task
+	if r.task.DispatchPayload != nil {
+		if err := r.writePayload(); err != nil {
+			r.setState(
+				structs.TaskStateDead,
+				structs.NewTaskEvent(structs.TaskSetupFailure).SetSetupError(err).SetFailsTask())
+			resultCh <- false
+			return
+		}
+	}
+
 	for {
 		// Download the task's artifacts
 		if !r.artifactsDownloaded && len(r.task.Artifacts) > 0 {
 			r.setState(structs.TaskStatePending, structs.NewTaskEvent(structs.TaskDownloadingArtifacts))
 			for _, artifact := range r.task.Artifacts {
 				// TODO wrap
-				if err := getter.GetArtifact(r.getTaskEnv(), artifact, r.taskDir); err != nil {
+				if err := getter.GetArtifact(r.getTaskEnv(), artifact, r.taskDir, r.getterConfig()); err != nil {
 					r.setState(structs.TaskStatePending,
 						structs.NewTaskEvent(structs.TaskArtifactDownloadFailed).SetDownloadError(err))
 					r.restartTracker.SetStartError(structs.NewRecoverableError(err, true))
@@ -774,6 +861,18 @@ func (r *TaskRunner) prestart(resultCh chan bool) {
 	}
 }
 
+// writePayload writes the job's payload into the task's local directory
+func (r *TaskRunner) writePayload() error {
+	dest := filepath.Join(r.taskDir, allocdir.TaskLocal, r.task.DispatchPayload.File)
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return fmt.Errorf("failed to create directory for the payload: %v", err)
+	}
+	if err := ioutil.WriteFile(dest, r.alloc.Job.Payload, 0666); err != nil {
+		return fmt.Errorf("failed to write the payload: %v", err)
+	}
+	return nil
+}
+
 // postrun is used to do any cleanup that is necessary after exiting the runloop
 func (r *TaskRunner) postrun() {
 	// Stop the template manager
@@ -810,6 +909,21 @@ func (r *TaskRunner) run() {
 				r.handleLock.Unlock()
 
 				if handleEmpty {
+					// Destroying the task kills the hook rather than waiting
+					// for it to time out
+					if err := r.runHooks(structs.TaskHookPrestart, structs.TaskStatePending, r.destroyCh); err != nil {
+						// A hook killed by the destroy isn't a failure
+						select {
+						case <-r.destroyCh:
+							r.setState(structs.TaskStateDead, r.destroyEvent)
+							return
+						default:
+						}
+						r.restartTracker.SetStartError(structs.NewRecoverableError(err, true))
+						r.setState(structs.TaskStateDead, structs.NewTaskEvent(structs.TaskHookFailed).SetHookError(err))
+						goto RESTART
+					}
+
 					startErr := r.startTask()
 					r.restartTracker.SetStartError(startErr)
 					if startErr != nil {
@@ -843,6 +957,12 @@ func (r *TaskRunner) run() {
 				// Stop collection of the task's resource usage
 				close(stopCollection)
 
+				// A failing poststop hook fails the task even if it exited
+				// successfully.
+				if err := r.runHooks(structs.TaskHookPoststop, structs.TaskStateDead, nil); err != nil {
+					waitRes = dstructs.NewWaitResult(waitRes.ExitCode, waitRes.Signal, err)
+				}
+
 				// Log whether the task was successful or not.
 				r.restartTracker.SetWaitResult(waitRes)
 				r.setState(structs.TaskStateDead, r.waitErrorToEvent(waitRes))
@@ -1004,6 +1124,12 @@ func (r *TaskRunner) killTask(killingEvent *structs.TaskEvent) {
 
 	// Store that the task has been destroyed and any associated error.
 	r.setState(structs.TaskStateDead, structs.NewTaskEvent(structs.TaskKilled).SetKillError(err))
+
+	// Run the poststop hooks. As the task is being stopped anyway, failures are
+	// only emitted as events.
+	if err := r.runHooks(structs.TaskHookPoststop, structs.TaskStateDead, nil); err != nil {
+		r.setState(structs.TaskStateDead, structs.NewTaskEvent(structs.TaskHookFailed).SetHookError(err))
+	}
 }
 
 // startTask creates the driver and starts the task.
@@ -1015,8 +1141,13 @@ func (r *TaskRunner) startTask() error {
 			r.task.Name, r.alloc.ID, err)
 	}
 
+	// Interpolate the driver config with the task environment, so drivers
+	// see the values for the node the task has been placed on
+	task := r.task.Copy()
+	task.Config = r.getTaskEnv().ParseAndReplaceConfig(task.Config)
+
 	// Start the job
-	handle, err := driver.Start(r.ctx, r.task)
+	handle, err := driver.Start(r.ctx, task)
 	if err != nil {
 		wrapped := fmt.Errorf("failed to start task '%s' for alloc '%s': %v",
 			r.task.Name, r.alloc.ID, err)
@@ -1216,6 +1347,34 @@ func (r *TaskRunner) Signal(source, reason string, s os.Signal) error {
 	return <-resCh
 }
 
+// Exec runs a command inside the task and returns once it exits
+func (r *TaskRunner) Exec(cmd string, args []string) (*dstructs.ExecResult, error) {
+	r.handleLock.Lock()
+	handle := r.handle
+	r.handleLock.Unlock()
+
+	if handle == nil {
+		return nil, fmt.Errorf("task %q isn't running", r.task.Name)
+	}
+	r.logger.Printf("[DEBUG] client: running command %q in task %v for alloc %q", cmd, r.task.Name, r.alloc.ID)
+	return handle.Exec(cmd, args)
+}
+
+// Suspend asks the task to save its state by the deadline if its driver
+// supports it, as the client is shutting down.
+func (r *TaskRunner) Suspend(deadline time.Time) error {
+	r.handleLock.Lock()
+	handle := r.handle
+	r.handleLock.Unlock()
+
+	sh, ok := handle.(driver.SuspendableHandle)
+	if !ok {
+		return nil
+	}
+	r.logger.Printf("[DEBUG] client: suspending task %v for alloc %q", r.task.Name, r.alloc.ID)
+	return sh.Suspend(deadline.Sub(time.Now()))
+}
+
 // Kill will kill a task and store the error, no longer restarting the task. If
 // fail is set, the task is marked as having failed.
 func (r *TaskRunner) Kill(source, reason string, fail bool) {
@@ -1285,6 +1444,7 @@ func (r *TaskRunner) emitStats(ru *cstructs.TaskResourceUsage) {
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "max_usage"}, float32(ru.ResourceUsage.MemoryStats.MaxUsage))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "kernel_usage"}, float32(ru.ResourceUsage.MemoryStats.KernelUsage))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "kernel_max_usage"}, float32(ru.ResourceUsage.MemoryStats.KernelMaxUsage))
+		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "guest_usage"}, float32(ru.ResourceUsage.MemoryStats.GuestUsage))
 	}
 
 	if ru.ResourceUsage.CpuStats != nil && r.config.PublishAllocationMetrics {
@@ -8,6 +8,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -507,6 +510,233 @@ func TestTaskRunner_Validate_UserEnforcement(t *testing.T) {
 	}
 }
 
+func TestTaskRunner_Validate_Hooks(t *testing.T) {
+	_, tr := testTaskRunner(false)
+	defer tr.Destroy(structs.NewTaskEvent(structs.TaskKilled))
+	defer tr.ctx.AllocDir.Destroy()
+
+	if err := tr.setTaskEnv(); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Hooks are disabled by default.
+	tr.task.Hooks = []*structs.TaskHook{{Type: structs.TaskHookPrestart, Command: "/bin/true"}}
+	if err := tr.validateTask(); err == nil {
+		t.Fatalf("expected error running hooks")
+	}
+
+	tr.config.Options = map[string]string{hooksEnabledOption: "true"}
+	if err := tr.validateTask(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTaskRunner_Hooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with a shell")
+	}
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": "0",
+		"run_for":   "10ms",
+	}
+	task.Hooks = []*structs.TaskHook{
+		{
+			Type:    structs.TaskHookPrestart,
+			Command: "/bin/sh",
+			Args:    []string{"-c", "echo $NOMAD_TASK_NAME > prestart"},
+		},
+		{
+			Type:          structs.TaskHookPoststop,
+			Command:       "/bin/sh",
+			Args:          []string{"-c", "exit 1"},
+			IgnoreFailure: true,
+		},
+		{
+			Type:    structs.TaskHookPoststop,
+			Command: "/bin/sh",
+			Args:    []string{"-c", "echo ${NOMAD_ALLOC_ID} > poststop"},
+		},
+	}
+
+	upd, tr := testTaskRunnerFromAlloc(false, alloc)
+	tr.config.Options = map[string]string{hooksEnabledOption: "true"}
+	tr.MarkReceived()
+	go tr.Run()
+	defer tr.Destroy(structs.NewTaskEvent(structs.TaskKilled))
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if len(upd.events) != 4 {
+		t.Fatalf("should have 4 updates: %#v", upd.events)
+	}
+	if upd.events[2].Type != structs.TaskHookFailed {
+		t.Fatalf("Third Event was %v; want %v", upd.events[2].Type, structs.TaskHookFailed)
+	}
+	if upd.events[3].Type != structs.TaskTerminated {
+		t.Fatalf("Fourth Event was %v; want %v", upd.events[3].Type, structs.TaskTerminated)
+	}
+
+	taskDir := tr.ctx.AllocDir.TaskDirs[task.Name]
+	for file, expected := range map[string]string{"prestart": task.Name, "poststop": alloc.ID} {
+		data, err := ioutil.ReadFile(filepath.Join(taskDir, file))
+		if err != nil {
+			t.Fatalf("%s hook didn't run: %v", file, err)
+		}
+		if act := strings.TrimSpace(string(data)); act != expected {
+			t.Fatalf("%s hook wrote %q; want %q", file, act, expected)
+		}
+	}
+}
+
+func TestTaskRunner_Hooks_PrestartFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with a shell")
+	}
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": "0",
+		"run_for":   "10s",
+	}
+	task.Hooks = []*structs.TaskHook{
+		{
+			Type:    structs.TaskHookPrestart,
+			Command: "/bin/sh",
+			Args:    []string{"-c", "sleep 10"},
+			Timeout: 100 * time.Millisecond,
+		},
+	}
+
+	upd, tr := testTaskRunnerFromAlloc(false, alloc)
+	tr.config.Options = map[string]string{hooksEnabledOption: "true"}
+	tr.MarkReceived()
+	go tr.Run()
+	defer tr.Destroy(structs.NewTaskEvent(structs.TaskKilled))
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if len(upd.events) != 3 {
+		t.Fatalf("should have 3 updates: %#v", upd.events)
+	}
+	if upd.state != structs.TaskStateDead {
+		t.Fatalf("TaskState %v; want %v", upd.state, structs.TaskStateDead)
+	}
+	if upd.events[1].Type != structs.TaskHookFailed {
+		t.Fatalf("Second Event was %v; want %v", upd.events[1].Type, structs.TaskHookFailed)
+	}
+	if !strings.Contains(upd.events[1].HookError, "timed out") {
+		t.Fatalf("bad hook error: %q", upd.events[1].HookError)
+	}
+	if upd.events[2].Type != structs.TaskNotRestarting {
+		t.Fatalf("Third Event was %v; want %v", upd.events[2].Type, structs.TaskNotRestarting)
+	}
+}
+
+func TestTaskRunner_Hooks_PrestartDestroy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with a shell")
+	}
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": "0",
+		"run_for":   "10s",
+	}
+	task.Hooks = []*structs.TaskHook{
+		{
+			Type:    structs.TaskHookPrestart,
+			Command: "/bin/sh",
+			Args:    []string{"-c", "touch started; sleep 60; true"},
+			Timeout: time.Minute,
+		},
+	}
+
+	upd, tr := testTaskRunnerFromAlloc(false, alloc)
+	tr.config.Options = map[string]string{hooksEnabledOption: "true"}
+	tr.MarkReceived()
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	taskDir := tr.ctx.AllocDir.TaskDirs[task.Name]
+	testutil.WaitForResult(func() (bool, error) {
+		if _, err := os.Stat(filepath.Join(taskDir, "started")); err != nil {
+			return false, fmt.Errorf("prestart hook hasn't started: %v", err)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Destroying the task kills the hook instead of waiting for it
+	tr.Destroy(structs.NewTaskEvent(structs.TaskKilled))
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if upd.state != structs.TaskStateDead {
+		t.Fatalf("TaskState %v; want %v", upd.state, structs.TaskStateDead)
+	}
+	if last := upd.events[len(upd.events)-1]; last.Type != structs.TaskKilled {
+		t.Fatalf("Last event was %v; want %v", last.Type, structs.TaskKilled)
+	}
+}
+
+func TestTaskRunner_DispatchPayload(t *testing.T) {
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": "0",
+		"run_for":   "10ms",
+	}
+	task.DispatchPayload = &structs.DispatchPayloadConfig{
+		File: "in/input.json",
+	}
+	alloc.Job.Payload = []byte(`{"hello": "world"}`)
+
+	upd, tr := testTaskRunnerFromAlloc(false, alloc)
+	tr.MarkReceived()
+	go tr.Run()
+	defer tr.Destroy(structs.NewTaskEvent(structs.TaskKilled))
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if upd.events[len(upd.events)-1].Type != structs.TaskTerminated {
+		t.Fatalf("task didn't terminate: %#v", upd.events)
+	}
+
+	path := filepath.Join(tr.taskDir, allocdir.TaskLocal, "in", "input.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("payload wasn't written: %v", err)
+	}
+	if !reflect.DeepEqual(data, alloc.Job.Payload) {
+		t.Fatalf("got %q; want %q", data, alloc.Job.Payload)
+	}
+}
+
 func TestTaskRunner_RestartTask(t *testing.T) {
 	alloc := mock.Alloc()
 	task := alloc.Job.TaskGroups[0].Tasks[0]
@@ -657,6 +887,72 @@ func TestTaskRunner_SignalFailure(t *testing.T) {
 	}
 }
 
+func TestTaskRunner_DriverEvent(t *testing.T) {
+	upd, tr := testTaskRunner(false)
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Lifecycle events duplicate the task runner's own events
+	at := time.Now().Add(-time.Minute)
+	tr.driverEvent(&driver.DriverEvent{Type: driver.DriverEventProcessStarted, Time: at})
+	if len(upd.events) != 0 {
+		t.Fatalf("recorded lifecycle event: %#v", upd.events)
+	}
+
+	tr.driverEvent(&driver.DriverEvent{
+		Type:    "Display",
+		Time:    at,
+		Details: map[string]string{"port": "5900", "address": "127.0.0.1"},
+	})
+	if upd.state != structs.TaskStatePending {
+		t.Fatalf("state %q; want %q", upd.state, structs.TaskStatePending)
+	}
+
+	tr.running = true
+	tr.driverEvent(&driver.DriverEvent{Type: "Restored", Time: at})
+	if upd.state != structs.TaskStateRunning {
+		t.Fatalf("state %q; want %q", upd.state, structs.TaskStateRunning)
+	}
+
+	if len(upd.events) != 2 {
+		t.Fatalf("got %d events; want 2", len(upd.events))
+	}
+	for i, msg := range []string{"Display: address=127.0.0.1, port=5900", "Restored"} {
+		event := upd.events[i]
+		if event.Type != structs.TaskDriverMessage || event.DriverMessage != msg || event.Time != at.UnixNano() {
+			t.Fatalf("event %d: %#v; want driver message %q at %v", i, event, msg, at)
+		}
+	}
+}
+
+func TestTaskRunner_Exec(t *testing.T) {
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": "0",
+		"run_for":   "10s",
+	}
+
+	_, tr := testTaskRunnerFromAlloc(false, alloc)
+	tr.MarkReceived()
+	go tr.Run()
+	defer tr.Destroy(structs.NewTaskEvent(structs.TaskKilled))
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		res, err := tr.Exec("ps", []string{"aux"})
+		if err != nil {
+			return false, err
+		}
+		if res.ExitCode != 0 || res.Output != "ps aux" {
+			return false, fmt.Errorf("bad: %#v", res)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
 func TestTaskRunner_BlockForVault(t *testing.T) {
 	alloc := mock.Alloc()
 	task := alloc.Job.TaskGroups[0].Tasks[0]
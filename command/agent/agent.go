@@ -185,6 +185,14 @@ func (a *Agent) serverConfig() (*nomad.Config, error) {
 		conf.HeartbeatGrace = dur
 	}
 
+	if maxKillTimeout := a.config.Server.MaxKillTimeout; maxKillTimeout != "" {
+		dur, err := time.ParseDuration(maxKillTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conf.MaxKillTimeout = dur
+	}
+
 	if a.config.Consul.AutoAdvertise && a.config.Consul.ServerServiceName == "" {
 		return nil, fmt.Errorf("server_service_name must be set when auto_advertise is enabled")
 	}
@@ -218,6 +226,7 @@ func (a *Agent) clientConfig() (*clientconfig.Config, error) {
 	if a.config.DataDir != "" {
 		conf.StateDir = filepath.Join(a.config.DataDir, "client")
 		conf.AllocDir = filepath.Join(a.config.DataDir, "alloc")
+		conf.PluginDir = filepath.Join(a.config.DataDir, "plugins")
 	}
 	if a.config.Client.StateDir != "" {
 		conf.StateDir = a.config.Client.StateDir
@@ -225,6 +234,9 @@ func (a *Agent) clientConfig() (*clientconfig.Config, error) {
 	if a.config.Client.AllocDir != "" {
 		conf.AllocDir = a.config.Client.AllocDir
 	}
+	if a.config.Client.PluginDir != "" {
+		conf.PluginDir = a.config.Client.PluginDir
+	}
 	conf.Servers = a.config.Client.Servers
 	if a.config.Client.NetworkInterface != "" {
 		conf.NetworkInterface = a.config.Client.NetworkInterface
@@ -256,6 +268,26 @@ func (a *Agent) clientConfig() (*clientconfig.Config, error) {
 		}
 		conf.MaxKillTimeout = dur
 	}
+	if a.config.Client.GCInterval != "" {
+		dur, err := time.ParseDuration(a.config.Client.GCInterval)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing gc_interval: %s", err)
+		}
+		conf.GCInterval = dur
+	}
+	if a.config.Client.GCMaxAge != "" {
+		dur, err := time.ParseDuration(a.config.Client.GCMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing gc_max_age: %s", err)
+		}
+		conf.GCMaxAge = dur
+	}
+	if a.config.Client.GCMaxAllocs != 0 {
+		conf.GCMaxAllocs = a.config.Client.GCMaxAllocs
+	}
+	if a.config.Client.GCDiskUsageThreshold != 0 {
+		conf.GCDiskUsageThreshold = a.config.Client.GCDiskUsageThreshold
+	}
 	conf.ClientMaxPort = uint(a.config.Client.ClientMaxPort)
 	conf.ClientMinPort = uint(a.config.Client.ClientMinPort)
 
@@ -244,6 +244,17 @@ func TestAgent_ServerConfig(t *testing.T) {
 		t.Fatalf("expect 37s, got: %s", threshold)
 	}
 
+	conf.Server.MaxKillTimeout = "42g"
+	out, err = a.serverConfig()
+	if err == nil || !strings.Contains(err.Error(), "unknown unit") {
+		t.Fatalf("expected unknown unit error, got: %#v", err)
+	}
+	conf.Server.MaxKillTimeout = "1m"
+	out, err = a.serverConfig()
+	if timeout := out.MaxKillTimeout; timeout != time.Minute {
+		t.Fatalf("expect 1m, got: %s", timeout)
+	}
+
 	// Defaults to the global bind addr
 	conf.Addresses.RPC = ""
 	conf.Addresses.Serf = ""
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
@@ -13,6 +14,16 @@ const (
 	resourceNotFoundErr = "resource not found"
 )
 
+// allocExecRequest is the body of requests to run a command in a task
+type allocExecRequest struct {
+	// Task is the task to run the command in, which may be omitted if the
+	// allocation has a single task
+	Task string
+
+	Cmd  string
+	Args []string
+}
+
 func (s *HTTPServer) AllocsRequest(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	if req.Method != "GET" {
 		return nil, CodedError(405, ErrInvalidMethod)
@@ -79,6 +90,10 @@ func (s *HTTPServer) ClientAllocRequest(resp http.ResponseWriter, req *http.Requ
 		return s.allocStats(allocID, resp, req)
 	case "snapshot":
 		return s.allocSnapshot(allocID, resp, req)
+	case "signal":
+		return s.allocSignal(allocID, resp, req)
+	case "exec":
+		return s.allocExec(allocID, resp, req)
 	}
 
 	return nil, CodedError(404, resourceNotFoundErr)
@@ -105,3 +120,47 @@ func (s *HTTPServer) allocStats(allocID string, resp http.ResponseWriter, req *h
 	task := req.URL.Query().Get("task")
 	return aStats.LatestAllocStats(task)
 }
+
+// allocSignal sends the signal given by the signal parameter, e.g. SIGHUP or
+// HUP, to the task given by the task parameter, or to all tasks of the
+// allocation if it is omitted.
+func (s *HTTPServer) allocSignal(allocID string, resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "PUT" && req.Method != "POST" {
+		return nil, CodedError(405, ErrInvalidMethod)
+	}
+
+	name := strings.ToUpper(req.URL.Query().Get("signal"))
+	if name == "" {
+		return nil, CodedError(400, "signal must be specified")
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, err := signals.Parse(name)
+	if err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+
+	task := req.URL.Query().Get("task")
+	if err := s.agent.Client().SignalAlloc(allocID, task, sig); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// allocExec runs the command given by the allocExecRequest in the body inside
+// a task of the allocation, and returns its exit code and output.
+func (s *HTTPServer) allocExec(allocID string, resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "PUT" && req.Method != "POST" {
+		return nil, CodedError(405, ErrInvalidMethod)
+	}
+
+	var args allocExecRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+	if args.Cmd == "" {
+		return nil, CodedError(400, "command must be specified")
+	}
+	return s.agent.Client().ExecAlloc(allocID, args.Task, args.Cmd, args.Args)
+}
@@ -194,3 +194,57 @@ func TestHTTP_AllocSnapshot(t *testing.T) {
 		}
 	})
 }
+
+func TestHTTP_AllocSignal(t *testing.T) {
+	httpTest(t, nil, func(s *TestServer) {
+		cases := []struct {
+			method string
+			query  string
+			err    string
+		}{
+			{"GET", "signal=SIGHUP", ErrInvalidMethod},
+			{"PUT", "", "signal must be specified"},
+			{"PUT", "signal=SIGFOO", "invalid signal"},
+			{"PUT", "signal=hup&task=web", "unknown allocation ID"},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(c.method, "/v1/client/allocation/123/signal?"+c.query, nil)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			respW := httptest.NewRecorder()
+
+			_, err = s.Server.ClientAllocRequest(respW, req)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s %q: expected error containing %q; got %v", c.method, c.query, c.err, err)
+			}
+		}
+	})
+}
+
+func TestHTTP_AllocExec(t *testing.T) {
+	httpTest(t, nil, func(s *TestServer) {
+		cases := []struct {
+			method string
+			body   string
+			err    string
+		}{
+			{"GET", `{"Cmd": "ps"}`, ErrInvalidMethod},
+			{"PUT", `{"Cmd": `, "unexpected EOF"},
+			{"PUT", `{"Task": "web"}`, "command must be specified"},
+			{"PUT", `{"Task": "web", "Cmd": "ps", "Args": ["aux"]}`, "unknown allocation ID"},
+		}
+		for _, c := range cases {
+			req, err := http.NewRequest(c.method, "/v1/client/allocation/123/exec", strings.NewReader(c.body))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			respW := httptest.NewRecorder()
+
+			_, err = s.Server.ClientAllocRequest(respW, req)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s %q: expected error containing %q; got %v", c.method, c.body, c.err, err)
+			}
+		}
+	})
+}
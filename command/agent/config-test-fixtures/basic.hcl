@@ -23,6 +23,7 @@ client {
 	enabled = true
 	state_dir = "/tmp/client-state"
 	alloc_dir = "/tmp/alloc"
+	plugin_dir = "/tmp/plugins"
 	servers = ["a.b.c:80", "127.0.0.1:1234"]
 	node_class = "linux-medium-64bit"
 	meta {
@@ -49,6 +50,10 @@ client {
 	client_min_port = 1000
 	client_max_port = 2000
     max_kill_timeout = "10s"
+    gc_interval = "5m"
+    gc_max_age = "48h"
+    gc_max_allocs = 100
+    gc_disk_usage_threshold = 90
     stats {
         data_points = 35
         collection_interval = "5s"
@@ -63,6 +68,7 @@ server {
 	enabled_schedulers = ["test"]
 	node_gc_threshold = "12h"
 	heartbeat_grace   = "30s"
+	max_kill_timeout  = "1m"
 	retry_join = [ "1.1.1.1", "2.2.2.2" ]
 	start_join = [ "1.1.1.1", "2.2.2.2" ]
 	retry_max = 3
@@ -150,6 +150,9 @@ type ClientConfig struct {
 	// AllocDir is the directory for storing allocation data
 	AllocDir string `mapstructure:"alloc_dir"`
 
+	// PluginDir is the directory external task drivers are installed to
+	PluginDir string `mapstructure:"plugin_dir"`
+
 	// Servers is a list of known server addresses. These are as "host:port"
 	Servers []string `mapstructure:"servers"`
 
@@ -178,6 +181,23 @@ type ClientConfig struct {
 	// MaxKillTimeout allows capping the user-specifiable KillTimeout.
 	MaxKillTimeout string `mapstructure:"max_kill_timeout"`
 
+	// GCInterval is the interval at which the directories of terminal
+	// allocations are garbage collected
+	GCInterval string `mapstructure:"gc_interval"`
+
+	// GCMaxAge is how long after terminating the directory of an allocation
+	// is garbage collected
+	GCMaxAge string `mapstructure:"gc_max_age"`
+
+	// GCMaxAllocs is the number of terminal allocations whose directories are
+	// kept
+	GCMaxAllocs int `mapstructure:"gc_max_allocs"`
+
+	// GCDiskUsageThreshold is the used percentage of the disk holding the
+	// allocation directories above which the directories of terminal
+	// allocations are garbage collected
+	GCDiskUsageThreshold float64 `mapstructure:"gc_disk_usage_threshold"`
+
 	// ClientMaxPort is the upper range of the ports that the client uses for
 	// communicating with plugin subsystems
 	ClientMaxPort int `mapstructure:"client_max_port"`
@@ -225,6 +245,10 @@ type ServerConfig struct {
 	// processing delays and clock skew before marking a node as "down".
 	HeartbeatGrace string `mapstructure:"heartbeat_grace"`
 
+	// MaxKillTimeout is the maximum KillTimeout tasks of registered jobs may
+	// specify.
+	MaxKillTimeout string `mapstructure:"max_kill_timeout"`
+
 	// StartJoin is a list of addresses to attempt to join when the
 	// agent starts. If Serf is unable to communicate with any of these
 	// addresses, then the agent will error and exit.
@@ -471,12 +495,15 @@ func DefaultConfig() *Config {
 		Consul:         config.DefaultConsulConfig(),
 		Vault:          config.DefaultVaultConfig(),
 		Client: &ClientConfig{
-			Enabled:        false,
-			NetworkSpeed:   100,
-			MaxKillTimeout: "30s",
-			ClientMinPort:  14000,
-			ClientMaxPort:  14512,
-			Reserved:       &Resources{},
+			Enabled:              false,
+			NetworkSpeed:         100,
+			MaxKillTimeout:       "30s",
+			GCInterval:           "1m",
+			GCMaxAllocs:          50,
+			GCDiskUsageThreshold: 80,
+			ClientMinPort:        14000,
+			ClientMaxPort:        14512,
+			Reserved:             &Resources{},
 		},
 		Server: &ServerConfig{
 			Enabled:          false,
@@ -682,6 +709,9 @@ func (a *ServerConfig) Merge(b *ServerConfig) *ServerConfig {
 	if b.HeartbeatGrace != "" {
 		result.HeartbeatGrace = b.HeartbeatGrace
 	}
+	if b.MaxKillTimeout != "" {
+		result.MaxKillTimeout = b.MaxKillTimeout
+	}
 	if b.RetryMaxAttempts != 0 {
 		result.RetryMaxAttempts = b.RetryMaxAttempts
 	}
@@ -725,6 +755,9 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 	if b.AllocDir != "" {
 		result.AllocDir = b.AllocDir
 	}
+	if b.PluginDir != "" {
+		result.PluginDir = b.PluginDir
+	}
 	if b.NodeClass != "" {
 		result.NodeClass = b.NodeClass
 	}
@@ -737,6 +770,18 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 	if b.MaxKillTimeout != "" {
 		result.MaxKillTimeout = b.MaxKillTimeout
 	}
+	if b.GCInterval != "" {
+		result.GCInterval = b.GCInterval
+	}
+	if b.GCMaxAge != "" {
+		result.GCMaxAge = b.GCMaxAge
+	}
+	if b.GCMaxAllocs != 0 {
+		result.GCMaxAllocs = b.GCMaxAllocs
+	}
+	if b.GCDiskUsageThreshold != 0 {
+		result.GCDiskUsageThreshold = b.GCDiskUsageThreshold
+	}
 	if b.ClientMaxPort != 0 {
 		result.ClientMaxPort = b.ClientMaxPort
 	}
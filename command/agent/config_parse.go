@@ -329,6 +329,7 @@ func parseClient(result **ClientConfig, list *ast.ObjectList) error {
 		"enabled",
 		"state_dir",
 		"alloc_dir",
+		"plugin_dir",
 		"servers",
 		"node_class",
 		"options",
@@ -337,6 +338,10 @@ func parseClient(result **ClientConfig, list *ast.ObjectList) error {
 		"network_interface",
 		"network_speed",
 		"max_kill_timeout",
+		"gc_interval",
+		"gc_max_age",
+		"gc_max_allocs",
+		"gc_disk_usage_threshold",
 		"client_max_port",
 		"client_min_port",
 		"reserved",
@@ -488,6 +493,7 @@ func parseServer(result **ServerConfig, list *ast.ObjectList) error {
 		"enabled_schedulers",
 		"node_gc_threshold",
 		"heartbeat_grace",
+		"max_kill_timeout",
 		"start_join",
 		"retry_join",
 		"retry_max",
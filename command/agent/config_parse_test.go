@@ -43,6 +43,7 @@ func TestConfig_Parse(t *testing.T) {
 					Enabled:   true,
 					StateDir:  "/tmp/client-state",
 					AllocDir:  "/tmp/alloc",
+					PluginDir: "/tmp/plugins",
 					Servers:   []string{"a.b.c:80", "127.0.0.1:1234"},
 					NodeClass: "linux-medium-64bit",
 					Meta: map[string]string{
@@ -57,11 +58,15 @@ func TestConfig_Parse(t *testing.T) {
 						"/opt/myapp/etc": "/etc",
 						"/opt/myapp/bin": "/bin",
 					},
-					NetworkInterface: "eth0",
-					NetworkSpeed:     100,
-					MaxKillTimeout:   "10s",
-					ClientMinPort:    1000,
-					ClientMaxPort:    2000,
+					NetworkInterface:     "eth0",
+					NetworkSpeed:         100,
+					MaxKillTimeout:       "10s",
+					GCInterval:           "5m",
+					GCMaxAge:             "48h",
+					GCMaxAllocs:          100,
+					GCDiskUsageThreshold: 90,
+					ClientMinPort:        1000,
+					ClientMaxPort:        2000,
 					Reserved: &Resources{
 						CPU:                 10,
 						MemoryMB:            10,
@@ -80,6 +85,7 @@ func TestConfig_Parse(t *testing.T) {
 					EnabledSchedulers: []string{"test"},
 					NodeGCThreshold:   "12h",
 					HeartbeatGrace:    "30s",
+					MaxKillTimeout:    "1m",
 					RetryJoin:         []string{"1.1.1.1", "2.2.2.2"},
 					StartJoin:         []string{"1.1.1.1", "2.2.2.2"},
 					RetryInterval:     "15s",
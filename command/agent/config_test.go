@@ -54,13 +54,18 @@ func TestConfig_Merge(t *testing.T) {
 			Enabled:   false,
 			StateDir:  "/tmp/state1",
 			AllocDir:  "/tmp/alloc1",
+			PluginDir: "/tmp/plugins1",
 			NodeClass: "class1",
 			Options: map[string]string{
 				"foo": "bar",
 			},
-			NetworkSpeed:   100,
-			MaxKillTimeout: "20s",
-			ClientMaxPort:  19996,
+			NetworkSpeed:         100,
+			MaxKillTimeout:       "20s",
+			GCInterval:           "1m",
+			GCMaxAge:             "24h",
+			GCMaxAllocs:          50,
+			GCDiskUsageThreshold: 80,
+			ClientMaxPort:        19996,
 			Reserved: &Resources{
 				CPU:                 10,
 				MemoryMB:            10,
@@ -169,6 +174,7 @@ func TestConfig_Merge(t *testing.T) {
 			Enabled:   true,
 			StateDir:  "/tmp/state2",
 			AllocDir:  "/tmp/alloc2",
+			PluginDir: "/tmp/plugins2",
 			NodeClass: "class2",
 			Servers:   []string{"server2"},
 			Meta: map[string]string{
@@ -178,11 +184,15 @@ func TestConfig_Merge(t *testing.T) {
 				"foo": "bar",
 				"baz": "zip",
 			},
-			ChrootEnv:      map[string]string{},
-			ClientMaxPort:  20000,
-			ClientMinPort:  22000,
-			NetworkSpeed:   105,
-			MaxKillTimeout: "50s",
+			ChrootEnv:            map[string]string{},
+			ClientMaxPort:        20000,
+			ClientMinPort:        22000,
+			NetworkSpeed:         105,
+			MaxKillTimeout:       "50s",
+			GCInterval:           "5m",
+			GCMaxAge:             "48h",
+			GCMaxAllocs:          100,
+			GCDiskUsageThreshold: 90,
 			Reserved: &Resources{
 				CPU:                 15,
 				MemoryMB:            15,
@@ -201,6 +211,7 @@ func TestConfig_Merge(t *testing.T) {
 			EnabledSchedulers: []string{structs.JobTypeBatch},
 			NodeGCThreshold:   "12h",
 			HeartbeatGrace:    "2m",
+			MaxKillTimeout:    "1m",
 			RejoinAfterLeave:  true,
 			StartJoin:         []string{"1.1.1.1"},
 			RetryJoin:         []string{"1.1.1.1"},
@@ -0,0 +1,22 @@
+package agent
+
+import "net/http"
+
+// clientGCResponse is the response of a client garbage collection
+type clientGCResponse struct {
+	// Collected is the number of allocations garbage collected
+	Collected int
+}
+
+// ClientGCRequest garbage collects the directories of all terminal
+// allocations on the client
+func (s *HTTPServer) ClientGCRequest(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if s.agent.client == nil {
+		return nil, clientNotRunning
+	}
+	if req.Method != "PUT" && req.Method != "POST" {
+		return nil, CodedError(405, ErrInvalidMethod)
+	}
+
+	return &clientGCResponse{Collected: s.agent.client.CollectAllAllocs()}, nil
+}
@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientGCRequest(t *testing.T) {
+	httpTest(t, nil, func(s *TestServer) {
+		req, err := http.NewRequest("PUT", "/v1/client/gc", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		respW := httptest.NewRecorder()
+		obj, err := s.Server.ClientGCRequest(respW, req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if gc := obj.(*clientGCResponse); gc.Collected != 0 {
+			t.Fatalf("unexpected collection of %d allocations", gc.Collected)
+		}
+
+		// Only writes trigger a collection
+		req, err = http.NewRequest("GET", "/v1/client/gc", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := s.Server.ClientGCRequest(respW, req); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+)
+
+type AllocExecCommand struct {
+	Meta
+}
+
+func (c *AllocExecCommand) Help() string {
+	helpText := `
+Usage: nomad alloc-exec [options] <alloc-id> <command> [args...]
+
+  Runs a command inside a task of the given allocation, e.g. to diagnose it,
+  and prints its output once it exits. The exit code of the command is
+  returned. Commands that don't exit within 30 seconds are stopped.
+
+General Options:
+
+  ` + generalOptionsUsage() + `
+
+Alloc Exec Options:
+
+  -task <task>
+    The task to run the command in. It is required if the allocation has
+    multiple tasks.
+
+  -verbose
+    Show full information.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *AllocExecCommand) Synopsis() string {
+	return "Run a command inside the task of an allocation"
+}
+
+func (c *AllocExecCommand) Run(args []string) int {
+	var verbose bool
+	var task string
+
+	flags := c.Meta.FlagSet("alloc-exec", FlagSetClient)
+	flags.Usage = func() { c.Ui.Output(c.Help()) }
+	flags.BoolVar(&verbose, "verbose", false, "")
+	flags.StringVar(&task, "task", "", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	// Check that we got an allocation ID and a command
+	args = flags.Args()
+	if len(args) < 2 {
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	allocID, cmd := args[0], args[1]
+
+	// Get the HTTP client
+	client, err := c.Meta.Client()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error initializing client: %s", err))
+		return 1
+	}
+
+	// Truncate the id unless full length is requested
+	length := shortId
+	if verbose {
+		length = fullId
+	}
+
+	// Query the allocation info
+	if len(allocID) == 1 {
+		c.Ui.Error(fmt.Sprintf("Alloc ID must contain at least two characters."))
+		return 1
+	}
+	if len(allocID)%2 == 1 {
+		// Identifiers must be of even length, so we strip off the last byte
+		// to provide a consistent user experience.
+		allocID = allocID[:len(allocID)-1]
+	}
+
+	allocs, _, err := client.Allocations().PrefixList(allocID)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying allocation: %v", err))
+		return 1
+	}
+	if len(allocs) == 0 {
+		c.Ui.Error(fmt.Sprintf("No allocation(s) with prefix or id %q found", allocID))
+		return 1
+	}
+	if len(allocs) > 1 {
+		// Format the allocs
+		out := make([]string, len(allocs)+1)
+		out[0] = "ID|Eval ID|Job ID|Task Group|Desired Status|Client Status"
+		for i, alloc := range allocs {
+			out[i+1] = fmt.Sprintf("%s|%s|%s|%s|%s|%s",
+				limit(alloc.ID, length),
+				limit(alloc.EvalID, length),
+				alloc.JobID,
+				alloc.TaskGroup,
+				alloc.DesiredStatus,
+				alloc.ClientStatus,
+			)
+		}
+		c.Ui.Output(fmt.Sprintf("Prefix matched multiple allocations\n\n%s", formatList(out)))
+		return 0
+	}
+
+	// Prefix lookup matched a single allocation
+	alloc, _, err := client.Allocations().Info(allocs[0].ID, nil)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying allocation: %s", err))
+		return 1
+	}
+
+	res, err := client.Allocations().Exec(alloc, task, cmd, args[2:], nil)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error running command: %s", err))
+		return 1
+	}
+	if res.Output != "" {
+		c.Ui.Output(strings.TrimSuffix(res.Output, "\n"))
+	}
+	return res.ExitCode
+}
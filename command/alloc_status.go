@@ -308,6 +308,12 @@ func (c *AllocStatusCommand) outputTaskStatus(state *api.TaskState) {
 			} else {
 				desc = "Failed to download artifacts"
 			}
+		case api.TaskHookFailed:
+			if event.HookError != "" {
+				desc = event.HookError
+			} else {
+				desc = "Failed to run hook"
+			}
 		case api.TaskKilling:
 			if event.KillReason != "" {
 				desc = fmt.Sprintf("Killing task: %v", event.KillReason)
@@ -378,6 +384,8 @@ func (c *AllocStatusCommand) outputTaskStatus(state *api.TaskState) {
 			} else {
 				desc = "Task signaled to restart"
 			}
+		case api.TaskDriverMessage:
+			desc = event.DriverMessage
 		}
 
 		// Reverse order so we are sorted by time
@@ -446,6 +454,7 @@ func (c *AllocStatusCommand) outputTaskResources(alloc *api.Allocation, task str
 func (c *AllocStatusCommand) outputVerboseResourceUsage(task string, resourceUsage *api.ResourceUsage) {
 	memoryStats := resourceUsage.MemoryStats
 	cpuStats := resourceUsage.CpuStats
+	ioStats := resourceUsage.IOStats
 	if memoryStats != nil && len(memoryStats.Measured) > 0 {
 		c.Ui.Output("Memory Stats")
 
@@ -467,6 +476,8 @@ func (c *AllocStatusCommand) outputVerboseResourceUsage(task string, resourceUsa
 				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.KernelUsage))
 			case "Kernel Max Usage":
 				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.KernelMaxUsage))
+			case "Guest Usage":
+				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.GuestUsage))
 			}
 		}
 
@@ -507,6 +518,33 @@ func (c *AllocStatusCommand) outputVerboseResourceUsage(task string, resourceUsa
 		out[1] = strings.Join(measuredStats, "|")
 		c.Ui.Output(formatList(out))
 	}
+
+	if ioStats != nil && len(ioStats.Measured) > 0 {
+		c.Ui.Output("")
+		c.Ui.Output("Disk IO Stats")
+
+		// Sort the measured stats
+		sort.Strings(ioStats.Measured)
+
+		var measuredStats []string
+		for _, measured := range ioStats.Measured {
+			switch measured {
+			case "Read Bytes":
+				measuredStats = append(measuredStats, humanize.IBytes(ioStats.ReadBytes))
+			case "Write Bytes":
+				measuredStats = append(measuredStats, humanize.IBytes(ioStats.WriteBytes))
+			case "Read Ops":
+				measuredStats = append(measuredStats, fmt.Sprintf("%v", ioStats.ReadOps))
+			case "Write Ops":
+				measuredStats = append(measuredStats, fmt.Sprintf("%v", ioStats.WriteOps))
+			}
+		}
+
+		out := make([]string, 2)
+		out[0] = strings.Join(ioStats.Measured, "|")
+		out[1] = strings.Join(measuredStats, "|")
+		c.Ui.Output(formatList(out))
+	}
 }
 
 // shortTaskStatus prints out the current state of each task.
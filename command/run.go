@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strconv"
@@ -75,6 +76,11 @@ Run Options:
     the evaluation ID will be printed to the screen, which can be used to
     examine the evaluation using the eval-status command.
 
+  -payload <path>
+    Submit the contents of the file at the given path as the job's payload. The
+    payload is written into the local directory of the tasks with a
+    dispatch_payload stanza before they are started.
+
   -verbose
     Display full information.
 
@@ -97,7 +103,7 @@ func (c *RunCommand) Synopsis() string {
 
 func (c *RunCommand) Run(args []string) int {
 	var detach, verbose, output bool
-	var checkIndexStr, vaultToken string
+	var checkIndexStr, vaultToken, payloadPath string
 
 	flags := c.Meta.FlagSet("run", FlagSetClient)
 	flags.Usage = func() { c.Ui.Output(c.Help()) }
@@ -106,6 +112,7 @@ func (c *RunCommand) Run(args []string) int {
 	flags.BoolVar(&output, "output", false, "")
 	flags.StringVar(&checkIndexStr, "check-index", "", "")
 	flags.StringVar(&vaultToken, "vault-token", "", "")
+	flags.StringVar(&payloadPath, "payload", "", "")
 
 	if err := flags.Parse(args); err != nil {
 		return 1
@@ -138,6 +145,15 @@ func (c *RunCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Read the payload
+	if payloadPath != "" {
+		job.Payload, err = ioutil.ReadFile(payloadPath)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error reading payload: %s", err))
+			return 1
+		}
+	}
+
 	// Initialize any fields that need to be.
 	job.Canonicalize()
 
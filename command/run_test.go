@@ -144,6 +144,15 @@ job "job1" {
 	}
 	ui.ErrorWriter.Reset()
 
+	// Fails on a missing payload (requires a valid job)
+	if code := cmd.Run([]string{"-payload=/unicorns/leprechauns", fh3.Name()}); code != 1 {
+		t.Fatalf("expected exit code 1, got: %d", code)
+	}
+	if out := ui.ErrorWriter.String(); !strings.Contains(out, "Error reading payload") {
+		t.Fatalf("expected payload error, got: %s", out)
+	}
+	ui.ErrorWriter.Reset()
+
 }
 
 func TestRunCommand_From_STDIN(t *testing.T) {
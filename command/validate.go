@@ -3,6 +3,8 @@ package command
 import (
 	"fmt"
 	"strings"
+
+	"github.com/hashicorp/nomad/client/driver"
 )
 
 type ValidateCommand struct {
@@ -58,6 +60,17 @@ func (c *ValidateCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Drivers that aren't builtin can only be validated by the clients they
+	// are installed on
+	for _, tg := range job.TaskGroups {
+		for _, task := range tg.Tasks {
+			if !driver.IsBuiltinDriver(task.Driver) {
+				c.Ui.Warn(fmt.Sprintf("Task %q uses driver %q, which isn't builtin. It must be installed as an external driver on the clients, which validate its config.",
+					task.Name, task.Driver))
+			}
+		}
+	}
+
 	// Done!
 	c.Ui.Output("Job validation successful")
 	return 0
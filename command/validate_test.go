@@ -45,6 +45,41 @@ job "job1" {
 	}
 }
 
+func TestValidateCommand_ExternalDriver(t *testing.T) {
+	ui := new(cli.MockUi)
+	cmd := &ValidateCommand{Meta: Meta{Ui: ui}}
+
+	fh, err := ioutil.TempFile("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(fh.Name())
+	_, err = fh.WriteString(`
+job "job1" {
+	type = "service"
+	datacenters = [ "dc1" ]
+	group "group1" {
+		count = 1
+		task "task1" {
+			driver = "custom"
+			resources = {
+				cpu = 1000
+				memory = 512
+			}
+		}
+	}
+}`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if code := cmd.Run([]string{fh.Name()}); code != 0 {
+		t.Fatalf("expect exit 0, got: %d: %s", code, ui.ErrorWriter.String())
+	}
+	if out := ui.ErrorWriter.String(); !strings.Contains(out, `driver "custom", which isn't builtin`) {
+		t.Fatalf("expected external driver warning, got: %s", out)
+	}
+}
+
 func TestValidateCommand_Fails(t *testing.T) {
 	ui := new(cli.MockUi)
 	cmd := &ValidateCommand{Meta: Meta{Ui: ui}}
@@ -25,6 +25,16 @@ func Commands(metaPtr *command.Meta) map[string]cli.CommandFactory {
 	}
 
 	return map[string]cli.CommandFactory{
+		"alloc-exec": func() (cli.Command, error) {
+			return &command.AllocExecCommand{
+				Meta: meta,
+			}, nil
+		},
+		"alloc-signal": func() (cli.Command, error) {
+			return &command.AllocSignalCommand{
+				Meta: meta,
+			}, nil
+		},
 		"alloc-status": func() (cli.Command, error) {
 			return &command.AllocStatusCommand{
 				Meta: meta,
@@ -552,8 +552,10 @@ func parseTasks(jobName string, taskGroupName string, result *[]*structs.Task, l
 			"artifact",
 			"config",
 			"constraint",
+			"dispatch_payload",
 			"driver",
 			"env",
+			"hook",
 			"kill_timeout",
 			"logs",
 			"meta",
@@ -574,7 +576,9 @@ func parseTasks(jobName string, taskGroupName string, result *[]*structs.Task, l
 		delete(m, "artifact")
 		delete(m, "config")
 		delete(m, "constraint")
+		delete(m, "dispatch_payload")
 		delete(m, "env")
+		delete(m, "hook")
 		delete(m, "logs")
 		delete(m, "meta")
 		delete(m, "resources")
@@ -632,20 +636,24 @@ func parseTasks(jobName string, taskGroupName string, result *[]*structs.Task, l
 				}
 			}
 
-			// Instantiate a driver to validate the configuration
-			d, err := driver.NewDriver(
-				t.Driver,
-				driver.NewEmptyDriverContext(),
-			)
-
-			if err != nil {
-				return multierror.Prefix(err,
-					fmt.Sprintf("'%s', config ->", n))
-			}
+			// Instantiate a driver to validate the configuration. Tasks of
+			// external drivers are validated by the clients, and the servers
+			// reject drivers that no client has installed.
+			if driver.IsBuiltinDriver(t.Driver) {
+				d, err := driver.NewDriver(
+					t.Driver,
+					driver.NewEmptyDriverContext(),
+				)
+
+				if err != nil {
+					return multierror.Prefix(err,
+						fmt.Sprintf("'%s', config ->", n))
+				}
 
-			if err := d.Validate(t.Config); err != nil {
-				return multierror.Prefix(err,
-					fmt.Sprintf("'%s', config ->", n))
+				if err := d.Validate(t.Config); err != nil {
+					return multierror.Prefix(err,
+						fmt.Sprintf("'%s', config ->", n))
+				}
 			}
 		}
 
@@ -723,6 +731,39 @@ func parseTasks(jobName string, taskGroupName string, result *[]*structs.Task, l
 			}
 		}
 
+		// Parse hooks
+		if o := listVal.Filter("hook"); len(o.Items) > 0 {
+			if err := parseHooks(&t.Hooks, o); err != nil {
+				return multierror.Prefix(err, fmt.Sprintf("'%s', hook ->", n))
+			}
+		}
+
+		// If we have a dispatch_payload block parse that
+		if o := listVal.Filter("dispatch_payload"); len(o.Items) > 0 {
+			if len(o.Items) > 1 {
+				return fmt.Errorf("only one dispatch_payload block is allowed in a task. Number of dispatch_payload blocks found: %d", len(o.Items))
+			}
+			var m map[string]interface{}
+			dispatchBlock := o.Items[0]
+
+			// Check for invalid keys
+			valid := []string{
+				"file",
+			}
+			if err := checkHCLKeys(dispatchBlock.Val, valid); err != nil {
+				return multierror.Prefix(err, fmt.Sprintf("'%s', dispatch_payload ->", n))
+			}
+
+			if err := hcl.DecodeObject(&m, dispatchBlock.Val); err != nil {
+				return err
+			}
+
+			t.DispatchPayload = &structs.DispatchPayloadConfig{}
+			if err := mapstructure.WeakDecode(m, t.DispatchPayload); err != nil {
+				return err
+			}
+		}
+
 		// If we have a vault block, then parse that
 		if o := listVal.Filter("vault"); len(o.Items) > 0 {
 			v := structs.DefaultVaultBlock()
@@ -850,6 +891,48 @@ func parseTemplates(result *[]*structs.Template, list *ast.ObjectList) error {
 	return nil
 }
 
+func parseHooks(result *[]*structs.TaskHook, list *ast.ObjectList) error {
+	for _, o := range list.Items {
+		if len(o.Keys) != 1 {
+			return fmt.Errorf("hook must have a type, either %q or %q", structs.TaskHookPrestart, structs.TaskHookPoststop)
+		}
+		hookType := o.Keys[0].Token.Value().(string)
+
+		// Check for invalid keys
+		valid := []string{
+			"command",
+			"args",
+			"timeout",
+			"ignore_failure",
+		}
+		if err := checkHCLKeys(o.Val, valid); err != nil {
+			return multierror.Prefix(err, fmt.Sprintf("%s ->", hookType))
+		}
+
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o.Val); err != nil {
+			return err
+		}
+
+		hook := structs.DefaultTaskHook(hookType)
+		dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+			WeaklyTypedInput: true,
+			Result:           hook,
+		})
+		if err != nil {
+			return err
+		}
+		if err := dec.Decode(m); err != nil {
+			return err
+		}
+
+		*result = append(*result, hook)
+	}
+
+	return nil
+}
+
 func parseServices(jobName string, taskGroupName string, task *structs.Task, serviceObjs *ast.ObjectList) error {
 	task.Services = make([]*structs.Service, len(serviceObjs.Items))
 	var defaultServiceName bool
@@ -972,6 +1055,7 @@ func parseResources(result *structs.Resources, list *ast.ObjectList) error {
 	// Check for invalid keys
 	valid := []string{
 		"cpu",
+		"device",
 		"iops",
 		"memory",
 		"network",
@@ -984,6 +1068,7 @@ func parseResources(result *structs.Resources, list *ast.ObjectList) error {
 	if err := hcl.DecodeObject(&m, o.Val); err != nil {
 		return err
 	}
+	delete(m, "device")
 	delete(m, "network")
 
 	if err := mapstructure.WeakDecode(m, result); err != nil {
@@ -1027,6 +1112,13 @@ func parseResources(result *structs.Resources, list *ast.ObjectList) error {
 		result.Networks = []*structs.NetworkResource{&r}
 	}
 
+	// Parse the device resources
+	if o := listVal.Filter("device"); len(o.Items) > 0 {
+		if err := parseDevices(&result.Devices, o); err != nil {
+			return multierror.Prefix(err, "resources, device ->")
+		}
+	}
+
 	// Combine the parsed resources with a default resource block.
 	min := structs.DefaultResources()
 	min.Merge(result)
@@ -1034,6 +1126,41 @@ func parseResources(result *structs.Resources, list *ast.ObjectList) error {
 	return nil
 }
 
+func parseDevices(result *[]*structs.DeviceResource, list *ast.ObjectList) error {
+	for _, o := range list.Items {
+		if len(o.Keys) != 1 {
+			return fmt.Errorf("device must be given as <type>, <vendor>/<type> or <vendor>/<type>/<name>")
+		}
+		id := o.Keys[0].Token.Value().(string)
+
+		// Check for invalid keys
+		valid := []string{
+			"count",
+		}
+		if err := checkHCLKeys(o.Val, valid); err != nil {
+			return multierror.Prefix(err, fmt.Sprintf("%s ->", id))
+		}
+
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o.Val); err != nil {
+			return err
+		}
+
+		d, err := structs.ParseDeviceResource(id)
+		if err != nil {
+			return err
+		}
+		d.Count = 1
+		if err := mapstructure.WeakDecode(m, d); err != nil {
+			return err
+		}
+
+		*result = append(*result, d)
+	}
+
+	return nil
+}
+
 func parsePorts(networkObj *ast.ObjectList, nw *structs.NetworkResource) error {
 	// Check for invalid keys
 	valid := []string{
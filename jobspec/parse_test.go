@@ -179,6 +179,20 @@ func TestParse(t *testing.T) {
 										Splay:        5 * time.Second,
 									},
 								},
+								Hooks: []*structs.TaskHook{
+									{
+										Type:    structs.TaskHookPrestart,
+										Command: "/bin/migrate",
+										Args:    []string{"-up"},
+										Timeout: 5 * time.Minute,
+									},
+									{
+										Type:          structs.TaskHookPoststop,
+										Command:       "/bin/deregister",
+										Timeout:       structs.DefaultTaskHookTimeout,
+										IgnoreFailure: true,
+									},
+								},
 							},
 							&structs.Task{
 								Name:   "storagelocker",
@@ -537,6 +551,65 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"resource-devices.hcl",
+			&structs.Job{
+				ID:       "devices",
+				Name:     "devices",
+				Type:     "service",
+				Priority: 50,
+				Region:   "global",
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:          "gpus",
+						Count:         1,
+						EphemeralDisk: structs.DefaultEphemeralDisk(),
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:      "train",
+								LogConfig: structs.DefaultLogConfig(),
+								Resources: &structs.Resources{
+									CPU:      500,
+									MemoryMB: 128,
+									Devices: []*structs.DeviceResource{
+										{Vendor: "nvidia", Type: "gpu", Count: 2},
+										{Type: "fpga", Count: 1},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"dispatch-payload.hcl",
+			&structs.Job{
+				ID:       "dispatch",
+				Name:     "dispatch",
+				Type:     "batch",
+				Priority: 50,
+				Region:   "global",
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:          "work",
+						Count:         1,
+						EphemeralDisk: structs.DefaultEphemeralDisk(),
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:      "worker",
+								LogConfig: structs.DefaultLogConfig(),
+								DispatchPayload: &structs.DispatchPayloadConfig{
+									File: "input.json",
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
 	}
 
 	for _, tc := range cases {
@@ -146,6 +146,17 @@ job "binstore-storagelocker" {
         source = "bar"
         destination = "bar"
       }
+
+      hook "prestart" {
+        command = "/bin/migrate"
+        args = ["-up"]
+        timeout = "5m"
+      }
+
+      hook "poststop" {
+        command = "/bin/deregister"
+        ignore_failure = true
+      }
     }
 
     task "storagelocker" {
@@ -0,0 +1,10 @@
+job "dispatch" {
+    type = "batch"
+	group "work" {
+		task "worker" {
+            dispatch_payload {
+                file = "input.json"
+            }
+		}
+	}
+}
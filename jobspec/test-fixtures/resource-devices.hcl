@@ -0,0 +1,16 @@
+job "devices" {
+	group "gpus" {
+		task "train" {
+			resources {
+				cpu = 500
+				memory = 128
+
+				device "nvidia/gpu" {
+					count = 2
+				}
+
+				device "fpga" {}
+			}
+		}
+	}
+}
@@ -175,6 +175,11 @@ type Config struct {
 	// as well as clock skew.
 	HeartbeatGrace time.Duration
 
+	// MaxKillTimeout is the maximum KillTimeout tasks of registered jobs may
+	// specify. Jobs with tasks exceeding it are rejected. If zero, there is
+	// no limit.
+	MaxKillTimeout time.Duration
+
 	// FailoverHeartbeatTTL is the TTL applied to heartbeats after
 	// a new leader is elected, since we no longer know the status
 	// of all the heartbeats.
@@ -11,6 +11,7 @@ import (
 	"github.com/hashicorp/go-memdb"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/state"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/nomad/watch"
 	"github.com/hashicorp/nomad/scheduler"
@@ -59,6 +60,10 @@ func (j *Job) Register(args *structs.JobRegisterRequest, reply *structs.JobRegis
 	if err := validateJob(args.Job); err != nil {
 		return err
 	}
+	j.warnUnknownDrivers(args.Job)
+	if err := validateKillTimeouts(args.Job, j.srv.config.MaxKillTimeout); err != nil {
+		return err
+	}
 
 	if args.EnforceIndex {
 		// Lookup the job
@@ -625,6 +630,10 @@ func (j *Job) Plan(args *structs.JobPlanRequest, reply *structs.JobPlanResponse)
 	if err := validateJob(args.Job); err != nil {
 		return err
 	}
+	j.warnUnknownDrivers(args.Job)
+	if err := validateKillTimeouts(args.Job, j.srv.config.MaxKillTimeout); err != nil {
+		return err
+	}
 
 	// Acquire a snapshot of the state
 	snap, err := j.srv.fsm.State().Snapshot()
@@ -730,6 +739,11 @@ func validateJob(job *structs.Job) error {
 		tgSignals, tgOk := signals[tg.Name]
 
 		for _, task := range tg.Tasks {
+			// Tasks of external drivers are validated by the clients
+			if !driver.IsBuiltinDriver(task.Driver) {
+				continue
+			}
+
 			d, err := driver.NewDriver(
 				task.Driver,
 				driver.NewEmptyDriverContext(),
@@ -768,3 +782,82 @@ func validateJob(job *structs.Job) error {
 
 	return validationErrors.ErrorOrNil()
 }
+
+// warnUnknownDrivers logs a warning if a task of the job uses a driver that
+// isn't builtin and isn't installed on any client, as its name may be
+// misspelled. The job isn't rejected for it, as the clients with the driver
+// may not have joined yet or may be down, and the job then waits to be placed
+// like any other that no node is feasible for.
+func (j *Job) warnUnknownDrivers(job *structs.Job) {
+	if err := validateExternalDrivers(job, j.srv.fsm.State()); err != nil {
+		j.srv.logger.Printf("[WARN] nomad.job: job %q: %v", job.ID, err)
+	}
+}
+
+// validateExternalDrivers returns an error if a task of the job uses a driver
+// that isn't builtin and isn't installed as an external driver on any client,
+// in this server's view of the cluster. Drivers are looked up by the driver
+// attribute the clients fingerprint them with.
+func validateExternalDrivers(job *structs.Job, snap *state.StateStore) error {
+	var unknown []string
+	for _, tg := range job.TaskGroups {
+		for _, task := range tg.Tasks {
+			if !driver.IsBuiltinDriver(task.Driver) {
+				unknown = append(unknown, task.Driver)
+			}
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	installed := make(map[string]struct{})
+	iter, err := snap.Nodes()
+	if err != nil {
+		return err
+	}
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+		node := raw.(*structs.Node)
+		for _, name := range unknown {
+			if _, ok := node.Attributes["driver."+name]; ok {
+				installed[name] = struct{}{}
+			}
+		}
+	}
+
+	validationErrors := new(multierror.Error)
+	for _, tg := range job.TaskGroups {
+		for _, task := range tg.Tasks {
+			if driver.IsBuiltinDriver(task.Driver) {
+				continue
+			}
+			if _, ok := installed[task.Driver]; !ok {
+				multierror.Append(validationErrors, fmt.Errorf("group %q -> task %q: unknown driver %q, it isn't installed on any client", tg.Name, task.Name, task.Driver))
+			}
+		}
+	}
+	return validationErrors.ErrorOrNil()
+}
+
+// validateKillTimeouts returns an error if a task of the job specifies a
+// KillTimeout greater than max. A max of zero means there is no limit.
+func validateKillTimeouts(job *structs.Job, max time.Duration) error {
+	if max == 0 {
+		return nil
+	}
+	validationErrors := new(multierror.Error)
+	for _, tg := range job.TaskGroups {
+		for _, task := range tg.Tasks {
+			if task.KillTimeout > max {
+				formatted := fmt.Errorf("group %q -> task %q: kill_timeout %v exceeds the maximum of %v",
+					tg.Name, task.Name, task.KillTimeout, max)
+				multierror.Append(validationErrors, formatted)
+			}
+		}
+	}
+	return validationErrors.ErrorOrNil()
+}
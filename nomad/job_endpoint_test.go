@@ -249,6 +249,40 @@ func TestJobEndpoint_Register_Periodic(t *testing.T) {
 	}
 }
 
+func TestJobEndpoint_Register_MaxKillTimeout(t *testing.T) {
+	s1 := testServer(t, func(c *Config) {
+		c.NumSchedulers = 0 // Prevent automatic dequeue
+		c.MaxKillTimeout = time.Minute
+	})
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	testutil.WaitForLeader(t, s1.RPC)
+
+	// Create the register request with a kill timeout above the maximum
+	job := mock.Job()
+	job.TaskGroups[0].Tasks[0].KillTimeout = 2 * time.Minute
+	req := &structs.JobRegisterRequest{
+		Job:          job,
+		WriteRequest: structs.WriteRequest{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp structs.JobRegisterResponse
+	err := msgpackrpc.CallWithCodec(codec, "Job.Register", req, &resp)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("expected kill timeout error, got: %v", err)
+	}
+
+	// Kill timeouts up to the maximum are accepted
+	job.TaskGroups[0].Tasks[0].KillTimeout = time.Minute
+	if err := msgpackrpc.CallWithCodec(codec, "Job.Register", req, &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Index == 0 {
+		t.Fatalf("bad index: %d", resp.Index)
+	}
+}
+
 func TestJobEndpoint_Register_EnforceIndex(t *testing.T) {
 	s1 := testServer(t, func(c *Config) {
 		c.NumSchedulers = 0 // Prevent automatic dequeue
@@ -1711,10 +1745,50 @@ func TestJobEndpoint_ValidateJob_InvalidDriverConf(t *testing.T) {
 	}
 }
 
+func TestJobEndpoint_Register_UnknownDriver(t *testing.T) {
+	s1 := testServer(t, func(c *Config) {
+		c.NumSchedulers = 0 // Prevent automatic dequeue
+	})
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	testutil.WaitForLeader(t, s1.RPC)
+
+	// Create a job using a driver that isn't builtin
+	job := mock.Job()
+	job.TaskGroups[0].Tasks[0].Driver = "custom"
+	req := &structs.JobRegisterRequest{
+		Job:          job,
+		WriteRequest: structs.WriteRequest{Region: "global"},
+	}
+
+	// The job is accepted although no client has the driver installed yet
+	var resp structs.JobRegisterResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Job.Register", req, &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.EvalID == "" {
+		t.Fatalf("bad eval ID: %s", resp.EvalID)
+	}
+
+	// The driver is only reported as unknown by validateExternalDrivers
+	err := validateExternalDrivers(job, s1.fsm.State())
+	if err == nil || !strings.Contains(err.Error(), "unknown driver \"custom\"") {
+		t.Fatalf("expected unknown driver error; got %v", err)
+	}
+	node := mock.Node()
+	node.Attributes["driver.custom"] = "1"
+	if err := s1.fsm.State().UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := validateExternalDrivers(job, s1.fsm.State()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestJobEndpoint_ValidateJob_InvalidSignals(t *testing.T) {
 	// Create a mock job that wants to send a signal to a driver that can't
 	job := mock.Job()
-	job.TaskGroups[0].Tasks[0].Driver = "qemu"
+	job.TaskGroups[0].Tasks[0].Driver = "rkt"
 	job.TaskGroups[0].Tasks[0].Vault = &structs.Vault{
 		Policies:     []string{"foo"},
 		ChangeMode:   structs.VaultChangeModeSignal,
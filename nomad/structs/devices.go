@@ -0,0 +1,187 @@
+package structs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeviceResource is used to describe devices such as GPUs. On nodes it is a
+// group of identical devices and their IDs, in the resources a task asks for
+// it is the number of devices of a type the task needs, and in the resources
+// of an allocation it is the IDs of the devices assigned to the task.
+type DeviceResource struct {
+	// Vendor, Type and Name identify the devices, e.g. "nvidia", "gpu" and
+	// "Tesla K80". Asks must specify the type and may leave the vendor and the
+	// name empty to match any.
+	Vendor string
+	Type   string
+	Name   string
+
+	// Count is the number of devices a task asks for
+	Count int
+
+	// IDs are the IDs of the devices, such as GPU UUIDs or PCI addresses
+	IDs []string
+}
+
+// ParseDeviceResource parses a device ask given as "<type>",
+// "<vendor>/<type>" or "<vendor>/<type>/<name>".
+func ParseDeviceResource(id string) (*DeviceResource, error) {
+	parts := strings.SplitN(id, "/", 3)
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid device %q: must be given as <type>, <vendor>/<type> or <vendor>/<type>/<name>", id)
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		return &DeviceResource{Type: parts[0]}, nil
+	case 2:
+		return &DeviceResource{Vendor: parts[0], Type: parts[1]}, nil
+	default:
+		return &DeviceResource{Vendor: parts[0], Type: parts[1], Name: parts[2]}, nil
+	}
+}
+
+// ID returns the identifier of the devices in the form they are asked for
+func (d *DeviceResource) ID() string {
+	parts := []string{d.Type}
+	if d.Vendor != "" {
+		parts = []string{d.Vendor, d.Type}
+	}
+	if d.Name != "" {
+		parts = append(parts, d.Name)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Matches returns whether the devices satisfy the type, vendor and name of the
+// ask
+func (d *DeviceResource) Matches(ask *DeviceResource) bool {
+	if d.Type != ask.Type {
+		return false
+	}
+	if ask.Vendor != "" && d.Vendor != ask.Vendor {
+		return false
+	}
+	if ask.Name != "" && d.Name != ask.Name {
+		return false
+	}
+	return true
+}
+
+func (d *DeviceResource) Copy() *DeviceResource {
+	if d == nil {
+		return nil
+	}
+	nd := new(DeviceResource)
+	*nd = *d
+	nd.IDs = CopySliceString(d.IDs)
+	return nd
+}
+
+// MeetsMinResources returns an error if the ask is invalid
+func (d *DeviceResource) MeetsMinResources() error {
+	if d.Type == "" {
+		return fmt.Errorf("device type must be specified")
+	}
+	if d.Count < 1 {
+		return fmt.Errorf("minimum count of device %q is 1; got %d", d.ID(), d.Count)
+	}
+	return nil
+}
+
+func (d *DeviceResource) GoString() string {
+	return fmt.Sprintf("*%#v", *d)
+}
+
+// DeviceIndex is used to index the devices of a node and the devices used by
+// allocations
+type DeviceIndex struct {
+	AvailDevices []*DeviceResource   // Device groups of the node
+	UsedDevices  map[string]struct{} // IDs of the used devices
+}
+
+// NewDeviceIndex is used to construct a new device index
+func NewDeviceIndex() *DeviceIndex {
+	return &DeviceIndex{
+		UsedDevices: make(map[string]struct{}),
+	}
+}
+
+// SetNode is used to setup the available devices. Returns true if there is a
+// collision
+func (idx *DeviceIndex) SetNode(node *Node) (collide bool) {
+	idx.AvailDevices = append(idx.AvailDevices, node.Resources.Devices...)
+
+	if r := node.Reserved; r != nil {
+		for _, d := range r.Devices {
+			if idx.AddReserved(d) {
+				collide = true
+			}
+		}
+	}
+	return
+}
+
+// AddAllocs is used to add the devices used by allocations. Returns true if
+// there is a collision
+func (idx *DeviceIndex) AddAllocs(allocs []*Allocation) (collide bool) {
+	for _, alloc := range allocs {
+		for _, task := range alloc.TaskResources {
+			for _, d := range task.Devices {
+				if idx.AddReserved(d) {
+					collide = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// AddReserved is used to add devices as used, returns true if any of them
+// were already used
+func (idx *DeviceIndex) AddReserved(d *DeviceResource) (collide bool) {
+	for _, id := range d.IDs {
+		if _, ok := idx.UsedDevices[id]; ok {
+			collide = true
+		}
+		idx.UsedDevices[id] = struct{}{}
+	}
+	return
+}
+
+// AssignDevices is used to assign free devices of the node to an ask. The
+// returned offer is a copy of the matching device group with the IDs of the
+// assigned devices, which aren't yet marked as used.
+func (idx *DeviceIndex) AssignDevices(ask *DeviceResource) (*DeviceResource, error) {
+	for _, avail := range idx.AvailDevices {
+		if !avail.Matches(ask) {
+			continue
+		}
+
+		var free []string
+		for _, id := range avail.IDs {
+			if _, ok := idx.UsedDevices[id]; !ok {
+				free = append(free, id)
+			}
+			if len(free) == ask.Count {
+				break
+			}
+		}
+		if len(free) < ask.Count {
+			continue
+		}
+
+		offer := &DeviceResource{
+			Vendor: avail.Vendor,
+			Type:   avail.Type,
+			Name:   avail.Name,
+			Count:  ask.Count,
+			IDs:    free,
+		}
+		return offer, nil
+	}
+	return nil, fmt.Errorf("no %d free devices of %q", ask.Count, ask.ID())
+}
@@ -0,0 +1,155 @@
+package structs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceResource(t *testing.T) {
+	cases := map[string]*DeviceResource{
+		"gpu":                  {Type: "gpu"},
+		"nvidia/gpu":           {Vendor: "nvidia", Type: "gpu"},
+		"nvidia/gpu/Tesla K80": {Vendor: "nvidia", Type: "gpu", Name: "Tesla K80"},
+	}
+	for id, expected := range cases {
+		d, err := ParseDeviceResource(id)
+		if err != nil {
+			t.Fatalf("err for %q: %v", id, err)
+		}
+		if !reflect.DeepEqual(d, expected) {
+			t.Fatalf("got %#v for %q; want %#v", d, id, expected)
+		}
+		if d.ID() != id {
+			t.Fatalf("got ID %q; want %q", d.ID(), id)
+		}
+	}
+
+	for _, id := range []string{"", "nvidia/", "/gpu"} {
+		if _, err := ParseDeviceResource(id); err == nil {
+			t.Fatalf("expected an error for %q", id)
+		}
+	}
+}
+
+func TestDeviceResource_Matches(t *testing.T) {
+	d := &DeviceResource{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80"}
+	matching := []*DeviceResource{
+		{Type: "gpu"},
+		{Vendor: "nvidia", Type: "gpu"},
+		{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80"},
+	}
+	for _, ask := range matching {
+		if !d.Matches(ask) {
+			t.Fatalf("%q should match %q", d.ID(), ask.ID())
+		}
+	}
+	other := []*DeviceResource{
+		{Type: "vfio"},
+		{Vendor: "amd", Type: "gpu"},
+		{Vendor: "nvidia", Type: "gpu", Name: "Tesla P100"},
+	}
+	for _, ask := range other {
+		if d.Matches(ask) {
+			t.Fatalf("%q shouldn't match %q", d.ID(), ask.ID())
+		}
+	}
+}
+
+func TestDeviceIndex_AssignDevices(t *testing.T) {
+	n := &Node{
+		Resources: &Resources{
+			Devices: []*DeviceResource{
+				{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80", IDs: []string{"GPU-1", "GPU-2"}},
+				{Vendor: "nvidia", Type: "gpu", Name: "Tesla P100", IDs: []string{"GPU-3", "GPU-4"}},
+			},
+		},
+		Reserved: &Resources{
+			Devices: []*DeviceResource{
+				{IDs: []string{"GPU-1"}},
+			},
+		},
+	}
+	allocs := []*Allocation{
+		&Allocation{
+			TaskResources: map[string]*Resources{
+				"web": &Resources{
+					Devices: []*DeviceResource{
+						{Vendor: "nvidia", Type: "gpu", Name: "Tesla P100", IDs: []string{"GPU-3"}},
+					},
+				},
+			},
+		},
+	}
+	idx := NewDeviceIndex()
+	if idx.SetNode(n) || idx.AddAllocs(allocs) {
+		t.Fatalf("unexpected collision")
+	}
+
+	// The reserved and used devices aren't assigned
+	offer, err := idx.AssignDevices(&DeviceResource{Type: "gpu", Count: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if offer.Name != "Tesla K80" || !reflect.DeepEqual(offer.IDs, []string{"GPU-2"}) {
+		t.Fatalf("bad: %#v", offer)
+	}
+	if idx.AddReserved(offer) {
+		t.Fatalf("unexpected collision")
+	}
+
+	offer, err = idx.AssignDevices(&DeviceResource{Type: "gpu", Name: "Tesla P100", Count: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(offer.IDs, []string{"GPU-4"}) {
+		t.Fatalf("bad: %#v", offer)
+	}
+	idx.AddReserved(offer)
+
+	if _, err := idx.AssignDevices(&DeviceResource{Type: "gpu", Count: 1}); err == nil {
+		t.Fatalf("expected all devices to be used")
+	}
+
+	// Using a device twice is a collision
+	if !idx.AddReserved(&DeviceResource{IDs: []string{"GPU-4"}}) {
+		t.Fatalf("expected a collision")
+	}
+}
+
+func TestAllocsFit_Devices(t *testing.T) {
+	n := &Node{
+		Resources: &Resources{
+			CPU:      2000,
+			MemoryMB: 2048,
+			Devices: []*DeviceResource{
+				{Vendor: "nvidia", Type: "gpu", IDs: []string{"GPU-1", "GPU-2"}},
+			},
+		},
+	}
+	alloc := func(id string) *Allocation {
+		return &Allocation{
+			TaskResources: map[string]*Resources{
+				"web": &Resources{
+					CPU:      100,
+					MemoryMB: 100,
+					Devices: []*DeviceResource{
+						{Vendor: "nvidia", Type: "gpu", Count: 1, IDs: []string{id}},
+					},
+				},
+			},
+		}
+	}
+
+	fit, _, _, err := AllocsFit(n, []*Allocation{alloc("GPU-1"), alloc("GPU-2")}, nil)
+	if err != nil || !fit {
+		t.Fatalf("expected the allocs to fit: %v", err)
+	}
+
+	fit, dim, _, err := AllocsFit(n, []*Allocation{alloc("GPU-1"), alloc("GPU-1")}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fit || dim != "device collision" {
+		t.Fatalf("expected a device collision; got %v %q", fit, dim)
+	}
+}
@@ -392,7 +392,24 @@ func (t *Task) Diff(other *Task, contextual bool) (*TaskDiff, error) {
 		diff.Objects = append(diff.Objects, vDiff)
 	}
 
-	// Artifacts diff
+	// Hooks diff
+	hookDiffs := primitiveObjectSetDiff(
+		interfaceSlice(t.Hooks),
+		interfaceSlice(other.Hooks),
+		nil,
+		"Hook",
+		contextual)
+	if hookDiffs != nil {
+		diff.Objects = append(diff.Objects, hookDiffs...)
+	}
+
+	// DispatchPayload diff
+	dDiff := primitiveObjectDiff(t.DispatchPayload, other.DispatchPayload, nil, "DispatchPayload", contextual)
+	if dDiff != nil {
+		diff.Objects = append(diff.Objects, dDiff)
+	}
+
+	// Templates diff
 	tmplDiffs := primitiveObjectSetDiff(
 		interfaceSlice(t.Templates),
 		interfaceSlice(other.Templates),
@@ -659,6 +676,17 @@ func (r *Resources) Diff(other *Resources, contextual bool) *ObjectDiff {
 		diff.Objects = append(diff.Objects, nDiffs...)
 	}
 
+	// Device Resources diff
+	dDiffs := primitiveObjectSetDiff(
+		interfaceSlice(r.Devices),
+		interfaceSlice(other.Devices),
+		nil,
+		"Device",
+		contextual)
+	if dDiffs != nil {
+		diff.Objects = append(diff.Objects, dDiffs...)
+	}
+
 	return diff
 }
 
@@ -1964,6 +1964,36 @@ func TestTaskDiff(t *testing.T) {
 				},
 			},
 		},
+		{
+			// DispatchPayload edited
+			Old: &Task{
+				DispatchPayload: &DispatchPayloadConfig{
+					File: "input.json",
+				},
+			},
+			New: &Task{
+				DispatchPayload: &DispatchPayloadConfig{
+					File: "input.txt",
+				},
+			},
+			Expected: &TaskDiff{
+				Type: DiffTypeEdited,
+				Objects: []*ObjectDiff{
+					{
+						Type: DiffTypeEdited,
+						Name: "DispatchPayload",
+						Fields: []*FieldDiff{
+							{
+								Type: DiffTypeEdited,
+								Name: "File",
+								Old:  "input.json",
+								New:  "input.txt",
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			// LogConfig edited with context
 			Contextual: true,
@@ -113,6 +113,12 @@ func AllocsFit(node *Node, allocs []*Allocation, netIdx *NetworkIndex) (bool, st
 		return false, "bandwidth exceeded", used, nil
 	}
 
+	// Check that no device is assigned more than once
+	devIdx := NewDeviceIndex()
+	if devIdx.SetNode(node) || devIdx.AddAllocs(allocs) {
+		return false, "device collision", used, nil
+	}
+
 	// Allocations fit!
 	return true, "", used, nil
 }
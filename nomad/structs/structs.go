@@ -778,6 +778,7 @@ type Resources struct {
 	DiskMB   int `mapstructure:"disk"`
 	IOPS     int
 	Networks []*NetworkResource
+	Devices  []*DeviceResource
 }
 
 const (
@@ -815,6 +816,9 @@ func (r *Resources) Merge(other *Resources) {
 	if len(other.Networks) != 0 {
 		r.Networks = other.Networks
 	}
+	if len(other.Devices) != 0 {
+		r.Devices = other.Devices
+	}
 }
 
 func (r *Resources) Canonicalize() {
@@ -823,6 +827,9 @@ func (r *Resources) Canonicalize() {
 	if len(r.Networks) == 0 {
 		r.Networks = nil
 	}
+	if len(r.Devices) == 0 {
+		r.Devices = nil
+	}
 
 	for _, n := range r.Networks {
 		n.Canonicalize()
@@ -847,6 +854,11 @@ func (r *Resources) MeetsMinResources() error {
 			mErr.Errors = append(mErr.Errors, fmt.Errorf("network resource at index %d failed: %v", i, err))
 		}
 	}
+	for i, d := range r.Devices {
+		if err := d.MeetsMinResources(); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("device resource at index %d failed: %v", i, err))
+		}
+	}
 
 	return mErr.ErrorOrNil()
 }
@@ -865,6 +877,12 @@ func (r *Resources) Copy() *Resources {
 			newR.Networks[i] = r.Networks[i].Copy()
 		}
 	}
+	if r.Devices != nil {
+		newR.Devices = make([]*DeviceResource, len(r.Devices))
+		for i, d := range r.Devices {
+			newR.Devices[i] = d.Copy()
+		}
+	}
 	return newR
 }
 
@@ -879,8 +897,8 @@ func (r *Resources) NetIndex(n *NetworkResource) int {
 }
 
 // Superset checks if one set of resources is a superset
-// of another. This ignores network resources, and the NetworkIndex
-// should be used for that.
+// of another. This ignores network and device resources, and the
+// NetworkIndex and DeviceIndex should be used for those.
 func (r *Resources) Superset(other *Resources) (bool, string) {
 	if r.CPU < other.CPU {
 		return false, "cpu exhausted"
@@ -1131,6 +1149,10 @@ type Job struct {
 	// transfer the token and is not stored after Job submission.
 	VaultToken string `mapstructure:"vault_token"`
 
+	// Payload is an opaque blob submitted with the job that is written into
+	// the local directory of the tasks with a dispatch payload configured.
+	Payload []byte
+
 	// Job status
 	Status string
 
@@ -1178,6 +1200,10 @@ func (j *Job) Copy() *Job {
 
 	nj.Periodic = nj.Periodic.Copy()
 	nj.Meta = CopyMapStringString(nj.Meta)
+	if j.Payload != nil {
+		nj.Payload = make([]byte, len(j.Payload))
+		copy(nj.Payload, j.Payload)
+	}
 	return nj
 }
 
@@ -1207,6 +1233,9 @@ func (j *Job) Validate() error {
 	if len(j.TaskGroups) == 0 {
 		mErr.Errors = append(mErr.Errors, errors.New("Missing job task groups"))
 	}
+	if len(j.Payload) > DispatchPayloadSizeLimit {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Payload exceeds maximum size of %d bytes", DispatchPayloadSizeLimit))
+	}
 	for idx, constr := range j.Constraints {
 		if err := constr.Validate(); err != nil {
 			outer := fmt.Errorf("Constraint %d validation failed: %s", idx+1, err)
@@ -2042,6 +2071,14 @@ type Task struct {
 	// Artifacts is a list of artifacts to download and extract before running
 	// the task.
 	Artifacts []*TaskArtifact
+
+	// Hooks are commands the client runs before the task is started and after
+	// it has exited.
+	Hooks []*TaskHook
+
+	// DispatchPayload configures where the job's payload is written for the
+	// task.
+	DispatchPayload *DispatchPayloadConfig `mapstructure:"dispatch_payload"`
 }
 
 func (t *Task) Copy() *Task {
@@ -2063,6 +2100,7 @@ func (t *Task) Copy() *Task {
 	nt.Constraints = CopySliceConstraints(nt.Constraints)
 
 	nt.Vault = nt.Vault.Copy()
+	nt.DispatchPayload = nt.DispatchPayload.Copy()
 	nt.Resources = nt.Resources.Copy()
 	nt.Meta = CopyMapStringString(nt.Meta)
 
@@ -2074,6 +2112,14 @@ func (t *Task) Copy() *Task {
 		nt.Artifacts = artifacts
 	}
 
+	if t.Hooks != nil {
+		hooks := make([]*TaskHook, len(nt.Hooks))
+		for i, h := range nt.Hooks {
+			hooks[i] = h.Copy()
+		}
+		nt.Hooks = hooks
+	}
+
 	if i, err := copystructure.Copy(nt.Config); err != nil {
 		nt.Config = i.(map[string]interface{})
 	}
@@ -2126,6 +2172,10 @@ func (t *Task) Canonicalize(job *Job, tg *TaskGroup) {
 	for _, template := range t.Templates {
 		template.Canonicalize()
 	}
+
+	for _, hook := range t.Hooks {
+		hook.Canonicalize()
+	}
 }
 
 func (t *Task) GoString() string {
@@ -2214,6 +2264,19 @@ func (t *Task) Validate(ephemeralDisk *EphemeralDisk) error {
 		}
 	}
 
+	for idx, hook := range t.Hooks {
+		if err := hook.Validate(); err != nil {
+			outer := fmt.Errorf("Hook %d validation failed: %v", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+
+	if t.DispatchPayload != nil {
+		if err := t.DispatchPayload.Validate(); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Dispatch Payload validation failed: %v", err))
+		}
+	}
+
 	destinations := make(map[string]int, len(t.Templates))
 	for idx, tmpl := range t.Templates {
 		if err := tmpl.Validate(); err != nil {
@@ -2308,6 +2371,125 @@ var (
 	TemplateChangeModeInvalidError = errors.New("Invalid change mode. Must be one of the following: noop, signal, restart")
 )
 
+const (
+	// TaskHookPrestart hooks are run before the task is started
+	TaskHookPrestart = "prestart"
+
+	// TaskHookPoststop hooks are run after the task has exited
+	TaskHookPoststop = "poststop"
+
+	// DefaultTaskHookTimeout is used if a hook doesn't specify a timeout
+	DefaultTaskHookTimeout = 1 * time.Minute
+)
+
+// TaskHook is a command the client runs on the host before a task is started
+// or after it has exited, with the task's directory as its working directory
+// and the task's environment, e.g. to migrate a database schema or deregister
+// the task from an external system.
+type TaskHook struct {
+	// Type is when the hook is run, either TaskHookPrestart or
+	// TaskHookPoststop
+	Type string `mapstructure:"type"`
+
+	// Command is the command to run and Args its arguments
+	Command string   `mapstructure:"command"`
+	Args    []string `mapstructure:"args"`
+
+	// Timeout is how long the hook may run before it is killed and considered
+	// failed
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// IgnoreFailure lets the task start, or its exit be handled as usual, if
+	// the hook fails. Otherwise failing prestart hooks fail the start of the
+	// task and failing poststop hooks fail the task.
+	IgnoreFailure bool `mapstructure:"ignore_failure"`
+}
+
+// DefaultTaskHook returns a default hook of the given type.
+func DefaultTaskHook(hookType string) *TaskHook {
+	return &TaskHook{
+		Type:    hookType,
+		Timeout: DefaultTaskHookTimeout,
+	}
+}
+
+func (h *TaskHook) Copy() *TaskHook {
+	if h == nil {
+		return nil
+	}
+	copy := new(TaskHook)
+	*copy = *h
+	if h.Args != nil {
+		copy.Args = make([]string, len(h.Args))
+		for i, arg := range h.Args {
+			copy.Args[i] = arg
+		}
+	}
+	return copy
+}
+
+func (h *TaskHook) Canonicalize() {
+	if h.Timeout == 0 {
+		h.Timeout = DefaultTaskHookTimeout
+	}
+}
+
+func (h *TaskHook) Validate() error {
+	var mErr multierror.Error
+
+	switch h.Type {
+	case TaskHookPrestart, TaskHookPoststop:
+	default:
+		multierror.Append(&mErr, fmt.Errorf("Invalid hook type %q, must be %q or %q", h.Type, TaskHookPrestart, TaskHookPoststop))
+	}
+
+	if h.Command == "" {
+		multierror.Append(&mErr, fmt.Errorf("Must specify a command for the hook"))
+	}
+
+	if h.Timeout < 0 {
+		multierror.Append(&mErr, fmt.Errorf("Hook timeout must be a positive value"))
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+const (
+	// DispatchPayloadSizeLimit is the maximum size of a job's payload
+	DispatchPayloadSizeLimit = 16 * 1024
+)
+
+// DispatchPayloadConfig configures how a task gets its job's payload
+type DispatchPayloadConfig struct {
+	// File is the path the payload is written to, relative to the task's
+	// local directory
+	File string `mapstructure:"file"`
+}
+
+func (d *DispatchPayloadConfig) Copy() *DispatchPayloadConfig {
+	if d == nil {
+		return nil
+	}
+	nd := new(DispatchPayloadConfig)
+	*nd = *d
+	return nd
+}
+
+func (d *DispatchPayloadConfig) Validate() error {
+	if d.File == "" {
+		return fmt.Errorf("Must specify a file for the payload")
+	}
+
+	// Verify the destination doesn't escape the tasks directory
+	escaped, err := PathEscapesAllocDir(filepath.Join("local", d.File))
+	if err != nil {
+		return fmt.Errorf("invalid destination path: %v", err)
+	} else if escaped {
+		return fmt.Errorf("destination escapes task's directory")
+	}
+	return nil
+}
+
 // Template represents a template configuration to be rendered for a given task
 type Template struct {
 	// SourcePath is the path to the template to be rendered
@@ -2500,6 +2682,10 @@ const (
 	// failed.
 	TaskArtifactDownloadFailed = "Failed Artifact Download"
 
+	// TaskHookFailed indicates that a prestart or poststop hook of the task
+	// failed.
+	TaskHookFailed = "Hook Failed"
+
 	// TaskDiskExceeded indicates that one of the tasks in a taskgroup has
 	// exceeded the requested disk resources.
 	TaskDiskExceeded = "Disk Resources Exceeded"
@@ -2507,6 +2693,10 @@ const (
 	// TaskSiblingFailed indicates that a sibling task in the task group has
 	// failed.
 	TaskSiblingFailed = "Sibling task failed"
+
+	// TaskDriverMessage is an informational event emitted by the task's
+	// driver, such as the addresses a VM's guest got.
+	TaskDriverMessage = "Driver"
 )
 
 // TaskEvent is an event that effects the state of a task and contains meta-data
@@ -2547,6 +2737,9 @@ type TaskEvent struct {
 	// Artifact Download fields
 	DownloadError string // Error downloading artifacts
 
+	// Hook fields
+	HookError string // Error running a prestart or poststop hook
+
 	// Validation fields
 	ValidationError string // Validation error
 
@@ -2565,6 +2758,9 @@ type TaskEvent struct {
 
 	// TaskSignal is the signal that was sent to the task
 	TaskSignal string
+
+	// DriverMessage is the message of an informational driver event
+	DriverMessage string
 }
 
 func (te *TaskEvent) GoString() string {
@@ -2664,6 +2860,18 @@ func (e *TaskEvent) SetDownloadError(err error) *TaskEvent {
 	return e
 }
 
+func (e *TaskEvent) SetDriverMessage(m string) *TaskEvent {
+	e.DriverMessage = m
+	return e
+}
+
+func (e *TaskEvent) SetHookError(err error) *TaskEvent {
+	if err != nil {
+		e.HookError = err.Error()
+	}
+	return e
+}
+
 func (e *TaskEvent) SetValidationError(err error) *TaskEvent {
 	if err != nil {
 		e.ValidationError = err.Error()
@@ -628,6 +628,62 @@ func TestTask_Validate_Template(t *testing.T) {
 	}
 }
 
+func TestTaskHook_Validate(t *testing.T) {
+	hook := &TaskHook{Timeout: -1}
+	err := hook.Validate()
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, expected := range []string{"Invalid hook type", "specify a command", "positive value"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("missing %q in %v", expected, err)
+		}
+	}
+
+	hook = DefaultTaskHook(TaskHookPoststop)
+	hook.Command = "/bin/true"
+	if err := hook.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Hooks without a timeout get the default one
+	hook = &TaskHook{Type: TaskHookPrestart, Command: "/bin/true"}
+	hook.Canonicalize()
+	if hook.Timeout != DefaultTaskHookTimeout {
+		t.Fatalf("bad: %v", hook.Timeout)
+	}
+}
+
+func TestDispatchPayloadConfig_Validate(t *testing.T) {
+	d := &DispatchPayloadConfig{}
+	if err := d.Validate(); err == nil || !strings.Contains(err.Error(), "specify a file") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	d.File = "../../input.json"
+	if err := d.Validate(); err == nil || !strings.Contains(err.Error(), "escapes") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	d.File = "in/input.json"
+	if err := d.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestJob_Validate_Payload(t *testing.T) {
+	j := testJob()
+	j.Payload = make([]byte, DispatchPayloadSizeLimit)
+	if err := j.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	j.Payload = make([]byte, DispatchPayloadSizeLimit+1)
+	if err := j.Validate(); err == nil || !strings.Contains(err.Error(), "maximum size") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
 func TestTemplate_Validate(t *testing.T) {
 	cases := []struct {
 		Tmpl         *Template
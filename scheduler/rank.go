@@ -181,6 +181,11 @@ OUTER:
 		netIdx.SetNode(option.Node)
 		netIdx.AddAllocs(proposed)
 
+		// Index the existing device usage
+		devIdx := structs.NewDeviceIndex()
+		devIdx.SetNode(option.Node)
+		devIdx.AddAllocs(proposed)
+
 		// Assign the resources for each task
 		total := &structs.Resources{
 			DiskMB: iter.taskGroup.EphemeralDisk.SizeMB,
@@ -206,6 +211,21 @@ OUTER:
 				taskResources.Networks = []*structs.NetworkResource{offer}
 			}
 
+			// Assign the devices the task asks for
+			for i, ask := range taskResources.Devices {
+				offer, err := devIdx.AssignDevices(ask)
+				if offer == nil {
+					iter.ctx.Metrics().ExhaustedNode(option.Node,
+						fmt.Sprintf("devices: %s", err))
+					netIdx.Release()
+					continue OUTER
+				}
+
+				// Reserve this to prevent another task from using the devices
+				devIdx.AddReserved(offer)
+				taskResources.Devices[i] = offer
+			}
+
 			// Store the task resource
 			option.SetTaskResources(task, taskResources)
 
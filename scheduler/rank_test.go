@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/hashicorp/nomad/nomad/mock"
@@ -99,6 +100,94 @@ func TestBinPackIterator_NoExistingAlloc(t *testing.T) {
 	}
 }
 
+func TestBinPackIterator_Devices(t *testing.T) {
+	state, ctx := testContext(t)
+	gpus := &structs.DeviceResource{
+		Vendor: "nvidia",
+		Type:   "gpu",
+		Name:   "Tesla K80",
+		IDs:    []string{"GPU-1", "GPU-2"},
+	}
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				// No devices
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+				},
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				// One of the GPUs is used by an existing alloc
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+					Devices:  []*structs.DeviceResource{gpus},
+				},
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	alloc := mock.Alloc()
+	alloc.NodeID = nodes[1].Node.ID
+	alloc.Resources = &structs.Resources{CPU: 256, MemoryMB: 256}
+	alloc.TaskResources = map[string]*structs.Resources{
+		"web": &structs.Resources{
+			CPU:      256,
+			MemoryMB: 256,
+			Devices: []*structs.DeviceResource{
+				{Vendor: "nvidia", Type: "gpu", Name: "Tesla K80", Count: 1, IDs: []string{"GPU-1"}},
+			},
+		},
+	}
+	noErr(t, state.UpsertJobSummary(999, mock.JobSummary(alloc.JobID)))
+	noErr(t, state.UpsertAllocs(1000, []*structs.Allocation{alloc}))
+
+	taskGroup := &structs.TaskGroup{
+		EphemeralDisk: &structs.EphemeralDisk{},
+		Tasks: []*structs.Task{
+			{
+				Name: "web",
+				Resources: &structs.Resources{
+					CPU:      256,
+					MemoryMB: 256,
+					Devices: []*structs.DeviceResource{
+						{Vendor: "nvidia", Type: "gpu", Count: 1},
+					},
+				},
+			},
+		},
+	}
+	binp := NewBinPackIterator(ctx, static, false, 0)
+	binp.SetTaskGroup(taskGroup)
+
+	out := collectRanked(binp)
+	if len(out) != 1 || out[0] != nodes[1] {
+		t.Fatalf("Bad: %v", out)
+	}
+	devices := out[0].TaskResources["web"].Devices
+	if len(devices) != 1 || !reflect.DeepEqual(devices[0].IDs, []string{"GPU-2"}) {
+		t.Fatalf("Bad: %#v", devices)
+	}
+	if devices[0].Name != "Tesla K80" {
+		t.Fatalf("Bad: %#v", devices[0])
+	}
+
+	// Asking for more GPUs than are free exhausts the node
+	taskGroup.Tasks[0].Resources.Devices[0].Count = 2
+	static = NewStaticRankIterator(ctx, nodes)
+	binp = NewBinPackIterator(ctx, static, false, 0)
+	binp.SetTaskGroup(taskGroup)
+	if out := collectRanked(binp); len(out) != 0 {
+		t.Fatalf("Bad: %v", out)
+	}
+}
+
 func TestBinPackIterator_PlannedAlloc(t *testing.T) {
 	_, ctx := testContext(t)
 	nodes := []*RankedNode{
@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
@@ -371,6 +372,11 @@ func tasksUpdated(a, b *structs.TaskGroup) bool {
 			return true
 		}
 
+		// Inspect the devices the task asks for
+		if !reflect.DeepEqual(at.Resources.Devices, bt.Resources.Devices) {
+			return true
+		}
+
 		// Inspect the network to see if the dynamic ports are different
 		if len(at.Resources.Networks) != len(bt.Resources.Networks) {
 			return true
@@ -439,6 +445,21 @@ func setStatus(logger *log.Logger, planner Planner,
 	return planner.UpdateEval(newEval)
 }
 
+// payloadUpdated returns whether the payload of the job changed for a task
+// group with tasks the payload is written for, which requires the tasks to be
+// restarted to get the new payload.
+func payloadUpdated(a, b *structs.Job, tg *structs.TaskGroup) bool {
+	if bytes.Equal(a.Payload, b.Payload) {
+		return false
+	}
+	for _, task := range tg.Tasks {
+		if task.DispatchPayload != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // inplaceUpdate attempts to update allocations in-place where possible. It
 // returns the allocs that couldn't be done inplace and then those that could.
 func inplaceUpdate(ctx Context, eval *structs.Evaluation, job *structs.Job,
@@ -453,7 +474,7 @@ func inplaceUpdate(ctx Context, eval *structs.Evaluation, job *structs.Job,
 		// Check if the task drivers or config has changed, requires
 		// a rolling upgrade since that cannot be done in-place.
 		existing := update.Alloc.Job.LookupTaskGroup(update.TaskGroup.Name)
-		if tasksUpdated(update.TaskGroup, existing) {
+		if tasksUpdated(update.TaskGroup, existing) || payloadUpdated(job, update.Alloc.Job, update.TaskGroup) {
 			continue
 		}
 
@@ -489,13 +510,14 @@ func inplaceUpdate(ctx Context, eval *structs.Evaluation, job *structs.Job,
 			continue
 		}
 
-		// Restore the network offers from the existing allocation.
-		// We do not allow network resources (reserved/dynamic ports)
-		// to be updated. This is guarded in taskUpdated, so we can
+		// Restore the network and device offers from the existing allocation.
+		// We do not allow network resources (reserved/dynamic ports) or
+		// devices to be updated. This is guarded in taskUpdated, so we can
 		// safely restore those here.
 		for task, resources := range option.TaskResources {
 			existing := update.Alloc.TaskResources[task]
 			resources.Networks = existing.Networks
+			resources.Devices = existing.Devices
 		}
 
 		// Create a shallow copy
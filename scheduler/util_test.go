@@ -554,6 +554,28 @@ func TestTasksUpdated(t *testing.T) {
 	}
 }
 
+func TestPayloadUpdated(t *testing.T) {
+	j1 := mock.Job()
+	j2 := mock.Job()
+	j2.Payload = []byte("input")
+	tg := j1.TaskGroups[0]
+
+	// The payload isn't written for any of the tasks
+	if payloadUpdated(j1, j2, tg) {
+		t.Fatalf("bad")
+	}
+
+	tg.Tasks[0].DispatchPayload = &structs.DispatchPayloadConfig{File: "input"}
+	if !payloadUpdated(j1, j2, tg) {
+		t.Fatalf("bad")
+	}
+
+	j1.Payload = []byte("input")
+	if payloadUpdated(j1, j2, tg) {
+		t.Fatalf("bad")
+	}
+}
+
 func TestEvictAndPlace_LimitLessThanAllocs(t *testing.T) {
 	_, ctx := testContext(t)
 	allocs := []allocTuple{